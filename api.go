@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	apiDefaultPerPage     = 50
+	apiMaxPerPage         = 200
+	apiDefaultDays        = 30
+	apiMaxDays            = 365
+	apiUserItemsLimit     = 25
+	maxAPITokensPerServer = 10
+	apiTokenPrefix        = "dek_"
+)
+
+// Token that grants read access to one server's statistics
+type APIToken struct {
+	ID         int64
+	ServerID   int64
+	Name       string
+	CreatedBy  int64
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a token for a server. Only its hash is stored, so the plain token is returned once.
+func (b *Bot) createAPIToken(serverID int64, name string, createdBy int64) (string, error) {
+	var count int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE server_id = ?", serverID).Scan(&count); err != nil {
+		return "", err
+	}
+	if count >= maxAPITokensPerServer {
+		return "", fmt.Errorf("this server already has %d tokens; revoke one first", maxAPITokensPerServer)
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(buf)
+	_, err := b.DB.Exec("INSERT INTO api_tokens (server_id, name, token_hash, created_by) VALUES (?, ?, ?, ?)",
+		serverID, name, hashAPIToken(token), createdBy)
+	if err != nil {
+		return "", fmt.Errorf("failed to save token: %w", err)
+	}
+	return token, nil
+}
+
+func (b *Bot) getAPITokens(serverID int64) ([]APIToken, error) {
+	rows, err := b.DB.Query("SELECT id, server_id, name, created_by, created_at, last_used_at FROM api_tokens WHERE server_id = ? ORDER BY id", serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.ServerID, &t.Name, &t.CreatedBy, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Delete a server's token, reporting whether it existed
+func (b *Bot) revokeAPIToken(serverID, id int64) (bool, error) {
+	res, err := b.DB.Exec("DELETE FROM api_tokens WHERE server_id = ? AND id = ?", serverID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Server a token belongs to, or 0 if it is unknown
+func (b *Bot) lookupAPIToken(token string) (int64, error) {
+	var serverID int64
+	err := b.DB.QueryRow("SELECT server_id FROM api_tokens WHERE token_hash = ?", hashAPIToken(token)).Scan(&serverID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := b.DB.Exec("UPDATE api_tokens SET last_used_at = ? WHERE token_hash = ?", sqliteTime(time.Now()), hashAPIToken(token)); err != nil {
+		httpLog.Error("Error updating token last use", "err", err)
+	}
+	return serverID, nil
+}
+
+func (b *Bot) registerAPIRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/guilds/{guild}/emojis", b.apiAuth(b.apiListEmojis))
+	mux.HandleFunc("GET /api/v1/guilds/{guild}/emojis/{emoji}", b.apiAuth(b.apiEmojiDetail))
+	mux.HandleFunc("GET /api/v1/guilds/{guild}/stickers", b.apiAuth(b.apiListStickers))
+	mux.HandleFunc("GET /api/v1/guilds/{guild}/timeseries", b.apiAuth(b.apiTimeSeries))
+	mux.HandleFunc("GET /api/v1/guilds/{guild}/users", b.apiAuth(b.apiListUsers))
+	mux.HandleFunc("GET /api/v1/guilds/{guild}/users/{user}", b.apiAuth(b.apiUserStats))
+}
+
+// Require a bearer token issued for the guild in the path
+func (b *Bot) apiAuth(next func(w http.ResponseWriter, r *http.Request, serverID int64)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverID, err := strconv.ParseInt(r.PathValue("guild"), 10, 64)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid guild ID")
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, r, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		tokenServerID, err := b.lookupAPIToken(token)
+		if err != nil {
+			httpLog.Error("Error looking up API token", "err", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if tokenServerID == 0 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, r, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if tokenServerID != serverID {
+			writeJSONError(w, r, http.StatusForbidden, "token is not valid for this guild")
+			return
+		}
+		next(w, r, serverID)
+	}
+}
+
+// Read an integer query parameter within [min, max], or def if absent
+func queryInt(r *http.Request, name string, def, min, max int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be an integer from %d to %d", name, min, max)
+	}
+	return n, nil
+}
+
+// One page of a ranking
+type apiPage struct {
+	Items    any  `json:"items"`
+	Page     int  `json:"page"`
+	PerPage  int  `json:"per_page"`
+	Total    int  `json:"total"`
+	NextPage *int `json:"next_page"`
+}
+
+// Parse page and per_page, returning the page, its size and the row offset
+func parsePage(r *http.Request) (page, perPage, offset int, err error) {
+	if page, err = queryInt(r, "page", 1, 1, 1<<20); err != nil {
+		return
+	}
+	if perPage, err = queryInt(r, "per_page", apiDefaultPerPage, 1, apiMaxPerPage); err != nil {
+		return
+	}
+	return page, perPage, (page - 1) * perPage, nil
+}
+
+func newAPIPage(items any, page, perPage, total int) apiPage {
+	p := apiPage{Items: items, Page: page, PerPage: perPage, Total: total}
+	if page*perPage < total {
+		next := page + 1
+		p.NextPage = &next
+	}
+	return p
+}
+
+type apiEmoji struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Animated bool      `json:"animated"`
+	Count    int       `json:"count"`
+	LastUsed time.Time `json:"last_used"`
+	ImageURL string    `json:"image_url"`
+}
+
+type apiSticker struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Count    int       `json:"count"`
+	LastUsed time.Time `json:"last_used"`
+	ImageURL string    `json:"image_url"`
+}
+
+type apiEmojiDetailResponse struct {
+	apiEmoji
+	FirstUsed     time.Time `json:"first_used"`
+	Days          int       `json:"days"`
+	RecentCount   int       `json:"recent_count"`
+	DistinctUsers int       `json:"distinct_users"`
+}
+
+type apiDay struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+type apiTimeSeriesResponse struct {
+	Kind   string   `json:"kind"`
+	ItemID string   `json:"item_id,omitempty"`
+	Days   []apiDay `json:"days"`
+}
+
+type apiUser struct {
+	UserID string `json:"user_id"`
+	Count  int    `json:"count"`
+}
+
+type apiUserItem struct {
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Animated bool   `json:"animated,omitempty"`
+	Count    int    `json:"count"`
+}
+
+type apiUserStatsResponse struct {
+	UserID string        `json:"user_id"`
+	Items  []apiUserItem `json:"items"`
+}
+
+func toAPIEmoji(e EmojiData) apiEmoji {
+	return apiEmoji{
+		ID:       idString(e.ID),
+		Name:     e.Name,
+		Animated: e.Animated,
+		Count:    e.Count,
+		LastUsed: e.LastUsed.UTC(),
+		ImageURL: emojiImageURL(e.ID, e.Animated),
+	}
+}
+
+// GET /api/v1/guilds/{guild}/emojis
+func (b *Bot) apiListEmojis(w http.ResponseWriter, r *http.Request, serverID int64) {
+	page, perPage, offset, err := parsePage(r)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	total, err := b.countEmojis(serverID)
+	if err != nil {
+		httpLog.Error("Error counting emojis", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	emojis, err := b.getEmojis(serverID, offset, perPage)
+	if err != nil {
+		httpLog.Error("Error fetching emojis", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	items := make([]apiEmoji, 0, len(emojis))
+	for _, e := range emojis {
+		items = append(items, toAPIEmoji(e))
+	}
+	writeJSON(w, r, http.StatusOK, newAPIPage(items, page, perPage, total))
+}
+
+// GET /api/v1/guilds/{guild}/stickers
+func (b *Bot) apiListStickers(w http.ResponseWriter, r *http.Request, serverID int64) {
+	page, perPage, offset, err := parsePage(r)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	total, err := b.countStickers(serverID)
+	if err != nil {
+		httpLog.Error("Error counting stickers", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	stickers, err := b.getStickers(serverID, offset, perPage)
+	if err != nil {
+		httpLog.Error("Error fetching stickers", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	items := make([]apiSticker, 0, len(stickers))
+	for _, s := range stickers {
+		items = append(items, apiSticker{
+			ID:       idString(s.ID),
+			Name:     s.Name,
+			Count:    s.Count,
+			LastUsed: s.LastUsed.UTC(),
+			ImageURL: stickerImageURL(s.ID),
+		})
+	}
+	writeJSON(w, r, http.StatusOK, newAPIPage(items, page, perPage, total))
+}
+
+// GET /api/v1/guilds/{guild}/emojis/{emoji}
+func (b *Bot) apiEmojiDetail(w http.ResponseWriter, r *http.Request, serverID int64) {
+	emojiID, err := strconv.ParseInt(r.PathValue("emoji"), 10, 64)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid emoji ID")
+		return
+	}
+	days, err := queryInt(r, "days", apiDefaultDays, 1, apiMaxDays)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, err := b.getEmojiDetail(serverID, emojiID, days, time.Now())
+	if err != nil {
+		httpLog.Error("Error fetching emoji detail", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if d == nil {
+		writeJSONError(w, r, http.StatusNotFound, "emoji has no recorded usage")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, apiEmojiDetailResponse{
+		apiEmoji:      toAPIEmoji(d.EmojiData),
+		FirstUsed:     d.FirstUsed.UTC(),
+		Days:          d.Days,
+		RecentCount:   d.RecentUses,
+		DistinctUsers: d.DistinctUsers,
+	})
+}
+
+// GET /api/v1/guilds/{guild}/timeseries?kind=emoji&item=ID&days=30
+func (b *Bot) apiTimeSeries(w http.ResponseWriter, r *http.Request, serverID int64) {
+	kind := r.URL.Query().Get("kind")
+	if kind == "" {
+		kind = kindEmoji
+	}
+	if kind != kindEmoji && kind != kindSticker {
+		writeJSONError(w, r, http.StatusBadRequest, "kind must be emoji or sticker")
+		return
+	}
+	var itemID int64
+	if raw := r.URL.Query().Get("item"); raw != "" {
+		var err error
+		if itemID, err = strconv.ParseInt(raw, 10, 64); err != nil || itemID <= 0 {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid item ID")
+			return
+		}
+	}
+	days, err := queryInt(r, "days", apiDefaultDays, 1, apiMaxDays)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	series, err := b.getUsageSeries(serverID, kind, itemID, 0, now.AddDate(0, 0, -(days-1)), now)
+	if err != nil {
+		httpLog.Error("Error fetching usage series", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	resp := apiTimeSeriesResponse{Kind: kind, Days: make([]apiDay, 0, len(series))}
+	if itemID != 0 {
+		resp.ItemID = idString(itemID)
+	}
+	for _, d := range series {
+		resp.Days = append(resp.Days, apiDay{Date: d.Day.Format(time.DateOnly), Count: d.Count})
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// GET /api/v1/guilds/{guild}/users
+func (b *Bot) apiListUsers(w http.ResponseWriter, r *http.Request, serverID int64) {
+	page, perPage, offset, err := parsePage(r)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	total, err := b.countUsers(serverID)
+	if err != nil {
+		httpLog.Error("Error counting users", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	users, err := b.getTopUsers(serverID, offset, perPage)
+	if err != nil {
+		httpLog.Error("Error fetching users", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	items := make([]apiUser, 0, len(users))
+	for _, u := range users {
+		items = append(items, apiUser{UserID: idString(u.UserID), Count: u.Count})
+	}
+	writeJSON(w, r, http.StatusOK, newAPIPage(items, page, perPage, total))
+}
+
+// GET /api/v1/guilds/{guild}/users/{user}
+func (b *Bot) apiUserStats(w http.ResponseWriter, r *http.Request, serverID int64) {
+	userID, err := strconv.ParseInt(r.PathValue("user"), 10, 64)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid user ID")
+		return
+	}
+	limit, err := queryInt(r, "limit", apiUserItemsLimit, 1, apiMaxPerPage)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	top, err := b.getUserTopItems(serverID, userID, limit)
+	if err != nil {
+		httpLog.Error("Error fetching user stats", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	resp := apiUserStatsResponse{UserID: idString(userID), Items: make([]apiUserItem, 0, len(top))}
+	for _, u := range top {
+		resp.Items = append(resp.Items, apiUserItem{Kind: u.Kind, ID: idString(u.ID), Name: u.Name, Animated: u.Animated, Count: u.Count})
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func formatAPITokenList(tokens []APIToken) string {
+	var content strings.Builder
+	content.WriteString("**API Tokens**\n")
+	if len(tokens) == 0 {
+		content.WriteString("No tokens. Create one with `/apitoken create`.")
+	}
+	for _, t := range tokens {
+		lastUsed := "never used"
+		if t.LastUsedAt.Valid {
+			lastUsed = fmt.Sprintf("last used <t:%d:R>", t.LastUsedAt.Time.Unix())
+		}
+		content.WriteString(fmt.Sprintf("`#%d` **%s** by <@%d>, created <t:%d:d>, %s\n", t.ID, t.Name, t.CreatedBy, t.CreatedAt.Unix(), lastUsed))
+	}
+	return content.String()
+}
+
+// Handle /apitoken command
+func (b *Bot) handleAPIToken(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	serverID := int64(i.GuildID)
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+	var content string
+
+	switch sub.Name {
+	case "create":
+		name := strings.TrimSpace(sub.Options.Find("name").String())
+		if name == "" {
+			b.respondError(i, "Missing token name.")
+			return
+		}
+		token, err := b.createAPIToken(serverID, name, int64(i.Member.User.ID))
+		if err != nil {
+			b.interactionLog(i).Error("Error creating API token", "err", err)
+			b.respondError(i, fmt.Sprintf("Failed to create the token: %v.", err))
+			return
+		}
+		content = fmt.Sprintf("✅ Created token **%s**. Copy it now, it won't be shown again:\n```\n%s\n```\nSend it as `Authorization: Bearer <token>` to `/api/v1/guilds/%d/...`.", name, token, serverID)
+
+	case "list":
+		tokens, err := b.getAPITokens(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching API tokens", "err", err)
+			b.respondError(i, "Failed to fetch tokens.")
+			return
+		}
+		content = formatAPITokenList(tokens)
+
+	case "revoke":
+		id, err := sub.Options.Find("id").IntValue()
+		if err != nil {
+			b.respondError(i, "Missing token ID.")
+			return
+		}
+		ok, err := b.revokeAPIToken(serverID, id)
+		if err != nil {
+			b.interactionLog(i).Error("Error revoking API token", "err", err)
+			b.respondError(i, "Failed to revoke the token.")
+			return
+		}
+		if !ok {
+			b.respondError(i, "No token with that ID. Use `/apitoken list` to see them.")
+			return
+		}
+		content = fmt.Sprintf("✅ Revoked token `#%d`.", id)
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &api.InteractionResponseData{
+			Content: option.NewNullableString(content),
+			Flags:   discord.EphemeralMessage,
+		},
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// GET path from the bot's HTTP handler with a bearer token, if any
+func apiGet(h http.Handler, path, token string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIAuth(t *testing.T) {
+	b := newTestBot(t)
+	token, err := b.createAPIToken(int64(testGuildID), "ci", int64(testUserID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := b.createAPIToken(int64(otherGuildID), "other", int64(testUserID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := b.newHTTPHandler()
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "valid token", path: "/api/v1/guilds/1000/emojis", token: token, status: http.StatusOK},
+		{name: "missing token", path: "/api/v1/guilds/1000/emojis", status: http.StatusUnauthorized},
+		{name: "unknown token", path: "/api/v1/guilds/1000/emojis", token: apiTokenPrefix + "nope", status: http.StatusUnauthorized},
+		{name: "another guild's token", path: "/api/v1/guilds/1000/emojis", token: otherToken, status: http.StatusForbidden},
+		{name: "token for another guild's path", path: "/api/v1/guilds/1001/stickers", token: token, status: http.StatusForbidden},
+		{name: "invalid guild", path: "/api/v1/guilds/abc/emojis", token: token, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := apiGet(h, tt.path, tt.token, nil)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d (%s)", tt.name, rec.Code, tt.status, rec.Body)
+		}
+		if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: missing WWW-Authenticate challenge", tt.name)
+		}
+	}
+
+	tokens, err := b.getAPITokens(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || !tokens[0].LastUsedAt.Valid {
+		t.Errorf("tokens = %+v, want the last use recorded", tokens)
+	}
+}
+
+func TestAPIPagination(t *testing.T) {
+	b := newTestBot(t)
+	b.send(b.message("<:a:111> <:b:112> <:b:112> <:c:113> <:c:113> <:c:113>"))
+	token, err := b.createAPIToken(int64(testGuildID), "ci", int64(testUserID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := b.newHTTPHandler()
+
+	tests := []struct {
+		query    string
+		wantIDs  []string
+		wantNext int // 0 for the last page
+	}{
+		{query: "?per_page=2", wantIDs: []string{"113", "112"}, wantNext: 2},
+		{query: "?per_page=2&page=2", wantIDs: []string{"111"}},
+		{query: "?per_page=2&page=3"},
+	}
+	for _, tt := range tests {
+		rec := apiGet(h, "/api/v1/guilds/1000/emojis"+tt.query, token, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d (%s)", tt.query, rec.Code, rec.Body)
+		}
+		var page struct {
+			Items    []apiEmoji `json:"items"`
+			Total    int        `json:"total"`
+			NextPage *int       `json:"next_page"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 3 {
+			t.Errorf("%s: total = %d, want 3", tt.query, page.Total)
+		}
+		var ids []string
+		for _, e := range page.Items {
+			ids = append(ids, e.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+			t.Errorf("%s: items = %v, want %v", tt.query, ids, tt.wantIDs)
+		}
+		next := 0
+		if page.NextPage != nil {
+			next = *page.NextPage
+		}
+		if next != tt.wantNext {
+			t.Errorf("%s: next_page = %d, want %d", tt.query, next, tt.wantNext)
+		}
+	}
+
+	if rec := apiGet(h, "/api/v1/guilds/1000/emojis?per_page=1000", token, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("oversized per_page: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestAPIETag(t *testing.T) {
+	b := newTestBot(t)
+	b.send(b.message("<:wave:111>"))
+	token, err := b.createAPIToken(int64(testGuildID), "ci", int64(testUserID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := b.newHTTPHandler()
+	const path = "/api/v1/guilds/1000/emojis"
+
+	first := apiGet(h, path, token, nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first request: status = %d, ETag %q", first.Code, etag)
+	}
+
+	cached := apiGet(h, path, token, http.Header{"If-None-Match": {"W/" + etag}})
+	if cached.Code != http.StatusNotModified || cached.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: status = %d with %d bytes, want an empty 304", cached.Code, cached.Body.Len())
+	}
+
+	// New usage changes the body and so the ETag
+	b.send(b.message("<:wave:111>"))
+	changed := apiGet(h, path, token, http.Header{"If-None-Match": {etag}})
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("after new usage: status = %d, ETag %q unchanged", changed.Code, etag)
+	}
+}
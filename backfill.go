@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/httputil"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	backfillPageSize = 100 // Discord's maximum per request
+	// Pause between pages so live commands keep rate limit headroom
+	backfillPageDelay = time.Second
+	// Wait after arikawa gives up retrying a rate limited request
+	backfillRateLimitBackoff = time.Minute
+)
+
+// Backfill job statuses
+const (
+	backfillStatusRunning   = "running"
+	backfillStatusDone      = "done"
+	backfillStatusCancelled = "cancelled"
+	backfillStatusFailed    = "failed"
+)
+
+// Channels with message history worth crawling
+var backfillChannelTypes = map[discord.ChannelType]bool{
+	discord.GuildText:         true,
+	discord.GuildAnnouncement: true,
+}
+
+// History crawl for one server. Until is zero to crawl up to the present.
+type BackfillJob struct {
+	ServerID        int64
+	Since           time.Time
+	Until           time.Time
+	Status          string
+	StartedBy       int64
+	MessagesScanned int
+	MessagesSkipped int
+	ItemsCounted    int
+	Error           string
+	StartedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Crawl position in one channel. Cursor is the oldest message processed so far.
+type BackfillChannel struct {
+	ChannelID int64
+	Cursor    int64
+	Done      bool
+	Error     string
+}
+
+// Discord API calls the backfill needs. *api.Client implements it, so tests
+// can route them through one whose HTTP transport points at a fake API server.
+type BackfillAPI interface {
+	MessagesBefore(channelID discord.ChannelID, before discord.MessageID, limit uint) ([]discord.Message, error)
+	// Messages fetched from the API carry no member, so authors' roles are looked up
+	Member(guildID discord.GuildID, userID discord.UserID) (*discord.Member, error)
+}
+
+func scanBackfillJob(row interface{ Scan(...any) error }) (*BackfillJob, error) {
+	var j BackfillJob
+	var since, until, startedAt, updatedAt int64
+	var jobError sql.NullString
+	err := row.Scan(&j.ServerID, &since, &until, &j.Status, &j.StartedBy, &j.MessagesScanned, &j.MessagesSkipped, &j.ItemsCounted,
+		&jobError, &startedAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	j.Since = time.Unix(since, 0).UTC()
+	if until > 0 {
+		j.Until = time.Unix(until, 0).UTC()
+	}
+	j.Error = jobError.String
+	j.StartedAt = time.Unix(startedAt, 0).UTC()
+	j.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return &j, nil
+}
+
+const backfillJobColumns = `server_id, since, until, status, started_by, messages_scanned, messages_skipped, items_counted, error, started_at, updated_at`
+
+// Get a server's latest backfill job, or nil if it never ran one
+func (b *Bot) getBackfillJob(serverID int64) (*BackfillJob, error) {
+	row := b.DB.QueryRow("SELECT "+backfillJobColumns+" FROM backfill_jobs WHERE server_id = ?", serverID)
+	j, err := scanBackfillJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return j, err
+}
+
+func (b *Bot) getRunningBackfillJobs() ([]BackfillJob, error) {
+	rows, err := b.DB.Query("SELECT "+backfillJobColumns+" FROM backfill_jobs WHERE status = ?", backfillStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []BackfillJob
+	for rows.Next() {
+		j, err := scanBackfillJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// Create a job, replacing the server's previous one
+func (b *Bot) createBackfillJob(j *BackfillJob, channelIDs []discord.ChannelID) error {
+	var untilUnix int64
+	var startCursor discord.MessageID
+	if !j.Until.IsZero() {
+		untilUnix = j.Until.Unix()
+		startCursor = discord.MessageID(discord.NewSnowflake(j.Until))
+	}
+	now := time.Now()
+
+	return b.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM backfill_channels WHERE server_id = ?", j.ServerID); err != nil {
+			return fmt.Errorf("failed to clear backfill channels: %w", err)
+		}
+		query := `
+			INSERT OR REPLACE INTO backfill_jobs (server_id, since, until, status, started_by, started_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`
+		if _, err := tx.Exec(query, j.ServerID, j.Since.Unix(), untilUnix, backfillStatusRunning, j.StartedBy, now.Unix(), now.Unix()); err != nil {
+			return fmt.Errorf("failed to create backfill job: %w", err)
+		}
+		for _, id := range channelIDs {
+			if _, err := tx.Exec("INSERT INTO backfill_channels (server_id, channel_id, cursor) VALUES (?, ?, ?)", j.ServerID, id, startCursor); err != nil {
+				return fmt.Errorf("failed to add backfill channel: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bot) getBackfillChannels(serverID int64) ([]BackfillChannel, error) {
+	rows, err := b.DB.Query("SELECT channel_id, cursor, done, error FROM backfill_channels WHERE server_id = ? ORDER BY channel_id", serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []BackfillChannel
+	for rows.Next() {
+		var c BackfillChannel
+		var channelError sql.NullString
+		if err := rows.Scan(&c.ChannelID, &c.Cursor, &c.Done, &channelError); err != nil {
+			return nil, err
+		}
+		c.Error = channelError.String
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+// Result of crawling one page of a channel
+type backfillPage struct {
+	Scanned int
+	Skipped int
+	Counted int
+}
+
+// Save a channel's crawl position and add a page's counts to the job
+func (b *Bot) saveBackfillProgress(serverID int64, c BackfillChannel, p backfillPage) error {
+	return b.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE backfill_channels SET cursor = ?, done = ?, error = ? WHERE server_id = ? AND channel_id = ?",
+			c.Cursor, c.Done, c.Error, serverID, c.ChannelID)
+		if err != nil {
+			return fmt.Errorf("failed to save backfill cursor: %w", err)
+		}
+		query := `
+			UPDATE backfill_jobs SET
+				messages_scanned = messages_scanned + ?,
+				messages_skipped = messages_skipped + ?,
+				items_counted = items_counted + ?,
+				updated_at = ?
+			WHERE server_id = ?
+		`
+		if _, err := tx.Exec(query, p.Scanned, p.Skipped, p.Counted, time.Now().Unix(), serverID); err != nil {
+			return fmt.Errorf("failed to save backfill progress: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *Bot) setBackfillStatus(serverID int64, status, jobError string) error {
+	_, err := b.DB.Exec("UPDATE backfill_jobs SET status = ?, error = ?, updated_at = ? WHERE server_id = ?",
+		status, jobError, time.Now().Unix(), serverID)
+	return err
+}
+
+// Whether usage from a message was already recorded from the given source,
+// either live or by an earlier backfill
+func (b *Bot) messageRecorded(serverID, messageID int64, source string) (bool, error) {
+	var exists bool
+	err := b.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM usage_events WHERE server_id = ? AND message_id = ? AND source = ?)",
+		serverID, messageID, source,
+	).Scan(&exists)
+	return exists, err
+}
+
+// Count a historical message's emojis, stickers and reactions, skipping its
+// content if already recorded and reactions up to each emoji's net recorded
+// count. Returns whether everything in the
+// message was already counted and how many items were counted now. The
+// author's member, when known, is checked against the server's role filters.
+func (b *Bot) backfillMessage(guildID discord.GuildID, m discord.Message, author *discord.Member) (bool, int, error) {
+	settings := b.getGuildSettings(int64(guildID))
+	if m.Author.Bot && !settings.TrackBotMessages {
+		return false, 0, nil
+	}
+	roleFiltered := b.hasRoleFilters(int64(guildID))
+
+	// Compacted events can't show whether the message was counted
+	compactedBefore, err := b.getCompactedBefore(int64(guildID))
+	if err != nil {
+		return false, 0, err
+	}
+	if m.Timestamp.Time().Before(compactedBefore) {
+		return true, 0, nil
+	}
+
+	uc := UsageContext{
+		ServerID:  int64(guildID),
+		ChannelID: int64(m.ChannelID),
+		MessageID: int64(m.ID),
+		UserID:    int64(m.Author.ID),
+		Source:    sourceMessage,
+		Time:      m.Timestamp.Time(),
+	}
+	b.applyUserPrivacy(&uc)
+
+	counted := 0
+	messageDone, err := b.messageRecorded(uc.ServerID, uc.MessageID, sourceMessage)
+	if err != nil {
+		return false, 0, err
+	}
+	if !messageDone && !b.rolesIgnored(uc.ServerID, memberRoleIDs(author)) {
+		if settings.TrackMessages {
+			counted += b.processCustomEmojis(m.Content, uc)
+		}
+		if settings.TrackStickers && len(m.Stickers) > 0 {
+			b.processStickers(m.Stickers, uc)
+			counted += len(m.Stickers)
+		}
+	}
+
+	// Reactors aren't listed with the message, so their roles can't be checked
+	var reactions []discord.Reaction
+	for _, r := range m.Reactions {
+		if settings.TrackReactions && !roleFiltered && r.Emoji.IsCustom() {
+			reactions = append(reactions, r)
+		}
+	}
+	// Only the reactions beyond each emoji's net recorded count are added, so
+	// reactions recorded live before the crawl aren't counted twice
+	reactionsDone := true
+	if len(reactions) > 0 {
+		recorded, err := b.getRecordedReactions(uc.ServerID, uc.MessageID)
+		if err != nil {
+			return false, counted, err
+		}
+		// Reactors aren't listed with the message, so reactions are recorded without a user
+		ruc := uc
+		ruc.UserID = 0
+		ruc.Source = sourceReaction
+		for _, r := range reactions {
+			missing := r.Count - recorded[int64(r.Emoji.ID)]
+			for n := 0; n < missing; n++ {
+				if err := b.trackCustomEmoji(r.Emoji.Name, int64(r.Emoji.ID), r.Emoji.Animated, ruc); err != nil {
+					return false, counted, err
+				}
+				counted++
+				reactionsDone = false
+			}
+		}
+	}
+
+	skipped := messageDone && reactionsDone
+	return skipped, counted, nil
+}
+
+// Runs backfill jobs in the background, one goroutine per server
+type Backfiller struct {
+	ctx       context.Context
+	bot       *Bot
+	pageDelay time.Duration
+
+	mu      sync.Mutex
+	cancels map[int64]context.CancelFunc
+}
+
+func NewBackfiller(ctx context.Context, bot *Bot) *Backfiller {
+	return &Backfiller{
+		ctx:       ctx,
+		bot:       bot,
+		pageDelay: backfillPageDelay,
+		cancels:   make(map[int64]context.CancelFunc),
+	}
+}
+
+// Start crawling a job in the background. Returns false if the server already has one running.
+func (b *Backfiller) Start(serverID int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.cancels[serverID]; ok {
+		return false
+	}
+	ctx, cancel := context.WithCancel(b.ctx)
+	b.cancels[serverID] = cancel
+
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			delete(b.cancels, serverID)
+			b.mu.Unlock()
+			cancel()
+		}()
+		b.run(ctx, serverID)
+	}()
+	return true
+}
+
+// Whether a server's job is crawling right now
+func (b *Backfiller) Running(serverID int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.cancels[serverID]
+	return ok
+}
+
+// Stop a server's running job
+func (b *Backfiller) Cancel(serverID int64) error {
+	b.mu.Lock()
+	if cancel, ok := b.cancels[serverID]; ok {
+		cancel()
+	}
+	b.mu.Unlock()
+	return b.bot.setBackfillStatus(serverID, backfillStatusCancelled, "")
+}
+
+// Resume jobs interrupted by a restart
+func (b *Backfiller) ResumeAll() {
+	jobs, err := b.bot.getRunningBackfillJobs()
+	if err != nil {
+		backfillLog.Error("Error fetching backfill jobs", "err", err)
+		return
+	}
+	for _, j := range jobs {
+		backfillLog.Info("Resuming backfill", idAttr("guild_id", j.ServerID))
+		b.Start(j.ServerID)
+	}
+}
+
+func (b *Backfiller) run(ctx context.Context, serverID int64) {
+	job, err := b.bot.getBackfillJob(serverID)
+	if err != nil || job == nil {
+		backfillLog.Error("Error loading backfill job", idAttr("guild_id", serverID), "err", err)
+		return
+	}
+	channels, err := b.bot.getBackfillChannels(serverID)
+	if err != nil {
+		backfillLog.Error("Error loading backfill channels", idAttr("guild_id", serverID), "err", err)
+		return
+	}
+
+	sinceID := discord.MessageID(discord.NewSnowflake(job.Since))
+	for _, c := range channels {
+		if c.Done {
+			continue
+		}
+		if err := b.crawlChannel(ctx, discord.GuildID(serverID), c, sinceID); err != nil {
+			if ctx.Err() != nil {
+				// Cancelled or shutting down; a shutdown leaves the job running so it resumes on restart
+				return
+			}
+			backfillLog.Error("Backfill failed", idAttr("guild_id", serverID), "err", err)
+			if err := b.bot.setBackfillStatus(serverID, backfillStatusFailed, err.Error()); err != nil {
+				backfillLog.Error("Error saving backfill status", idAttr("guild_id", serverID), "err", err)
+			}
+			return
+		}
+	}
+
+	if err := b.bot.setBackfillStatus(serverID, backfillStatusDone, ""); err != nil {
+		backfillLog.Error("Error saving backfill status", idAttr("guild_id", serverID), "err", err)
+	}
+	backfillLog.Info("Backfill finished", idAttr("guild_id", serverID))
+}
+
+// Walk one channel back from its cursor to sinceID, saving progress after every page
+func (b *Backfiller) crawlChannel(ctx context.Context, guildID discord.GuildID, c BackfillChannel, sinceID discord.MessageID) error {
+	// The channel may have been ignored since the job was created
+	if !c.Done && !b.bot.channelTracked(guildID, discord.ChannelID(c.ChannelID)) {
+		c.Done = true
+		c.Error = "not tracked"
+		if err := b.bot.saveBackfillProgress(int64(guildID), c, backfillPage{}); err != nil {
+			return err
+		}
+		backfillLog.Info("Backfill skipped untracked channel", idAttr("channel_id", c.ChannelID))
+		return nil
+	}
+
+	authors := make(map[discord.UserID]*discord.Member)
+	for !c.Done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		msgs, err := b.bot.Client.MessagesBefore(discord.ChannelID(c.ChannelID), discord.MessageID(c.Cursor), backfillPageSize)
+		var httpErr *httputil.HTTPError
+		if errors.As(err, &httpErr) {
+			switch httpErr.Status {
+			case http.StatusForbidden, http.StatusNotFound:
+				// Lost access or the channel was deleted; skip it rather than failing the job
+				c.Done = true
+				c.Error = httpErr.Message
+				if err := b.bot.saveBackfillProgress(int64(guildID), c, backfillPage{}); err != nil {
+					return err
+				}
+				backfillLog.Warn("Backfill skipped channel", idAttr("channel_id", int64(c.ChannelID)), "reason", httpErr.Message)
+				return nil
+			case httputil.StatusTooManyRequests:
+				backfillLog.Warn("Backfill rate limited", idAttr("channel_id", int64(c.ChannelID)), "wait", backfillRateLimitBackoff)
+				if err := sleepContext(ctx, backfillRateLimitBackoff); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch messages in channel %d: %w", c.ChannelID, err)
+		}
+
+		var page backfillPage
+		c.Done = len(msgs) < backfillPageSize
+		roleFiltered := b.bot.hasRoleFilters(int64(guildID))
+		// Messages come newest first
+		for _, m := range msgs {
+			if m.ID < sinceID {
+				c.Done = true
+				break
+			}
+			var author *discord.Member
+			if roleFiltered {
+				author = b.author(guildID, m.Author.ID, authors)
+			}
+			skipped, counted, err := b.bot.backfillMessage(guildID, m, author)
+			if err != nil {
+				return fmt.Errorf("failed to count message %d: %w", m.ID, err)
+			}
+			page.Scanned++
+			if skipped {
+				page.Skipped++
+			}
+			page.Counted += counted
+			c.Cursor = int64(m.ID)
+		}
+
+		if err := b.bot.saveBackfillProgress(int64(guildID), c, page); err != nil {
+			return err
+		}
+		if !c.Done {
+			if err := sleepContext(ctx, b.pageDelay); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Look up a message author for role filters, once per crawl. Authors who left
+// have no roles, so their messages are counted like live events without a member.
+func (b *Backfiller) author(guildID discord.GuildID, userID discord.UserID, authors map[discord.UserID]*discord.Member) *discord.Member {
+	if m, ok := authors[userID]; ok {
+		return m
+	}
+	m, err := b.bot.Client.Member(guildID, userID)
+	if err != nil {
+		attrs := []any{idAttr("guild_id", int64(guildID)), "err", err}
+		if stored, ok := b.bot.storedUserID(int64(guildID), int64(userID)); ok {
+			attrs = append(attrs, idAttr("user_id", stored))
+		}
+		backfillLog.Debug("Backfill could not look up author", attrs...)
+		m = nil
+	}
+	authors[userID] = m
+	return m
+}
+
+// Sleep for d, returning early with the context's error if it is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Text channels the bot can read history in
+func (b *Bot) backfillableChannels(guildID discord.GuildID) ([]discord.ChannelID, error) {
+	channels, err := b.Client.Channels(guildID)
+	if err != nil {
+		return nil, err
+	}
+	me, err := b.Client.Me()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []discord.ChannelID
+	for _, ch := range channels {
+		if !backfillChannelTypes[ch.Type] || !b.channelTracked(guildID, ch.ID) {
+			continue
+		}
+		perms, err := b.Client.Permissions(ch.ID, me.ID)
+		if err != nil {
+			// Let the crawl find out; it skips channels it can't read
+			ids = append(ids, ch.ID)
+			continue
+		}
+		if perms.Has(discord.PermissionViewChannel | discord.PermissionReadMessageHistory) {
+			ids = append(ids, ch.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Describe a job's progress
+func formatBackfillStatus(j *BackfillJob, channels []BackfillChannel) string {
+	done, skipped := 0, 0
+	var oldest time.Time
+	for _, c := range channels {
+		if c.Done {
+			done++
+			if c.Error != "" {
+				skipped++
+			}
+			continue
+		}
+		if c.Cursor != 0 {
+			if t := discord.MessageID(c.Cursor).Time(); oldest.IsZero() || t.Before(oldest) {
+				oldest = t
+			}
+		}
+	}
+
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**History Backfill**: %s\n", j.Status))
+	window := fmt.Sprintf("since %s", j.Since.Format(time.DateOnly))
+	if !j.Until.IsZero() {
+		window = fmt.Sprintf("from %s to %s", j.Since.Format(time.DateTime), j.Until.Format(time.DateTime))
+	}
+	content.WriteString(fmt.Sprintf("- Window: %s (UTC)\n", window))
+	content.WriteString(fmt.Sprintf("- Channels: %d/%d done", done, len(channels)))
+	if skipped > 0 {
+		content.WriteString(fmt.Sprintf(" (%d skipped, no access)", skipped))
+	}
+	content.WriteString("\n")
+	if !oldest.IsZero() && j.Status == backfillStatusRunning {
+		content.WriteString(fmt.Sprintf("- Reached: <t:%d:f>\n", oldest.Unix()))
+	}
+	content.WriteString(fmt.Sprintf("- Messages scanned: %d (%d already counted)\n", j.MessagesScanned, j.MessagesSkipped))
+	content.WriteString(fmt.Sprintf("- Emojis and stickers counted: %d\n", j.ItemsCounted))
+	startedBy := fmt.Sprintf("by <@%d>", j.StartedBy)
+	if j.StartedBy == 0 {
+		startedBy = "automatically after an outage"
+	}
+	content.WriteString(fmt.Sprintf("- Started <t:%d:R> %s, last progress <t:%d:R>\n", j.StartedAt.Unix(), startedBy, j.UpdatedAt.Unix()))
+	if j.Error != "" {
+		content.WriteString(fmt.Sprintf("- Error: %s\n", j.Error))
+	}
+	return content.String()
+}
+
+// Handle /backfill command
+func (b *Bot) handleBackfill(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	serverID := int64(i.GuildID)
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+
+	var content string
+	switch sub.Name {
+	case "start":
+		if b.Backfiller.Running(serverID) {
+			b.respondError(i, "A backfill is already running. Use `/backfill status` to follow it or `/backfill cancel` to stop it.")
+			return
+		}
+
+		since, err := time.Parse(time.DateOnly, sub.Options.Find("since").String())
+		if err != nil {
+			b.respondError(i, "Invalid date. Use YYYY-MM-DD.")
+			return
+		}
+		if !since.Before(time.Now()) {
+			b.respondError(i, "The start date must be in the past.")
+			return
+		}
+
+		var channelIDs []discord.ChannelID
+		if id, err := sub.Options.Find("channel").SnowflakeValue(); err == nil && id.IsValid() {
+			if !b.channelTracked(i.GuildID, discord.ChannelID(id)) {
+				b.respondError(i, "That channel isn't tracked. Check `/tracking list`.")
+				return
+			}
+			channelIDs = []discord.ChannelID{discord.ChannelID(id)}
+		} else {
+			channelIDs, err = b.backfillableChannels(i.GuildID)
+			if err != nil {
+				b.interactionLog(i).Error("Error fetching channels", "err", err)
+				b.respondError(i, "Failed to fetch channels.")
+				return
+			}
+		}
+		if len(channelIDs) == 0 {
+			b.respondError(i, "The bot can't read message history in any channel.")
+			return
+		}
+
+		job := &BackfillJob{ServerID: serverID, Since: since, StartedBy: int64(i.Member.User.ID)}
+		if err := b.createBackfillJob(job, channelIDs); err != nil {
+			b.interactionLog(i).Error("Error creating backfill job", "err", err)
+			b.respondError(i, "Failed to start the backfill.")
+			return
+		}
+		b.Backfiller.Start(serverID)
+		b.interactionLog(i).Info("Backfill started", "channels", len(channelIDs), "since", since.Format(time.DateOnly))
+		content = fmt.Sprintf("✅ Backfilling %d channels back to %s. Use `/backfill status` to follow progress.", len(channelIDs), since.Format(time.DateOnly))
+
+	case "status":
+		job, err := b.getBackfillJob(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching backfill job", "err", err)
+			b.respondError(i, "Failed to fetch backfill status.")
+			return
+		}
+		if job == nil {
+			b.respondError(i, "No backfill has been run in this server.")
+			return
+		}
+		channels, err := b.getBackfillChannels(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching backfill channels", "err", err)
+			b.respondError(i, "Failed to fetch backfill status.")
+			return
+		}
+		content = formatBackfillStatus(job, channels)
+
+	case "cancel":
+		if !b.Backfiller.Running(serverID) {
+			b.respondError(i, "No backfill is running.")
+			return
+		}
+		if err := b.Backfiller.Cancel(serverID); err != nil {
+			b.interactionLog(i).Error("Error cancelling backfill", "err", err)
+			b.respondError(i, "Failed to cancel the backfill.")
+			return
+		}
+		content = "Backfill cancelled. Counts already added are kept."
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &api.InteractionResponseData{
+			Content: option.NewNullableString(content),
+			Flags:   discord.EphemeralMessage,
+		},
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/httputil"
+	"github.com/diamondburned/arikawa/v3/utils/httputil/httpdriver"
+)
+
+// A channel history of n messages a minute apart, each using one emoji, oldest first
+func backfillHistory(b *testBot, n int, start time.Time) []discord.Message {
+	msgs := make([]discord.Message, n)
+	for i := range msgs {
+		at := start.Add(time.Duration(i) * time.Minute)
+		msgs[i] = discord.Message{
+			ID:        discord.MessageID(discord.NewSnowflake(at)),
+			ChannelID: testChannelID,
+			GuildID:   testGuildID,
+			Author:    discord.User{ID: testUserID},
+			Content:   "<:wave:111>",
+			Timestamp: discord.NewTimestamp(at),
+		}
+	}
+	b.fake.History[testChannelID] = msgs
+	return msgs
+}
+
+// Crawl the test channel with a job created for it and return the stored job
+func crawlTestChannel(t *testing.T, b *testBot, since time.Time, cursor discord.MessageID) (*BackfillJob, error) {
+	t.Helper()
+	if err := b.createBackfillJob(&BackfillJob{ServerID: int64(testGuildID), Since: since}, []discord.ChannelID{testChannelID}); err != nil {
+		t.Fatal(err)
+	}
+	crawler := NewBackfiller(context.Background(), b.Bot)
+	crawler.pageDelay = 0
+	c := BackfillChannel{ChannelID: int64(testChannelID), Cursor: int64(cursor)}
+	crawlErr := crawler.crawlChannel(context.Background(), testGuildID, c, discord.MessageID(discord.NewSnowflake(since)))
+	job, err := b.getBackfillJob(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job, crawlErr
+}
+
+func TestBackfillCrawl(t *testing.T) {
+	start := time.Now().Add(-48 * time.Hour).Truncate(time.Minute)
+	const messages = 250 // Three pages
+
+	tests := []struct {
+		name string
+		// Index of the first message on or after the stop date
+		since int
+		// Index of the message a crawl resumes before, or messages for a new crawl
+		cursor int
+		// Messages from the end of the history already recorded live
+		live        int
+		wantScanned int
+		wantSkipped int
+	}{
+		{name: "whole history", cursor: messages, wantScanned: 250},
+		{name: "stop date", since: 100, cursor: messages, wantScanned: 150},
+		{name: "resume", cursor: 200, wantScanned: 200},
+		{name: "live events", cursor: messages, live: 10, wantScanned: 250, wantSkipped: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			history := backfillHistory(b, messages, start)
+			for _, m := range history[messages-tt.live:] {
+				b.dispatch(&gateway.MessageCreateEvent{Message: m}, m.Timestamp.Time())
+			}
+			var cursor discord.MessageID
+			if tt.cursor < messages {
+				cursor = history[tt.cursor].ID
+			}
+
+			job, err := crawlTestChannel(t, b, history[tt.since].Timestamp.Time(), cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCounted := tt.wantScanned - tt.wantSkipped
+			if job.MessagesScanned != tt.wantScanned || job.MessagesSkipped != tt.wantSkipped || job.ItemsCounted != wantCounted {
+				t.Errorf("job = %d scanned, %d skipped, %d counted; want %d, %d, %d",
+					job.MessagesScanned, job.MessagesSkipped, job.ItemsCounted, tt.wantScanned, tt.wantSkipped, wantCounted)
+			}
+			if got := b.emojiCount(111); got != wantCounted+tt.live {
+				t.Errorf("emoji count = %d, want %d", got, wantCounted+tt.live)
+			}
+			channels, err := b.getBackfillChannels(int64(testGuildID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(channels) != 1 || !channels[0].Done || channels[0].Cursor != int64(history[tt.since].ID) {
+				t.Errorf("channel = %+v, want done at the oldest message crawled", channels)
+			}
+		})
+	}
+}
+
+// A crawl that fails midway resumes from its saved cursor without counting twice
+func TestBackfillResumesAfterFailure(t *testing.T) {
+	b := newTestBot(t)
+	history := backfillHistory(b, 250, time.Now().Add(-48*time.Hour))
+	b.fake.HistoryErrs = []error{nil, errors.New("gateway timeout")}
+
+	if _, err := crawlTestChannel(t, b, history[0].Timestamp.Time(), 0); err == nil {
+		t.Fatal("crawl succeeded through a failed page")
+	}
+	channels, err := b.getBackfillChannels(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Done || channels[0].Cursor != int64(history[150].ID) {
+		t.Fatalf("channel after failure = %+v, want the first page saved", channels)
+	}
+
+	crawler := NewBackfiller(context.Background(), b.Bot)
+	crawler.pageDelay = 0
+	if err := crawler.crawlChannel(context.Background(), testGuildID, channels[0], history[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	job, err := b.getBackfillJob(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.MessagesScanned != 250 || job.ItemsCounted != 250 || b.emojiCount(111) != 250 {
+		t.Errorf("after resuming: %d scanned, %d counted, emoji count %d; want 250 each", job.MessagesScanned, job.ItemsCounted, b.emojiCount(111))
+	}
+}
+
+// Sends every request to a test server instead of Discord
+type testServerTransport struct {
+	server *url.URL
+}
+
+func (t testServerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.server.Scheme
+	r.URL.Host = t.server.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Fake client whose backfill calls go through a real API client
+type apiBackfillClient struct {
+	*fakeDiscord
+	api *api.Client
+}
+
+func (c apiBackfillClient) MessagesBefore(channelID discord.ChannelID, before discord.MessageID, limit uint) ([]discord.Message, error) {
+	return c.api.MessagesBefore(channelID, before, limit)
+}
+
+func (c apiBackfillClient) Member(guildID discord.GuildID, userID discord.UserID) (*discord.Member, error) {
+	return c.api.Member(guildID, userID)
+}
+
+// Crawl through an API client against a fake API server that rate limits the
+// first page and answers 403 for a channel the bot can't read
+func TestBackfillCrawlThroughAPI(t *testing.T) {
+	b := newTestBot(t)
+	history := backfillHistory(b, 150, time.Now().Add(-48*time.Hour))
+	const hiddenChannelID = discord.ChannelID(2002)
+
+	var mu sync.Mutex
+	requests, limited := 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/channels/"+hiddenChannelID.String()+"/") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "Missing Access", "code": 50001}`))
+			return
+		}
+		if !limited {
+			limited = true
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(httputil.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 0, "global": false}`))
+			return
+		}
+		before, _ := strconv.ParseUint(r.URL.Query().Get("before"), 10, 64)
+		limit, _ := strconv.ParseUint(r.URL.Query().Get("limit"), 10, 64)
+		msgs, _ := b.fake.MessagesBefore(testChannelID, discord.MessageID(before), uint(limit))
+		json.NewEncoder(w).Encode(msgs)
+	}))
+	t.Cleanup(server.Close)
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := httputil.NewClient()
+	httpClient.Client = httpdriver.WrapClient(http.Client{Transport: testServerTransport{serverURL}})
+	b.Client = apiBackfillClient{fakeDiscord: b.fake, api: api.NewCustomClient("token", httpClient)}
+
+	since := history[0].Timestamp.Time()
+	if err := b.createBackfillJob(&BackfillJob{ServerID: int64(testGuildID), Since: since}, []discord.ChannelID{testChannelID, hiddenChannelID}); err != nil {
+		t.Fatal(err)
+	}
+	channels, err := b.getBackfillChannels(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range channels {
+		if err := b.Backfiller.crawlChannel(context.Background(), testGuildID, c, discord.MessageID(discord.NewSnowflake(since))); err != nil {
+			t.Fatalf("crawl of channel %d: %v", c.ChannelID, err)
+		}
+	}
+
+	if got := b.emojiCount(111); got != 150 {
+		t.Errorf("emoji count = %d, want 150", got)
+	}
+	if !limited || requests < 4 {
+		t.Errorf("server saw %d requests, rate limited %t; want the limited page retried", requests, limited)
+	}
+	channels, err = b.getBackfillChannels(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range channels {
+		if !c.Done {
+			t.Errorf("channel %d not done", c.ChannelID)
+		}
+		if discord.ChannelID(c.ChannelID) == hiddenChannelID && c.Error != "Missing Access" {
+			t.Errorf("hidden channel error = %q, want Missing Access", c.Error)
+		}
+	}
+}
+
+// A channel ignored after its job was created is skipped without counting
+func TestBackfillSkipsIgnoredChannel(t *testing.T) {
+	b := newTestBot(t)
+	history := backfillHistory(b, 3, time.Now().Add(-time.Hour))
+	b.send(b.command("tracking", subcommand(filterIgnore, channelOption("channel", testChannelID))))
+
+	job, err := crawlTestChannel(t, b, history[0].Timestamp.Time(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.MessagesScanned != 0 || b.emojiCount(111) != -1 {
+		t.Errorf("scanned %d messages of an ignored channel, emoji count %d", job.MessagesScanned, b.emojiCount(111))
+	}
+	channels, err := b.getBackfillChannels(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || !channels[0].Done || channels[0].Error == "" {
+		t.Errorf("channels = %+v, want the ignored channel done with an error", channels)
+	}
+}
+
+// Backfilled reactions only add what each emoji's live reactions are missing
+func TestBackfillReactionsPerEmoji(t *testing.T) {
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	party := discord.Emoji{ID: 112, Name: "party"}
+	tests := []struct {
+		name        string
+		live        []discord.Emoji // Reactions recorded live
+		reactions   []discord.Reaction
+		wantCounted int
+		wantWave    int
+		wantParty   int
+	}{
+		{
+			name:        "nothing recorded",
+			reactions:   []discord.Reaction{{Emoji: wave, Count: 2}, {Emoji: party, Count: 1}},
+			wantCounted: 3, wantWave: 2, wantParty: 1,
+		},
+		{
+			name:        "another emoji recorded live",
+			live:        []discord.Emoji{wave},
+			reactions:   []discord.Reaction{{Emoji: wave, Count: 1}, {Emoji: party, Count: 2}},
+			wantCounted: 2, wantWave: 1, wantParty: 2,
+		},
+		{
+			name:        "some reactions recorded live",
+			live:        []discord.Emoji{wave},
+			reactions:   []discord.Reaction{{Emoji: wave, Count: 3}},
+			wantCounted: 2, wantWave: 3, wantParty: -1,
+		},
+		{
+			name:      "everything recorded live",
+			live:      []discord.Emoji{wave, wave},
+			reactions: []discord.Reaction{{Emoji: wave, Count: 2}},
+			wantWave:  2, wantParty: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			const message = discord.MessageID(500)
+			for n, e := range tt.live {
+				add := b.reactionAdd(message, e)
+				add.UserID = testUserID + discord.UserID(n)
+				b.send(add)
+			}
+			m := discord.Message{ID: message, ChannelID: testChannelID, Author: discord.User{ID: testUserID}, Reactions: tt.reactions}
+			if _, counted, err := b.backfillMessage(testGuildID, m, nil); err != nil || counted != tt.wantCounted {
+				t.Errorf("counted %d, %v; want %d", counted, err, tt.wantCounted)
+			}
+			if got := b.emojiCount(111); got != tt.wantWave {
+				t.Errorf("wave count = %d, want %d", got, tt.wantWave)
+			}
+			if got := b.emojiCount(112); got != tt.wantParty {
+				t.Errorf("party count = %d, want %d", got, tt.wantParty)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/httputil"
+)
+
+// Discord API calls the bot makes. stateClient implements it over a gateway
+// session; tests use a fake.
+type DiscordClient interface {
+	BackfillAPI
+	ReconcileAPI
+
+	RespondInteraction(id discord.InteractionID, token string, resp api.InteractionResponse) error
+	EditInteractionResponse(appID discord.AppID, token string, data api.EditInteractionResponseData) (*discord.Message, error)
+	FollowUpInteraction(appID discord.AppID, token string, data api.InteractionResponseData) (*discord.Message, error)
+	BulkOverwriteCommands(appID discord.AppID, commands []api.CreateCommandData) ([]discord.Command, error)
+
+	SendMessageComplex(channelID discord.ChannelID, data api.SendMessageData) (*discord.Message, error)
+	EditMessageComplex(channelID discord.ChannelID, messageID discord.MessageID, data api.EditMessageData) (*discord.Message, error)
+	CreatePrivateChannel(recipientID discord.UserID) (*discord.Channel, error)
+
+	Me() (*discord.User, error)
+	Guild(id discord.GuildID) (*discord.Guild, error)
+	Channel(id discord.ChannelID) (*discord.Channel, error)
+	Channels(guildID discord.GuildID) ([]discord.Channel, error)
+	// Members after a user ID, paging through all of them when limit is 0
+	MembersAfter(guildID discord.GuildID, after discord.UserID, limit uint) ([]discord.Member, error)
+	Permissions(channelID discord.ChannelID, userID discord.UserID) (discord.Permissions, error)
+
+	Emojis(guildID discord.GuildID) ([]discord.Emoji, error)
+	CreateEmoji(guildID discord.GuildID, data api.CreateEmojiData) (*discord.Emoji, error)
+	DeleteEmoji(guildID discord.GuildID, emojiID discord.EmojiID, reason api.AuditLogReason) error
+	GuildStickers(guildID discord.GuildID) ([]discord.Sticker, error)
+	DeleteGuildSticker(guildID discord.GuildID, stickerID discord.StickerID, reason api.AuditLogReason) error
+}
+
+// DiscordClient over a gateway session. Guilds, channels, members and emojis
+// come from the state's cache.
+type stateClient struct {
+	*state.State
+}
+
+var _ DiscordClient = stateClient{}
+
+// Fetch messages from the API; the state's cached copy would only repeat what
+// the gateway already told us, which is what reconciliation checks against
+func (c stateClient) Message(channelID discord.ChannelID, messageID discord.MessageID) (*discord.Message, error) {
+	return c.Client.Message(channelID, messageID)
+}
+
+func (c stateClient) GuildStickers(guildID discord.GuildID) ([]discord.Sticker, error) {
+	return fetchGuildStickers(c.Client, guildID)
+}
+
+// Arikawa has no wrapper for this endpoint
+func (c stateClient) DeleteGuildSticker(guildID discord.GuildID, stickerID discord.StickerID, reason api.AuditLogReason) error {
+	return c.FastRequest(
+		"DELETE", api.EndpointGuilds+guildID.String()+"/stickers/"+stickerID.String(),
+		httputil.WithHeaders(reason.Header()),
+	)
+}
+
+// The Discord client and database the handlers work against, and what the
+// handlers keep in memory between events. Bots share nothing, so several can
+// run in one process.
+type Bot struct {
+	Client DiscordClient
+	DB     *sql.DB
+	// Writes the events the bot consumes to a file when set
+	Recorder *EventRecorder
+	// Emoji and sticker images for the dashboard, pruning and polls
+	Images *ImageCache
+	// Runs backfill jobs in the background
+	Backfiller *Backfiller
+
+	health  healthState
+	metrics *botMetrics
+	gaps    gapTracker
+
+	emojiCache      map[discord.GuildID]CachedEmojiList
+	emojiCacheMutex sync.Mutex
+
+	// Settings by server, filled on first use and dropped when changed
+	settingsCache      map[int64]GuildSettings
+	settingsCacheMutex sync.Mutex
+
+	// Channel filters by server, filled on first use and dropped when changed
+	channelFilterCache      map[int64]channelFilters
+	channelFilterCacheMutex sync.Mutex
+
+	// Ignored roles by server, filled on first use and dropped when changed
+	roleFilterCache      map[int64]map[int64]bool
+	roleFilterCacheMutex sync.Mutex
+
+	// Members who opted out, loaded on first use and kept up to date on change.
+	// Opt-outs are few, so the whole set is cached.
+	optOutCache      map[int64]bool
+	optOutCacheMutex sync.Mutex
+
+	// Pseudonym keys by server, filled on first use and dropped when rotated.
+	// Servers without a secret aren't cached, so a new secret is seen once its
+	// transaction commits.
+	pseudonymKeyCache      map[int64][]byte
+	pseudonymKeyCacheMutex sync.Mutex
+
+	// Pruning proposals waiting for a moderator's confirmation
+	pruneSelections      map[discord.MessageID]pruneSelection
+	pruneSelectionsMutex sync.Mutex
+
+	// Imports waiting for a moderator's confirmation
+	pendingImports      map[discord.MessageID]pendingImport
+	pendingImportsMutex sync.Mutex
+}
+
+func NewBot(client DiscordClient, store *sql.DB) *Bot {
+	return &Bot{
+		Client:             client,
+		DB:                 store,
+		health:             healthState{gateway: gatewayConnecting, gatewaySince: time.Now()},
+		metrics:            newBotMetrics(),
+		emojiCache:         make(map[discord.GuildID]CachedEmojiList),
+		settingsCache:      make(map[int64]GuildSettings),
+		channelFilterCache: make(map[int64]channelFilters),
+		roleFilterCache:    make(map[int64]map[int64]bool),
+		pseudonymKeyCache:  make(map[int64][]byte),
+		pruneSelections:    make(map[discord.MessageID]pruneSelection),
+		pendingImports:     make(map[discord.MessageID]pendingImport),
+	}
+}
+
+// Dispatch a gateway event to its handlers
+func (b *Bot) HandleEvent(e gateway.Event) {
+	at := time.Now()
+	if b.Recorder != nil && b.recordable(e) {
+		if err := b.Recorder.Record(e, at); err != nil {
+			gatewayLog.Error("Error recording event", "type", e.EventType(), "err", err)
+		}
+	}
+	b.handleGatewayEvent(e)
+	b.dispatch(e, at)
+}
+
+// Run the handlers for an event received at the given time
+func (b *Bot) dispatch(e gateway.Event, at time.Time) {
+	switch e := e.(type) {
+	case *gateway.ReadyEvent:
+		b.handleReady(e)
+		b.handleReadyGuilds(e)
+	case *gateway.GuildCreateEvent:
+		b.handleGuildCreate(e)
+	case *gateway.GuildDeleteEvent:
+		b.handleGuildDelete(e)
+	case *gateway.MessageCreateEvent:
+		b.handleMessageCreate(e, at)
+	case *gateway.MessageReactionAddEvent:
+		b.handleMessageReactionAdd(e, at)
+	case *gateway.MessageReactionRemoveEvent:
+		b.handleMessageReactionRemove(e, at)
+	case *gateway.GuildEmojisUpdateEvent:
+		b.handleGuildEmojisUpdate(e)
+	case *gateway.InteractionCreateEvent:
+		b.handleInteractionCreate(e)
+	}
+}
+
+// Register slash commands once connected
+func (b *Bot) handleReady(e *gateway.ReadyEvent) {
+	gatewayLog.Info("Bot is ready", "user", e.User.Tag())
+
+	if err := registerCommands(b.Client, discord.AppID(e.User.ID)); err != nil {
+		commandLog.Error("Failed to register commands", "err", err)
+	} else {
+		gatewayLog.Info("All commands registered")
+	}
+}
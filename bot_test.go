@@ -0,0 +1,1224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+func TestMessageTracking(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		stickers []discord.StickerItem
+		edit     func(m *gateway.MessageCreateEvent)
+		emojis   map[int64]int
+		stickerN map[int64]int
+		events   int
+	}{
+		{
+			name:    "custom emoji",
+			content: "hello <:wave:111>",
+			emojis:  map[int64]int{111: 1},
+			events:  1,
+		},
+		{
+			name:    "animated emoji",
+			content: "<a:dance:112>",
+			emojis:  map[int64]int{112: 1},
+			events:  1,
+		},
+		{
+			name:    "repeated and mixed emojis",
+			content: "<:wave:111> <:wave:111> <a:dance:112>",
+			emojis:  map[int64]int{111: 2, 112: 1},
+			events:  3,
+		},
+		{
+			name:     "sticker",
+			stickers: []discord.StickerItem{{ID: 211, Name: "cat"}},
+			stickerN: map[int64]int{211: 1},
+			events:   1,
+		},
+		{
+			name:     "emoji and sticker",
+			content:  "<:wave:111>",
+			stickers: []discord.StickerItem{{ID: 211, Name: "cat"}},
+			emojis:   map[int64]int{111: 1},
+			stickerN: map[int64]int{211: 1},
+			events:   2,
+		},
+		{
+			name:    "unicode emoji is not tracked",
+			content: "😀 :wave:",
+		},
+		{
+			name:    "bot author is ignored",
+			content: "<:wave:111>",
+			edit:    func(m *gateway.MessageCreateEvent) { m.Author.Bot = true },
+			emojis:  map[int64]int{111: -1},
+		},
+		{
+			name:    "direct message is ignored",
+			content: "<:wave:111>",
+			edit:    func(m *gateway.MessageCreateEvent) { m.GuildID = 0 },
+			emojis:  map[int64]int{111: -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			m := b.message(tt.content, tt.stickers...)
+			if tt.edit != nil {
+				tt.edit(m)
+			}
+			b.send(m)
+
+			for id, want := range tt.emojis {
+				if got := b.emojiCount(id); got != want {
+					t.Errorf("emoji %d count = %d, want %d", id, got, want)
+				}
+			}
+			for id, want := range tt.stickerN {
+				if got := b.stickerCount(id); got != want {
+					t.Errorf("sticker %d count = %d, want %d", id, got, want)
+				}
+			}
+			if got := b.rows("usage_events"); got != tt.events {
+				t.Errorf("usage events = %d, want %d", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestAnimatedFlagIsStored(t *testing.T) {
+	b := newTestBot(t)
+	b.send(b.message("<a:dance:112>"))
+
+	var animated bool
+	if err := b.DB.QueryRow("SELECT animated FROM emojis WHERE emote_id = 112").Scan(&animated); err != nil {
+		t.Fatal(err)
+	}
+	if !animated {
+		t.Error("animated = false, want true")
+	}
+}
+
+func TestReactionTracking(t *testing.T) {
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	thumbs := discord.Emoji{Name: "👍"}
+	const message = discord.MessageID(500)
+
+	tests := []struct {
+		name   string
+		events func(b *testBot) []gateway.Event
+		want   int
+	}{
+		{
+			name: "add",
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, wave)}
+			},
+			want: 1,
+		},
+		{
+			name: "add from two messages",
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, wave), b.reactionAdd(message+1, wave)}
+			},
+			want: 2,
+		},
+		{
+			name: "add then remove",
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, wave), b.reactionRemove(message, wave)}
+			},
+			want: 0,
+		},
+		{
+			name: "count does not go below zero",
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, wave), b.reactionRemove(message, wave), b.reactionRemove(message, wave)}
+			},
+			want: 0,
+		},
+		{
+			name: "remove without add",
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionRemove(message, wave)}
+			},
+			want: -1,
+		},
+		{
+			name: "unicode reaction is not tracked",
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, thumbs)}
+			},
+			want: -1,
+		},
+		{
+			name: "direct message reaction is ignored",
+			events: func(b *testBot) []gateway.Event {
+				r := b.reactionAdd(message, wave)
+				r.GuildID = 0
+				return []gateway.Event{r}
+			},
+			want: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.send(tt.events(b)...)
+			if got := b.emojiCount(int64(wave.ID)); got != tt.want {
+				t.Errorf("emoji count = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReactionRemovalTakesBackTheAddDay(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	added := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	b.dispatch(b.reactionAdd(500, wave), added)
+	b.dispatch(b.reactionRemove(500, wave), added.Add(2*time.Hour))
+
+	rows, err := b.DB.Query("SELECT date(day), usage_count FROM usage_daily WHERE item_id = 111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	days := make(map[string]int)
+	for rows.Next() {
+		var day string
+		var n int
+		if err := rows.Scan(&day, &n); err != nil {
+			t.Fatal(err)
+		}
+		days[day] = n
+	}
+	if len(days) != 1 || days["2024-03-01"] != 0 {
+		t.Errorf("daily usage = %v, want the add's day back at 0", days)
+	}
+}
+
+// Track n emojis, the first used most
+func seedEmojis(b *testBot, n int) {
+	for e := 0; e < n; e++ {
+		var content strings.Builder
+		for range n - e {
+			content.WriteString(fmt.Sprintf("<:e%d:%d> ", e, 10000+e))
+		}
+		b.send(b.message(content.String()))
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, b *testBot)
+		event     func(b *testBot) *gateway.InteractionCreateEvent
+		want      string
+		ephemeral bool
+		// Deferred commands finish by editing their response
+		deferred bool
+		check    func(t *testing.T, b *testBot)
+	}{
+		{
+			name: "outside a server",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				e := b.command("listemotes")
+				e.GuildID = 0
+				e.Member = nil
+				e.User = &discord.User{ID: testUserID}
+				return e
+			},
+			want:      "only be used in a server",
+			ephemeral: true,
+		},
+		{
+			name:      "listemotes without data",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("listemotes") },
+			want:      "No emoji data found",
+			ephemeral: true,
+		},
+		{
+			name: "listemotes",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("<:wave:111> <:wave:111> <a:dance:112>"))
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("listemotes") },
+			want:      "<:wave:111> **x2**",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				if content := b.fake.lastContent(t); !strings.Contains(content, "<a:dance:112> **x1**") {
+					t.Errorf("animated emoji missing from %q", content)
+				}
+			},
+		},
+		{
+			name: "listemotes shared",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("<:wave:111>"))
+			},
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("listemotes", boolOption("share", true))
+			},
+			want: "<:wave:111> **x1**",
+		},
+		{
+			name: "liststickers",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("", discord.StickerItem{ID: 211, Name: "cat"}))
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("liststickers") },
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				data := b.fake.lastResponse(t).Data
+				if data.Embeds == nil || len(*data.Embeds) != 1 || (*data.Embeds)[0].Title != "cat x1" {
+					t.Errorf("embeds = %+v, want one titled %q", data.Embeds, "cat x1")
+				}
+			},
+		},
+		{
+			name: "listleastused only lists live emojis",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("<:wave:111> <:wave:111> <:gone:113> <:old:114>"))
+				b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}, {ID: 114, Name: "old"}}
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("listleastused") },
+			want:      "<:old:114> **x1**",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				content := b.fake.lastContent(t)
+				if strings.Contains(content, "gone") {
+					t.Errorf("deleted emoji listed in %q", content)
+				}
+				if strings.Index(content, "old") > strings.Index(content, "wave") {
+					t.Errorf("least used emoji is not first in %q", content)
+				}
+			},
+		},
+		{
+			name:      "listleastused without live emojis",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("listleastused") },
+			want:      "No custom emojis found",
+			ephemeral: true,
+		},
+		{
+			name: "resetcount",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("<:wave:111>", discord.StickerItem{ID: 211, Name: "cat"}))
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("resetcount") },
+			want:      "counts have been reset",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				for _, table := range []string{"emojis", "stickers", "usage_daily", "usage_events"} {
+					if n := b.rows(table); n != 0 {
+						t.Errorf("%s has %d rows after reset", table, n)
+					}
+				}
+			},
+		},
+		{
+			name: "resetcount failing partway",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("<:wave:111>"))
+				// The last table's delete fails after the others ran
+				if _, err := b.DB.Exec("DROP TABLE retention_state"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("resetcount") },
+			want:      "Failed to reset counts",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				if got := b.emojiCount(111); got != 1 {
+					t.Errorf("emoji count = %d after a failed reset, want 1", got)
+				}
+				if n := b.rows("usage_events"); n != 1 {
+					t.Errorf("usage_events has %d rows after a failed reset, want 1", n)
+				}
+			},
+		},
+		{
+			name:      "trending",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("trending") },
+			want:      "No emojis above the minimum volume",
+			ephemeral: true,
+		},
+		{
+			name: "slots",
+			setup: func(t *testing.T, b *testBot) {
+				b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}, {ID: 112, Name: "dance", Animated: true}}
+				b.fake.StickersByGuild[testGuildID] = []discord.Sticker{{ID: 211, Name: "cat"}}
+				b.send(b.message("<:wave:111>"))
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("slots") },
+			want:      "Static emojis: **1/50**",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				content := b.fake.lastContent(t)
+				for _, want := range []string{"Animated emojis: **1/50**", "Stickers: **1/5**", "1. "} {
+					if !strings.Contains(content, want) {
+						t.Errorf("%q missing from %q", want, content)
+					}
+				}
+			},
+		},
+		{
+			name: "outages list",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("outages", subcommand("list"))
+			},
+			want:      "No outages recorded",
+			ephemeral: true,
+		},
+		{
+			name: "apitoken create",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("apitoken", subcommand("create", stringOption("name", "ci")))
+			},
+			want:      "Created token **ci**",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				if n := b.rows("api_tokens"); n != 1 {
+					t.Errorf("api_tokens has %d rows, want 1", n)
+				}
+			},
+		},
+		{
+			name: "apitoken revoke unknown",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("apitoken", subcommand("revoke", intOption("id", 42)))
+			},
+			want:      "No token with that ID",
+			ephemeral: true,
+		},
+		{
+			name:      "dashboard disabled",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("dashboard") },
+			want:      "not enabled",
+			ephemeral: true,
+		},
+		{
+			name:      "dashboard needs manage server",
+			setup:     enableDashboard,
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("dashboard") },
+			want:      "Manage Server permission",
+			ephemeral: true,
+		},
+		{
+			name: "dashboard sends a login link",
+			setup: func(t *testing.T, b *testBot) {
+				enableDashboard(t, b)
+				b.fake.Perms[testUserID] = discord.PermissionManageGuild
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("dashboard") },
+			want:      "Sent you a login link",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				if len(b.fake.Sent) != 1 || !strings.Contains(b.fake.Sent[0].Data.Content, "https://stats.example.com/dashboard/login?token=") {
+					t.Errorf("sent = %+v, want one login link", b.fake.Sent)
+				}
+			},
+		},
+		{
+			name: "dashboard with DMs closed",
+			setup: func(t *testing.T, b *testBot) {
+				enableDashboard(t, b)
+				b.fake.Perms[testUserID] = discord.PermissionManageGuild
+				b.fake.DMsDisabled = true
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("dashboard") },
+			want:      "Couldn't DM you",
+			ephemeral: true,
+		},
+		{
+			name:      "prune without emojis",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("prune") },
+			want:      "No emojis or stickers found",
+			ephemeral: true,
+		},
+		{
+			name:      "digest channel",
+			event:     digestChannelCommand,
+			want:      "Digest is **enabled** in <#2000>",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				if n := b.rows("digests"); n != 1 {
+					t.Errorf("digests has %d rows, want 1", n)
+				}
+			},
+		},
+		{
+			name: "digest schedule without a channel",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("digest", subcommand("schedule", stringOption("cron", "0 9 * * 1")))
+			},
+			want:      "Set a digest channel first",
+			ephemeral: true,
+		},
+		{
+			name:  "digest schedule",
+			setup: func(t *testing.T, b *testBot) { b.send(digestChannelCommand(b)) },
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("digest", subcommand("schedule", stringOption("cron", "0 9 * * 1")))
+			},
+			want:      "on schedule `0 9 * * 1`",
+			ephemeral: true,
+		},
+		{
+			name: "digest schedule invalid",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("digest", subcommand("schedule", stringOption("cron", "every monday")))
+			},
+			want:      "Invalid schedule",
+			ephemeral: true,
+		},
+		{
+			name: "digest preview",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.message("<:wave:111>"))
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("digest", subcommand("preview")) },
+			want:      "<:wave:111>",
+			ephemeral: true,
+		},
+		{
+			name:      "digest disable",
+			setup:     func(t *testing.T, b *testBot) { b.send(digestChannelCommand(b)) },
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("digest", subcommand("disable")) },
+			want:      "Digest disabled",
+			ephemeral: true,
+		},
+		{
+			name:      "digest disable without a digest",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("digest", subcommand("disable")) },
+			want:      "No digest is configured",
+			ephemeral: true,
+		},
+		{
+			name: "emojivote remove",
+			setup: func(t *testing.T, b *testBot) {
+				b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}}
+				b.send(b.message("<:wave:111>"))
+			},
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("emojivote", subcommand(pollActionRemove, stringOption("emoji", ":wave:")))
+			},
+			want:      "Poll posted",
+			ephemeral: true,
+			deferred:  true,
+			check: func(t *testing.T, b *testBot) {
+				if len(b.fake.Sent) != 1 || !strings.Contains(b.fake.Sent[0].Data.Content, "wave") {
+					t.Errorf("sent = %+v, want the poll", b.fake.Sent)
+				}
+				if n := b.rows("emoji_polls"); n != 1 {
+					t.Errorf("emoji_polls has %d rows, want 1", n)
+				}
+			},
+		},
+		{
+			name: "emojivote remove unknown emoji",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("emojivote", subcommand(pollActionRemove, stringOption("emoji", "gone")))
+			},
+			want:      "That emoji isn't in this server",
+			ephemeral: true,
+			deferred:  true,
+		},
+		{
+			name:      "emojivote add",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return emojiVoteAddCommand(b, testPNG) },
+			want:      "Poll posted",
+			ephemeral: true,
+			deferred:  true,
+			check: func(t *testing.T, b *testBot) {
+				p, err := b.getEmojiPoll(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p == nil || p.EmojiName != "party" || p.ImageType != "image/png" || len(p.Image) != len(testPNG) {
+					t.Errorf("poll = %+v, want one adding party with the uploaded image", p)
+				}
+			},
+		},
+		{
+			name: "emojivote remove when the poll can't be posted",
+			setup: func(t *testing.T, b *testBot) {
+				b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}}
+				b.fake.SendErr = errors.New("missing access")
+			},
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("emojivote", subcommand(pollActionRemove, stringOption("emoji", "wave")))
+			},
+			want:      "Failed to post the poll",
+			ephemeral: true,
+			deferred:  true,
+			check: func(t *testing.T, b *testBot) {
+				if n := b.rows("emoji_polls"); n != 0 {
+					t.Errorf("emoji_polls has %d rows of an unposted poll", n)
+				}
+			},
+		},
+		{
+			name: "emojivote add with an image too large",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return emojiVoteAddCommand(b, append(testPNG, make([]byte, maxEmojiImageBytes)...))
+			},
+			want:      "256 KB or smaller",
+			ephemeral: true,
+			deferred:  true,
+		},
+		{
+			name: "emojivote add with a text file",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return emojiVoteAddCommand(b, []byte("not an image"))
+			},
+			want:      "must be PNG, JPEG or GIF",
+			ephemeral: true,
+			deferred:  true,
+		},
+		{
+			name: "import preview",
+			setup: func(t *testing.T, b *testBot) {
+				b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}}
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return importCommand(b, "Emoji,Uses\n111,5\n") },
+			want:      "1 new, 0 changed, 0 unchanged, 0 skipped",
+			ephemeral: true,
+			deferred:  true,
+			check: func(t *testing.T, b *testBot) {
+				b.pendingImportsMutex.Lock()
+				defer b.pendingImportsMutex.Unlock()
+				if len(b.pendingImports) != 1 {
+					t.Errorf("%d pending imports, want 1", len(b.pendingImports))
+				}
+			},
+		},
+		{
+			name:      "import of an unreadable file",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return importCommand(b, "Uses\n5\n") },
+			want:      "Failed to read the file",
+			ephemeral: true,
+			deferred:  true,
+		},
+		{
+			name:      "import without a file",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("import") },
+			want:      "Missing file",
+			ephemeral: true,
+		},
+		{
+			name: "backfill start",
+			setup: func(t *testing.T, b *testBot) {
+				backfillHistory(b, 3, time.Now().Add(-time.Hour))
+			},
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("backfill", subcommand("start", stringOption("since", time.Now().AddDate(0, 0, -1).Format(time.DateOnly))))
+			},
+			want:      "Backfilling 1 channels",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				waitForBackfill(t, b)
+				job, err := b.getBackfillJob(int64(testGuildID))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if job.Status != backfillStatusDone || job.ItemsCounted != 3 || b.emojiCount(111) != 3 {
+					t.Errorf("job = %+v with emoji count %d, want done after counting 3", job, b.emojiCount(111))
+				}
+			},
+		},
+		{
+			name: "backfill start with a future date",
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("backfill", subcommand("start", stringOption("since", time.Now().AddDate(0, 0, 2).Format(time.DateOnly))))
+			},
+			want:      "must be in the past",
+			ephemeral: true,
+		},
+		{
+			name: "backfill start in an ignored channel",
+			setup: func(t *testing.T, b *testBot) {
+				b.send(b.command("tracking", subcommand(filterIgnore, channelOption("channel", testChannelID))))
+			},
+			event: func(b *testBot) *gateway.InteractionCreateEvent {
+				return b.command("backfill", subcommand("start",
+					stringOption("since", time.Now().AddDate(0, 0, -1).Format(time.DateOnly)),
+					channelOption("channel", testChannelID)))
+			},
+			want:      "isn't tracked",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				if got := b.rows("backfill_jobs"); got != 0 {
+					t.Errorf("created %d backfill jobs", got)
+				}
+			},
+		},
+		{
+			name:      "backfill status without a job",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("backfill", subcommand("status")) },
+			want:      "No backfill has been run",
+			ephemeral: true,
+		},
+		{
+			name:      "backfill status",
+			setup:     createTestBackfillJob,
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("backfill", subcommand("status")) },
+			want:      "Messages scanned: 0",
+			ephemeral: true,
+		},
+		{
+			name: "backfill cancel",
+			setup: func(t *testing.T, b *testBot) {
+				createTestBackfillJob(t, b)
+				// Hold the job as running without crawling
+				b.Backfiller.mu.Lock()
+				b.Backfiller.cancels[int64(testGuildID)] = func() {}
+				b.Backfiller.mu.Unlock()
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("backfill", subcommand("cancel")) },
+			want:      "Backfill cancelled",
+			ephemeral: true,
+			check: func(t *testing.T, b *testBot) {
+				job, err := b.getBackfillJob(int64(testGuildID))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if job.Status != backfillStatusCancelled {
+					t.Errorf("job status = %q, want %q", job.Status, backfillStatusCancelled)
+				}
+			},
+		},
+		{
+			name:      "backfill cancel without a job",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("backfill", subcommand("cancel")) },
+			want:      "No backfill is running",
+			ephemeral: true,
+		},
+		{
+			name: "reconcile run",
+			setup: func(t *testing.T, b *testBot) {
+				wave := discord.Emoji{ID: 111, Name: "wave"}
+				b.send(b.reactionAdd(500, wave))
+				b.fake.Messages[500] = discord.Message{ID: 500, ChannelID: testChannelID, Reactions: []discord.Reaction{{Emoji: wave, Count: 3}}}
+			},
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("reconcile", subcommand("run")) },
+			want:      "Checked 1 recently active messages: 1 corrections (+2/-0 reactions)",
+			ephemeral: true,
+			deferred:  true,
+			check: func(t *testing.T, b *testBot) {
+				if got := b.emojiCount(111); got != 3 {
+					t.Errorf("emoji count = %d, want 3", got)
+				}
+			},
+		},
+		{
+			name:      "reconcile stats before any run",
+			event:     func(b *testBot) *gateway.InteractionCreateEvent { return b.command("reconcile", subcommand("stats")) },
+			want:      "No reconciliation has run yet",
+			ephemeral: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			if tt.setup != nil {
+				tt.setup(t, b)
+			}
+			b.send(tt.event(b))
+
+			resp := b.fake.lastResponse(t)
+			wantType, content := api.MessageInteractionWithSource, ""
+			if tt.deferred {
+				wantType, content = api.DeferredMessageInteractionWithSource, b.fake.lastEdit(t)
+			} else {
+				content = b.fake.lastContent(t)
+			}
+			if resp.Type != wantType {
+				t.Errorf("response type = %v, want %v", resp.Type, wantType)
+			}
+			if !strings.Contains(content, tt.want) {
+				t.Errorf("content = %q, want it to contain %q", content, tt.want)
+			}
+			if got := resp.Data.Flags&discord.EphemeralMessage != 0; got != tt.ephemeral {
+				t.Errorf("ephemeral = %t, want %t", got, tt.ephemeral)
+			}
+			if tt.check != nil {
+				tt.check(t, b)
+			}
+		})
+	}
+}
+
+// Commands with subcommands refuse an interaction without one
+func TestMissingSubcommand(t *testing.T) {
+	for _, name := range []string{"digest", "emojivote", "backfill", "reconcile", "outages", "apitoken", "config", "tracking", "privacy"} {
+		b := newTestBot(t)
+		b.send(b.command(name))
+		if content := b.fake.lastContent(t); !strings.Contains(content, "Missing subcommand") {
+			t.Errorf("/%s without a subcommand replied %q", name, content)
+		}
+	}
+}
+
+// And refuse a subcommand they don't have
+func TestUnknownSubcommand(t *testing.T) {
+	for _, name := range []string{"digest", "emojivote", "backfill", "reconcile", "outages", "apitoken", "config", "tracking", "privacy"} {
+		b := newTestBot(t)
+		b.send(b.command(name, subcommand("bogus")))
+		content := b.fake.lastContent(t)
+		if len(b.fake.Edits) > 0 {
+			// Deferred before the subcommand is read
+			content = b.fake.lastEdit(t)
+		}
+		if !strings.Contains(content, "Unknown subcommand") {
+			t.Errorf("/%s bogus replied %q", name, content)
+		}
+	}
+}
+
+// Smallest valid PNG header
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+
+func digestChannelCommand(b *testBot) *gateway.InteractionCreateEvent {
+	return b.command("digest", subcommand("channel", channelOption("channel", testChannelID)))
+}
+
+func emojiVoteAddCommand(b *testBot, image []byte) *gateway.InteractionCreateEvent {
+	a := b.attachment("party.png", image)
+	return withAttachments(b.command("emojivote", subcommand(pollActionAdd, stringOption("name", "party"), attachmentOption("image", a))), a)
+}
+
+// /import of a CSV file with Emoji and Uses columns
+func importCommand(b *testBot, csv string) *gateway.InteractionCreateEvent {
+	a := b.attachment("counts.csv", []byte(csv))
+	return withAttachments(b.command("import",
+		stringOption("strategy", importStrategyAdd),
+		stringOption("mapping", "id=Emoji,count=Uses"),
+		attachmentOption("file", a),
+	), a)
+}
+
+func createTestBackfillJob(t *testing.T, b *testBot) {
+	t.Helper()
+	job := &BackfillJob{ServerID: int64(testGuildID), Since: time.Now().AddDate(0, 0, -7), StartedBy: int64(testUserID)}
+	if err := b.createBackfillJob(job, []discord.ChannelID{testChannelID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Wait for the server's backfill to stop crawling
+func waitForBackfill(t *testing.T, b *testBot) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Backfiller.Running(int64(testGuildID)) {
+		if time.Now().After(deadline) {
+			t.Fatal("backfill still running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func enableDashboard(t *testing.T, b *testBot) {
+	t.Setenv("DASHBOARD_URL", "https://stats.example.com")
+	t.Setenv("HTTP_LISTEN_ADDR", ":0")
+}
+
+func TestReadyRegistersCommands(t *testing.T) {
+	b := newTestBot(t)
+	b.send(&gateway.ReadyEvent{User: discord.User{ID: testBotUserID, Username: "emote_keeper"}})
+
+	names := make(map[string]bool)
+	for _, c := range b.fake.Commands {
+		if names[c.Name] {
+			t.Errorf("command %s registered twice", c.Name)
+		}
+		names[c.Name] = true
+	}
+	for _, want := range []string{"listemotes", "liststickers", "trending", "prune", "apitoken", "dashboard"} {
+		if !names[want] {
+			t.Errorf("command %s was not registered", want)
+		}
+	}
+}
+
+// Entries in a list message, one per line starting with "- "
+func listLines(content string) int {
+	return strings.Count(content, "\n- ")
+}
+
+func TestButtons(t *testing.T) {
+	tests := []struct {
+		name     string
+		customID string
+		respType api.InteractionResponseType
+		check    func(t *testing.T, resp api.InteractionResponse)
+	}{
+		{
+			name:     "next emoji page",
+			customID: "emoji_page:1",
+			respType: api.UpdateMessage,
+			check: func(t *testing.T, resp api.InteractionResponse) {
+				if n := listLines(resp.Data.Content.Val); n != 5 {
+					t.Errorf("page 2 lists %d emojis, want 5", n)
+				}
+				if !strings.Contains(resp.Data.Content.Val, "<:e25:10025>") {
+					t.Errorf("page 2 does not start at the 26th emoji: %q", resp.Data.Content.Val)
+				}
+			},
+		},
+		{
+			name:     "first emoji page",
+			customID: "emoji_page:0",
+			respType: api.UpdateMessage,
+			check: func(t *testing.T, resp api.InteractionResponse) {
+				if n := listLines(resp.Data.Content.Val); n != 25 {
+					t.Errorf("page 1 lists %d emojis, want 25", n)
+				}
+			},
+		},
+		{
+			name:     "sticker page",
+			customID: "sticker_page:0",
+			respType: api.UpdateMessage,
+			check: func(t *testing.T, resp api.InteractionResponse) {
+				if resp.Data.Embeds == nil || len(*resp.Data.Embeds) != 1 {
+					t.Errorf("embeds = %+v, want one sticker", resp.Data.Embeds)
+				}
+			},
+		},
+		{
+			name:     "page jump opens a modal",
+			customID: "emoji_page:1:jump",
+			respType: api.ModalResponse,
+			check: func(t *testing.T, resp api.InteractionResponse) {
+				if got := resp.Data.CustomID.Val; got != "emoji_page:1:jump" {
+					t.Errorf("modal custom ID = %q", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			seedEmojis(b, 30)
+			b.send(b.message("", discord.StickerItem{ID: 211, Name: "cat"}))
+
+			b.send(b.button(tt.customID))
+			resp := b.fake.lastResponse(t)
+			if resp.Type != tt.respType {
+				t.Fatalf("response type = %v, want %v", resp.Type, tt.respType)
+			}
+			tt.check(t, resp)
+		})
+	}
+}
+
+func TestIgnoredButtons(t *testing.T) {
+	for _, customID := range []string{"unknown", "emoji_page:x", "other_page:1"} {
+		t.Run(customID, func(t *testing.T) {
+			b := newTestBot(t)
+			b.send(b.button(customID))
+			if len(b.fake.Responses) != 0 {
+				t.Errorf("responded to %q: %+v", customID, b.fake.Responses)
+			}
+		})
+	}
+}
+
+func TestPageJumpModal(t *testing.T) {
+	tests := []struct {
+		name     string
+		customID string
+		value    string
+		lines    int // -1 when no response is expected
+	}{
+		{name: "second page", customID: "emoji_page:0:jump", value: "2", lines: 5},
+		{name: "first page", customID: "emoji_page:1:jump", value: "1", lines: 25},
+		{name: "page past the end", customID: "emoji_page:0:jump", value: "3", lines: -1},
+		{name: "page zero", customID: "emoji_page:0:jump", value: "0", lines: -1},
+		{name: "not a number", customID: "emoji_page:0:jump", value: "two", lines: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			seedEmojis(b, 30)
+
+			b.send(b.modal(tt.customID, "page_input", tt.value))
+			if tt.lines < 0 {
+				if len(b.fake.Responses) != 0 {
+					t.Errorf("responded: %+v", b.fake.Responses)
+				}
+				return
+			}
+			resp := b.fake.lastResponse(t)
+			if resp.Type != api.UpdateMessage {
+				t.Fatalf("response type = %v, want %v", resp.Type, api.UpdateMessage)
+			}
+			if n := listLines(resp.Data.Content.Val); n != tt.lines {
+				t.Errorf("lists %d emojis, want %d", n, tt.lines)
+			}
+		})
+	}
+}
+
+func TestPruneFlow(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       bool
+		deleteErr   error
+		want        string
+		wantDeleted int
+		wantRows    int
+	}{
+		{name: "deleted and archived", image: true, want: "unused deleted", wantDeleted: 1, wantRows: 1},
+		{name: "image unavailable", want: "couldn't archive its image, not deleted"},
+		{name: "delete fails", image: true, deleteErr: errors.New("missing permissions"), want: "failed to delete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}, {ID: 112, Name: "unused"}}
+			if tt.image {
+				b.fake.Files[emojiImageURL(112, false)] = testPNG
+			}
+			b.fake.DeleteErr = tt.deleteErr
+			b.send(b.message("<:wave:111>"))
+
+			b.send(b.command("prune"))
+			if content := b.fake.lastContent(t); !strings.Contains(content, "Pruning Proposal") {
+				t.Fatalf("content = %q, want a proposal", content)
+			}
+
+			proposal := &discord.Message{ID: 700}
+			sel := b.interaction(&discord.StringSelectInteraction{CustomID: "prune_select", Values: []string{pruneValue(kindEmoji, 112)}})
+			sel.Message = proposal
+			b.send(sel)
+			if resp := b.fake.lastResponse(t); resp.Type != api.DeferredMessageUpdate {
+				t.Fatalf("selection response type = %v, want %v", resp.Type, api.DeferredMessageUpdate)
+			}
+
+			confirm := b.button("prune_confirm")
+			confirm.Message = proposal
+			b.send(confirm)
+
+			if len(b.fake.DeletedEmojis) != tt.wantDeleted {
+				t.Errorf("deleted emojis = %v, want %d", b.fake.DeletedEmojis, tt.wantDeleted)
+			}
+			if n := b.rows("pruned_items"); n != tt.wantRows {
+				t.Errorf("pruned_items has %d rows, want %d", n, tt.wantRows)
+			}
+			if len(b.fake.Edits) != 1 || !strings.Contains(b.fake.Edits[0].Content.Val, "Pruning Results") || !strings.Contains(b.fake.Edits[0].Content.Val, tt.want) {
+				t.Errorf("edits = %+v, want the results with %q", b.fake.Edits, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneProposalOwnership(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}, {ID: 112, Name: "unused"}}
+	b.fake.Files[emojiImageURL(112, false)] = testPNG
+
+	proposal := &discord.Message{ID: 700, Interaction: &discord.MessageInteraction{User: discord.User{ID: testUserID}}}
+	byOther := func(e *gateway.InteractionCreateEvent) *gateway.InteractionCreateEvent {
+		e.Message = proposal
+		e.Member = &discord.Member{User: discord.User{ID: testUserID + 1, Username: "other"}}
+		return e
+	}
+
+	// Nothing is selected yet, so the proposal belongs to whoever ran /prune
+	b.send(byOther(b.button("prune_cancel")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Only the moderator who started this can cancel it.") {
+		t.Errorf("other moderator's cancel replied %q", content)
+	}
+
+	sel := b.interaction(&discord.StringSelectInteraction{CustomID: "prune_select", Values: []string{pruneValue(kindEmoji, 112)}})
+	sel.Message = proposal
+	b.send(sel)
+	b.send(byOther(b.interaction(&discord.StringSelectInteraction{CustomID: "prune_select", Values: []string{pruneValue(kindEmoji, 111)}})))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Only the moderator who started this can change the selection.") {
+		t.Errorf("other moderator's selection replied %q", content)
+	}
+	b.send(byOther(b.button("prune_confirm")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Only the moderator who started this can confirm it.") {
+		t.Errorf("other moderator's confirm replied %q", content)
+	}
+	if len(b.fake.DeletedEmojis) != 0 {
+		t.Fatalf("other moderator deleted %v", b.fake.DeletedEmojis)
+	}
+
+	// The proposer's selection survived
+	confirm := b.button("prune_confirm")
+	confirm.Message = proposal
+	b.send(confirm)
+	if len(b.fake.DeletedEmojis) != 1 || b.fake.DeletedEmojis[0] != 112 {
+		t.Errorf("deleted emojis = %v, want 112", b.fake.DeletedEmojis)
+	}
+}
+
+func TestImportFlow(t *testing.T) {
+	tests := []struct {
+		name      string
+		customID  string
+		user      discord.UserID
+		want      string
+		wantCount int
+	}{
+		{name: "apply", customID: "import_apply", user: testUserID, want: "Imported 1 items", wantCount: 7},
+		{name: "cancel", customID: "import_cancel", user: testUserID, want: "Import cancelled", wantCount: 2},
+		{name: "another moderator", customID: "import_apply", user: testUserID + 1, want: "preview has expired", wantCount: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}}
+			b.send(b.message("<:wave:111> <:wave:111>"))
+			b.send(importCommand(b, "Emoji,Uses\n111,5\n"))
+			if content := b.fake.lastEdit(t); !strings.Contains(content, "0 new, 1 changed") {
+				t.Fatalf("preview = %q, want one change", content)
+			}
+
+			b.pendingImportsMutex.Lock()
+			var preview discord.MessageID
+			for id := range b.pendingImports {
+				preview = id
+			}
+			b.pendingImportsMutex.Unlock()
+			click := b.button(tt.customID)
+			click.Message = &discord.Message{ID: preview}
+			click.Member.User.ID = tt.user
+			b.send(click)
+
+			resp := b.fake.lastResponse(t)
+			if resp.Type != api.UpdateMessage {
+				t.Errorf("response type = %v, want %v", resp.Type, api.UpdateMessage)
+			}
+			if content := b.fake.lastContent(t); !strings.Contains(content, tt.want) {
+				t.Errorf("content = %q, want it to contain %q", content, tt.want)
+			}
+			if got := b.emojiCount(111); got != tt.wantCount {
+				t.Errorf("emoji count = %d, want %d", got, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestEmojiVoteFlow(t *testing.T) {
+	tests := []struct {
+		name        string
+		votes       []string
+		wantStatus  string
+		wantDeleted int
+	}{
+		{name: "passed", votes: []string{"yes", "yes", "no"}, wantStatus: pollStatusApplied, wantDeleted: 1},
+		{name: "rejected", votes: []string{"yes", "no", "no"}, wantStatus: pollStatusFailed},
+		{name: "tied", votes: []string{"yes", "no"}, wantStatus: pollStatusFailed},
+		{name: "changed vote", votes: []string{"yes", "no"}, wantStatus: pollStatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}}
+			b.send(b.command("emojivote", subcommand(pollActionRemove, stringOption("emoji", "wave"), boolOption("apply", true))))
+			if content := b.fake.lastEdit(t); !strings.Contains(content, "Poll posted") {
+				t.Fatalf("content = %q, want the poll posted", content)
+			}
+
+			for n, vote := range tt.votes {
+				click := b.button(fmt.Sprintf("emojivote:1:%s", vote))
+				click.Member.User.ID = testUserID + discord.UserID(n)
+				if tt.name == "changed vote" {
+					// The same member votes twice and the second vote counts
+					click.Member.User.ID = testUserID
+				}
+				b.send(click)
+				if content := b.fake.lastContent(t); !strings.Contains(content, "Your vote") {
+					t.Fatalf("vote response = %q", content)
+				}
+			}
+
+			p, err := b.getEmojiPoll(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.finishEmojiPoll(p)
+			// A check that loaded the poll before it closed doesn't apply it again
+			b.finishEmojiPoll(p)
+
+			p, err = b.getEmojiPoll(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", p.Status, tt.wantStatus)
+			}
+			if len(b.fake.DeletedEmojis) != tt.wantDeleted {
+				t.Errorf("deleted emojis = %v, want %d", b.fake.DeletedEmojis, tt.wantDeleted)
+			}
+			if len(b.fake.MessageEdits) != 1 || !strings.Contains(b.fake.MessageEdits[0].Content.Val, "Poll closed") {
+				t.Errorf("message edits = %+v, want the poll closed", b.fake.MessageEdits)
+			}
+
+			// Votes on a closed poll are refused
+			b.send(b.button("emojivote:1:yes"))
+			if content := b.fake.lastContent(t); !strings.Contains(content, "poll is closed") {
+				t.Errorf("vote after closing = %q", content)
+			}
+		})
+	}
+}
+
+func TestGuildEmojisUpdateRefreshesCache(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.EmojisByGuild[testGuildID] = []discord.Emoji{{ID: 111, Name: "wave"}}
+	if _, err := b.getGuildEmojis(testGuildID); err != nil {
+		t.Fatal(err)
+	}
+
+	b.send(&gateway.GuildEmojisUpdateEvent{GuildID: testGuildID, Emojis: []discord.Emoji{{ID: 112, Name: "new"}}})
+	emojis, err := b.getGuildEmojis(testGuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emojis) != 1 || emojis[0].ID != 112 {
+		t.Errorf("cached emojis = %+v, want the updated list", emojis)
+	}
+}
+
+// Each bot keeps its own database and caches, so bots can run side by side
+func TestBotsAreIndependent(t *testing.T) {
+	t.Parallel()
+	a, b := newTestBot(t), newTestBot(t)
+	a.send(a.message("<:wave:111>"))
+	a.send(&gateway.GuildEmojisUpdateEvent{GuildID: testGuildID, Emojis: []discord.Emoji{{ID: 111, Name: "wave"}}})
+
+	if got := a.emojiCount(111); got != 1 {
+		t.Errorf("emoji count = %d, want 1", got)
+	}
+	if got := b.emojiCount(111); got != -1 {
+		t.Errorf("other bot's emoji count = %d, want none recorded", got)
+	}
+	b.emojiCacheMutex.Lock()
+	cached := len(b.emojiCache)
+	b.emojiCacheMutex.Unlock()
+	if cached != 0 {
+		t.Errorf("other bot cached %d emoji lists, want none", cached)
+	}
+}
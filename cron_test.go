@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "0 9 * * 1"},
+		{expr: " @Weekly "},
+		{expr: "0,30 8-18/2 1-7 */3 1-5"},
+		{expr: "0 0 * * 7"},
+		{expr: "", wantErr: true},
+		{expr: "0 9 * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) err = %v, want error %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNextAndPrev(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		name       string
+		expr       string
+		from       string
+		next, prev string
+	}{
+		{"weekday", "0 9 * * 1", "2024-01-03 10:00:00", "2024-01-08 09:00:00", "2024-01-01 09:00:00"},
+		{"exactly on a run", "0 9 * * 1", "2024-01-08 09:00:00", "2024-01-15 09:00:00", "2024-01-01 09:00:00"},
+		{"minute step", "*/15 * * * *", "2024-01-01 10:15:30", "2024-01-01 10:30:00", "2024-01-01 10:15:00"},
+		{"hour range with step", "30 8-12/2 * * *", "2024-01-01 08:30:00", "2024-01-01 10:30:00", "2023-12-31 12:30:00"},
+		{"Sunday as 7", "0 0 * * 7", "2024-01-01 00:00:00", "2024-01-07 00:00:00", "2023-12-31 00:00:00"},
+		{"month rollover", "0 0 1 * *", "2024-01-31 23:30:00", "2024-02-01 00:00:00", "2024-01-01 00:00:00"},
+		{"year rollover", "@monthly", "2024-12-15 00:00:00", "2025-01-01 00:00:00", "2024-12-01 00:00:00"},
+		{"skips short months", "0 12 31 * *", "2024-02-01 00:00:00", "2024-03-31 12:00:00", "2024-01-31 12:00:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00:00", "2024-02-29 00:00:00"},
+		{"day of month or week", "0 0 13 * 5", "2024-01-06 00:00:00", "2024-01-12 00:00:00", "2024-01-05 00:00:00"},
+		{"never", "0 0 30 2 *", "2024-01-01 00:00:00", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wantNext, wantPrev time.Time
+			if tt.next != "" {
+				wantNext, wantPrev = at(tt.next), at(tt.prev)
+			}
+			if got := c.Next(at(tt.from)); !got.Equal(wantNext) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, wantNext)
+			}
+			if got := c.Prev(at(tt.from)); !got.Equal(wantPrev) {
+				t.Errorf("Prev(%s) = %s, want %s", tt.from, got, wantPrev)
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	dashboardLoginTTL = 15 * time.Minute
+	// Manage Server is only checked when a link is requested, so a session
+	// outlives a lost permission by at most this long
+	dashboardSessionTTL  = time.Hour
+	dashboardCookie      = "dek_dashboard"
+	dashboardRankLimit   = 100
+	dashboardDefaultDays = 30
+	dashboardChartWidth  = 720
+	dashboardChartHeight = 160
+)
+
+// Windows offered by the dashboard filters; 0 is all time
+var dashboardDayChoices = []int{7, 30, 90, 365, 0}
+
+//go:embed dashboard/templates dashboard/static
+var dashboardFS embed.FS
+
+var dashboardTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+	"imageURL": func(serverID int64, kind string, id int64) string {
+		return fmt.Sprintf("/dashboard/guilds/%d/images/%s/%d", serverID, kind, id)
+	},
+}).ParseFS(dashboardFS, "dashboard/templates/*.html"))
+
+// Public base URL of the dashboard, used in login links. The dashboard is off when empty.
+func dashboardBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("DASHBOARD_URL"), "/")
+}
+
+func newDashboardSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create a one-time login token for a member of a server. The member is
+// stored under their pseudonym in pseudonymizing servers.
+func (b *Bot) createDashboardLogin(serverID, userID int64, now time.Time) (string, error) {
+	userID, ok := b.storedUserID(serverID, userID)
+	if !ok {
+		return "", errors.New("failed to pseudonymize member")
+	}
+	if _, err := b.DB.Exec("DELETE FROM dashboard_logins WHERE expires_at < ?", now.Unix()); err != nil {
+		httpLog.Error("Error deleting expired dashboard logins", "err", err)
+	}
+
+	token, err := newDashboardSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = b.DB.Exec("INSERT INTO dashboard_logins (token_hash, server_id, user_id, expires_at) VALUES (?, ?, ?, ?)",
+		hashAPIToken(token), serverID, userID, now.Add(dashboardLoginTTL).Unix())
+	if err != nil {
+		return "", fmt.Errorf("failed to save login: %w", err)
+	}
+	return token, nil
+}
+
+// Dashboard session, bound to the server the login link was requested in
+type DashboardSession struct {
+	ServerID int64
+	UserID   int64
+}
+
+// Redeem a login token for a new session. Returns "" if the token is unknown, used or expired.
+func (b *Bot) redeemDashboardLogin(token string, now time.Time) (string, error) {
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var s DashboardSession
+	err = tx.QueryRow("SELECT server_id, user_id FROM dashboard_logins WHERE token_hash = ? AND used_at IS NULL AND expires_at >= ?",
+		hashAPIToken(token), now.Unix()).Scan(&s.ServerID, &s.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE dashboard_logins SET used_at = ? WHERE token_hash = ?", now.Unix(), hashAPIToken(token)); err != nil {
+		return "", err
+	}
+
+	session, err := newDashboardSecret()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM dashboard_sessions WHERE expires_at < ?", now.Unix()); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO dashboard_sessions (session_hash, server_id, user_id, expires_at) VALUES (?, ?, ?, ?)",
+		hashAPIToken(session), s.ServerID, s.UserID, now.Add(dashboardSessionTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return session, tx.Commit()
+}
+
+// Session for a cookie value, or nil if it is unknown or expired
+func (b *Bot) getDashboardSession(session string, now time.Time) (*DashboardSession, error) {
+	var s DashboardSession
+	err := b.DB.QueryRow("SELECT server_id, user_id FROM dashboard_sessions WHERE session_hash = ? AND expires_at >= ?",
+		hashAPIToken(session), now.Unix()).Scan(&s.ServerID, &s.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (b *Bot) deleteDashboardSession(session string) error {
+	_, err := b.DB.Exec("DELETE FROM dashboard_sessions WHERE session_hash = ?", hashAPIToken(session))
+	return err
+}
+
+func (b *Bot) registerDashboardRoutes(mux *http.ServeMux) {
+	static, _ := fs.Sub(dashboardFS, "dashboard/static")
+	mux.Handle("GET /dashboard/static/", http.StripPrefix("/dashboard/static/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("GET /dashboard/login", dashboardLoginPage)
+	mux.HandleFunc("POST /dashboard/login", b.dashboardLogin)
+	mux.HandleFunc("POST /dashboard/logout", b.dashboardLogout)
+	mux.HandleFunc("GET /dashboard/guilds/{guild}", b.dashboardAuth(b.dashboardGuildPage))
+	mux.HandleFunc("GET /dashboard/guilds/{guild}/images/{kind}/{id}", b.dashboardAuth(b.dashboardImage))
+}
+
+func renderDashboard(w http.ResponseWriter, status int, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self'; style-src 'self'")
+	w.WriteHeader(status)
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		httpLog.Error("Error rendering dashboard template", "template", name, "err", err)
+	}
+}
+
+func renderDashboardError(w http.ResponseWriter, status int, message string) {
+	renderDashboard(w, status, "error.html", map[string]string{"Message": message})
+}
+
+// Require a session for the guild in the path
+func (b *Bot) dashboardAuth(next func(w http.ResponseWriter, r *http.Request, s *DashboardSession)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverID, err := strconv.ParseInt(r.PathValue("guild"), 10, 64)
+		if err != nil {
+			renderDashboardError(w, http.StatusBadRequest, "Invalid server ID.")
+			return
+		}
+		cookie, err := r.Cookie(dashboardCookie)
+		if err != nil {
+			renderDashboardError(w, http.StatusUnauthorized, "You are not logged in. Use /dashboard in the server to get a login link.")
+			return
+		}
+		s, err := b.getDashboardSession(cookie.Value, time.Now())
+		if err != nil {
+			httpLog.Error("Error fetching dashboard session", "err", err)
+			renderDashboardError(w, http.StatusInternalServerError, "Something went wrong.")
+			return
+		}
+		if s == nil {
+			renderDashboardError(w, http.StatusUnauthorized, "Your session has expired. Use /dashboard in the server to get a new login link.")
+			return
+		}
+		if s.ServerID != serverID {
+			renderDashboardError(w, http.StatusForbidden, "You are logged in to a different server. Use /dashboard in this server to switch.")
+			return
+		}
+		next(w, r, s)
+	}
+}
+
+// GET /dashboard/login. Link previews fetch the URL, so the token is only redeemed by the form's POST.
+func dashboardLoginPage(w http.ResponseWriter, r *http.Request) {
+	renderDashboard(w, http.StatusOK, "login.html", map[string]string{"Token": r.URL.Query().Get("token")})
+}
+
+// POST /dashboard/login
+func (b *Bot) dashboardLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if token == "" {
+		renderDashboardError(w, http.StatusBadRequest, "Missing login token.")
+		return
+	}
+	session, err := b.redeemDashboardLogin(token, time.Now())
+	if err != nil {
+		httpLog.Error("Error redeeming dashboard login", "err", err)
+		renderDashboardError(w, http.StatusInternalServerError, "Something went wrong.")
+		return
+	}
+	if session == "" {
+		renderDashboardError(w, http.StatusUnauthorized, "This login link is invalid, expired or already used. Use /dashboard to get a new one.")
+		return
+	}
+	s, err := b.getDashboardSession(session, time.Now())
+	if err != nil || s == nil {
+		httpLog.Error("Error fetching new dashboard session", "err", err)
+		renderDashboardError(w, http.StatusInternalServerError, "Something went wrong.")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    session,
+		Path:     "/dashboard",
+		MaxAge:   int(dashboardSessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(dashboardBaseURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, fmt.Sprintf("/dashboard/guilds/%d", s.ServerID), http.StatusSeeOther)
+}
+
+// POST /dashboard/logout
+func (b *Bot) dashboardLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(dashboardCookie); err == nil {
+		if err := b.deleteDashboardSession(cookie.Value); err != nil {
+			httpLog.Error("Error deleting dashboard session", "err", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: "/dashboard", MaxAge: -1})
+	renderDashboardError(w, http.StatusOK, "You have been logged out.")
+}
+
+// Bar of the usage chart, in SVG user units
+type chartBar struct {
+	X, Y, Width, Height float64
+	Date                string
+	Count               int
+}
+
+type usageChart struct {
+	Width, Height int
+	Bars          []chartBar
+	Max           int
+	Total         int
+	First, Last   string
+}
+
+func newUsageChart(series []DailyCount) usageChart {
+	c := usageChart{Width: dashboardChartWidth, Height: dashboardChartHeight}
+	if len(series) == 0 {
+		return c
+	}
+	for _, d := range series {
+		c.Total += d.Count
+		if d.Count > c.Max {
+			c.Max = d.Count
+		}
+	}
+	c.First = series[0].Day.Format(time.DateOnly)
+	c.Last = series[len(series)-1].Day.Format(time.DateOnly)
+
+	step := float64(c.Width) / float64(len(series))
+	for i, d := range series {
+		h := 0.0
+		if c.Max > 0 {
+			h = float64(d.Count) / float64(c.Max) * float64(c.Height)
+		}
+		c.Bars = append(c.Bars, chartBar{
+			X:      float64(i) * step,
+			Y:      float64(c.Height) - h,
+			Width:  max(step-1, 1),
+			Height: h,
+			Date:   d.Day.Format(time.DateOnly),
+			Count:  d.Count,
+		})
+	}
+	return c
+}
+
+type dashboardChannel struct {
+	ID       int64
+	Name     string
+	Count    int
+	Selected bool
+}
+
+type dashboardDayChoice struct {
+	Days     int
+	Label    string
+	Selected bool
+}
+
+type dashboardPage struct {
+	ServerID   int64
+	ServerName string
+	Kind       string
+	Days       int
+	DayChoices []dashboardDayChoice
+	Name       string
+	ChannelID  int64
+	Channel    string
+	Channels   []dashboardChannel
+	Items      []ItemUsage
+	Item       *ItemUsage
+	Chart      usageChart
+	Notice     string
+}
+
+// Link to the page with one filter changed
+func (p dashboardPage) Link(key, value string) string {
+	q := url.Values{}
+	q.Set("kind", p.Kind)
+	q.Set("days", strconv.Itoa(p.Days))
+	if p.ChannelID != 0 {
+		q.Set("channel", strconv.FormatInt(p.ChannelID, 10))
+	}
+	if p.Name != "" {
+		q.Set("name", p.Name)
+	}
+	if value == "" {
+		q.Del(key)
+	} else {
+		q.Set(key, value)
+	}
+	return fmt.Sprintf("/dashboard/guilds/%d?%s", p.ServerID, q.Encode())
+}
+
+// Channel names by ID, from the state cache when possible
+func (b *Bot) guildChannelNames(guildID discord.GuildID) map[int64]string {
+	names := make(map[int64]string)
+	if b.Client == nil {
+		return names
+	}
+	channels, err := b.Client.Channels(guildID)
+	if err != nil {
+		httpLog.Error("Error fetching channels", idAttr("guild_id", int64(guildID)), "err", err)
+		return names
+	}
+	for _, ch := range channels {
+		names[int64(ch.ID)] = ch.Name
+	}
+	return names
+}
+
+func (b *Bot) guildName(guildID discord.GuildID) string {
+	if b.Client != nil {
+		if g, err := b.Client.Guild(guildID); err == nil {
+			return g.Name
+		}
+	}
+	return guildID.String()
+}
+
+// GET /dashboard/guilds/{guild}?kind=emoji&days=30&channel=ID&name=text&item=ID
+func (b *Bot) dashboardGuildPage(w http.ResponseWriter, r *http.Request, s *DashboardSession) {
+	q := r.URL.Query()
+	p := dashboardPage{ServerID: s.ServerID, Kind: kindEmoji, Days: dashboardDefaultDays, Name: strings.TrimSpace(q.Get("name"))}
+	if q.Get("kind") == kindSticker {
+		p.Kind = kindSticker
+	}
+	if days, err := strconv.Atoi(q.Get("days")); err == nil && days >= 0 && days <= apiMaxDays {
+		p.Days = days
+	}
+	for _, d := range dashboardDayChoices {
+		label := fmt.Sprintf("%d days", d)
+		if d == 0 {
+			label = "All time"
+		}
+		p.DayChoices = append(p.DayChoices, dashboardDayChoice{Days: d, Label: label, Selected: d == p.Days})
+	}
+	p.ChannelID, _ = strconv.ParseInt(q.Get("channel"), 10, 64)
+	itemID, _ := strconv.ParseInt(q.Get("item"), 10, 64)
+
+	now := time.Now()
+	var since time.Time
+	if p.Days > 0 {
+		since = now.AddDate(0, 0, -(p.Days - 1)).UTC().Truncate(24 * time.Hour)
+	}
+
+	var err error
+	p.Items, err = b.getItemRanking(s.ServerID, RankingFilter{Kind: p.Kind, ChannelID: p.ChannelID, Since: since, Name: p.Name}, dashboardRankLimit)
+	if err != nil {
+		httpLog.Error("Error fetching dashboard ranking", "err", err)
+		renderDashboardError(w, http.StatusInternalServerError, "Failed to load the ranking.")
+		return
+	}
+	for i := range p.Items {
+		if p.Items[i].ID == itemID {
+			p.Item = &p.Items[i]
+		}
+	}
+	if p.Item == nil {
+		itemID = 0
+	}
+
+	channels, err := b.getChannelUsage(s.ServerID, p.Kind, since)
+	if err != nil {
+		httpLog.Error("Error fetching channel usage", "err", err)
+		renderDashboardError(w, http.StatusInternalServerError, "Failed to load channels.")
+		return
+	}
+	names := b.guildChannelNames(discord.GuildID(s.ServerID))
+	for _, c := range channels {
+		name := names[c.ChannelID]
+		if name == "" {
+			name = strconv.FormatInt(c.ChannelID, 10)
+		}
+		p.Channels = append(p.Channels, dashboardChannel{ID: c.ChannelID, Name: name, Count: c.Count, Selected: c.ChannelID == p.ChannelID})
+		if c.ChannelID == p.ChannelID {
+			p.Channel = name
+		}
+	}
+
+	// All time is charted over a year so the bars stay readable
+	chartSince := since
+	if chartSince.IsZero() {
+		chartSince = now.AddDate(0, 0, -(apiMaxDays - 1)).UTC().Truncate(24 * time.Hour)
+	}
+	series, err := b.getUsageSeries(s.ServerID, p.Kind, itemID, p.ChannelID, chartSince, now)
+	if err != nil {
+		httpLog.Error("Error fetching usage series", "err", err)
+		renderDashboardError(w, http.StatusInternalServerError, "Failed to load the chart.")
+		return
+	}
+	p.Chart = newUsageChart(series)
+	p.Notice = b.outageNotice(chartSince, now)
+	p.ServerName = b.guildName(discord.GuildID(s.ServerID))
+
+	renderDashboard(w, http.StatusOK, "guild.html", p)
+}
+
+// GET /dashboard/guilds/{guild}/images/{kind}/{id}, served from the image cache
+func (b *Bot) dashboardImage(w http.ResponseWriter, r *http.Request, s *DashboardSession) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var img *CachedImage
+	switch r.PathValue("kind") {
+	case kindEmoji:
+		var e EmojiData
+		err = b.DB.QueryRow("SELECT emote_name, emote_id, animated FROM emojis WHERE server_id = ? AND emote_id = ?", s.ServerID, id).Scan(&e.Name, &e.ID, &e.Animated)
+		if err == nil {
+			img, err = b.Images.EmojiImage(r.Context(), s.ServerID, e)
+		}
+	case kindSticker:
+		var st StickerData
+		err = b.DB.QueryRow("SELECT sticker_name, sticker_id FROM stickers WHERE server_id = ? AND sticker_id = ?", s.ServerID, id).Scan(&st.Name, &st.ID)
+		if err == nil {
+			img, err = b.Images.StickerImage(r.Context(), s.ServerID, st)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Error loading image", idAttr("guild_id", s.ServerID), "kind", r.PathValue("kind"), idAttr("item_id", id), "err", err)
+		http.Error(w, "image unavailable", http.StatusBadGateway)
+		return
+	}
+
+	etag := `"` + img.Hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Write(img.Data)
+}
+
+// Whether a member may use the dashboard for the server an interaction came from
+func (b *Bot) canManageGuild(i *gateway.InteractionCreateEvent) (bool, error) {
+	perms, err := b.Client.Permissions(i.ChannelID, i.Member.User.ID)
+	if err != nil {
+		return false, err
+	}
+	return perms.Has(discord.PermissionManageGuild), nil
+}
+
+// Handle /dashboard command
+func (b *Bot) handleDashboard(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+	base := dashboardBaseURL()
+	if base == "" || os.Getenv("HTTP_LISTEN_ADDR") == "" {
+		b.respondError(i, "The dashboard is not enabled on this bot.")
+		return
+	}
+	ok, err := b.canManageGuild(i)
+	if err != nil {
+		b.interactionLog(i).Error("Error checking dashboard permissions", "err", err)
+		b.respondError(i, "Failed to check your permissions.")
+		return
+	}
+	if !ok {
+		b.respondError(i, "You need the Manage Server permission to open the dashboard.")
+		return
+	}
+
+	token, err := b.createDashboardLogin(int64(i.GuildID), int64(i.Member.User.ID), time.Now())
+	if err != nil {
+		b.interactionLog(i).Error("Error creating dashboard login", "err", err)
+		b.respondError(i, "Failed to create a login link.")
+		return
+	}
+
+	content := "✅ Sent you a login link in DMs."
+	dm, err := b.Client.CreatePrivateChannel(i.Member.User.ID)
+	if err == nil {
+		_, err = b.Client.SendMessageComplex(dm.ID, api.SendMessageData{
+			Content: fmt.Sprintf("Your dashboard login link for **%s**. It works once and expires in %d minutes:\n%s/dashboard/login?token=%s",
+				b.guildName(i.GuildID), int(dashboardLoginTTL.Minutes()), base, token),
+			Flags: discord.SuppressEmbeds,
+		})
+	}
+	if err != nil {
+		b.interactionLog(i).Error("Error sending dashboard link", "err", err)
+		content = "❌ Couldn't DM you the login link. Allow direct messages from server members and try again."
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &api.InteractionResponseData{
+			Content: option.NewNullableString(content),
+			Flags:   discord.EphemeralMessage,
+		},
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err)
+	}
+}
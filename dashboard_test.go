@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Log in through the HTTP handler, returning the response
+func dashboardPostLogin(h http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/dashboard/login", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRedeemDashboardLogin(t *testing.T) {
+	b := newTestBot(t)
+	now := time.Now()
+	tests := []struct {
+		name string
+		// Redemptions before the checked one
+		redeemed  int
+		after     time.Duration
+		wantValid bool
+	}{
+		{name: "fresh", wantValid: true},
+		{name: "just before expiry", after: dashboardLoginTTL, wantValid: true},
+		{name: "expired", after: dashboardLoginTTL + time.Second},
+		{name: "already used", redeemed: 1},
+	}
+	for _, tt := range tests {
+		token, err := b.createDashboardLogin(int64(testGuildID), int64(testUserID), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range tt.redeemed {
+			if _, err := b.redeemDashboardLogin(token, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		session, err := b.redeemDashboardLogin(token, now.Add(tt.after))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (session != "") != tt.wantValid {
+			t.Errorf("%s: session = %q, want valid %t", tt.name, session, tt.wantValid)
+		}
+	}
+}
+
+// Link previews GET the login URL, which must not use up the token
+func TestDashboardLoginPageDoesNotRedeem(t *testing.T) {
+	b := newTestBot(t)
+	h := b.newHTTPHandler()
+	token, err := b.createDashboardLogin(int64(testGuildID), int64(testUserID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dashboard/login?token="+token, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("GET login: status = %d, Set-Cookie %q", rec.Code, rec.Header().Get("Set-Cookie"))
+	}
+
+	rec = dashboardPostLogin(h, token)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard/guilds/1000" {
+		t.Fatalf("POST login: status = %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := dashboardPostLogin(h, token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("second POST login: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestDashboardAuth(t *testing.T) {
+	b := newTestBot(t)
+	h := b.newHTTPHandler()
+	token, err := b.createDashboardLogin(int64(testGuildID), int64(testUserID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := dashboardPostLogin(h, token)
+	cookies := login.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != dashboardCookie {
+		t.Fatalf("login cookies = %+v", cookies)
+	}
+	session := cookies[0]
+
+	expired := &http.Cookie{Name: dashboardCookie, Value: "expired"}
+	if _, err := b.DB.Exec("INSERT INTO dashboard_sessions (session_hash, server_id, user_id, expires_at) VALUES (?, ?, ?, ?)",
+		hashAPIToken(expired.Value), int64(testGuildID), int64(testUserID), time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "own server", path: "/dashboard/guilds/1000", cookie: session, status: http.StatusOK},
+		{name: "another server", path: "/dashboard/guilds/1001", cookie: session, status: http.StatusForbidden},
+		{name: "another server's image", path: "/dashboard/guilds/1001/images/emoji/111", cookie: session, status: http.StatusForbidden},
+		{name: "no session", path: "/dashboard/guilds/1000", status: http.StatusUnauthorized},
+		{name: "expired session", path: "/dashboard/guilds/1000", cookie: expired, status: http.StatusUnauthorized},
+		{name: "invalid server", path: "/dashboard/guilds/abc", cookie: session, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
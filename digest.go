@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	defaultDigestSchedule  = "0 9 * * 1" // Mondays at 09:00 UTC
+	digestCheckInterval    = time.Minute
+	digestTopEmojis        = 10
+	digestTopStickers      = 3
+	digestMovers           = 5
+	digestNeverUsedShown   = 20
+	discordMaxContentChars = 2000
+)
+
+// Per-guild digest configuration
+type DigestConfig struct {
+	ServerID  int64
+	ChannelID int64
+	Schedule  string
+	Enabled   bool
+	NextRun   time.Time
+	LastRun   time.Time
+}
+
+func scanDigestConfig(row interface{ Scan(...any) error }) (*DigestConfig, error) {
+	var d DigestConfig
+	var nextRun, lastRun sql.NullInt64
+	if err := row.Scan(&d.ServerID, &d.ChannelID, &d.Schedule, &d.Enabled, &nextRun, &lastRun); err != nil {
+		return nil, err
+	}
+	if nextRun.Valid {
+		d.NextRun = time.Unix(nextRun.Int64, 0).UTC()
+	}
+	if lastRun.Valid {
+		d.LastRun = time.Unix(lastRun.Int64, 0).UTC()
+	}
+	return &d, nil
+}
+
+// Get digest configuration for a server, nil if none is set
+func (b *Bot) getDigestConfig(serverID int64) (*DigestConfig, error) {
+	row := b.DB.QueryRow("SELECT server_id, channel_id, schedule, enabled, next_run, last_run FROM digests WHERE server_id = ?", serverID)
+	d, err := scanDigestConfig(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return d, err
+}
+
+// Set digest channel and enable the digest, keeping any existing schedule
+func (b *Bot) setDigestChannel(serverID, channelID int64, now time.Time) (*DigestConfig, error) {
+	existing, err := b.getDigestConfig(serverID)
+	if err != nil {
+		return nil, err
+	}
+	schedule := defaultDigestSchedule
+	if existing != nil {
+		schedule = existing.Schedule
+	}
+
+	cron, err := parseCron(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("stored schedule is invalid: %w", err)
+	}
+	next := cron.Next(now.UTC())
+
+	query := `
+		INSERT INTO digests (server_id, channel_id, schedule, enabled, next_run)
+		VALUES (?, ?, ?, TRUE, ?)
+		ON CONFLICT(server_id) DO UPDATE SET
+			channel_id = excluded.channel_id,
+			enabled = TRUE,
+			next_run = excluded.next_run
+	`
+	if _, err := b.DB.Exec(query, serverID, channelID, schedule, next.Unix()); err != nil {
+		return nil, fmt.Errorf("failed to set digest channel: %w", err)
+	}
+	return b.getDigestConfig(serverID)
+}
+
+// Set digest schedule. The digest must already have a channel.
+func (b *Bot) setDigestSchedule(serverID int64, expr string, now time.Time) (*DigestConfig, error) {
+	cron, err := parseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	next := cron.Next(now.UTC())
+	if next.IsZero() {
+		return nil, errors.New("schedule never fires")
+	}
+
+	res, err := b.DB.Exec("UPDATE digests SET schedule = ?, next_run = ? WHERE server_id = ?", strings.TrimSpace(expr), next.Unix(), serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set digest schedule: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	return b.getDigestConfig(serverID)
+}
+
+func (b *Bot) disableDigest(serverID int64) (bool, error) {
+	res, err := b.DB.Exec("UPDATE digests SET enabled = FALSE WHERE server_id = ?", serverID)
+	if err != nil {
+		return false, fmt.Errorf("failed to disable digest: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Get enabled digests whose next run is due
+func (b *Bot) getDueDigests(now time.Time) ([]DigestConfig, error) {
+	rows, err := b.DB.Query("SELECT server_id, channel_id, schedule, enabled, next_run, last_run FROM digests WHERE enabled = TRUE AND next_run <= ?", now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []DigestConfig
+	for rows.Next() {
+		d, err := scanDigestConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, *d)
+	}
+	return due, rows.Err()
+}
+
+func (b *Bot) markDigestRun(serverID int64, ran, next time.Time) error {
+	_, err := b.DB.Exec("UPDATE digests SET last_run = ?, next_run = ? WHERE server_id = ?", ran.Unix(), next.Unix(), serverID)
+	return err
+}
+
+// IDs of emojis with at least one recorded use
+func (b *Bot) getUsedEmojiIDs(serverID int64) (map[int64]bool, error) {
+	rows, err := b.DB.Query("SELECT emote_id FROM emojis WHERE server_id = ? AND usage_count > 0", serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	used := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		used[id] = true
+	}
+	return used, rows.Err()
+}
+
+// Period a digest covers: from the digest's last run, or the schedule's run before the given one
+type DigestPeriod struct {
+	Title string
+	From  time.Time
+	To    time.Time
+}
+
+// Period of the digest run at fire, ending at now. It starts at lastRun when
+// the digest has run before, so runs missed while offline or a changed
+// schedule leave no gap. The title names the schedule's interval, e.g.
+// weekly, when it has a common one.
+func digestPeriod(schedule string, fire, lastRun, now time.Time) DigestPeriod {
+	p := DigestPeriod{Title: "Emoji Digest", From: fire.AddDate(0, 0, -defaultTrendingDays), To: now}
+	cron, err := parseCron(schedule)
+	if err != nil {
+		return p
+	}
+	if !lastRun.IsZero() {
+		p.From = lastRun
+	}
+	prev := cron.Prev(fire)
+	if prev.IsZero() {
+		return p
+	}
+	if lastRun.IsZero() {
+		p.From = prev
+	}
+
+	interval := fire.Sub(prev)
+	switch {
+	case interval == time.Hour:
+		p.Title = "Hourly Emoji Digest"
+	case interval == 24*time.Hour:
+		p.Title = "Daily Emoji Digest"
+	case interval == 7*24*time.Hour:
+		p.Title = "Weekly Emoji Digest"
+	case prev.AddDate(0, 1, 0).Equal(fire):
+		p.Title = "Monthly Emoji Digest"
+	case prev.AddDate(1, 0, 0).Equal(fire):
+		p.Title = "Yearly Emoji Digest"
+	}
+	return p
+}
+
+// Period a digest previewed now covers: since the last run
+func digestPreviewPeriod(schedule string, lastRun, now time.Time) DigestPeriod {
+	cron, err := parseCron(schedule)
+	if err != nil {
+		return digestPeriod(schedule, now, lastRun, now)
+	}
+	return digestPeriod(schedule, cron.Next(now), lastRun, now)
+}
+
+// Build digest content and sticker embeds for a server's usage in a period
+func (b *Bot) buildDigest(guildID discord.GuildID, p DigestPeriod) (string, []discord.Embed, error) {
+	serverID := int64(guildID)
+
+	emojis, err := b.getItemRanking(serverID, RankingFilter{Kind: kindEmoji, Since: p.From}, digestTopEmojis)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch top emojis: %w", err)
+	}
+	stickers, err := b.getItemRanking(serverID, RankingFilter{Kind: kindSticker, Since: p.From}, digestTopStickers)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch top stickers: %w", err)
+	}
+
+	// Movers compare the period with the weeks before it
+	days := max(int(math.Round(p.To.Sub(p.From).Hours()/24)), 1)
+	w := TrendingWindow{RecentDays: days, BaselineDays: max(defaultTrendingBaseline, 4*days), MinCount: defaultTrendingMinCount}
+	movers, err := b.getTrending(serverID, kindEmoji, p.To, w, digestMovers)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch movers: %w", err)
+	}
+
+	var neverUsed []discord.Emoji
+	liveEmojis, liveErr := b.getGuildEmojis(guildID)
+	if liveErr != nil {
+		digestLog.Error("Error fetching guild emojis for digest", "err", liveErr)
+	} else {
+		used, err := b.getUsedEmojiIDs(serverID)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to fetch used emojis: %w", err)
+		}
+		for _, e := range liveEmojis {
+			if !used[int64(e.ID)] {
+				neverUsed = append(neverUsed, e)
+			}
+		}
+	}
+
+	locale := b.getGuildSettings(serverID).Locale
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**%s**\n<t:%d:f> to <t:%d:f>\n\n", p.Title, p.From.Unix(), p.To.Unix()))
+
+	content.WriteString("__Top Emojis__\n")
+	if len(emojis) == 0 {
+		content.WriteString("No emojis used in this period.\n")
+	}
+	for _, e := range emojis {
+		content.WriteString(fmt.Sprintf("- %s **x%s**\n", formatItem(e), formatCount(e.Count, locale)))
+	}
+
+	content.WriteString("\n__Biggest Movers__\n")
+	if len(movers) == 0 {
+		content.WriteString("No emojis above the minimum volume.\n")
+	}
+	for _, t := range movers {
+		content.WriteString(formatTrendingLine(t, w))
+	}
+
+	// Skip the section rather than report every emoji as unused when the guild list is unavailable
+	if liveErr == nil {
+		content.WriteString("\n__Never Used__\n")
+		if len(neverUsed) == 0 {
+			content.WriteString("Every emoji has been used at least once.\n")
+		} else {
+			for i, e := range neverUsed {
+				if i == digestNeverUsedShown {
+					content.WriteString(fmt.Sprintf("…and %d more", len(neverUsed)-i))
+					break
+				}
+				content.WriteString(e.String() + " ")
+			}
+			content.WriteString("\n")
+		}
+	}
+
+	if notice := b.outageNotice(p.From, p.To); notice != "" {
+		content.WriteString("\n" + notice + "\n")
+	}
+
+	if len(stickers) > 0 {
+		content.WriteString("\n__Top Stickers__\n")
+	}
+
+	text := truncateContent(content.String())
+
+	embeds := make([]discord.Embed, 0, len(stickers))
+	for _, s := range stickers {
+		embeds = append(embeds, createStickerEmbed(StickerData{Name: s.Name, ID: s.ID, Count: s.Count}, locale))
+	}
+	return text, embeds, nil
+}
+
+// Post a digest due at its next run to its configured channel
+func (b *Bot) postDigest(d DigestConfig, now time.Time) error {
+	content, embeds, err := b.buildDigest(discord.GuildID(d.ServerID), digestPeriod(d.Schedule, d.NextRun, d.LastRun, now))
+	if err != nil {
+		return err
+	}
+	_, err = b.Client.SendMessageComplex(discord.ChannelID(d.ChannelID), api.SendMessageData{
+		Content:         content,
+		Embeds:          embeds,
+		AllowedMentions: &api.AllowedMentions{},
+	})
+	return err
+}
+
+// Post due digests once a minute until the context is cancelled.
+// Digests missed while the bot was offline are posted once on the next check.
+func (b *Bot) runDigestScheduler(ctx context.Context) {
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().UTC()
+		due, err := b.getDueDigests(now)
+		if err != nil {
+			digestLog.Error("Error fetching due digests", "err", err)
+			continue
+		}
+
+		for _, d := range due {
+			if err := b.postDigest(d, now); err != nil {
+				digestLog.Error("Error posting digest", idAttr("guild_id", d.ServerID), idAttr("channel_id", d.ChannelID), "err", err)
+			} else {
+				digestLog.Info("Posted digest", idAttr("guild_id", d.ServerID), idAttr("channel_id", d.ChannelID))
+			}
+
+			// Always advance so a failing channel isn't retried every minute
+			next := now.Add(24 * time.Hour)
+			if cron, err := parseCron(d.Schedule); err == nil {
+				next = cron.Next(now)
+			} else {
+				digestLog.Error("Invalid digest schedule", idAttr("guild_id", d.ServerID), "schedule", d.Schedule, "err", err)
+			}
+			if err := b.markDigestRun(d.ServerID, now, next); err != nil {
+				digestLog.Error("Error updating digest run time", idAttr("guild_id", d.ServerID), "err", err)
+			}
+		}
+	}
+}
+
+func describeDigest(d *DigestConfig) string {
+	status := "enabled"
+	if !d.Enabled {
+		status = "disabled"
+	}
+	return fmt.Sprintf("Digest is **%s** in <#%d> on schedule `%s` (UTC). Next run: <t:%d:F>", status, d.ChannelID, d.Schedule, d.NextRun.Unix())
+}
+
+// Handle /digest command group
+func (b *Bot) handleDigest(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+	serverID := int64(i.GuildID)
+
+	var response api.InteractionResponseData
+
+	switch sub.Name {
+	case "channel":
+		channelID, err := sub.Options.Find("channel").SnowflakeValue()
+		if err != nil {
+			b.respondError(i, "Invalid channel.")
+			return
+		}
+		d, err := b.setDigestChannel(serverID, int64(channelID), time.Now())
+		if err != nil {
+			b.interactionLog(i).Error("Error setting digest channel", "err", err)
+			b.respondError(i, "Failed to set digest channel.")
+			return
+		}
+		response.Content = option.NewNullableString("✅ " + describeDigest(d))
+
+	case "schedule":
+		d, err := b.setDigestSchedule(serverID, sub.Options.Find("cron").String(), time.Now())
+		if err != nil {
+			b.respondError(i, fmt.Sprintf("Invalid schedule: %v", err))
+			return
+		}
+		if d == nil {
+			b.respondError(i, "Set a digest channel first with `/digest channel`.")
+			return
+		}
+		response.Content = option.NewNullableString("✅ " + describeDigest(d))
+
+	case "preview":
+		schedule := defaultDigestSchedule
+		var lastRun time.Time
+		d, err := b.getDigestConfig(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching digest", "err", err)
+			b.respondError(i, "Failed to build digest.")
+			return
+		}
+		if d != nil {
+			schedule, lastRun = d.Schedule, d.LastRun
+		}
+		content, embeds, err := b.buildDigest(i.GuildID, digestPreviewPeriod(schedule, lastRun, time.Now().UTC()))
+		if err != nil {
+			b.interactionLog(i).Error("Error building digest preview", "err", err)
+			b.respondError(i, "Failed to build digest.")
+			return
+		}
+		response.Content = option.NewNullableString(content)
+		response.Embeds = &embeds
+
+	case "disable":
+		ok, err := b.disableDigest(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error disabling digest", "err", err)
+			b.respondError(i, "Failed to disable digest.")
+			return
+		}
+		if !ok {
+			b.respondError(i, "No digest is configured for this server.")
+			return
+		}
+		response.Content = option.NewNullableString("✅ Digest disabled.")
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	response.Flags = discord.EphemeralMessage
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
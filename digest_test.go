@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestPeriod(t *testing.T) {
+	// 2024-01-08 is a Monday
+	monday := time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		schedule  string
+		fire      time.Time
+		lastRun   time.Time
+		wantTitle string
+		wantFrom  time.Time
+	}{
+		{"0 9 * * 1", monday, time.Time{}, "Weekly Emoji Digest", monday.AddDate(0, 0, -7)},
+		{"0 9 * * *", monday, time.Time{}, "Daily Emoji Digest", monday.AddDate(0, 0, -1)},
+		{"@hourly", monday.Add(-9 * time.Hour), time.Time{}, "Hourly Emoji Digest", monday.Add(-10 * time.Hour)},
+		{"@monthly", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Time{}, "Monthly Emoji Digest", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}, "Yearly Emoji Digest", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1,4", monday, time.Time{}, "Emoji Digest", monday.AddDate(0, 0, -4)},
+		// Runs missed while offline are covered from the last run
+		{"0 9 * * *", monday, monday.AddDate(0, 0, -3), "Daily Emoji Digest", monday.AddDate(0, 0, -3)},
+		// A run posted late starts the next period where it ended
+		{"0 9 * * 1", monday, monday.AddDate(0, 0, -7).Add(time.Hour), "Weekly Emoji Digest", monday.AddDate(0, 0, -7).Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		p := digestPeriod(tt.schedule, tt.fire, tt.lastRun, tt.fire.Add(time.Minute))
+		if p.Title != tt.wantTitle || !p.From.Equal(tt.wantFrom) {
+			t.Errorf("%s at %s = %q from %s, want %q from %s", tt.schedule, tt.fire, p.Title, p.From, tt.wantTitle, tt.wantFrom)
+		}
+	}
+
+	// A preview covers the time since the last run
+	now := monday.AddDate(0, 0, 2)
+	p := digestPreviewPeriod("0 9 * * 1", time.Time{}, now)
+	if p.Title != "Weekly Emoji Digest" || !p.From.Equal(monday) || !p.To.Equal(now) {
+		t.Errorf("preview = %+v, want the week from %s so far", p, monday)
+	}
+}
+
+func TestDigestCoversItsPeriod(t *testing.T) {
+	b := newTestBot(t)
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	b.dispatch(b.message("<:old:111> <:old:111>"), today.AddDate(0, 0, -10))
+	b.dispatch(b.message("<:new:112>"), today)
+
+	for _, schedule := range []string{"@daily", "@weekly"} {
+		p := digestPreviewPeriod(schedule, time.Time{}, now)
+		content, _, err := b.buildDigest(testGuildID, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(content, "**"+p.Title+"**") || p.Title == "Emoji Digest" {
+			t.Errorf("%s digest = %q, want a titled period", schedule, content)
+		}
+		top, _, _ := strings.Cut(content, "__Biggest Movers__")
+		if !strings.Contains(top, "<:new:112> **x1**") || strings.Contains(top, "<:old:111>") {
+			t.Errorf("%s top emojis = %q, want only the emoji used in the period", schedule, top)
+		}
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/diamondburned/arikawa/v3/utils/sendpart"
+)
+
+const (
+	defaultPollHours   = 24
+	maxPollHours       = 24 * 14
+	maxEmojiImageBytes = 256 * 1024 // Discord's emoji upload limit
+	pollCheckInterval  = time.Minute
+	pollStatsDays      = 30
+)
+
+// Poll actions
+const (
+	pollActionAdd    = "add"
+	pollActionRemove = "remove"
+)
+
+// Poll statuses
+const (
+	pollStatusOpen    = "open"
+	pollStatusClosing = "closing" // Claimed for closing, result not recorded yet
+	pollStatusPassed  = "passed"
+	pollStatusFailed  = "failed"
+	pollStatusApplied = "applied"
+)
+
+var emojiNameRegex = regexp.MustCompile(`^\w{2,32}$`)
+
+// Community vote on adding or removing an emoji
+type EmojiPoll struct {
+	ID         int64
+	ServerID   int64
+	ChannelID  int64
+	MessageID  int64
+	Action     string
+	EmojiID    int64
+	EmojiName  string
+	Animated   bool
+	Image      []byte
+	ImageType  string
+	CreatedBy  int64
+	ClosesAt   time.Time
+	Apply      bool
+	Status     string
+	YesVotes   int
+	NoVotes    int
+	ApplyError string
+}
+
+func scanEmojiPoll(row interface{ Scan(...any) error }) (*EmojiPoll, error) {
+	var p EmojiPoll
+	var closesAt int64
+	var applyError sql.NullString
+	err := row.Scan(&p.ID, &p.ServerID, &p.ChannelID, &p.MessageID, &p.Action, &p.EmojiID, &p.EmojiName, &p.Animated,
+		&p.Image, &p.ImageType, &p.CreatedBy, &closesAt, &p.Apply, &p.Status, &p.YesVotes, &p.NoVotes, &applyError)
+	if err != nil {
+		return nil, err
+	}
+	p.ClosesAt = time.Unix(closesAt, 0).UTC()
+	p.ApplyError = applyError.String
+	return &p, nil
+}
+
+const emojiPollColumns = `id, server_id, channel_id, COALESCE(message_id, 0), action, COALESCE(emoji_id, 0), emoji_name, animated,
+	image, COALESCE(image_type, ''), created_by, closes_at, apply, status, yes_votes, no_votes, apply_error`
+
+func (b *Bot) getEmojiPoll(pollID int64) (*EmojiPoll, error) {
+	row := b.DB.QueryRow("SELECT "+emojiPollColumns+" FROM emoji_polls WHERE id = ?", pollID)
+	p, err := scanEmojiPoll(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+func (b *Bot) createEmojiPoll(p *EmojiPoll) error {
+	query := `
+		INSERT INTO emoji_polls (server_id, channel_id, action, emoji_id, emoji_name, animated, image, image_type, created_by, closes_at, apply, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := b.DB.Exec(query, p.ServerID, p.ChannelID, p.Action, p.EmojiID, p.EmojiName, p.Animated, p.Image, p.ImageType,
+		p.CreatedBy, p.ClosesAt.Unix(), p.Apply, pollStatusOpen)
+	if err != nil {
+		return fmt.Errorf("failed to create poll: %w", err)
+	}
+	p.ID, err = res.LastInsertId()
+	p.Status = pollStatusOpen
+	return err
+}
+
+// Delete a poll and its votes
+func (b *Bot) deleteEmojiPoll(pollID int64) error {
+	return b.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM emoji_poll_votes WHERE poll_id = ?", pollID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM emoji_polls WHERE id = ?", pollID)
+		return err
+	})
+}
+
+func (b *Bot) setEmojiPollMessage(pollID, messageID int64) error {
+	_, err := b.DB.Exec("UPDATE emoji_polls SET message_id = ? WHERE id = ?", messageID, pollID)
+	return err
+}
+
+// Record a member's vote, replacing any earlier vote so each member counts
+// once. The vote is stored under the member's pseudonym in pseudonymizing servers.
+func (b *Bot) castEmojiPollVote(serverID, pollID, userID int64, yes bool) error {
+	stored, ok := b.storedUserID(serverID, userID)
+	if !ok {
+		return errors.New("failed to pseudonymize voter")
+	}
+	// A vote cast before pseudonymize_users was turned off is under the other ID
+	ids, err := b.userIDCandidates(serverID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to load pseudonym key: %w", err)
+	}
+
+	return b.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM emoji_poll_votes WHERE poll_id = ? AND user_id IN (?, ?) AND user_id != ?", pollID, ids[0], ids[1], stored); err != nil {
+			return fmt.Errorf("failed to replace vote: %w", err)
+		}
+		query := `
+			INSERT INTO emoji_poll_votes (poll_id, user_id, vote)
+			VALUES (?, ?, ?)
+			ON CONFLICT(poll_id, user_id) DO UPDATE SET
+				vote = excluded.vote,
+				voted_at = CURRENT_TIMESTAMP
+		`
+		if _, err := tx.Exec(query, pollID, stored, yes); err != nil {
+			return fmt.Errorf("failed to record vote: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *Bot) tallyEmojiPoll(pollID int64) (yes, no int, err error) {
+	err = b.DB.QueryRow(
+		"SELECT COALESCE(SUM(CASE WHEN vote THEN 1 ELSE 0 END), 0), COALESCE(SUM(CASE WHEN vote THEN 0 ELSE 1 END), 0) FROM emoji_poll_votes WHERE poll_id = ?",
+		pollID,
+	).Scan(&yes, &no)
+	return yes, no, err
+}
+
+// Claim an open poll for closing, returning false if it was already claimed.
+// A poll stuck claiming is never applied twice, only left unrecorded.
+func (b *Bot) claimEmojiPoll(pollID int64) (bool, error) {
+	res, err := b.DB.Exec("UPDATE emoji_polls SET status = ? WHERE id = ? AND status = ?", pollStatusClosing, pollID, pollStatusOpen)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (b *Bot) closeEmojiPoll(p *EmojiPoll) error {
+	_, err := b.DB.Exec("UPDATE emoji_polls SET status = ?, yes_votes = ?, no_votes = ?, apply_error = ? WHERE id = ?",
+		p.Status, p.YesVotes, p.NoVotes, p.ApplyError, p.ID)
+	return err
+}
+
+func (b *Bot) getDueEmojiPolls(now time.Time) ([]EmojiPoll, error) {
+	rows, err := b.DB.Query("SELECT "+emojiPollColumns+" FROM emoji_polls WHERE status = ? AND closes_at <= ?", pollStatusOpen, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var polls []EmojiPoll
+	for rows.Next() {
+		p, err := scanEmojiPoll(rows)
+		if err != nil {
+			return nil, err
+		}
+		polls = append(polls, *p)
+	}
+	return polls, rows.Err()
+}
+
+// Usage summary shown on removal polls
+func (b *Bot) formatEmojiUsageSummary(serverID, emojiID int64) (string, error) {
+	var count int
+	var lastUsed time.Time
+	err := b.DB.QueryRow("SELECT usage_count, last_used FROM emojis WHERE server_id = ? AND emote_id = ?", serverID, emojiID).Scan(&count, &lastUsed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "Never used since tracking started.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	since := time.Now().AddDate(0, 0, -pollStatsDays)
+	recent, err := b.getRecentUsage(serverID, kindEmoji, since)
+	if err != nil {
+		return "", err
+	}
+	users, err := b.getDistinctUsers(serverID, kindEmoji, since)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Used **x%d** in total, %d times by %d members in the last %dd. Last used <t:%d:R>.",
+		count, recent[emojiID], users[emojiID], pollStatsDays, lastUsed.Unix()), nil
+}
+
+func pollTitle(p *EmojiPoll) string {
+	if p.Action == pollActionAdd {
+		return fmt.Sprintf("**Emoji Vote: Add `:%s:`**", p.EmojiName)
+	}
+	emoji := discord.Emoji{ID: discord.EmojiID(p.EmojiID), Name: p.EmojiName, Animated: p.Animated}
+	return fmt.Sprintf("**Emoji Vote: Remove %s `:%s:`**", emoji.String(), p.EmojiName)
+}
+
+func pollImageFilename(p *EmojiPoll) string {
+	ext := "png"
+	switch p.ImageType {
+	case "image/gif":
+		ext = "gif"
+	case "image/jpeg":
+		ext = "jpg"
+	}
+	return fmt.Sprintf("%s.%s", p.EmojiName, ext)
+}
+
+// Create poll message content, embeds and voting buttons
+func createEmojiPollMessage(p *EmojiPoll, usage string) api.SendMessageData {
+	var content strings.Builder
+	content.WriteString(pollTitle(p) + "\n")
+	if usage != "" {
+		content.WriteString(usage + "\n")
+	}
+	if p.Apply {
+		content.WriteString("The result will be applied automatically.\n")
+	}
+	content.WriteString(fmt.Sprintf("Vote below. One vote per member, you can change it until the poll closes <t:%d:R>.", p.ClosesAt.Unix()))
+
+	data := api.SendMessageData{
+		Content: content.String(),
+		Components: discord.ContainerComponents{
+			&discord.ActionRowComponent{
+				&discord.ButtonComponent{
+					CustomID: discord.ComponentID(fmt.Sprintf("emojivote:%d:yes", p.ID)),
+					Label:    "Yes",
+					Style:    discord.SuccessButtonStyle(),
+				},
+				&discord.ButtonComponent{
+					CustomID: discord.ComponentID(fmt.Sprintf("emojivote:%d:no", p.ID)),
+					Label:    "No",
+					Style:    discord.DangerButtonStyle(),
+				},
+			},
+		},
+		AllowedMentions: &api.AllowedMentions{},
+	}
+
+	if p.Action == pollActionAdd && len(p.Image) > 0 {
+		file := sendpart.File{Name: pollImageFilename(p), Reader: bytes.NewReader(p.Image)}
+		data.Files = []sendpart.File{file}
+		data.Embeds = []discord.Embed{{Image: &discord.EmbedImage{URL: file.AttachmentURI()}}}
+	}
+	return data
+}
+
+// Find a guild emoji from markup like <:name:id> or a bare name
+func findGuildEmoji(emojis []discord.Emoji, input string) (discord.Emoji, bool) {
+	input = strings.TrimSpace(input)
+	if m := customEmojiRegex.FindStringSubmatch(input); m != nil {
+		id, err := strconv.ParseInt(m[2], 10, 64)
+		if err == nil {
+			for _, e := range emojis {
+				if int64(e.ID) == id {
+					return e, true
+				}
+			}
+		}
+		return discord.Emoji{}, false
+	}
+
+	name := strings.Trim(input, ":")
+	for _, e := range emojis {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return discord.Emoji{}, false
+}
+
+// Handle /emojivote command group
+func (b *Bot) handleEmojiVote(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+
+	// Downloading the image and posting the poll can exceed the 3 second response window
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.DeferredMessageInteractionWithSource,
+		Data: &api.InteractionResponseData{Flags: discord.EphemeralMessage},
+	}); err != nil {
+		b.interactionLog(i).Error("Error deferring emoji vote", "err", err)
+		return
+	}
+
+	respond := func(content string) {
+		if _, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+			Content: option.NewNullableString(content),
+		}); err != nil {
+			b.interactionLog(i).Error("Error editing interaction response", "err", err)
+		}
+	}
+	fail := func(message string) { respond("❌ " + message) }
+
+	hours := defaultPollHours
+	if v, err := sub.Options.Find("hours").IntValue(); err == nil && v > 0 {
+		hours = min(int(v), maxPollHours)
+	}
+	apply, _ := sub.Options.Find("apply").BoolValue()
+
+	p := &EmojiPoll{
+		ServerID:  int64(i.GuildID),
+		ChannelID: int64(i.ChannelID),
+		CreatedBy: int64(i.Member.User.ID),
+		ClosesAt:  time.Now().Add(time.Duration(hours) * time.Hour).UTC(),
+		Apply:     apply,
+	}
+
+	if apply {
+		ok, err := b.botCanManageEmojis(i.ChannelID)
+		if err != nil || !ok {
+			fail(fmt.Sprintf("The bot needs the **%s** permission to apply the result.", prunePermissionName))
+			return
+		}
+	}
+
+	var usage string
+
+	switch sub.Name {
+	case pollActionAdd:
+		p.Action = pollActionAdd
+		p.EmojiName = strings.Trim(sub.Options.Find("name").String(), ":")
+		if !emojiNameRegex.MatchString(p.EmojiName) {
+			fail("Emoji names must be 2-32 letters, numbers or underscores.")
+			return
+		}
+
+		attachmentID, err := sub.Options.Find("image").SnowflakeValue()
+		if err != nil {
+			fail("Missing image.")
+			return
+		}
+		attachment, ok := data.Resolved.Attachments[discord.AttachmentID(attachmentID)]
+		if !ok {
+			fail("Missing image.")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		image, contentType, err := b.Images.Download(ctx, string(attachment.URL), maxEmojiImageBytes)
+		if errors.Is(err, errDownloadTooLarge) {
+			fail("Emoji images must be 256 KB or smaller.")
+			return
+		}
+		if err != nil {
+			b.interactionLog(i).Error("Error downloading poll image", "err", err)
+			fail("Failed to download the image.")
+			return
+		}
+		contentType, _, _ = strings.Cut(contentType, ";")
+		if contentType != "image/png" && contentType != "image/jpeg" && contentType != "image/gif" {
+			fail("Emoji images must be PNG, JPEG or GIF.")
+			return
+		}
+		p.Image = image
+		p.ImageType = contentType
+		p.Animated = contentType == "image/gif"
+
+	case pollActionRemove:
+		p.Action = pollActionRemove
+		emojis, err := b.getGuildEmojis(i.GuildID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching guild emojis", "err", err)
+			fail("Failed to fetch guild emojis.")
+			return
+		}
+		emoji, ok := findGuildEmoji(emojis, sub.Options.Find("emoji").String())
+		if !ok {
+			fail("That emoji isn't in this server.")
+			return
+		}
+		p.EmojiID = int64(emoji.ID)
+		p.EmojiName = emoji.Name
+		p.Animated = emoji.Animated
+
+		usage, err = b.formatEmojiUsageSummary(p.ServerID, p.EmojiID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching emoji usage", "err", err)
+			fail("Failed to fetch usage data.")
+			return
+		}
+
+	default:
+		fail("Unknown subcommand.")
+		return
+	}
+
+	if err := b.createEmojiPoll(p); err != nil {
+		b.interactionLog(i).Error("Error creating poll", "err", err)
+		fail("Failed to create poll.")
+		return
+	}
+
+	msg, err := b.Client.SendMessageComplex(i.ChannelID, createEmojiPollMessage(p, usage))
+	if err != nil {
+		b.interactionLog(i).Error("Error posting poll", "err", err)
+		// Without its message nobody can vote, so the scheduler must not close it
+		if err := b.deleteEmojiPoll(p.ID); err != nil {
+			b.interactionLog(i).Error("Error deleting unposted poll", "err", err)
+		}
+		fail("Failed to post the poll in this channel.")
+		return
+	}
+	if err := b.setEmojiPollMessage(p.ID, int64(msg.ID)); err != nil {
+		b.interactionLog(i).Error("Error saving poll message", "err", err)
+	}
+
+	respond(fmt.Sprintf("✅ Poll posted. It closes <t:%d:R>.", p.ClosesAt.Unix()))
+}
+
+// Handle Yes/No buttons (format: "emojivote:<poll id>:yes")
+func (b *Bot) handleEmojiVoteButton(i *gateway.InteractionCreateEvent, customID string) {
+	if !isInGuild(&i.InteractionEvent) {
+		return
+	}
+
+	parts := strings.Split(customID, ":")
+	if len(parts) != 3 {
+		return
+	}
+	pollID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return
+	}
+
+	p, err := b.getEmojiPoll(pollID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching poll", "poll_id", pollID, "err", err)
+		b.respondError(i, "Failed to record your vote.")
+		return
+	}
+	if p == nil || p.ServerID != int64(i.GuildID) {
+		b.respondError(i, "This poll no longer exists.")
+		return
+	}
+	if p.Status != pollStatusOpen || time.Now().After(p.ClosesAt) {
+		b.respondError(i, "This poll is closed.")
+		return
+	}
+
+	yes := parts[2] == "yes"
+	if err := b.castEmojiPollVote(p.ServerID, pollID, int64(i.Member.User.ID), yes); err != nil {
+		b.interactionLog(i).Error("Error recording vote", "err", err)
+		b.respondError(i, "Failed to record your vote.")
+		return
+	}
+
+	vote := "No"
+	if yes {
+		vote = "Yes"
+	}
+	response := api.InteractionResponseData{
+		Content: option.NewNullableString(fmt.Sprintf("✅ Your vote: **%s**. Votes are tallied when the poll closes <t:%d:R>.", vote, p.ClosesAt.Unix())),
+		Flags:   discord.EphemeralMessage,
+	}
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err)
+	}
+}
+
+// Apply a passed poll by adding or deleting the emoji
+func (b *Bot) applyEmojiPoll(p *EmojiPoll) error {
+	guildID := discord.GuildID(p.ServerID)
+	reason := api.AuditLogReason(fmt.Sprintf("Community emoji vote #%d passed (%d yes / %d no)", p.ID, p.YesVotes, p.NoVotes))
+
+	if p.Action == pollActionAdd {
+		_, err := b.Client.CreateEmoji(guildID, api.CreateEmojiData{
+			Name:           p.EmojiName,
+			Image:          api.Image{ContentType: p.ImageType, Content: p.Image},
+			AuditLogReason: reason,
+		})
+		return err
+	}
+
+	// Keep the image so historical reports still render
+	if _, err := b.Images.EmojiImage(context.Background(), p.ServerID, EmojiData{Name: p.EmojiName, ID: p.EmojiID, Animated: p.Animated}); err != nil {
+		pollLog.Error("Error caching image of emoji", idAttr("guild_id", p.ServerID), idAttr("emoji_id", p.EmojiID), "err", err)
+	} else if err := b.Images.Retain(kindEmoji, p.EmojiID); err != nil {
+		pollLog.Error("Error retaining image of emoji", idAttr("guild_id", p.ServerID), idAttr("emoji_id", p.EmojiID), "err", err)
+	}
+	return b.Client.DeleteEmoji(guildID, discord.EmojiID(p.EmojiID), reason)
+}
+
+// Tally a due poll, apply it if requested and update its message
+func (b *Bot) finishEmojiPoll(p *EmojiPoll) {
+	// Claim the poll first, so a result that fails to save can't have it
+	// applied again on the next check
+	claimed, err := b.claimEmojiPoll(p.ID)
+	if err != nil {
+		pollLog.Error("Error claiming poll", idAttr("guild_id", p.ServerID), "poll_id", p.ID, "err", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	yes, no, err := b.tallyEmojiPoll(p.ID)
+	if err != nil {
+		pollLog.Error("Error tallying poll", idAttr("guild_id", p.ServerID), "poll_id", p.ID, "err", err)
+		return
+	}
+	p.YesVotes, p.NoVotes = yes, no
+
+	p.Status = pollStatusFailed
+	if yes > no {
+		p.Status = pollStatusPassed
+	}
+
+	result := fmt.Sprintf("❌ **Rejected** (%d yes / %d no)", yes, no)
+	if p.Status == pollStatusPassed {
+		result = fmt.Sprintf("✅ **Passed** (%d yes / %d no)", yes, no)
+		if p.Apply {
+			if err := b.applyEmojiPoll(p); err != nil {
+				pollLog.Error("Error applying poll", idAttr("guild_id", p.ServerID), "poll_id", p.ID, "err", err)
+				p.ApplyError = err.Error()
+				result += ", but applying it failed"
+			} else {
+				p.Status = pollStatusApplied
+				pollLog.Info("Applied emoji poll", idAttr("guild_id", p.ServerID), "poll_id", p.ID, "action", p.Action, "emoji", p.EmojiName)
+				result += ", applied"
+			}
+		}
+	}
+
+	if err := b.closeEmojiPoll(p); err != nil {
+		pollLog.Error("Error closing poll", idAttr("guild_id", p.ServerID), "poll_id", p.ID, "err", err)
+	}
+
+	if p.MessageID == 0 {
+		return
+	}
+	content := fmt.Sprintf("%s\nPoll closed <t:%d:R>: %s", pollTitle(p), p.ClosesAt.Unix(), result)
+	emptyComponents := discord.ContainerComponents{}
+	if _, err := b.Client.EditMessageComplex(discord.ChannelID(p.ChannelID), discord.MessageID(p.MessageID), api.EditMessageData{
+		Content:    option.NewNullableString(content),
+		Components: &emptyComponents,
+	}); err != nil {
+		pollLog.Error("Error updating poll message", idAttr("guild_id", p.ServerID), idAttr("message_id", p.MessageID), "err", err)
+	}
+}
+
+// Close due polls once a minute until the context is cancelled
+func (b *Bot) runEmojiPollScheduler(ctx context.Context) {
+	ticker := time.NewTicker(pollCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		polls, err := b.getDueEmojiPolls(time.Now())
+		if err != nil {
+			pollLog.Error("Error fetching due polls", "err", err)
+			continue
+		}
+		for i := range polls {
+			b.finishEmojiPoll(&polls[i])
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/diamondburned/arikawa/v3/utils/sendpart"
+)
+
+// Export formats
+const (
+	exportFormatCSV  = "csv"
+	exportFormatJSON = "json"
+)
+
+// Export data types
+const (
+	exportTypeEmojis   = "emojis"
+	exportTypeStickers = "stickers"
+	exportTypeEvents   = "events"
+	exportTypeRollups  = "rollups"
+)
+
+// Bumped when columns change so importers can tell exports apart
+const exportFormatVersion = 1
+
+// Columns and query for one exportable table. Scan returns values in column order.
+type exportSpec struct {
+	columns []string
+	query   string
+	scan    func(rows *sql.Rows) ([]any, error)
+}
+
+// IDs are exported as strings since they don't fit in a JSON number without losing precision
+func idString(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+var exportSpecs = map[string]exportSpec{
+	exportTypeEmojis: {
+		columns: []string{"server_id", "emote_id", "emote_name", "animated", "usage_count", "first_used", "last_used"},
+		query:   `SELECT server_id, emote_id, emote_name, animated, usage_count, first_used, last_used FROM emojis WHERE server_id = ? ORDER BY usage_count DESC, emote_id`,
+		scan: func(rows *sql.Rows) ([]any, error) {
+			var serverID, emojiID int64
+			var name string
+			var animated bool
+			var count int
+			var firstUsed, lastUsed time.Time
+			if err := rows.Scan(&serverID, &emojiID, &name, &animated, &count, &firstUsed, &lastUsed); err != nil {
+				return nil, err
+			}
+			return []any{idString(serverID), idString(emojiID), name, animated, count, firstUsed.UTC().Format(time.RFC3339), lastUsed.UTC().Format(time.RFC3339)}, nil
+		},
+	},
+	exportTypeStickers: {
+		columns: []string{"server_id", "sticker_id", "sticker_name", "usage_count", "first_used", "last_used"},
+		query:   `SELECT server_id, sticker_id, sticker_name, usage_count, first_used, last_used FROM stickers WHERE server_id = ? ORDER BY usage_count DESC, sticker_id`,
+		scan: func(rows *sql.Rows) ([]any, error) {
+			var serverID, stickerID int64
+			var name string
+			var count int
+			var firstUsed, lastUsed time.Time
+			if err := rows.Scan(&serverID, &stickerID, &name, &count, &firstUsed, &lastUsed); err != nil {
+				return nil, err
+			}
+			return []any{idString(serverID), idString(stickerID), name, count, firstUsed.UTC().Format(time.RFC3339), lastUsed.UTC().Format(time.RFC3339)}, nil
+		},
+	},
+	exportTypeEvents: {
+		columns: []string{"id", "server_id", "channel_id", "message_id", "user_id", "kind", "item_id", "source", "delta", "created_at"},
+		query:   `SELECT id, server_id, COALESCE(channel_id, 0), COALESCE(message_id, 0), COALESCE(` + reportedUserID + `, 0), kind, item_id, source, delta, created_at FROM usage_events WHERE server_id = ? ORDER BY id`,
+		scan: func(rows *sql.Rows) ([]any, error) {
+			var id, serverID, channelID, messageID, userID, itemID int64
+			var kind, source string
+			var delta int
+			var createdAt time.Time
+			if err := rows.Scan(&id, &serverID, &channelID, &messageID, &userID, &kind, &itemID, &source, &delta, &createdAt); err != nil {
+				return nil, err
+			}
+			return []any{id, idString(serverID), idString(channelID), idString(messageID), idString(userID), kind, idString(itemID), source, delta, createdAt.UTC().Format(time.RFC3339)}, nil
+		},
+	},
+	// Usage events compacted by retention, which the events export no longer has
+	exportTypeRollups: {
+		columns: []string{"server_id", "period", "period_start", "channel_id", "user_id", "kind", "item_id", "uses"},
+		query:   `SELECT server_id, period, period_start, channel_id, COALESCE(` + reportedUserID + `, 0), kind, item_id, uses FROM usage_rollups WHERE server_id = ? ORDER BY period_start, channel_id, kind, item_id, user_id`,
+		scan: func(rows *sql.Rows) ([]any, error) {
+			var serverID, channelID, userID, itemID int64
+			var period, kind string
+			var uses int
+			var periodStart time.Time
+			if err := rows.Scan(&serverID, &period, &periodStart, &channelID, &userID, &kind, &itemID, &uses); err != nil {
+				return nil, err
+			}
+			return []any{idString(serverID), period, periodStart.UTC().Format(time.RFC3339), idString(channelID), idString(userID), kind, idString(itemID), uses}, nil
+		},
+	},
+}
+
+// Stream a server's data of the given type to w
+func (b *Bot) writeExport(w io.Writer, serverID int64, format, dataType string) error {
+	spec, ok := exportSpecs[dataType]
+	if !ok {
+		return fmt.Errorf("unknown export type %q", dataType)
+	}
+	if format != exportFormatCSV && format != exportFormatJSON {
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	rows, err := b.DB.Query(spec.query, serverID)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", dataType, err)
+	}
+	defer rows.Close()
+
+	if format == exportFormatCSV {
+		return writeCSVExport(w, spec, rows)
+	}
+	return writeJSONExport(w, serverID, dataType, spec, rows)
+}
+
+func writeCSVExport(w io.Writer, spec exportSpec, rows *sql.Rows) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(spec.columns); err != nil {
+		return err
+	}
+
+	record := make([]string, len(spec.columns))
+	for rows.Next() {
+		values, err := spec.scan(rows)
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			record[i] = fmt.Sprint(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// JSON exports are one object with metadata and a rows array, written row by row
+func writeJSONExport(w io.Writer, serverID int64, dataType string, spec exportSpec, rows *sql.Rows) error {
+	header := fmt.Sprintf(`{"format_version":%d,"type":%q,"server_id":%q,"exported_at":%q,"rows":[`,
+		exportFormatVersion, dataType, idString(serverID), time.Now().UTC().Format(time.RFC3339))
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	first := true
+	var buf bytes.Buffer
+	for rows.Next() {
+		values, err := spec.scan(rows)
+		if err != nil {
+			return err
+		}
+
+		buf.Reset()
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.WriteString("\n{")
+		for i, v := range values {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(spec.columns[i])
+			val, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(val)
+		}
+		buf.WriteByte('}')
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n]}\n")
+	return err
+}
+
+// Gzip stream cut into attachments no larger than limit. Each part is held
+// until the next one starts, so the last part is known when it is sent.
+type exportParts struct {
+	name  string
+	limit int
+	part  bytes.Buffer
+	count int
+	send  func(f sendpart.File, last bool) error
+}
+
+func (p *exportParts) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if p.part.Len() == p.limit {
+			if err := p.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(b), p.limit-p.part.Len())
+		p.part.Write(b[:n])
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Send the held part. A gzip file that fits one attachment keeps its name;
+// parts are byte ranges joined back with `cat name.part* > name`.
+func (p *exportParts) flush(last bool) error {
+	p.count++
+	name := p.name
+	if !last || p.count > 1 {
+		name = fmt.Sprintf("%s.part%03d", p.name, p.count)
+	}
+	data := p.part.Bytes()
+	p.part = bytes.Buffer{}
+	return p.send(sendpart.File{Name: name, Reader: bytes.NewReader(data)}, last)
+}
+
+// Send an export as attachments no larger than limit, reading it as it is
+// written. Exports that fit are sent as they are; larger ones are gzipped and
+// split into numbered parts if still too large. At most one attachment of
+// raw and one of compressed data are held in memory.
+func streamExport(name string, r io.Reader, limit int, send func(f sendpart.File, last bool) error) error {
+	head := make([]byte, limit+1)
+	n, err := io.ReadFull(r, head)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return send(sendpart.File{Name: name, Reader: bytes.NewReader(head[:n])}, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	parts := &exportParts{name: name + ".gz", limit: limit, send: send}
+	zw := gzip.NewWriter(parts)
+	if _, err := zw.Write(head); err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return parts.flush(true)
+}
+
+// Write a server's export to a temporary file. Uploading takes a while, and
+// the export's query would hold SQLite's read lock and block tracking writes
+// for as long as it is read, so it is read to the end before anything is sent.
+func (b *Bot) writeExportFile(serverID int64, format, dataType string) (*os.File, error) {
+	f, err := os.CreateTemp("", "export-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+	if err := b.writeExport(f, serverID, format, dataType); err != nil {
+		removeExportFile(f)
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		removeExportFile(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+func removeExportFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// Send an export part as the deferred response, or as a follow-up after the first
+func (b *Bot) sendExportPart(i *gateway.InteractionCreateEvent, name, dataType, format string, sent *int) func(f sendpart.File, last bool) error {
+	return func(f sendpart.File, last bool) error {
+		*sent++
+		if *sent > 1 {
+			_, err := b.Client.FollowUpInteraction(i.AppID, i.Token, api.InteractionResponseData{
+				Files: []sendpart.File{f},
+				Flags: discord.EphemeralMessage,
+			})
+			return err
+		}
+		content := fmt.Sprintf("✅ Exported %s as %s.", dataType, format)
+		if !last {
+			content += fmt.Sprintf(" The export is split into parts; join them with `cat %s.gz.part* > %s.gz`.", name, name)
+		}
+		_, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+			Content: option.NewNullableString(content),
+			Files:   []sendpart.File{f},
+		})
+		return err
+	}
+}
+
+// Handle /export command
+func (b *Bot) handleExport(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	opts := i.Data.(*discord.CommandInteraction).Options
+	format := opts.Find("format").String()
+	dataType := opts.Find("type").String()
+	if _, ok := exportSpecs[dataType]; !ok || (format != exportFormatCSV && format != exportFormatJSON) {
+		b.respondError(i, "Unknown export format or type.")
+		return
+	}
+
+	// Large exports can take longer than the 3 second response window
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.DeferredMessageInteractionWithSource,
+		Data: &api.InteractionResponseData{Flags: discord.EphemeralMessage},
+	}); err != nil {
+		b.interactionLog(i).Error("Error deferring export", "err", err)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%d-%s.%s", dataType, i.GuildID, time.Now().UTC().Format("20060102"), format)
+	sent := 0
+	file, err := b.writeExportFile(int64(i.GuildID), format, dataType)
+	if err == nil {
+		defer removeExportFile(file)
+		err = streamExport(name, file, api.UploadSizeLimit, b.sendExportPart(i, name, dataType, format, &sent))
+	}
+	if err == nil {
+		return
+	}
+
+	b.interactionLog(i).Error("Error exporting", "type", dataType, "parts_sent", sent, "err", err)
+	if sent == 0 {
+		_, err = b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+			Content: option.NewNullableString("❌ Failed to export data."),
+		})
+	} else {
+		_, err = b.Client.FollowUpInteraction(i.AppID, i.Token, api.InteractionResponseData{
+			Content: option.NewNullableString("❌ The export failed before its last part. Run it again."),
+			Flags:   discord.EphemeralMessage,
+		})
+	}
+	if err != nil {
+		b.interactionLog(i).Error("Error editing interaction response", "err", err)
+	}
+}
+
+// Offline export against the database file:
+//
+//	emote_keeper export -guild 123 -format csv -type emojis -o emojis.csv
+func runExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the SQLite database")
+	guild := fs.Int64("guild", 0, "guild (server) ID to export")
+	format := fs.String("format", exportFormatCSV, "csv or json")
+	dataType := fs.String("type", exportTypeEmojis, "emojis, stickers, events or rollups")
+	out := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+
+	if *guild == 0 {
+		return fmt.Errorf("-guild is required")
+	}
+
+	b, err := newOfflineBot(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer b.DB.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return b.writeExport(w, *guild, *format, *dataType)
+}
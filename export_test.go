@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/utils/sendpart"
+)
+
+func TestStreamExport(t *testing.T) {
+	const limit = 256
+	noise := make([]byte, 3*limit)
+	rand.NewChaCha8([32]byte{}).Read(noise)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantNames []string
+	}{
+		{"fits", []byte("id,name\n1,wave\n"), []string{"e.csv"}},
+		{"exactly the limit", bytes.Repeat([]byte("x"), limit), []string{"e.csv"}},
+		{"compressed to fit", []byte(strings.Repeat("1,wave\n", limit)), []string{"e.csv.gz"}},
+		{"split", noise, []string{"e.csv.gz.part001", "e.csv.gz.part002", "e.csv.gz.part003", "e.csv.gz.part004"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			var joined bytes.Buffer
+			sawLast := false
+			err := streamExport("e.csv", bytes.NewReader(tt.data), limit, func(f sendpart.File, last bool) error {
+				if sawLast {
+					t.Error("part sent after the last one")
+				}
+				sawLast = last
+				n, err := io.Copy(&joined, f.Reader)
+				if n > limit {
+					t.Errorf("%s is %d bytes, over the limit", f.Name, n)
+				}
+				names = append(names, f.Name)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sawLast || strings.Join(names, " ") != strings.Join(tt.wantNames, " ") {
+				t.Fatalf("sent %v (last marked: %v), want %v", names, sawLast, tt.wantNames)
+			}
+
+			got := joined.Bytes()
+			if strings.Contains(names[0], ".gz") {
+				zr, err := gzip.NewReader(&joined)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("joined export differs from the original: %d bytes, want %d", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+// A failed write or send stops the export with its error
+func TestStreamExportErrors(t *testing.T) {
+	broken := errors.New("broken")
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(bytes.Repeat([]byte("x"), 1000))
+		pw.CloseWithError(broken)
+	}()
+	err := streamExport("e.csv", pr, 10, func(sendpart.File, bool) error { return nil })
+	if !errors.Is(err, broken) {
+		t.Errorf("failed export err = %v, want the write error", err)
+	}
+
+	sends := 0
+	err = streamExport("e.csv", bytes.NewReader(make([]byte, 1000)), 10, func(sendpart.File, bool) error {
+		sends++
+		return broken
+	})
+	if !errors.Is(err, broken) || sends != 1 {
+		t.Errorf("failed send = %v after %d sends, want the send error after 1", err, sends)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	b := newTestBot(t)
+	b.send(b.message("<:wave:111>"))
+	b.send(b.command("export", stringOption("format", exportFormatCSV), stringOption("type", exportTypeEmojis)))
+
+	if len(b.fake.Edits) != 1 || len(b.fake.Edits[0].Files) != 1 {
+		t.Fatalf("edits = %+v, want one with the file", b.fake.Edits)
+	}
+	f := b.fake.Edits[0].Files[0]
+	data, err := io.ReadAll(f.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(f.Name, ".csv") || !strings.Contains(string(data), ",111,wave,") {
+		t.Errorf("exported %s = %q", f.Name, data)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json"
+)
+
+const (
+	testGuildID   = discord.GuildID(1000)
+	testChannelID = discord.ChannelID(2000)
+	testUserID    = discord.UserID(3000)
+	testAppID     = discord.AppID(4000)
+	testBotUserID = discord.UserID(4000)
+)
+
+var errFakeNotFound = errors.New("fake discord: not found")
+
+// Message the bot sent to a channel
+type sentMessage struct {
+	ChannelID discord.ChannelID
+	Data      api.SendMessageData
+}
+
+// DiscordClient that serves canned guild data and records what the bot sends
+type fakeDiscord struct {
+	mu sync.Mutex
+
+	// Canned data
+	Guilds          map[discord.GuildID]discord.Guild
+	ChannelsByGuild map[discord.GuildID][]discord.Channel
+	MembersByGuild  map[discord.GuildID][]discord.Member
+	EmojisByGuild   map[discord.GuildID][]discord.Emoji
+	StickersByGuild map[discord.GuildID][]discord.Sticker
+	Perms           map[discord.UserID]discord.Permissions
+	Messages        map[discord.MessageID]discord.Message
+	// Channel history, oldest first
+	History map[discord.ChannelID][]discord.Message
+	// Errors MessagesBefore returns, one per call, before serving history again
+	HistoryErrs []error
+	// Attachments and images by URL
+	Files       map[string][]byte
+	DMsDisabled bool
+	// Error DeleteEmoji and DeleteGuildSticker return
+	DeleteErr error
+	// Error SendMessageComplex returns
+	SendErr error
+
+	// Recorded calls
+	Responses       []api.InteractionResponse
+	Edits           []api.EditInteractionResponseData
+	FollowUps       []api.InteractionResponseData
+	Sent            []sentMessage
+	MessageEdits    []api.EditMessageData
+	Commands        []api.CreateCommandData
+	DeletedEmojis   []discord.EmojiID
+	DeletedStickers []discord.StickerID
+
+	nextID discord.Snowflake
+}
+
+var _ DiscordClient = (*fakeDiscord)(nil)
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{
+		Guilds:          map[discord.GuildID]discord.Guild{testGuildID: {ID: testGuildID, Name: "Test Server"}},
+		ChannelsByGuild: map[discord.GuildID][]discord.Channel{testGuildID: {{ID: testChannelID, GuildID: testGuildID, Name: "general", Type: discord.GuildText}}},
+		MembersByGuild:  make(map[discord.GuildID][]discord.Member),
+		EmojisByGuild:   make(map[discord.GuildID][]discord.Emoji),
+		StickersByGuild: make(map[discord.GuildID][]discord.Sticker),
+		Perms:           make(map[discord.UserID]discord.Permissions),
+		Messages:        make(map[discord.MessageID]discord.Message),
+		History:         make(map[discord.ChannelID][]discord.Message),
+		Files:           make(map[string][]byte),
+		nextID:          900000,
+	}
+}
+
+func (f *fakeDiscord) newID() discord.Snowflake {
+	f.nextID++
+	return f.nextID
+}
+
+func (f *fakeDiscord) RespondInteraction(id discord.InteractionID, token string, resp api.InteractionResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Responses = append(f.Responses, resp)
+	return nil
+}
+
+func (f *fakeDiscord) EditInteractionResponse(appID discord.AppID, token string, data api.EditInteractionResponseData) (*discord.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Edits = append(f.Edits, data)
+	return &discord.Message{ID: discord.MessageID(f.newID()), ChannelID: testChannelID}, nil
+}
+
+func (f *fakeDiscord) FollowUpInteraction(appID discord.AppID, token string, data api.InteractionResponseData) (*discord.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.FollowUps = append(f.FollowUps, data)
+	return &discord.Message{ID: discord.MessageID(f.newID()), ChannelID: testChannelID}, nil
+}
+
+func (f *fakeDiscord) BulkOverwriteCommands(appID discord.AppID, commands []api.CreateCommandData) ([]discord.Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Commands = commands
+	cmds := make([]discord.Command, len(commands))
+	for i, c := range commands {
+		cmds[i] = discord.Command{ID: discord.CommandID(f.newID()), AppID: appID, Name: c.Name}
+	}
+	return cmds, nil
+}
+
+func (f *fakeDiscord) SendMessageComplex(channelID discord.ChannelID, data api.SendMessageData) (*discord.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.SendErr != nil {
+		return nil, f.SendErr
+	}
+	f.Sent = append(f.Sent, sentMessage{ChannelID: channelID, Data: data})
+	return &discord.Message{ID: discord.MessageID(f.newID()), ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (f *fakeDiscord) EditMessageComplex(channelID discord.ChannelID, messageID discord.MessageID, data api.EditMessageData) (*discord.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.MessageEdits = append(f.MessageEdits, data)
+	return &discord.Message{ID: messageID, ChannelID: channelID}, nil
+}
+
+func (f *fakeDiscord) CreatePrivateChannel(recipientID discord.UserID) (*discord.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DMsDisabled {
+		return nil, errors.New("fake discord: cannot send messages to this user")
+	}
+	return &discord.Channel{ID: discord.ChannelID(f.newID()), Type: discord.DirectMessage}, nil
+}
+
+func (f *fakeDiscord) Me() (*discord.User, error) {
+	return &discord.User{ID: testBotUserID, Username: "emote_keeper", Bot: true}, nil
+}
+
+func (f *fakeDiscord) Guild(id discord.GuildID) (*discord.Guild, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	g, ok := f.Guilds[id]
+	if !ok {
+		return nil, errFakeNotFound
+	}
+	return &g, nil
+}
+
+func (f *fakeDiscord) Channel(id discord.ChannelID) (*discord.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, channels := range f.ChannelsByGuild {
+		for _, ch := range channels {
+			if ch.ID == id {
+				return &ch, nil
+			}
+		}
+	}
+	return nil, errFakeNotFound
+}
+
+func (f *fakeDiscord) Channels(guildID discord.GuildID) ([]discord.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ChannelsByGuild[guildID], nil
+}
+
+func (f *fakeDiscord) MembersAfter(guildID discord.GuildID, after discord.UserID, limit uint) ([]discord.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	members, ok := f.MembersByGuild[guildID]
+	if !ok {
+		return nil, errFakeNotFound
+	}
+	var page []discord.Member
+	for _, m := range members {
+		if m.User.ID > after && (limit == 0 || uint(len(page)) < limit) {
+			page = append(page, m)
+		}
+	}
+	return page, nil
+}
+
+func (f *fakeDiscord) Member(guildID discord.GuildID, userID discord.UserID) (*discord.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.MembersByGuild[guildID] {
+		if m.User.ID == userID {
+			return &m, nil
+		}
+	}
+	return nil, errFakeNotFound
+}
+
+func (f *fakeDiscord) Permissions(channelID discord.ChannelID, userID discord.UserID) (discord.Permissions, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if userID == testBotUserID {
+		return discord.PermissionAll, nil
+	}
+	return f.Perms[userID], nil
+}
+
+func (f *fakeDiscord) Emojis(guildID discord.GuildID) ([]discord.Emoji, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.EmojisByGuild[guildID], nil
+}
+
+func (f *fakeDiscord) CreateEmoji(guildID discord.GuildID, data api.CreateEmojiData) (*discord.Emoji, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := discord.Emoji{ID: discord.EmojiID(f.newID()), Name: data.Name}
+	f.EmojisByGuild[guildID] = append(f.EmojisByGuild[guildID], e)
+	return &e, nil
+}
+
+func (f *fakeDiscord) DeleteEmoji(guildID discord.GuildID, emojiID discord.EmojiID, reason api.AuditLogReason) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DeleteErr != nil {
+		return f.DeleteErr
+	}
+	f.DeletedEmojis = append(f.DeletedEmojis, emojiID)
+	return nil
+}
+
+func (f *fakeDiscord) GuildStickers(guildID discord.GuildID) ([]discord.Sticker, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.StickersByGuild[guildID], nil
+}
+
+func (f *fakeDiscord) DeleteGuildSticker(guildID discord.GuildID, stickerID discord.StickerID, reason api.AuditLogReason) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DeleteErr != nil {
+		return f.DeleteErr
+	}
+	f.DeletedStickers = append(f.DeletedStickers, stickerID)
+	return nil
+}
+
+func (f *fakeDiscord) Message(channelID discord.ChannelID, messageID discord.MessageID) (*discord.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.Messages[messageID]
+	if !ok {
+		return nil, errFakeNotFound
+	}
+	return &m, nil
+}
+
+// Up to limit messages older than before, or the latest when before is 0, newest first
+func (f *fakeDiscord) MessagesBefore(channelID discord.ChannelID, before discord.MessageID, limit uint) ([]discord.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.HistoryErrs) > 0 {
+		err := f.HistoryErrs[0]
+		f.HistoryErrs = f.HistoryErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	var msgs []discord.Message
+	history := f.History[channelID]
+	for n := len(history) - 1; n >= 0 && uint(len(msgs)) < limit; n-- {
+		if before == 0 || history[n].ID < before {
+			msgs = append(msgs, history[n])
+		}
+	}
+	return msgs, nil
+}
+
+// Last interaction response, failing the test if there was none
+func (f *fakeDiscord) lastResponse(t *testing.T) api.InteractionResponse {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.Responses) == 0 {
+		t.Fatal("no interaction response was sent")
+	}
+	return f.Responses[len(f.Responses)-1]
+}
+
+// Content of the last interaction response
+func (f *fakeDiscord) lastContent(t *testing.T) string {
+	t.Helper()
+	resp := f.lastResponse(t)
+	if resp.Data == nil || resp.Data.Content == nil {
+		return ""
+	}
+	return resp.Data.Content.Val
+}
+
+// Content of the last edit to a deferred interaction response
+func (f *fakeDiscord) lastEdit(t *testing.T) string {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.Edits) == 0 {
+		t.Fatal("the interaction response was never edited")
+	}
+	return f.Edits[len(f.Edits)-1].Content.Val
+}
+
+// Serve downloads from Files; anything else is not found
+func (f *fakeDiscord) Fetch(ctx context.Context, url string, maxBytes int64) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.Files[url]
+	if !ok {
+		return nil, "", errFakeNotFound
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", errDownloadTooLarge
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+// A Bot wired to a fake Discord client and a fresh in-memory database
+type testBot struct {
+	*Bot
+	t      *testing.T
+	fake   *fakeDiscord
+	nextID discord.Snowflake
+}
+
+func newTestBot(t *testing.T) *testBot {
+	t.Helper()
+	store, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	// Every connection to :memory: is its own database
+	store.SetMaxOpenConns(1)
+
+	fake := newFakeDiscord()
+	b := &testBot{Bot: NewBot(fake, store), t: t, fake: fake, nextID: 100000}
+	if err := b.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	b.Images, err = NewImageCache(store, t.TempDir(), fake, defaultMaxImageBytes, defaultMaxImageCacheLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Backfiller = NewBackfiller(context.Background(), b.Bot)
+	b.Backfiller.pageDelay = 0
+	return b
+}
+
+func (b *testBot) newID() discord.Snowflake {
+	b.nextID++
+	return b.nextID
+}
+
+// Feed events through the same dispatch the gateway uses
+func (b *testBot) send(events ...gateway.Event) {
+	for _, e := range events {
+		b.HandleEvent(e)
+	}
+}
+
+// Guild message from a user
+func (b *testBot) message(content string, stickers ...discord.StickerItem) *gateway.MessageCreateEvent {
+	return &gateway.MessageCreateEvent{
+		Message: discord.Message{
+			ID:        discord.MessageID(b.newID()),
+			ChannelID: testChannelID,
+			GuildID:   testGuildID,
+			Author:    discord.User{ID: testUserID, Username: "user"},
+			Content:   content,
+			Stickers:  stickers,
+		},
+	}
+}
+
+func (b *testBot) reactionAdd(messageID discord.MessageID, emoji discord.Emoji) *gateway.MessageReactionAddEvent {
+	return &gateway.MessageReactionAddEvent{
+		UserID:    testUserID,
+		ChannelID: testChannelID,
+		MessageID: messageID,
+		GuildID:   testGuildID,
+		Emoji:     emoji,
+	}
+}
+
+func (b *testBot) reactionRemove(messageID discord.MessageID, emoji discord.Emoji) *gateway.MessageReactionRemoveEvent {
+	return &gateway.MessageReactionRemoveEvent{
+		UserID:    testUserID,
+		ChannelID: testChannelID,
+		MessageID: messageID,
+		GuildID:   testGuildID,
+		Emoji:     emoji,
+	}
+}
+
+func (b *testBot) interaction(data discord.InteractionData) *gateway.InteractionCreateEvent {
+	return &gateway.InteractionCreateEvent{
+		InteractionEvent: discord.InteractionEvent{
+			ID:        discord.InteractionID(b.newID()),
+			AppID:     testAppID,
+			ChannelID: testChannelID,
+			GuildID:   testGuildID,
+			Token:     "token",
+			Member:    &discord.Member{User: discord.User{ID: testUserID, Username: "user"}},
+			Data:      data,
+		},
+	}
+}
+
+// Slash command with options
+func (b *testBot) command(name string, options ...discord.CommandInteractionOption) *gateway.InteractionCreateEvent {
+	return b.interaction(&discord.CommandInteraction{ID: discord.CommandID(b.newID()), Name: name, Options: options})
+}
+
+func (b *testBot) button(customID string) *gateway.InteractionCreateEvent {
+	return b.interaction(&discord.ButtonInteraction{CustomID: discord.ComponentID(customID)})
+}
+
+// Submitted modal with one text input
+func (b *testBot) modal(customID, inputID, value string) *gateway.InteractionCreateEvent {
+	return b.interaction(&discord.ModalInteraction{
+		CustomID: discord.ComponentID(customID),
+		Components: discord.ContainerComponents{
+			&discord.ActionRowComponent{&discord.TextInputComponent{CustomID: discord.ComponentID(inputID), Value: value}},
+		},
+	})
+}
+
+// File uploaded with a command, served from the fake's Files
+func (b *testBot) attachment(filename string, data []byte) discord.Attachment {
+	a := discord.Attachment{
+		ID:       discord.AttachmentID(b.newID()),
+		Filename: filename,
+		URL:      "https://cdn.example.com/attachments/" + filename,
+		Size:     uint64(len(data)),
+	}
+	b.fake.mu.Lock()
+	b.fake.Files[a.URL] = data
+	b.fake.mu.Unlock()
+	return a
+}
+
+// Resolve attachments a command's options refer to
+func withAttachments(e *gateway.InteractionCreateEvent, attachments ...discord.Attachment) *gateway.InteractionCreateEvent {
+	data := e.Data.(*discord.CommandInteraction)
+	data.Resolved.Attachments = make(map[discord.AttachmentID]discord.Attachment)
+	for _, a := range attachments {
+		data.Resolved.Attachments[a.ID] = a
+	}
+	return e
+}
+
+// Command option with a JSON-encoded value
+func commandOption(name string, optionType discord.CommandOptionType, value any) discord.CommandInteractionOption {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		panic(fmt.Sprintf("marshal option %s: %v", name, err))
+	}
+	return discord.CommandInteractionOption{Name: name, Type: optionType, Value: json.Raw(raw)}
+}
+
+func boolOption(name string, v bool) discord.CommandInteractionOption {
+	return commandOption(name, discord.BooleanOptionType, v)
+}
+
+func stringOption(name, v string) discord.CommandInteractionOption {
+	return commandOption(name, discord.StringOptionType, v)
+}
+
+func intOption(name string, v int) discord.CommandInteractionOption {
+	return commandOption(name, discord.IntegerOptionType, v)
+}
+
+func channelOption(name string, id discord.ChannelID) discord.CommandInteractionOption {
+	return commandOption(name, discord.ChannelOptionType, id)
+}
+
+func roleOption(name string, id discord.RoleID) discord.CommandInteractionOption {
+	return commandOption(name, discord.RoleOptionType, id)
+}
+
+func attachmentOption(name string, a discord.Attachment) discord.CommandInteractionOption {
+	return commandOption(name, discord.AttachmentOptionType, a.ID)
+}
+
+func subcommand(name string, options ...discord.CommandInteractionOption) discord.CommandInteractionOption {
+	return discord.CommandInteractionOption{Name: name, Type: discord.SubcommandOptionType, Options: options}
+}
+
+// Usage count stored for an emoji in the test guild, or -1 when it has no row
+func (b *testBot) emojiCount(emojiID int64) int {
+	b.t.Helper()
+	var count int
+	err := b.DB.QueryRow("SELECT usage_count FROM emojis WHERE server_id = ? AND emote_id = ?", int64(testGuildID), emojiID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1
+	}
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return count
+}
+
+// Usage count stored for a sticker in the test guild, or -1 when it has no row
+func (b *testBot) stickerCount(stickerID int64) int {
+	b.t.Helper()
+	var count int
+	err := b.DB.QueryRow("SELECT usage_count FROM stickers WHERE server_id = ? AND sticker_id = ?", int64(testGuildID), stickerID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1
+	}
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return count
+}
+
+// Rows in a table for the test guild
+func (b *testBot) rows(table string) int {
+	b.t.Helper()
+	var n int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE server_id = ?", int64(testGuildID)).Scan(&n); err != nil {
+		b.t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/diamondburned/arikawa/v3/utils/ws"
+)
+
+const (
+	heartbeatInterval = 30 * time.Second
+	// Shorter gaps are ordinary heartbeat jitter
+	minOutageDuration = 2 * heartbeatInterval
+	// Channels with usage this long before an outage are backfilled
+	gapBackfillActiveWindow = 7 * 24 * time.Hour
+	outageListDays          = 30
+	outageListLimit         = 15
+)
+
+// Outage causes
+const (
+	outageOffline   = "offline"   // The bot process was not running
+	outageReconnect = "reconnect" // The gateway session was lost and events were not replayed
+)
+
+// Period when no usage was recorded
+type Outage struct {
+	ID        int64
+	StartedAt time.Time
+	EndedAt   time.Time
+	Reason    string
+}
+
+func (o Outage) Duration() time.Duration {
+	return o.EndedAt.Sub(o.StartedAt)
+}
+
+// Tracks when the gateway connection was lost, to spot sessions lost while running
+type gapTracker struct {
+	mu sync.Mutex
+	// When the first Ready was received; zero before it
+	readyAt time.Time
+	// When the connection closed, zero while connected or after a resume
+	disconnectedAt time.Time
+	heartbeat      sync.Once
+}
+
+// Count every gateway event and track disconnects. Ready is handled by handleReadyGap.
+func (b *Bot) handleGatewayEvent(e gateway.Event) {
+	now := time.Now()
+	b.health.noteEvent(e, now)
+	b.metrics.eventsReceived.Inc(string(e.EventType()))
+	b.gaps.noteEvent(e, now)
+}
+
+// Note when the connection closes. A quiet server can go hours without an
+// event, so the last event says nothing about when the session was lost.
+func (g *gapTracker) noteEvent(e gateway.Event, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch e.(type) {
+	case *ws.CloseEvent:
+		// Reconnect attempts close again; the first close starts the outage
+		if !g.readyAt.IsZero() && g.disconnectedAt.IsZero() {
+			g.disconnectedAt = now
+		}
+	case *gateway.ResumedEvent:
+		// Discord replays the missed events on resume
+		g.disconnectedAt = time.Time{}
+	}
+}
+
+func (b *Bot) getLastHeartbeat() (time.Time, error) {
+	var lastSeen int64
+	err := b.DB.QueryRow("SELECT last_seen FROM heartbeat WHERE id = 1").Scan(&lastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(lastSeen, 0).UTC(), nil
+}
+
+func (b *Bot) saveHeartbeat(t time.Time) error {
+	_, err := b.DB.Exec("INSERT INTO heartbeat (id, last_seen) VALUES (1, ?) ON CONFLICT(id) DO UPDATE SET last_seen = excluded.last_seen", t.Unix())
+	b.health.noteDBWrite(err)
+	return err
+}
+
+// Persist that the bot is alive every heartbeatInterval until the context is cancelled
+func (b *Bot) runHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := b.saveHeartbeat(time.Now()); err != nil {
+			gatewayLog.Error("Error saving heartbeat", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			// Mark a clean shutdown so the outage starts now, not at the last tick
+			if err := b.saveHeartbeat(time.Now()); err != nil {
+				gatewayLog.Error("Error saving heartbeat", "err", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Bot) recordOutage(o *Outage) error {
+	res, err := b.DB.Exec("INSERT INTO outages (started_at, ended_at, reason) VALUES (?, ?, ?)",
+		o.StartedAt.Unix(), o.EndedAt.Unix(), o.Reason)
+	if err != nil {
+		return fmt.Errorf("failed to record outage: %w", err)
+	}
+	o.ID, err = res.LastInsertId()
+	return err
+}
+
+func scanOutage(row interface{ Scan(...any) error }) (*Outage, error) {
+	var o Outage
+	var startedAt, endedAt int64
+	if err := row.Scan(&o.ID, &startedAt, &endedAt, &o.Reason); err != nil {
+		return nil, err
+	}
+	o.StartedAt = time.Unix(startedAt, 0).UTC()
+	o.EndedAt = time.Unix(endedAt, 0).UTC()
+	return &o, nil
+}
+
+func (b *Bot) getOutage(id int64) (*Outage, error) {
+	o, err := scanOutage(b.DB.QueryRow("SELECT id, started_at, ended_at, reason FROM outages WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return o, err
+}
+
+// Outages overlapping a period, most recent first
+func (b *Bot) getOutages(from, to time.Time, limit int) ([]Outage, error) {
+	rows, err := b.DB.Query(
+		"SELECT id, started_at, ended_at, reason FROM outages WHERE ended_at > ? AND started_at < ? ORDER BY started_at DESC LIMIT ?",
+		from.Unix(), to.Unix(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outages []Outage
+	for rows.Next() {
+		o, err := scanOutage(rows)
+		if err != nil {
+			return nil, err
+		}
+		outages = append(outages, *o)
+	}
+	return outages, rows.Err()
+}
+
+// Warning for reports covering a period with outages, or "" if data is complete
+func (b *Bot) outageNotice(from, to time.Time) string {
+	outages, err := b.getOutages(from, to, outageListLimit)
+	if err != nil {
+		gatewayLog.Error("Error fetching outages", "err", err)
+		return ""
+	}
+	if len(outages) == 0 {
+		return ""
+	}
+
+	var missing time.Duration
+	for _, o := range outages {
+		start, end := o.StartedAt, o.EndedAt
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		missing += end.Sub(start)
+	}
+	plural := "s"
+	if len(outages) == 1 {
+		plural = ""
+	}
+	return fmt.Sprintf("⚠️ Data incomplete: the bot missed %s of this period in %d outage%s.", formatOutageDuration(missing), len(outages), plural)
+}
+
+func formatOutageDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "under a minute"
+	}
+	return strings.TrimSuffix(d.String(), "0s")
+}
+
+// Detect an outage before this Ready event. The first Ready in a process
+// compares against the persisted heartbeat; later ones against the time the
+// connection closed.
+func (b *Bot) detectOutage(now time.Time) (*Outage, error) {
+	g := &b.gaps
+	g.mu.Lock()
+	first := g.readyAt.IsZero()
+	disconnectedAt := g.disconnectedAt
+	if first {
+		g.readyAt = now
+	}
+	g.disconnectedAt = time.Time{}
+	g.mu.Unlock()
+
+	o := &Outage{StartedAt: disconnectedAt, EndedAt: now, Reason: outageReconnect}
+	if first {
+		lastSeen, err := b.getLastHeartbeat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read heartbeat: %w", err)
+		}
+		if lastSeen.IsZero() {
+			// First run with this database
+			return nil, nil
+		}
+		o.StartedAt = lastSeen
+		o.Reason = outageOffline
+	} else if disconnectedAt.IsZero() {
+		// A new session always follows a close
+		return nil, nil
+	}
+
+	if o.Duration() < minOutageDuration {
+		return nil, nil
+	}
+	if err := b.recordOutage(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Channels per server with usage in the week before a time
+func (b *Bot) getActiveChannels(before time.Time) (map[int64][]discord.ChannelID, error) {
+	rows, err := b.DB.Query(
+		"SELECT DISTINCT server_id, channel_id FROM usage_events WHERE created_at >= ? AND created_at < ? AND channel_id != 0",
+		sqliteTime(before.Add(-gapBackfillActiveWindow)), sqliteTime(before),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := make(map[int64][]discord.ChannelID)
+	for rows.Next() {
+		var serverID, channelID int64
+		if err := rows.Scan(&serverID, &channelID); err != nil {
+			return nil, err
+		}
+		channels[serverID] = append(channels[serverID], discord.ChannelID(channelID))
+	}
+	return channels, rows.Err()
+}
+
+// Start a backfill of an outage window in one server's active channels.
+// Returns the number of channels, or 0 if the server had no recent activity.
+func (b *Bot) backfillOutage(o *Outage, serverID int64, channelIDs []discord.ChannelID, startedBy int64) (int, error) {
+	if len(channelIDs) == 0 {
+		return 0, nil
+	}
+	if b.Backfiller.Running(serverID) {
+		return 0, fmt.Errorf("a backfill is already running")
+	}
+	job := &BackfillJob{ServerID: serverID, Since: o.StartedAt, Until: o.EndedAt, StartedBy: startedBy}
+	if err := b.createBackfillJob(job, channelIDs); err != nil {
+		return 0, err
+	}
+	b.Backfiller.Start(serverID)
+	return len(channelIDs), nil
+}
+
+// Whether outages should be backfilled automatically
+func gapBackfillEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("BACKFILL_GAPS"))
+	return enabled
+}
+
+// Check for an outage on every Ready and start the heartbeat on the first
+func (b *Bot) handleReadyGap(ctx context.Context) func(*gateway.ReadyEvent) {
+	return func(e *gateway.ReadyEvent) {
+		o, err := b.detectOutage(time.Now())
+		if err != nil {
+			gatewayLog.Error("Error detecting outage", "err", err)
+		}
+		b.gaps.heartbeat.Do(func() { go b.runHeartbeat(ctx) })
+		if o == nil {
+			return
+		}
+		gatewayLog.Warn("Detected outage", "reason", o.Reason, "started_at", o.StartedAt, "ended_at", o.EndedAt, "duration", o.Duration())
+
+		if !gapBackfillEnabled() {
+			return
+		}
+		channels, err := b.getActiveChannels(o.StartedAt)
+		if err != nil {
+			gatewayLog.Error("Error fetching active channels", "err", err)
+			return
+		}
+		for serverID, ids := range channels {
+			if _, err := b.backfillOutage(o, serverID, ids, 0); err != nil {
+				gatewayLog.Warn("Skipping outage backfill", idAttr("guild_id", serverID), "err", err)
+			}
+		}
+	}
+}
+
+func formatOutageList(outages []Outage) string {
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**Outages** (last %d days)\n", outageListDays))
+	if len(outages) == 0 {
+		content.WriteString("No outages recorded. Data is complete.")
+	}
+	for _, o := range outages {
+		content.WriteString(fmt.Sprintf("`#%d` <t:%d:f> to <t:%d:t> (%s, %s)\n", o.ID, o.StartedAt.Unix(), o.EndedAt.Unix(), formatOutageDuration(o.Duration()), o.Reason))
+	}
+	return content.String()
+}
+
+// Handle /outages command
+func (b *Bot) handleOutages(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+	var content string
+
+	switch sub.Name {
+	case "list":
+		now := time.Now()
+		outages, err := b.getOutages(now.AddDate(0, 0, -outageListDays), now, outageListLimit)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching outages", "err", err)
+			b.respondError(i, "Failed to fetch outages.")
+			return
+		}
+		content = formatOutageList(outages)
+
+	case "backfill":
+		id, err := sub.Options.Find("id").IntValue()
+		if err != nil {
+			b.respondError(i, "Missing outage ID.")
+			return
+		}
+		o, err := b.getOutage(id)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching outage", "err", err)
+			b.respondError(i, "Failed to fetch the outage.")
+			return
+		}
+		if o == nil {
+			b.respondError(i, "No outage with that ID. Use `/outages list` to see them.")
+			return
+		}
+
+		channels, err := b.getActiveChannels(o.StartedAt)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching active channels", "err", err)
+			b.respondError(i, "Failed to fetch active channels.")
+			return
+		}
+		n, err := b.backfillOutage(o, int64(i.GuildID), channels[int64(i.GuildID)], int64(i.Member.User.ID))
+		if err != nil {
+			b.respondError(i, fmt.Sprintf("Failed to start the backfill: %v.", err))
+			return
+		}
+		if n == 0 {
+			b.respondError(i, "No channels were active in the week before this outage.")
+			return
+		}
+		content = fmt.Sprintf("✅ Backfilling outage `#%d` in %d active channels. Use `/backfill status` to follow progress.", o.ID, n)
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &api.InteractionResponseData{
+			Content: option.NewNullableString(content),
+			Flags:   discord.EphemeralMessage,
+		},
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/ws"
+)
+
+func TestDetectOutage(t *testing.T) {
+	b := newTestBot(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	g := &b.gaps
+
+	if o, err := b.detectOutage(start); err != nil || o != nil {
+		t.Fatalf("first Ready with a new database = %+v, %v; want no outage", o, err)
+	}
+
+	// Hours without events are a quiet server, not an outage
+	quiet := start.Add(5 * time.Hour)
+	g.noteEvent(&ws.CloseEvent{}, quiet)
+	if o, err := b.detectOutage(quiet.Add(10 * time.Second)); err != nil || o != nil {
+		t.Errorf("quick reconnect = %+v, %v; want no outage", o, err)
+	}
+
+	// Retries close again without moving the start
+	closed := start.Add(6 * time.Hour)
+	g.noteEvent(&ws.CloseEvent{}, closed)
+	g.noteEvent(&ws.CloseEvent{}, closed.Add(time.Minute))
+	o, err := b.detectOutage(closed.Add(5 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil || !o.StartedAt.Equal(closed) || o.Duration() != 5*time.Minute || o.Reason != outageReconnect {
+		t.Errorf("outage = %+v, want 5 minutes from the close", o)
+	}
+
+	// A resumed session missed nothing
+	g.noteEvent(&ws.CloseEvent{}, closed.Add(time.Hour))
+	g.noteEvent(&gateway.ResumedEvent{}, closed.Add(time.Hour+5*time.Minute))
+	if o, err := b.detectOutage(closed.Add(2 * time.Hour)); err != nil || o != nil {
+		t.Errorf("Ready after a resume = %+v, %v; want no outage", o, err)
+	}
+
+	// A restarted process starts from the last heartbeat
+	if err := b.saveHeartbeat(start.Add(-10 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewBot(b.Client, b.DB)
+	o, err = restarted.detectOutage(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil || o.Reason != outageOffline || o.Duration() != 10*time.Minute {
+		t.Errorf("outage after restart = %+v, want 10 minutes offline", o)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+const (
+	defaultGuildPurgeDays = 30
+	guildPurgeInterval    = time.Hour
+)
+
+// A table with per-server data and the SQL expression for a row's server
+type guildTable struct {
+	name   string
+	server string
+}
+
+// Every table purged with a server. Tables whose rows belong to another
+// table's row come first, so their parent is still there to match.
+var guildDataTables = []guildTable{
+	{"usage_event_roles", "(SELECT server_id FROM usage_events WHERE id = event_id)"},
+	{"emoji_poll_votes", "(SELECT server_id FROM emoji_polls WHERE id = poll_id)"},
+	{"emojis", "server_id"},
+	{"stickers", "server_id"},
+	{"usage_daily", "server_id"},
+	{"usage_events", "server_id"},
+	{"usage_rollups", "server_id"},
+	{"usage_role_rollups", "server_id"},
+	{"retention_state", "server_id"},
+	{"digests", "server_id"},
+	{"pruned_items", "server_id"},
+	{"emoji_polls", "server_id"},
+	{"backfill_channels", "server_id"},
+	{"backfill_jobs", "server_id"},
+	{"reaction_corrections", "server_id"},
+	{"reconcile_runs", "server_id"},
+	{"api_tokens", "server_id"},
+	{"dashboard_logins", "server_id"},
+	{"dashboard_sessions", "server_id"},
+	{"guild_settings", "server_id"},
+	{"guild_settings_audit", "server_id"},
+	{"channel_filters", "server_id"},
+	{"role_filters", "server_id"},
+	{"guild_secrets", "server_id"},
+}
+
+// Parse GUILD_PURGE_DAYS, the days a server's data is kept after the bot
+// leaves it. Empty means the default; 0 keeps the data.
+func parseGuildPurgeDays(s string) (int, error) {
+	if s == "" {
+		return defaultGuildPurgeDays, nil
+	}
+	days, err := strconv.Atoi(s)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("expected a number of days, got %q", s)
+	}
+	return days, nil
+}
+
+// Record that the bot is in a server, returning whether it had left it
+func (b *Bot) markGuildJoined(serverID int64, name string, at time.Time) (bool, error) {
+	res, err := b.DB.Exec("UPDATE guilds SET left_at = NULL WHERE server_id = ? AND left_at IS NOT NULL", serverID)
+	if err != nil {
+		return false, err
+	}
+	rejoined, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	_, err = b.DB.Exec(`
+		INSERT INTO guilds (server_id, name, joined_at) VALUES (?, ?, ?)
+		ON CONFLICT(server_id) DO UPDATE SET
+			name = excluded.name,
+			joined_at = COALESCE(joined_at, excluded.joined_at)`,
+		serverID, name, sqliteTime(at),
+	)
+	return rejoined > 0, err
+}
+
+// Record that the bot left a server. A server that already left keeps the
+// earlier time, so leaving again doesn't delay the purge.
+func (b *Bot) markGuildLeft(serverID int64, at time.Time) error {
+	_, err := b.DB.Exec(`
+		INSERT INTO guilds (server_id, left_at) VALUES (?, ?)
+		ON CONFLICT(server_id) DO UPDATE SET
+			left_at = COALESCE(left_at, excluded.left_at)`,
+		serverID, sqliteTime(at),
+	)
+	return err
+}
+
+// Mark servers with data that aren't in the Ready event's list as left, as
+// the bot was removed from them while offline
+func (b *Bot) markMissingGuildsLeft(present []int64, at time.Time) ([]int64, error) {
+	rows, err := b.DB.Query(`
+		SELECT server_id FROM guilds WHERE left_at IS NULL
+		UNION SELECT server_id FROM emojis
+		UNION SELECT server_id FROM stickers
+		UNION SELECT server_id FROM usage_daily
+		EXCEPT SELECT server_id FROM guilds WHERE left_at IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	var missing []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !slices.Contains(present, id) {
+			missing = append(missing, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range missing {
+		if err := b.markGuildLeft(id, at); err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// Handle the bot joining a server, or a server's data arriving after connecting
+func (b *Bot) handleGuildCreate(e *gateway.GuildCreateEvent) {
+	if e.Unavailable {
+		return
+	}
+	rejoined, err := b.markGuildJoined(int64(e.ID), e.Name, time.Now())
+	if err != nil {
+		gatewayLog.Error("Error recording server", idAttr("guild_id", int64(e.ID)), "err", err)
+		return
+	}
+	if rejoined {
+		gatewayLog.Info("Rejoined server, its data is kept", idAttr("guild_id", int64(e.ID)), "name", e.Name)
+	}
+}
+
+// Handle the bot being removed from a server. Unavailable servers are in an
+// outage and still have the bot.
+func (b *Bot) handleGuildDelete(e *gateway.GuildDeleteEvent) {
+	if e.Unavailable {
+		return
+	}
+	if err := b.markGuildLeft(int64(e.ID), time.Now()); err != nil {
+		gatewayLog.Error("Error recording server leave", idAttr("guild_id", int64(e.ID)), "err", err)
+		return
+	}
+	gatewayLog.Info("Removed from server, its data will be purged", idAttr("guild_id", int64(e.ID)))
+}
+
+// Check the servers listed on connecting against the servers with data
+func (b *Bot) handleReadyGuilds(e *gateway.ReadyEvent) {
+	present := make([]int64, len(e.Guilds))
+	for n, g := range e.Guilds {
+		present[n] = int64(g.ID)
+	}
+	missing, err := b.markMissingGuildsLeft(present, time.Now())
+	if err != nil {
+		gatewayLog.Error("Error checking for servers left while offline", "err", err)
+		return
+	}
+	for _, id := range missing {
+		gatewayLog.Info("Removed from server while offline, its data will be purged", idAttr("guild_id", id))
+	}
+}
+
+// Delete everything stored about a server the bot left before cutoff, and
+// record the purge. Returns whether it was purged and the rows deleted; a
+// server that was rejoined is kept.
+func (b *Bot) purgeGuild(serverID int64, cutoff, now time.Time) (bool, int64, error) {
+	var purged bool
+	var deleted int64
+	err := b.withTx(func(tx *sql.Tx) error {
+		var name string
+		var leftAt time.Time
+		err := tx.QueryRow("SELECT name, left_at FROM guilds WHERE server_id = ? AND left_at < ?", serverID, sqliteTime(cutoff)).Scan(&name, &leftAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, t := range guildDataTables {
+			res, err := tx.Exec("DELETE FROM "+t.name+" WHERE "+t.server+" = ?", serverID)
+			if err != nil {
+				return fmt.Errorf("failed to purge %s: %w", t.name, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		if _, err := tx.Exec("DELETE FROM guilds WHERE server_id = ?", serverID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO guild_purges (server_id, name, left_at, purged_at, rows_deleted) VALUES (?, ?, ?, ?, ?)",
+			serverID, name, sqliteTime(leftAt), sqliteTime(now), deleted,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record purge: %w", err)
+		}
+		purged = true
+		return nil
+	})
+	if err != nil || !purged {
+		return false, 0, err
+	}
+
+	if b.Images != nil {
+		if err := b.Images.ForgetServer(serverID); err != nil {
+			imageLog.Error("Error removing images of purged server", idAttr("guild_id", serverID), "err", err)
+		}
+	}
+	b.invalidateGuildSettings(serverID)
+	b.invalidateChannelFilters(serverID)
+	b.invalidateRoleFilters(serverID)
+	b.invalidatePseudonymKey(serverID)
+	b.emojiCacheMutex.Lock()
+	delete(b.emojiCache, discord.GuildID(serverID))
+	b.emojiCacheMutex.Unlock()
+	return true, deleted, nil
+}
+
+// Purge every server the bot left more than graceDays ago
+func (b *Bot) purgeLeftGuilds(now time.Time, graceDays int) (map[int64]int64, error) {
+	cutoff := now.AddDate(0, 0, -graceDays)
+	rows, err := b.DB.Query("SELECT server_id FROM guilds WHERE left_at < ?", sqliteTime(cutoff))
+	if err != nil {
+		return nil, err
+	}
+	var due []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	purged := make(map[int64]int64)
+	for _, id := range due {
+		ok, n, err := b.purgeGuild(id, cutoff, now)
+		if err != nil {
+			dataLog.Error("Error purging server data", idAttr("guild_id", id), "err", err)
+			continue
+		}
+		if ok {
+			dataLog.Info("Purged data of a server the bot left", idAttr("guild_id", id), "rows", n, "grace_days", graceDays)
+			purged[id] = n
+		}
+	}
+	return purged, nil
+}
+
+// Purge left servers once their grace period is over. graceDays 0 keeps
+// their data.
+func (b *Bot) runGuildPurgeScheduler(ctx context.Context, graceDays int) {
+	if graceDays == 0 {
+		return
+	}
+	ticker := time.NewTicker(guildPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := b.purgeLeftGuilds(time.Now(), graceDays); err != nil {
+			dataLog.Error("Error purging left servers", "err", err)
+		}
+	}
+}
+
+// A server with stored data, for operators
+type GuildInfo struct {
+	ServerID     int64
+	Name         string
+	Known        bool      // Whether the bot saw it join or leave
+	LeftAt       time.Time // Zero while the bot is in the server
+	Rows         int64
+	ImageBytes   int64
+	LastActivity time.Time
+}
+
+// Every server with stored data or a record, most rows first
+func (b *Bot) listGuilds() ([]GuildInfo, error) {
+	byID := make(map[int64]*GuildInfo)
+	get := func(id int64) *GuildInfo {
+		g, ok := byID[id]
+		if !ok {
+			g = &GuildInfo{ServerID: id}
+			byID[id] = g
+		}
+		return g
+	}
+
+	rows, err := b.DB.Query("SELECT server_id, name, COALESCE(left_at, '') FROM guilds")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var name, leftAt string
+		if err := rows.Scan(&id, &name, &leftAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g := get(id)
+		g.Name, g.Known = name, true
+		if leftAt != "" {
+			g.LeftAt, _ = time.Parse(sqliteTimeLayout, leftAt)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sums per server of a query returning server_id and a number
+	sum := func(query string, field func(*GuildInfo) *int64) error {
+		rows, err := b.DB.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, n int64
+			if err := rows.Scan(&id, &n); err != nil {
+				return err
+			}
+			*field(get(id)) += n
+		}
+		return rows.Err()
+	}
+	for _, t := range guildDataTables {
+		query := "SELECT sid, COUNT(*) FROM (SELECT " + t.server + " AS sid FROM " + t.name + ") WHERE sid IS NOT NULL GROUP BY sid"
+		if err := sum(query, func(g *GuildInfo) *int64 { return &g.Rows }); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", t.name, err)
+		}
+	}
+	if err := sum("SELECT server_id, SUM(size) FROM images GROUP BY server_id", func(g *GuildInfo) *int64 { return &g.ImageBytes }); err != nil {
+		return nil, fmt.Errorf("failed to size images: %w", err)
+	}
+
+	rows, err = b.DB.Query(`
+		SELECT server_id, MAX(last_used) FROM (
+			SELECT server_id, last_used FROM emojis
+			UNION ALL SELECT server_id, last_used FROM stickers
+		) GROUP BY server_id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var last string
+		if err := rows.Scan(&id, &last); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		get(id).LastActivity, _ = time.Parse(sqliteTimeLayout, last)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	guilds := make([]GuildInfo, 0, len(byID))
+	for _, g := range byID {
+		guilds = append(guilds, *g)
+	}
+	slices.SortFunc(guilds, func(a, b GuildInfo) int {
+		return cmp.Or(cmp.Compare(b.Rows, a.Rows), cmp.Compare(a.ServerID, b.ServerID))
+	})
+	return guilds, nil
+}
+
+func formatListTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func writeGuildList(w io.Writer, guilds []GuildInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GUILD\tNAME\tSTATUS\tROWS\tIMAGE BYTES\tLAST ACTIVITY")
+	for _, g := range guilds {
+		status := "active"
+		switch {
+		case !g.LeftAt.IsZero():
+			status = "left " + g.LeftAt.Format(time.DateOnly)
+		case !g.Known:
+			status = "unknown"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n", g.ServerID, g.Name, status, g.Rows, g.ImageBytes, formatListTime(g.LastActivity))
+	}
+	return tw.Flush()
+}
+
+// Write the purge log, oldest first
+func (b *Bot) writePurgeLog(w io.Writer) error {
+	rows, err := b.DB.Query("SELECT server_id, name, left_at, purged_at, rows_deleted FROM guild_purges ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GUILD\tNAME\tLEFT\tPURGED\tROWS")
+	for rows.Next() {
+		var id, deleted int64
+		var name string
+		var leftAt, purgedAt time.Time
+		if err := rows.Scan(&id, &name, &leftAt, &purgedAt, &deleted); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\n", id, name, formatListTime(leftAt), formatListTime(purgedAt), deleted)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// List servers with their data size and last activity, or the purge log
+func runGuildsCommand(args []string) error {
+	fs := flag.NewFlagSet("guilds", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the SQLite database")
+	purges := fs.Bool("purges", false, "show the log of purged servers instead")
+	fs.Parse(args)
+
+	b, err := newOfflineBot(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer b.DB.Close()
+
+	if *purges {
+		return b.writePurgeLog(os.Stdout)
+	}
+	guilds, err := b.listGuilds()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(*dbPath); err == nil {
+		fmt.Printf("%s: %d bytes, %d servers\n\n", *dbPath, info.Size(), len(guilds))
+	}
+	return writeGuildList(os.Stdout, guilds)
+}
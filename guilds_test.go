@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+const otherGuildID = discord.GuildID(1001)
+
+// Whether the test guild is recorded as left
+func (b *testBot) guildLeft() bool {
+	b.t.Helper()
+	var left bool
+	if err := b.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM guilds WHERE server_id = ? AND left_at IS NOT NULL)", int64(testGuildID)).Scan(&left); err != nil {
+		b.t.Fatal(err)
+	}
+	return left
+}
+
+func TestGuildLeaveAndPurge(t *testing.T) {
+	b := newTestBot(t)
+	m := b.message("<:wave:111>")
+	m.Member = withRoles(modRoleID)
+	other := b.message("<:wave:111>")
+	other.GuildID = otherGuildID
+	b.send(&gateway.GuildCreateEvent{Guild: discord.Guild{ID: testGuildID, Name: "test"}}, m, other)
+	b.configure("emoji_page_size", "10")
+
+	// An outage isn't a leave
+	b.send(&gateway.GuildDeleteEvent{ID: testGuildID, Unavailable: true})
+	if b.guildLeft() {
+		t.Fatal("unavailable guild marked as left")
+	}
+
+	b.send(&gateway.GuildDeleteEvent{ID: testGuildID})
+	if !b.guildLeft() {
+		t.Fatal("guild not marked as left")
+	}
+	now := time.Now()
+	if purged, err := b.purgeLeftGuilds(now.AddDate(0, 0, 29), 30); err != nil || len(purged) != 0 {
+		t.Fatalf("purged within the grace period: %v, %v", purged, err)
+	}
+
+	// Rejoining cancels the purge
+	b.send(&gateway.GuildCreateEvent{Guild: discord.Guild{ID: testGuildID, Name: "test"}})
+	if b.guildLeft() {
+		t.Fatal("rejoined guild still marked as left")
+	}
+	if purged, err := b.purgeLeftGuilds(now.AddDate(0, 0, 31), 30); err != nil || len(purged) != 0 {
+		t.Fatalf("purged a rejoined guild: %v, %v", purged, err)
+	}
+
+	b.send(&gateway.GuildDeleteEvent{ID: testGuildID})
+	purged, err := b.purgeLeftGuilds(now.AddDate(0, 0, 31), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged[int64(testGuildID)] == 0 {
+		t.Fatalf("purged = %v, want the test guild", purged)
+	}
+	for _, table := range []string{"emojis", "usage_daily", "usage_events", "guild_settings", "guild_settings_audit", "guilds"} {
+		if got := b.rows(table); got != 0 {
+			t.Errorf("%s rows after purge = %d, want 0", table, got)
+		}
+	}
+	if got := b.getGuildSettings(int64(testGuildID)).EmojiPageSize; got != 25 {
+		t.Errorf("cached page size after purge = %d, want the default", got)
+	}
+	var roles, otherEmojis int
+	b.DB.QueryRow("SELECT COUNT(*) FROM usage_event_roles").Scan(&roles)
+	b.DB.QueryRow("SELECT COUNT(*) FROM emojis WHERE server_id = ?", int64(otherGuildID)).Scan(&otherEmojis)
+	if roles != 0 || otherEmojis != 1 {
+		t.Errorf("event roles = %d, other guild's emojis = %d; want 0 and 1", roles, otherEmojis)
+	}
+
+	var log strings.Builder
+	if err := b.writePurgeLog(&log); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(log.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(strings.Join(strings.Fields(lines[1]), " "), "1000 test ") {
+		t.Errorf("purge log = %q, want the test guild", log.String())
+	}
+}
+
+func TestReadyMarksMissingGuildsLeft(t *testing.T) {
+	b := newTestBot(t)
+	other := b.message("<:wave:111>")
+	other.GuildID = otherGuildID
+	b.send(b.message("<:wave:111>"), other)
+
+	b.send(&gateway.ReadyEvent{
+		User:   discord.User{ID: testBotUserID, Username: "emote_keeper"},
+		Guilds: []gateway.GuildCreateEvent{{Guild: discord.Guild{ID: otherGuildID}, Unavailable: true}},
+	})
+	if !b.guildLeft() {
+		t.Error("guild missing from Ready not marked as left")
+	}
+	var left bool
+	b.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM guilds WHERE server_id = ? AND left_at IS NOT NULL)", int64(otherGuildID)).Scan(&left)
+	if left {
+		t.Error("guild listed in Ready marked as left")
+	}
+}
+
+func TestGuildList(t *testing.T) {
+	b := newTestBot(t)
+	b.send(&gateway.GuildCreateEvent{Guild: discord.Guild{ID: testGuildID, Name: "test"}})
+	b.send(b.message("<:wave:111> <:cat:112>"))
+	other := b.message("<:wave:111>")
+	other.GuildID = otherGuildID
+	b.send(other, &gateway.GuildDeleteEvent{ID: otherGuildID})
+
+	guilds, err := b.listGuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(guilds) != 2 || guilds[0].ServerID != int64(testGuildID) || guilds[0].Name != "test" {
+		t.Fatalf("guilds = %+v, want the test guild first", guilds)
+	}
+	// 2 emojis, their daily usage and 2 events
+	if g := guilds[0]; g.Rows != 6 || g.LastActivity.IsZero() || !g.LeftAt.IsZero() {
+		t.Errorf("test guild = %+v", g)
+	}
+	if g := guilds[1]; g.Rows != 3 || g.LeftAt.IsZero() {
+		t.Errorf("other guild = %+v, want left with 3 rows", g)
+	}
+
+	var out strings.Builder
+	if err := writeGuildList(&out, guilds); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "active") || !strings.Contains(out.String(), "left "+time.Now().UTC().Format(time.DateOnly)) {
+		t.Errorf("guild list = %q", out.String())
+	}
+}
+
+// A new table with per-server data must be purged with its server
+func TestGuildDataTablesComplete(t *testing.T) {
+	b := newTestBot(t)
+	kept := map[string]bool{"guilds": true, "guild_purges": true, "images": true}
+	for _, gt := range guildDataTables {
+		kept[gt.name] = true
+	}
+	rows, err := b.DB.Query("SELECT m.name FROM sqlite_master m JOIN pragma_table_info(m.name) c WHERE m.type = 'table' AND c.name = 'server_id'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if !kept[name] {
+			t.Errorf("table %s has server_id but isn't purged", name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/ws"
+)
+
+const (
+	// More disconnects than this within stormWindow mark the bot as not ready
+	stormDisconnects = 5
+	stormWindow      = 5 * time.Minute
+	// Unhealthy when the gateway has been down this long, so the container is restarted
+	gatewayStuckAfter = 5 * time.Minute
+)
+
+// Gateway connection states
+const (
+	gatewayConnecting   = "connecting"
+	gatewayConnected    = "connected"
+	gatewayDisconnected = "disconnected"
+)
+
+// What /healthz and /readyz report, updated by the gateway handler and database writes
+type healthState struct {
+	mu           sync.Mutex
+	gateway      string
+	gatewaySince time.Time
+	lastEvent    time.Time
+	disconnects  []time.Time
+	lastDBWrite  time.Time
+	lastDBError  time.Time
+	dbVersion    int
+	migrating    bool
+	dbReady      bool
+}
+
+// Update the gateway state from an event
+func (h *healthState) noteEvent(e gateway.Event, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch e.(type) {
+	case *gateway.ReadyEvent, *gateway.ResumedEvent:
+		h.setGateway(gatewayConnected, now)
+	case *ws.CloseEvent:
+		h.setGateway(gatewayDisconnected, now)
+		h.disconnects = append(h.recentDisconnects(now), now)
+		return
+	}
+	h.lastEvent = now
+}
+
+func (h *healthState) setGateway(state string, now time.Time) {
+	if h.gateway != state {
+		h.gateway = state
+		h.gatewaySince = now
+	}
+}
+
+// Disconnects within stormWindow of now. Callers hold mu.
+func (h *healthState) recentDisconnects(now time.Time) []time.Time {
+	i := 0
+	for i < len(h.disconnects) && now.Sub(h.disconnects[i]) > stormWindow {
+		i++
+	}
+	return h.disconnects[i:]
+}
+
+func (h *healthState) noteDBWrite(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastDBError = time.Now()
+	} else {
+		h.lastDBWrite = time.Now()
+	}
+}
+
+// Record the schema version, and whether migrations are still being applied
+func (h *healthState) noteMigration(version int, migrating bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dbVersion = version
+	h.migrating = migrating
+	if !migrating {
+		h.dbReady = true
+	}
+}
+
+// Whether the database is open and fully migrated
+func (h *healthState) DBReady() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dbReady
+}
+
+type gatewayHealth struct {
+	State       string     `json:"state"`
+	Since       time.Time  `json:"since"`
+	LastEvent   *time.Time `json:"last_event"`
+	Disconnects int        `json:"recent_disconnects"`
+}
+
+type databaseHealth struct {
+	LastWrite       *time.Time `json:"last_write"`
+	LastError       *time.Time `json:"last_error"`
+	Version         int        `json:"migration_version"`
+	LatestMigration int        `json:"latest_migration"`
+	Migrating       bool       `json:"migrating"`
+}
+
+type healthReport struct {
+	Status   string         `json:"status"`
+	Problems []string       `json:"problems"`
+	Gateway  gatewayHealth  `json:"gateway"`
+	Database databaseHealth `json:"database"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// Snapshot the state, listing why the bot is unhealthy (live) or not ready
+func (h *healthState) report(now time.Time) (r healthReport, live, ready []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	disconnects := len(h.recentDisconnects(now))
+	r.Gateway = gatewayHealth{
+		State:       h.gateway,
+		Since:       h.gatewaySince.UTC(),
+		LastEvent:   optionalTime(h.lastEvent),
+		Disconnects: disconnects,
+	}
+	r.Database = databaseHealth{
+		LastWrite:       optionalTime(h.lastDBWrite),
+		LastError:       optionalTime(h.lastDBError),
+		Version:         h.dbVersion,
+		LatestMigration: migrations[len(migrations)-1].version,
+		Migrating:       h.migrating,
+	}
+
+	if h.gateway != gatewayConnected && now.Sub(h.gatewaySince) > gatewayStuckAfter {
+		live = append(live, "gateway has been "+h.gateway+" since "+h.gatewaySince.UTC().Format(time.RFC3339))
+	}
+	ready = append(ready, live...)
+	if h.migrating {
+		ready = append(ready, "database migrations are running")
+	} else if !h.dbReady {
+		ready = append(ready, "database is not open")
+	}
+	if h.lastDBError.After(h.lastDBWrite) {
+		ready = append(ready, "last database write failed")
+	}
+	if h.gateway != gatewayConnected {
+		ready = append(ready, "gateway is "+h.gateway)
+	}
+	if disconnects > stormDisconnects {
+		ready = append(ready, "gateway is reconnecting repeatedly")
+	}
+	return r, live, ready
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, report healthReport, problems []string) {
+	report.Status = "ok"
+	report.Problems = append([]string{}, problems...)
+	status := http.StatusOK
+	if len(problems) > 0 {
+		report.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, status, report)
+}
+
+// GET /healthz: fails only when restarting would help
+func (b *Bot) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report, live, _ := b.health.report(time.Now())
+	writeHealth(w, r, report, live)
+}
+
+// GET /readyz: fails while the bot can't record usage or serve consistent data
+func (b *Bot) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report, _, ready := b.health.report(time.Now())
+	writeHealth(w, r, report, ready)
+}
+
+// Answer 503 on routes that need the database until it is migrated
+func (b *Bot) requireDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.health.DBReady() {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "starting up", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
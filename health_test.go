@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/ws"
+)
+
+func TestHealthReport(t *testing.T) {
+	now := time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)
+	connected := func(h *healthState) {
+		h.noteMigration(1, false)
+		h.noteEvent(&gateway.ReadyEvent{}, now.Add(-time.Hour))
+	}
+
+	tests := []struct {
+		name  string
+		setup func(h *healthState)
+		// Problems the report must list, matched by substring
+		wantLive  []string
+		wantReady []string
+	}{
+		{
+			name:  "healthy",
+			setup: connected,
+		},
+		{
+			name:      "starting up",
+			setup:     func(h *healthState) {},
+			wantReady: []string{"database is not open", "gateway is connecting"},
+		},
+		{
+			name: "migrating",
+			setup: func(h *healthState) {
+				connected(h)
+				h.noteMigration(1, true)
+			},
+			wantReady: []string{"database migrations are running"},
+		},
+		{
+			name: "reconnect storm",
+			setup: func(h *healthState) {
+				connected(h)
+				for n := range stormDisconnects + 1 {
+					at := now.Add(-time.Duration(n+1) * time.Second)
+					h.noteEvent(&ws.CloseEvent{}, at)
+					h.noteEvent(&gateway.ResumedEvent{}, at)
+				}
+			},
+			wantReady: []string{"gateway is reconnecting repeatedly"},
+		},
+		{
+			name: "disconnects outside the storm window",
+			setup: func(h *healthState) {
+				connected(h)
+				for n := range stormDisconnects + 1 {
+					at := now.Add(-stormWindow - time.Duration(n+1)*time.Second)
+					h.noteEvent(&ws.CloseEvent{}, at)
+					h.noteEvent(&gateway.ResumedEvent{}, at)
+				}
+			},
+		},
+		{
+			name: "last database write failed",
+			setup: func(h *healthState) {
+				connected(h)
+				h.lastDBWrite = now.Add(-time.Minute)
+				h.lastDBError = now.Add(-time.Second)
+			},
+			wantReady: []string{"last database write failed"},
+		},
+		{
+			name: "database write recovered",
+			setup: func(h *healthState) {
+				connected(h)
+				h.lastDBError = now.Add(-time.Minute)
+				h.lastDBWrite = now.Add(-time.Second)
+			},
+		},
+		{
+			name: "briefly disconnected",
+			setup: func(h *healthState) {
+				connected(h)
+				h.noteEvent(&ws.CloseEvent{}, now.Add(-time.Minute))
+			},
+			wantReady: []string{"gateway is disconnected"},
+		},
+		{
+			name: "stuck gateway",
+			setup: func(h *healthState) {
+				connected(h)
+				h.noteEvent(&ws.CloseEvent{}, now.Add(-gatewayStuckAfter-time.Second))
+			},
+			wantLive:  []string{"gateway has been disconnected since"},
+			wantReady: []string{"gateway has been disconnected since", "gateway is disconnected"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &healthState{gateway: gatewayConnecting, gatewaySince: now.Add(-time.Minute)}
+			tt.setup(h)
+			_, live, ready := h.report(now)
+			checkProblems(t, "live", live, tt.wantLive)
+			checkProblems(t, "ready", ready, tt.wantReady)
+		})
+	}
+}
+
+// Problems must match the wanted substrings one for one
+func checkProblems(t *testing.T, kind string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s problems = %q, want %q", kind, got, want)
+		return
+	}
+	for n := range want {
+		if !strings.Contains(got[n], want[n]) {
+			t.Errorf("%s problems = %q, want %q", kind, got, want)
+			return
+		}
+	}
+}
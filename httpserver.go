@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// Build the handler for every HTTP endpoint
+func (b *Bot) newHTTPHandler() http.Handler {
+	app := http.NewServeMux()
+	b.registerAPIRoutes(app)
+	b.registerDashboardRoutes(app)
+	app.HandleFunc("GET /metrics", b.handleMetrics)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", b.handleHealthz)
+	mux.HandleFunc("GET /readyz", b.handleReadyz)
+	mux.Handle("/", b.requireDB(app))
+	return mux
+}
+
+// Serve HTTP on addr until the context is cancelled
+func (b *Bot) runHTTPServer(ctx context.Context, addr string) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           b.newHTTPHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			httpLog.Error("Error shutting down HTTP server", "err", err)
+		}
+	}()
+
+	httpLog.Info("HTTP server listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		httpLog.Error("HTTP server failed", "err", err)
+	}
+}
+
+// Write v as JSON with an ETag, answering 304 when the client already has it
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		httpLog.Error("Error encoding JSON response", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if status == http.StatusOK {
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeJSON(w, r, status, map[string]string{"error": message})
+}
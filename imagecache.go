@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+const (
+	imageCacheDir           = "./image_cache"
+	defaultMaxImageBytes    = 1 << 20   // 1 MiB, larger than any emoji or sticker Discord accepts
+	defaultMaxImageCacheLen = 256 << 20 // 256 MiB across all cached images
+	// Time allowed to cache the images of a server's new emojis
+	emojiImagePrefetchTimeout = 2 * time.Minute
+)
+
+var errDownloadTooLarge = errors.New("download exceeds size limit")
+
+// ImageFetcher downloads an image. Tests can point it at a local server.
+type ImageFetcher interface {
+	Fetch(ctx context.Context, url string, maxBytes int64) (data []byte, contentType string, err error)
+}
+
+// HTTP implementation of ImageFetcher
+type httpImageFetcher struct {
+	client *http.Client
+}
+
+func newHTTPImageFetcher() *httpImageFetcher {
+	return &httpImageFetcher{client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (f *httpImageFetcher) Fetch(ctx context.Context, url string, maxBytes int64) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s fetching %s", resp.Status, url)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, "", errDownloadTooLarge
+	}
+
+	// Read one byte past the limit to detect oversized bodies without a Content-Length
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", errDownloadTooLarge
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
+
+// Content-addressed image cache. Files are stored by SHA-256 of their bytes,
+// and the images table maps emoji/sticker IDs to those hashes.
+type ImageCache struct {
+	db            *sql.DB
+	dir           string
+	fetcher       ImageFetcher
+	maxImageBytes int64
+	maxTotalBytes int64
+	mu            sync.Mutex
+	// Fetches in progress by kind and item ID, so concurrent misses download once
+	fetching map[string]*imageFetch
+}
+
+// A download other callers can wait for
+type imageFetch struct {
+	done  chan struct{}
+	image *CachedImage
+	err   error
+}
+
+// Cached image for an emoji or sticker
+type CachedImage struct {
+	Data        []byte
+	ContentType string
+	Hash        string
+}
+
+func NewImageCache(db *sql.DB, dir string, fetcher ImageFetcher, maxImageBytes, maxTotalBytes int64) (*ImageCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+	return &ImageCache{
+		db:            db,
+		dir:           dir,
+		fetcher:       fetcher,
+		maxImageBytes: maxImageBytes,
+		maxTotalBytes: maxTotalBytes,
+		fetching:      make(map[string]*imageFetch),
+	}, nil
+}
+
+// CDN URL for a custom emoji image
+func emojiImageURL(emojiID int64, animated bool) string {
+	return discord.Emoji{ID: discord.EmojiID(emojiID), Animated: animated}.EmojiURL()
+}
+
+// CDN URL for a sticker image
+func stickerImageURL(stickerID int64) string {
+	return fmt.Sprintf("https://media.discordapp.net/stickers/%d.webp?size=96&quality=lossless", stickerID)
+}
+
+func (c *ImageCache) blobPath(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash)
+}
+
+// Get emoji image, fetching it on a cache miss
+func (c *ImageCache) EmojiImage(ctx context.Context, serverID int64, e EmojiData) (*CachedImage, error) {
+	return c.get(ctx, kindEmoji, serverID, e.ID, e.Name, emojiImageURL(e.ID, e.Animated))
+}
+
+// Get sticker image, fetching it on a cache miss
+func (c *ImageCache) StickerImage(ctx context.Context, serverID int64, s StickerData) (*CachedImage, error) {
+	return c.get(ctx, kindSticker, serverID, s.ID, s.Name, stickerImageURL(s.ID))
+}
+
+// Download a file such as a command's attachment with the cache's fetcher,
+// without caching it. Files over maxBytes fail with errDownloadTooLarge.
+func (c *ImageCache) Download(ctx context.Context, url string, maxBytes int64) ([]byte, string, error) {
+	return c.fetcher.Fetch(ctx, url, maxBytes)
+}
+
+// Fetch the images of emojis that aren't cached yet, while the CDN still serves
+// them, so the images outlive the emojis. Stops at the first failed fetch.
+func (c *ImageCache) CacheEmojis(ctx context.Context, serverID int64, emojis []discord.Emoji) error {
+	c.mu.Lock()
+	rows, err := c.db.Query("SELECT item_id FROM images WHERE kind = ? AND server_id = ?", kindEmoji, serverID)
+	if err != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("failed to list cached emoji images: %w", err)
+	}
+	cached := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			c.mu.Unlock()
+			return err
+		}
+		cached[id] = true
+	}
+	rows.Close()
+	c.mu.Unlock()
+
+	for _, e := range emojis {
+		if cached[int64(e.ID)] {
+			continue
+		}
+		if _, err := c.EmojiImage(ctx, serverID, EmojiData{Name: e.Name, ID: int64(e.ID), Animated: e.Animated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get an image from the cache or fetch it. The lock is only held around the
+// database and files, never during the download.
+func (c *ImageCache) get(ctx context.Context, kind string, serverID, itemID int64, name, url string) (*CachedImage, error) {
+	c.mu.Lock()
+	image, err := c.lookup(kind, itemID)
+	if image != nil || err != nil {
+		c.mu.Unlock()
+		return image, err
+	}
+	key := fmt.Sprintf("%s:%d", kind, itemID)
+	if f, ok := c.fetching[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.image, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &imageFetch{done: make(chan struct{})}
+	c.fetching[key] = f
+	c.mu.Unlock()
+
+	data, contentType, err := c.fetcher.Fetch(ctx, url, c.maxImageBytes)
+	if err != nil {
+		f.err = fmt.Errorf("failed to fetch %s %d: %w", kind, itemID, err)
+	}
+
+	c.mu.Lock()
+	if f.err == nil {
+		f.image, f.err = c.store(kind, serverID, itemID, name, data, contentType)
+	}
+	delete(c.fetching, key)
+	c.mu.Unlock()
+	close(f.done)
+	return f.image, f.err
+}
+
+// Cached image, or nil on a miss. Must be called with c.mu held.
+func (c *ImageCache) lookup(kind string, itemID int64) (*CachedImage, error) {
+	var hash, contentType string
+	err := c.db.QueryRow("SELECT hash, content_type FROM images WHERE kind = ? AND item_id = ?", kind, itemID).Scan(&hash, &contentType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up cached image: %w", err)
+	}
+	data, err := os.ReadFile(c.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		// Row without a file, fetch again
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached image: %w", err)
+	}
+	if _, err := c.db.Exec("UPDATE images SET last_accessed = CURRENT_TIMESTAMP WHERE kind = ? AND item_id = ?", kind, itemID); err != nil {
+		imageLog.Error("Error updating image access time", "kind", kind, idAttr("item_id", itemID), "err", err)
+	}
+	return &CachedImage{Data: data, ContentType: contentType, Hash: hash}, nil
+}
+
+// Save a fetched image and evict others to make room. Must be called with c.mu held.
+func (c *ImageCache) store(kind string, serverID, itemID int64, name string, data []byte, contentType string) (*CachedImage, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if err := c.writeBlob(hash, data); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO images (kind, item_id, server_id, name, hash, content_type, size)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(kind, item_id) DO UPDATE SET
+			name = excluded.name,
+			hash = excluded.hash,
+			content_type = excluded.content_type,
+			size = excluded.size,
+			fetched_at = CURRENT_TIMESTAMP,
+			last_accessed = CURRENT_TIMESTAMP
+	`
+	if _, err := c.db.Exec(query, kind, itemID, serverID, name, hash, contentType, len(data)); err != nil {
+		return nil, fmt.Errorf("failed to record cached image: %w", err)
+	}
+
+	if err := c.evict(); err != nil {
+		imageLog.Error("Error evicting cached images", "err", err)
+	}
+
+	return &CachedImage{Data: data, ContentType: contentType, Hash: hash}, nil
+}
+
+func (c *ImageCache) writeBlob(hash string, data []byte) error {
+	path := c.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create image directory: %w", err)
+	}
+
+	// Write to a temp file first so a crash never leaves a truncated blob under its hash
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write image file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write image file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to store image file: %w", err)
+	}
+	return nil
+}
+
+// Mark an image as retained so eviction never removes it
+func (c *ImageCache) Retain(kind string, itemID int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec("UPDATE images SET retained = TRUE WHERE kind = ? AND item_id = ?", kind, itemID)
+	return err
+}
+
+// Mark images of emojis that are no longer in the guild as retained so
+// eviction never removes them and historical reports still render
+func (c *ImageCache) RetainDeletedEmojis(serverID int64, liveEmojis []discord.Emoji) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	live := make(map[int64]bool, len(liveEmojis))
+	for _, e := range liveEmojis {
+		live[int64(e.ID)] = true
+	}
+
+	rows, err := c.db.Query("SELECT item_id FROM images WHERE kind = ? AND server_id = ? AND retained = FALSE", kindEmoji, serverID)
+	if err != nil {
+		return fmt.Errorf("failed to list cached emoji images: %w", err)
+	}
+	var deleted []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if !live[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range deleted {
+		if _, err := c.db.Exec("UPDATE images SET retained = TRUE WHERE kind = ? AND item_id = ?", kindEmoji, id); err != nil {
+			return fmt.Errorf("failed to retain emoji image %d: %w", id, err)
+		}
+		imageLog.Info("Retaining image of deleted emoji", idAttr("guild_id", serverID), idAttr("emoji_id", id))
+	}
+	return nil
+}
+
+// Bytes stored on disk. Blobs are shared between rows with the same hash, so each hash is sized once.
+func (c *ImageCache) TotalBytes() (int64, error) {
+	var total int64
+	err := c.db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM (SELECT hash, MAX(size) AS size FROM images GROUP BY hash)").Scan(&total)
+	return total, err
+}
+
+// Remove least recently used, non-retained images until the cache fits its size limit.
+// Must be called with c.mu held.
+func (c *ImageCache) evict() error {
+	total, err := c.TotalBytes()
+	if err != nil {
+		return err
+	}
+	if total <= c.maxTotalBytes {
+		return nil
+	}
+
+	rows, err := c.db.Query(`
+		SELECT hash, MAX(size) FROM images
+		GROUP BY hash
+		HAVING MAX(retained) = FALSE
+		ORDER BY MAX(last_accessed) ASC
+	`)
+	if err != nil {
+		return err
+	}
+	var victims []string
+	for rows.Next() && total > c.maxTotalBytes {
+		var hash string
+		var size int64
+		if err := rows.Scan(&hash, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		victims = append(victims, hash)
+		total -= size
+	}
+	rows.Close()
+
+	for _, hash := range victims {
+		if _, err := c.db.Exec("DELETE FROM images WHERE hash = ?", hash); err != nil {
+			return err
+		}
+		if err := os.Remove(c.blobPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			imageLog.Error("Error removing cached image", "hash", hash, "err", err)
+		}
+	}
+	return nil
+}
+
+// Remove a server's images, including retained ones, and the files no other
+// server's images share
+func (c *ImageCache) ForgetServer(serverID int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rows, err := c.db.Query("SELECT DISTINCT hash FROM images WHERE server_id = ?", serverID)
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := c.db.Exec("DELETE FROM images WHERE server_id = ?", serverID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		var shared bool
+		if err := c.db.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE hash = ?)", hash).Scan(&shared); err != nil {
+			return err
+		}
+		if shared {
+			continue
+		}
+		if err := os.Remove(c.blobPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			imageLog.Error("Error removing cached image", "hash", hash, "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// Image server answering "image <file>" for any path, counting requests
+type imageServer struct {
+	*httptest.Server
+	requests atomic.Int32
+	// Closed to let requests through; nil answers right away
+	release chan struct{}
+}
+
+func newImageServer(t *testing.T) *imageServer {
+	t.Helper()
+	s := &imageServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if s.release != nil {
+			<-s.release
+		}
+		switch file := path.Base(r.URL.Path); file {
+		case "missing":
+			http.NotFound(w, r)
+		case "unsized":
+			// Flushing first sends the body without a Content-Length
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("x", 64)))
+		case "untyped":
+			w.Header()["Content-Type"] = nil
+			w.Write([]byte("GIF89a"))
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("image " + file))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Sends every request to the server, whatever its host
+type serverTransport struct {
+	target *url.URL
+}
+
+func (t serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Image cache of a test bot's database, fetching from the server
+func newTestImageCache(t *testing.T, b *testBot, s *imageServer, maxTotalBytes int64) *ImageCache {
+	t.Helper()
+	target, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &httpImageFetcher{client: &http.Client{Transport: serverTransport{target}}}
+	c, err := NewImageCache(b.DB, t.TempDir(), fetcher, 32, maxTotalBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestHTTPImageFetcher(t *testing.T) {
+	s := newImageServer(t)
+	tests := []struct {
+		file            string
+		maxBytes        int64
+		wantData        string
+		wantContentType string
+		wantErr         error
+	}{
+		{file: "a.png", maxBytes: 32, wantData: "image a.png", wantContentType: "image/png"},
+		{file: "untyped", maxBytes: 32, wantData: "GIF89a", wantContentType: "image/gif"},
+		{file: "a.png", maxBytes: 5, wantErr: errDownloadTooLarge},
+		{file: "unsized", maxBytes: 32, wantErr: errDownloadTooLarge},
+		{file: "unsized", maxBytes: 64, wantData: strings.Repeat("x", 64), wantContentType: "text/plain; charset=utf-8"},
+		{file: "missing", maxBytes: 32},
+	}
+	fetcher := newHTTPImageFetcher()
+	for _, tt := range tests {
+		data, contentType, err := fetcher.Fetch(context.Background(), s.URL+"/"+tt.file, tt.maxBytes)
+		if tt.wantData == "" {
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("%s within %d bytes: err = %v, want %v", tt.file, tt.maxBytes, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.wantData || contentType != tt.wantContentType {
+			t.Errorf("%s within %d bytes = %q, %q, %v; want %q, %q", tt.file, tt.maxBytes, data, contentType, err, tt.wantData, tt.wantContentType)
+		}
+	}
+}
+
+func TestImageCacheFetchesOnce(t *testing.T) {
+	b := newTestBot(t)
+	s := newImageServer(t)
+	s.release = make(chan struct{})
+	c := newTestImageCache(t, b, s, defaultMaxImageCacheLen)
+	wave := EmojiData{ID: 111, Name: "wave"}
+
+	// Concurrent misses share one download
+	var wg sync.WaitGroup
+	images := make([]*CachedImage, 4)
+	errs := make([]error, len(images))
+	for n := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			images[n], errs[n] = c.EmojiImage(context.Background(), int64(testGuildID), wave)
+		}()
+	}
+	for s.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The cache isn't locked during the download
+	retained := make(chan error)
+	go func() { retained <- c.Retain(kindEmoji, 112) }()
+	select {
+	case err := <-retained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(s.release)
+		t.Fatal("cache locked during a download")
+	}
+	close(s.release)
+	wg.Wait()
+	for n := range images {
+		if errs[n] != nil || string(images[n].Data) != "image 111.png" {
+			t.Fatalf("image %d = %+v, %v", n, images[n], errs[n])
+		}
+	}
+
+	image, err := c.EmojiImage(context.Background(), int64(testGuildID), wave)
+	if err != nil || image.Hash != images[0].Hash || image.ContentType != "image/png" {
+		t.Errorf("cached image = %+v, %v", image, err)
+	}
+	if got := s.requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
+
+// Fetch an emoji image into the cache, or fail the test
+func cacheEmoji(t *testing.T, c *ImageCache, serverID discord.GuildID, id int64) *CachedImage {
+	t.Helper()
+	image, err := c.EmojiImage(context.Background(), int64(serverID), EmojiData{ID: id, Name: "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// Make an image the least recently used
+func touchImageLongAgo(t *testing.T, b *testBot, id int64) {
+	t.Helper()
+	if _, err := b.DB.Exec("UPDATE images SET last_accessed = '2020-01-01 00:00:00' WHERE item_id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageCacheEviction(t *testing.T) {
+	b := newTestBot(t)
+	// Room for two of the 13 byte images
+	c := newTestImageCache(t, b, newImageServer(t), 30)
+
+	first := cacheEmoji(t, c, testGuildID, 111)
+	cacheEmoji(t, c, testGuildID, 112)
+	touchImageLongAgo(t, b, 111)
+	cacheEmoji(t, c, testGuildID, 113)
+	if _, err := os.Stat(c.blobPath(first.Hash)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("least recently used image file still stored: %v", err)
+	}
+
+	// Retained images stay however old
+	if err := c.Retain(kindEmoji, 112); err != nil {
+		t.Fatal(err)
+	}
+	touchImageLongAgo(t, b, 112)
+	touchImageLongAgo(t, b, 113)
+	cacheEmoji(t, c, testGuildID, 114)
+	var ids []int64
+	rows, err := b.DB.Query("SELECT item_id FROM images ORDER BY item_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	if len(ids) != 2 || ids[0] != 112 || ids[1] != 114 {
+		t.Errorf("cached images = %v, want 112 (retained) and 114", ids)
+	}
+	if total, err := c.TotalBytes(); err != nil || total != 26 {
+		t.Errorf("total bytes = %d, %v; want 26", total, err)
+	}
+}
+
+func TestImageCacheSizeLimit(t *testing.T) {
+	b := newTestBot(t)
+	s := newImageServer(t)
+	c := newTestImageCache(t, b, s, defaultMaxImageCacheLen)
+	c.maxImageBytes = 5
+	if _, err := c.EmojiImage(context.Background(), int64(testGuildID), EmojiData{ID: 111}); !errors.Is(err, errDownloadTooLarge) {
+		t.Errorf("oversized image err = %v, want errDownloadTooLarge", err)
+	}
+	if got := b.rows("images"); got != 0 {
+		t.Errorf("cached %d oversized images", got)
+	}
+}
+
+func TestRetainDeletedEmojis(t *testing.T) {
+	b := newTestBot(t)
+	c := newTestImageCache(t, b, newImageServer(t), defaultMaxImageCacheLen)
+	cacheEmoji(t, c, testGuildID, 111)
+	cacheEmoji(t, c, testGuildID, 112)
+	cacheEmoji(t, c, otherGuildID, 113)
+
+	if err := c.RetainDeletedEmojis(int64(testGuildID), []discord.Emoji{{ID: 111}}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int64]bool{111: false, 112: true, 113: false} {
+		var retained bool
+		if err := b.DB.QueryRow("SELECT retained FROM images WHERE item_id = ?", id).Scan(&retained); err != nil {
+			t.Fatal(err)
+		}
+		if retained != want {
+			t.Errorf("emoji %d retained = %v, want %v", id, retained, want)
+		}
+	}
+}
+
+func TestCacheEmojis(t *testing.T) {
+	b := newTestBot(t)
+	s := newImageServer(t)
+	c := newTestImageCache(t, b, s, defaultMaxImageCacheLen)
+	cacheEmoji(t, c, testGuildID, 111)
+
+	// Only emojis missing from the cache are fetched
+	if err := c.CacheEmojis(context.Background(), int64(testGuildID), []discord.Emoji{{ID: 111}, {ID: 112, Name: "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+	if got := b.rows("images"); got != 2 {
+		t.Errorf("cached %d images, want 2", got)
+	}
+}
+
+// Images of added emojis are cached, so they can be archived after the emoji is deleted
+func TestEmojisUpdateCachesImages(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.Files[emojiImageURL(111, false)] = testPNG
+	b.send(&gateway.GuildEmojisUpdateEvent{GuildID: testGuildID, Emojis: []discord.Emoji{{ID: 111, Name: "wave"}}})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.rows("images") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("new emoji's image was never cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.send(&gateway.GuildEmojisUpdateEvent{GuildID: testGuildID})
+	var retained bool
+	if err := b.DB.QueryRow("SELECT retained FROM images WHERE item_id = 111").Scan(&retained); err != nil {
+		t.Fatal(err)
+	}
+	if !retained {
+		t.Error("image of the deleted emoji wasn't retained")
+	}
+}
@@ -0,0 +1,841 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/joho/godotenv"
+)
+
+// Merge strategies for imported counts
+const (
+	importStrategyAdd     = "add"
+	importStrategyReplace = "replace"
+	importStrategyMax     = "max"
+)
+
+const (
+	maxImportBytes   = 25 << 20
+	importDiffLines  = 20
+	pendingImportTTL = 15 * time.Minute
+)
+
+// Fields a mapping can assign a column to
+var importFields = []string{"id", "count", "name", "animated", "kind", "first_used", "last_used", "server_id"}
+
+// Column mappings for our own export files
+var (
+	emojiExportMapping   = importMapping{"id": "emote_id", "count": "usage_count", "name": "emote_name", "animated": "animated", "first_used": "first_used", "last_used": "last_used", "server_id": "server_id"}
+	stickerExportMapping = importMapping{"id": "sticker_id", "count": "usage_count", "name": "sticker_name", "first_used": "first_used", "last_used": "last_used", "server_id": "server_id"}
+)
+
+// Maps import fields to source column names
+type importMapping map[string]string
+
+// Parse a mapping like "id=Emoji ID,count=Uses,name=Name"
+func parseImportMapping(spec string) (importMapping, error) {
+	m := make(importMapping)
+	for _, pair := range strings.Split(spec, ",") {
+		field, column, ok := strings.Cut(pair, "=")
+		field = strings.TrimSpace(strings.ToLower(field))
+		column = strings.TrimSpace(column)
+		if !ok || column == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected field=column", pair)
+		}
+		known := false
+		for _, f := range importFields {
+			known = known || f == field
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown mapping field %q (known: %s)", field, strings.Join(importFields, ", "))
+		}
+		m[field] = column
+	}
+	if m["id"] == "" || m["count"] == "" {
+		return nil, fmt.Errorf("mapping must include id and count")
+	}
+	return m, nil
+}
+
+// One emoji or sticker count read from an import file
+type ImportRow struct {
+	Line      int
+	Kind      string
+	ID        int64
+	Name      string
+	Animated  bool
+	Count     int
+	FirstUsed time.Time
+	LastUsed  time.Time
+}
+
+// Row left out of an import, with the reason
+type ImportSkip struct {
+	Line   int
+	Reason string
+}
+
+// Parsed import file. ServerID is 0 when the file doesn't say which server it came from.
+type ImportFile struct {
+	ServerID int64
+	Rows     []ImportRow
+	Skipped  []ImportSkip
+}
+
+func (f *ImportFile) skip(line int, format string, args ...any) {
+	f.Skipped = append(f.Skipped, ImportSkip{Line: line, Reason: fmt.Sprintf(format, args...)})
+}
+
+// Parse a timestamp in any format we export or SQLite stores
+func parseImportTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, sqliteTimeLayout, time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// Build a row from one record. get returns the value of a source column.
+func (f *ImportFile) addRecord(line int, get func(column string) string, m importMapping, defaultKind string) error {
+	field := func(name string) string {
+		if column, ok := m[name]; ok {
+			return strings.TrimSpace(get(column))
+		}
+		return ""
+	}
+
+	if s := field("server_id"); s != "" {
+		serverID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			f.skip(line, "invalid server ID %q", s)
+			return nil
+		}
+		if f.ServerID != 0 && f.ServerID != serverID {
+			return fmt.Errorf("line %d: file mixes servers %d and %d", line, f.ServerID, serverID)
+		}
+		f.ServerID = serverID
+	}
+
+	row := ImportRow{Line: line, Kind: defaultKind, Name: field("name")}
+
+	switch strings.TrimSuffix(strings.ToLower(field("kind")), "s") {
+	case "":
+	case kindEmoji:
+		row.Kind = kindEmoji
+	case kindSticker:
+		row.Kind = kindSticker
+	default:
+		f.skip(line, "unknown kind %q", field("kind"))
+		return nil
+	}
+
+	// Other bots often store the emoji markup instead of a bare ID
+	id := field("id")
+	if match := customEmojiRegex.FindStringSubmatch(id); match != nil {
+		row.Kind = kindEmoji
+		row.Animated = strings.HasPrefix(id, "<a:")
+		if row.Name == "" {
+			row.Name = match[1]
+		}
+		id = match[2]
+	}
+	var err error
+	row.ID, err = strconv.ParseInt(id, 10, 64)
+	if err != nil || row.ID <= 0 {
+		f.skip(line, "invalid ID %q", id)
+		return nil
+	}
+
+	count, err := strconv.Atoi(field("count"))
+	if err != nil || count < 0 {
+		f.skip(line, "invalid count %q", field("count"))
+		return nil
+	}
+	row.Count = count
+
+	if s := field("animated"); s != "" {
+		if row.Animated, err = strconv.ParseBool(s); err != nil {
+			f.skip(line, "invalid animated flag %q", s)
+			return nil
+		}
+	}
+	if s := field("first_used"); s != "" {
+		if row.FirstUsed, err = parseImportTime(s); err != nil {
+			f.skip(line, "%v", err)
+			return nil
+		}
+	}
+	if s := field("last_used"); s != "" {
+		if row.LastUsed, err = parseImportTime(s); err != nil {
+			f.skip(line, "%v", err)
+			return nil
+		}
+	}
+
+	f.Rows = append(f.Rows, row)
+	return nil
+}
+
+// Decompress gzipped input, as produced by /export for large files
+func maybeGunzip(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxImportBytes*4+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxImportBytes*4 {
+		return nil, fmt.Errorf("decompressed file is too large")
+	}
+	return out, nil
+}
+
+// Parse an import file. With an empty mapping the file must be one of our own
+// exports (CSV or JSON); otherwise it is a CSV read with the given mapping, and
+// rows without a kind column are treated as defaultKind.
+func parseImport(data []byte, mapping importMapping, defaultKind string) (*ImportFile, error) {
+	data, err := maybeGunzip(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress file: %w", err)
+	}
+
+	if mapping == nil && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return parseJSONImport(data)
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for idx, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = idx
+	}
+
+	if mapping == nil {
+		switch {
+		case hasColumn(columns, "emote_id"):
+			mapping, defaultKind = emojiExportMapping, kindEmoji
+		case hasColumn(columns, "sticker_id"):
+			mapping, defaultKind = stickerExportMapping, kindSticker
+		default:
+			return nil, fmt.Errorf("not an emoji or sticker export; use a mapping for other CSV files")
+		}
+	}
+	for field, column := range mapping {
+		if !hasColumn(columns, column) && (field == "id" || field == "count") {
+			return nil, fmt.Errorf("column %q for %s not found in CSV header", column, field)
+		}
+	}
+
+	f := &ImportFile{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		get := func(column string) string {
+			if idx, ok := columns[column]; ok && idx < len(record) {
+				return record[idx]
+			}
+			return ""
+		}
+		if err := f.addRecord(line, get, mapping, defaultKind); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func hasColumn(columns map[string]int, name string) bool {
+	_, ok := columns[name]
+	return ok
+}
+
+// Parse one of our JSON exports
+func parseJSONImport(data []byte) (*ImportFile, error) {
+	var export struct {
+		FormatVersion int                          `json:"format_version"`
+		Type          string                       `json:"type"`
+		ServerID      string                       `json:"server_id"`
+		Rows          []map[string]json.RawMessage `json:"rows"`
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("invalid JSON export: %w", err)
+	}
+	if export.FormatVersion > exportFormatVersion {
+		return nil, fmt.Errorf("export format version %d is newer than this bot supports", export.FormatVersion)
+	}
+
+	var mapping importMapping
+	var kind string
+	switch export.Type {
+	case exportTypeEmojis:
+		mapping, kind = emojiExportMapping, kindEmoji
+	case exportTypeStickers:
+		mapping, kind = stickerExportMapping, kindSticker
+	default:
+		return nil, fmt.Errorf("%q exports can't be imported", export.Type)
+	}
+
+	f := &ImportFile{}
+	if export.ServerID != "" {
+		serverID, err := strconv.ParseInt(export.ServerID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server ID %q", export.ServerID)
+		}
+		f.ServerID = serverID
+	}
+
+	for idx, raw := range export.Rows {
+		get := func(column string) string {
+			v, ok := raw[column]
+			if !ok {
+				return ""
+			}
+			var s string
+			if json.Unmarshal(v, &s) == nil {
+				return s
+			}
+			return string(v)
+		}
+		// Rows are numbered from 1, like CSV data lines
+		if err := f.addRecord(idx+1, get, mapping, kind); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Emojis and stickers currently in a guild, keyed by kind then ID
+type guildItems map[string]map[int64]RemovalCandidate
+
+func newGuildItems(emojis []discord.Emoji, stickers []discord.Sticker) guildItems {
+	items := guildItems{kindEmoji: {}, kindSticker: {}}
+	for _, e := range emojis {
+		items[kindEmoji][int64(e.ID)] = RemovalCandidate{Kind: kindEmoji, ID: int64(e.ID), Name: e.Name, Animated: e.Animated}
+	}
+	for _, s := range stickers {
+		items[kindSticker][int64(s.ID)] = RemovalCandidate{Kind: kindSticker, ID: int64(s.ID), Name: s.Name}
+	}
+	return items
+}
+
+// Pending change to one item
+type ImportChange struct {
+	Row    ImportRow
+	Exists bool
+	Before int
+	After  int
+}
+
+// Dry-run result of an import
+type ImportPlan struct {
+	ServerID int64
+	Strategy string
+	Changes  []ImportChange
+	Skipped  []ImportSkip
+}
+
+func mergeImportCount(strategy string, current, imported int) int {
+	switch strategy {
+	case importStrategyReplace:
+		return imported
+	case importStrategyMax:
+		return max(current, imported)
+	default:
+		return current + imported
+	}
+}
+
+// Validate an import file against a server and compute the resulting counts.
+// When items is nil, IDs are not checked against the server's emoji list.
+func (b *Bot) planImport(serverID int64, f *ImportFile, strategy string, items guildItems) (*ImportPlan, error) {
+	if strategy != importStrategyAdd && strategy != importStrategyReplace && strategy != importStrategyMax {
+		return nil, fmt.Errorf("unknown strategy %q", strategy)
+	}
+	if f.ServerID != 0 && f.ServerID != serverID {
+		return nil, fmt.Errorf("file was exported from server %d, not %d", f.ServerID, serverID)
+	}
+
+	plan := &ImportPlan{ServerID: serverID, Strategy: strategy, Skipped: append([]ImportSkip(nil), f.Skipped...)}
+	seen := make(map[string]int)
+	for _, row := range f.Rows {
+		key := pruneValue(row.Kind, row.ID)
+		if line, ok := seen[key]; ok {
+			plan.Skipped = append(plan.Skipped, ImportSkip{Line: row.Line, Reason: fmt.Sprintf("duplicate of line %d", line)})
+			continue
+		}
+		seen[key] = row.Line
+
+		if items != nil {
+			live, ok := items[row.Kind][row.ID]
+			if !ok {
+				plan.Skipped = append(plan.Skipped, ImportSkip{Line: row.Line, Reason: fmt.Sprintf("%s %d is not in this server", row.Kind, row.ID)})
+				continue
+			}
+			if row.Name == "" {
+				row.Name = live.Name
+				row.Animated = live.Animated
+			}
+		}
+		if row.Name == "" {
+			plan.Skipped = append(plan.Skipped, ImportSkip{Line: row.Line, Reason: "missing name"})
+			continue
+		}
+
+		current, exists, err := b.getItemCount(serverID, row.Kind, row.ID)
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, ImportChange{
+			Row:    row,
+			Exists: exists,
+			Before: current,
+			After:  mergeImportCount(strategy, current, row.Count),
+		})
+	}
+	return plan, nil
+}
+
+// Current total for an emoji or sticker, and whether it has a row at all
+func (b *Bot) getItemCount(serverID int64, kind string, itemID int64) (int, bool, error) {
+	query := `SELECT usage_count FROM emojis WHERE server_id = ? AND emote_id = ?`
+	if kind == kindSticker {
+		query = `SELECT usage_count FROM stickers WHERE server_id = ? AND sticker_id = ?`
+	}
+	var count int
+	err := b.DB.QueryRow(query, serverID, itemID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to fetch %s count: %w", kind, err)
+	}
+	return count, true, nil
+}
+
+// Fit content into one message, cutting at the last whole line that fits, or
+// mid-line when a single line is too long
+func truncateContent(content string) string {
+	if len(content) <= discordMaxContentChars {
+		return content
+	}
+	cut := discordMaxContentChars - len("\n...")
+	if idx := strings.LastIndex(content[:cut], "\n"); idx >= 0 {
+		cut = idx
+	}
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	return content[:cut] + "\n..."
+}
+
+// Human-readable diff of a plan, listing at most limit changes
+func formatImportPlan(p *ImportPlan, limit int) string {
+	added, changed, unchanged := 0, 0, 0
+	for _, c := range p.Changes {
+		switch {
+		case !c.Exists:
+			added++
+		case c.Before != c.After:
+			changed++
+		default:
+			unchanged++
+		}
+	}
+
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**Import Preview** (strategy: %s)\n", p.Strategy))
+	content.WriteString(fmt.Sprintf("%d new, %d changed, %d unchanged, %d skipped\n\n", added, changed, unchanged, len(p.Skipped)))
+
+	// Largest changes first
+	changes := append([]ImportChange(nil), p.Changes...)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].After-changes[i].Before > changes[j].After-changes[j].Before
+	})
+	shown := 0
+	for _, c := range changes {
+		if c.Exists && c.Before == c.After {
+			continue
+		}
+		if shown == limit {
+			content.WriteString(fmt.Sprintf("...and %d more\n", added+changed-shown))
+			break
+		}
+		label := candidateLabel(RemovalCandidate{Kind: c.Row.Kind, ID: c.Row.ID, Name: c.Row.Name, Animated: c.Row.Animated})
+		if c.Exists {
+			content.WriteString(fmt.Sprintf("~ %s %d → %d\n", label, c.Before, c.After))
+		} else {
+			content.WriteString(fmt.Sprintf("+ %s %d (new)\n", label, c.After))
+		}
+		shown++
+	}
+
+	if len(p.Skipped) > 0 {
+		content.WriteString("\n**Skipped**\n")
+		for idx, s := range p.Skipped {
+			if idx == limit {
+				content.WriteString(fmt.Sprintf("...and %d more\n", len(p.Skipped)-limit))
+				break
+			}
+			content.WriteString(fmt.Sprintf("line %d: %s\n", s.Line, s.Reason))
+		}
+	}
+	return content.String()
+}
+
+// Timestamp parameter for SQL, NULL when unknown
+func nullableSQLiteTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return sqliteTime(t)
+}
+
+// Merge a plan's rows into the emojis and stickers tables. Counts are merged
+// in SQL so uses tracked since the preview are not lost.
+func (b *Bot) applyImport(p *ImportPlan) error {
+	countExpr := map[string]string{
+		importStrategyAdd:     "usage_count + excluded.usage_count",
+		importStrategyReplace: "excluded.usage_count",
+		importStrategyMax:     "MAX(usage_count, excluded.usage_count)",
+	}[p.Strategy]
+	if countExpr == "" {
+		return fmt.Errorf("unknown strategy %q", p.Strategy)
+	}
+
+	emojiQuery := `
+		INSERT INTO emojis (server_id, emote_id, emote_name, usage_count, animated, first_used, last_used)
+		VALUES (?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP))
+		ON CONFLICT(server_id, emote_id) DO UPDATE SET
+			usage_count = ` + countExpr + `,
+			first_used = MIN(first_used, excluded.first_used),
+			last_used = MAX(last_used, excluded.last_used)
+	`
+	stickerQuery := `
+		INSERT INTO stickers (server_id, sticker_id, sticker_name, usage_count, first_used, last_used)
+		VALUES (?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP))
+		ON CONFLICT(server_id, sticker_id) DO UPDATE SET
+			usage_count = ` + countExpr + `,
+			first_used = MIN(first_used, excluded.first_used),
+			last_used = MAX(last_used, excluded.last_used)
+	`
+
+	return b.withTx(func(tx *sql.Tx) error {
+		for _, c := range p.Changes {
+			r := c.Row
+			var err error
+			if r.Kind == kindSticker {
+				_, err = tx.Exec(stickerQuery, p.ServerID, r.ID, r.Name, r.Count, nullableSQLiteTime(r.FirstUsed), nullableSQLiteTime(r.LastUsed))
+			} else {
+				_, err = tx.Exec(emojiQuery, p.ServerID, r.ID, r.Name, r.Count, r.Animated, nullableSQLiteTime(r.FirstUsed), nullableSQLiteTime(r.LastUsed))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to import %s %d: %w", r.Kind, r.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Import previewed by a moderator, waiting for confirmation
+type pendingImport struct {
+	UserID    discord.UserID
+	Plan      *ImportPlan
+	ExpiresAt time.Time
+}
+
+// Handle /import command
+func (b *Bot) handleImport(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	strategy := data.Options.Find("strategy").String()
+	kind := data.Options.Find("kind").String()
+	if kind == "" {
+		kind = kindEmoji
+	}
+
+	var mapping importMapping
+	if spec := data.Options.Find("mapping").String(); spec != "" {
+		var err error
+		if mapping, err = parseImportMapping(spec); err != nil {
+			b.respondError(i, fmt.Sprintf("Invalid mapping: %v", err))
+			return
+		}
+	}
+
+	attachmentID, err := data.Options.Find("file").SnowflakeValue()
+	if err != nil {
+		b.respondError(i, "Missing file.")
+		return
+	}
+	attachment, ok := data.Resolved.Attachments[discord.AttachmentID(attachmentID)]
+	if !ok {
+		b.respondError(i, "Missing file.")
+		return
+	}
+
+	// Downloading and validating a large file can exceed the 3 second response window
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.DeferredMessageInteractionWithSource,
+		Data: &api.InteractionResponseData{Flags: discord.EphemeralMessage},
+	}); err != nil {
+		b.interactionLog(i).Error("Error deferring import", "err", err)
+		return
+	}
+
+	fail := func(message string) {
+		if _, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+			Content: option.NewNullableString("❌ " + message),
+		}); err != nil {
+			b.interactionLog(i).Error("Error editing interaction response", "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	file, _, err := b.Images.Download(ctx, string(attachment.URL), maxImportBytes)
+	if errors.Is(err, errDownloadTooLarge) {
+		fail(fmt.Sprintf("Import files must be %d MiB or smaller.", maxImportBytes>>20))
+		return
+	}
+	if err != nil {
+		b.interactionLog(i).Error("Error downloading import file", "err", err)
+		fail("Failed to download the file.")
+		return
+	}
+
+	parsed, err := parseImport(file, mapping, kind)
+	if err != nil {
+		fail(fmt.Sprintf("Failed to read the file: %v", err))
+		return
+	}
+
+	emojis, err := b.getGuildEmojis(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild emojis", "err", err)
+		fail("Failed to fetch guild emojis.")
+		return
+	}
+	stickers, err := b.getGuildStickers(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild stickers", "err", err)
+		fail("Failed to fetch guild stickers.")
+		return
+	}
+
+	plan, err := b.planImport(int64(i.GuildID), parsed, strategy, newGuildItems(emojis, stickers))
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	content := truncateContent(formatImportPlan(plan, importDiffLines))
+
+	components := discord.ContainerComponents{
+		&discord.ActionRowComponent{
+			&discord.ButtonComponent{
+				CustomID: "import_apply",
+				Label:    "Apply import",
+				Style:    discord.PrimaryButtonStyle(),
+				Disabled: len(plan.Changes) == 0,
+			},
+			&discord.ButtonComponent{
+				CustomID: "import_cancel",
+				Label:    "Cancel",
+				Style:    discord.SecondaryButtonStyle(),
+			},
+		},
+	}
+
+	msg, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+		Content:    option.NewNullableString(content),
+		Components: &components,
+	})
+	if err != nil {
+		b.interactionLog(i).Error("Error sending import preview", "err", err)
+		return
+	}
+
+	b.pendingImportsMutex.Lock()
+	now := time.Now()
+	for id, p := range b.pendingImports {
+		if now.After(p.ExpiresAt) {
+			delete(b.pendingImports, id)
+		}
+	}
+	b.pendingImports[msg.ID] = pendingImport{
+		UserID:    i.Member.User.ID,
+		Plan:      plan,
+		ExpiresAt: now.Add(pendingImportTTL),
+	}
+	b.pendingImportsMutex.Unlock()
+}
+
+// Handle Apply/Cancel on an import preview
+func (b *Bot) handleImportButton(i *gateway.InteractionCreateEvent, customID string) {
+	if i.Message == nil || i.Member == nil {
+		return
+	}
+
+	b.pendingImportsMutex.Lock()
+	pending, ok := b.pendingImports[i.Message.ID]
+	delete(b.pendingImports, i.Message.ID)
+	b.pendingImportsMutex.Unlock()
+
+	var response api.InteractionResponseData
+	emptyComponents := discord.ContainerComponents{}
+	response.Components = &emptyComponents
+
+	switch {
+	case customID == "import_cancel":
+		response.Content = option.NewNullableString("Import cancelled.")
+	case !ok || time.Now().After(pending.ExpiresAt) || pending.UserID != i.Member.User.ID:
+		response.Content = option.NewNullableString("This import preview has expired. Run `/import` again.")
+	default:
+		if err := b.applyImport(pending.Plan); err != nil {
+			b.interactionLog(i).Error("Error applying import", "err", err)
+			response.Content = option.NewNullableString("❌ Failed to apply the import. No counts were changed.")
+		} else {
+			b.interactionLog(i).Info("Imported items", "items", len(pending.Plan.Changes), "strategy", pending.Plan.Strategy)
+			response.Content = option.NewNullableString(fmt.Sprintf("✅ Imported %d items with the **%s** strategy.", len(pending.Plan.Changes), pending.Plan.Strategy))
+		}
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.UpdateMessage,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error updating message", "err", err)
+	}
+}
+
+// Offline import into the database file:
+//
+//	emote_keeper import -guild 123 -file emojis.csv -strategy max -dry-run
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the SQLite database")
+	guild := fs.Int64("guild", 0, "guild (server) ID to import into")
+	path := fs.String("file", "", "file to import, - for stdin")
+	mappingSpec := fs.String("mapping", "", "column mapping for other bots' CSV files, e.g. \"id=Emoji,count=Uses\"")
+	kind := fs.String("kind", kindEmoji, "emoji or sticker, for mapped CSV files without a kind column")
+	strategy := fs.String("strategy", importStrategyAdd, "add, replace or max")
+	dryRun := fs.Bool("dry-run", false, "show the changes without applying them")
+	fs.Parse(args)
+
+	if *guild == 0 || *path == "" {
+		return fmt.Errorf("-guild and -file are required")
+	}
+
+	var mapping importMapping
+	if *mappingSpec != "" {
+		var err error
+		if mapping, err = parseImportMapping(*mappingSpec); err != nil {
+			return err
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if *path != "-" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := io.ReadAll(bufio.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	parsed, err := parseImport(data, mapping, *kind)
+	if err != nil {
+		return err
+	}
+
+	items, err := fetchGuildItems(discord.GuildID(*guild))
+	if err != nil {
+		return err
+	}
+
+	b, err := newOfflineBot(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer b.DB.Close()
+
+	plan, err := b.planImport(*guild, parsed, *strategy, items)
+	if err != nil {
+		return err
+	}
+	fmt.Print(formatImportPlan(plan, len(plan.Changes)+len(plan.Skipped)))
+
+	if *dryRun {
+		return nil
+	}
+	if err := b.applyImport(plan); err != nil {
+		return err
+	}
+	dataLog.Info("Imported items", idAttr("guild_id", plan.ServerID), "items", len(plan.Changes), "strategy", plan.Strategy)
+	return nil
+}
+
+// Fetch a guild's emojis and stickers with the bot token from the environment.
+// Returns nil, skipping the ownership check, when no token is configured.
+func fetchGuildItems(guildID discord.GuildID) (guildItems, error) {
+	godotenv.Load()
+	token := os.Getenv("DISCORD_CLIENT_TOKEN")
+	if token == "" {
+		dataLog.Warn("DISCORD_CLIENT_TOKEN is not set; emoji IDs will not be checked against the server")
+		return nil, nil
+	}
+
+	client := api.NewClient("Bot " + token)
+	emojis, err := client.Emojis(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch guild emojis: %w", err)
+	}
+	stickers, err := fetchGuildStickers(client, guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch guild stickers: %w", err)
+	}
+	return newGuildItems(emojis, stickers), nil
+}
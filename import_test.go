@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTruncateContent(t *testing.T) {
+	long := strings.Repeat("x", discordMaxContentChars)
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"fits", "a\nb\n", "a\nb\n"},
+		{"cut at a line", "header\n" + long, "header\n..."},
+		{"one long line", long + "\nmore", long[:discordMaxContentChars-4] + "\n..."},
+		{"multibyte character at the cut", long[:discordMaxContentChars-5] + "é" + long, long[:discordMaxContentChars-5] + "\n..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateContent(tt.content)
+			if got != tt.want {
+				t.Errorf("truncateContent = %q (%d bytes), want %q", got[:min(len(got), 40)], len(got), tt.want[:min(len(tt.want), 40)])
+			}
+			if len(got) > discordMaxContentChars || !utf8.ValidString(got) {
+				t.Errorf("truncated content is %d bytes, valid UTF-8 %v", len(got), utf8.ValidString(got))
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseImport(t *testing.T) {
+	const emojiCSV = "server_id,emote_id,emote_name,usage_count,animated,first_used,last_used\n" +
+		"1000,111,wave,5,false,2024-01-01 00:00:00,2024-02-01T00:00:00Z\n" +
+		"1000,112,party,x,true,,\n"
+	mapping := importMapping{"id": "Emoji", "count": "Uses"}
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		mapping      importMapping
+		wantServerID int64
+		wantRows     []ImportRow
+		wantSkipped  []int // Lines
+		wantErr      string
+	}{
+		{
+			name:         "own emoji CSV",
+			data:         []byte(emojiCSV),
+			wantServerID: 1000,
+			wantRows:     []ImportRow{{Line: 2, Kind: kindEmoji, ID: 111, Name: "wave", Count: 5, FirstUsed: first, LastUsed: first.AddDate(0, 1, 0)}},
+			wantSkipped:  []int{3},
+		},
+		{
+			name:         "gzipped CSV",
+			data:         gzipped(t, emojiCSV),
+			wantServerID: 1000,
+			wantRows:     []ImportRow{{Line: 2, Kind: kindEmoji, ID: 111, Name: "wave", Count: 5, FirstUsed: first, LastUsed: first.AddDate(0, 1, 0)}},
+			wantSkipped:  []int{3},
+		},
+		{
+			name:     "own sticker CSV",
+			data:     []byte("sticker_id,sticker_name,usage_count\n211,cat,2\n"),
+			wantRows: []ImportRow{{Line: 2, Kind: kindSticker, ID: 211, Name: "cat", Count: 2}},
+		},
+		{
+			name: "own JSON",
+			data: []byte(`{"format_version": 1, "type": "emojis", "server_id": "1000", "rows": [
+				{"emote_id": "111", "emote_name": "wave", "usage_count": 5, "animated": true, "first_used": "2024-01-01T00:00:00Z"},
+				{"emote_id": "0", "emote_name": "none", "usage_count": 1}]}`),
+			wantServerID: 1000,
+			wantRows:     []ImportRow{{Line: 1, Kind: kindEmoji, ID: 111, Name: "wave", Animated: true, Count: 5, FirstUsed: first}},
+			wantSkipped:  []int{2},
+		},
+		{
+			name:        "generic CSV with a mapping",
+			data:        []byte("Emoji,Uses\n<a:party:112>,3\n113,4\nnot an emoji,1\n"),
+			mapping:     mapping,
+			wantRows:    []ImportRow{{Line: 2, Kind: kindEmoji, ID: 112, Name: "party", Animated: true, Count: 3}, {Line: 3, Kind: kindEmoji, ID: 113, Count: 4}},
+			wantSkipped: []int{4},
+		},
+		{
+			name:    "mapping to a missing column",
+			data:    []byte("Emoji,Count\n111,3\n"),
+			mapping: mapping,
+			wantErr: `column "Uses" for count not found`,
+		},
+		{
+			name:    "CSV that isn't an export",
+			data:    []byte("Emoji,Uses\n111,3\n"),
+			wantErr: "not an emoji or sticker export",
+		},
+		{
+			name:    "events JSON export",
+			data:    []byte(`{"format_version": 1, "type": "events", "rows": []}`),
+			wantErr: `"events" exports can't be imported`,
+		},
+		{
+			name:    "newer JSON format",
+			data:    []byte(`{"format_version": 99, "type": "emojis", "rows": []}`),
+			wantErr: "newer than this bot supports",
+		},
+		{
+			name:    "mixed servers",
+			data:    []byte("server_id,emote_id,emote_name,usage_count\n1000,111,wave,1\n1001,112,party,1\n"),
+			wantErr: "file mixes servers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseImport(tt.data, tt.mapping, kindEmoji)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.ServerID != tt.wantServerID {
+				t.Errorf("server ID = %d, want %d", f.ServerID, tt.wantServerID)
+			}
+			if len(f.Rows) != len(tt.wantRows) {
+				t.Fatalf("rows = %+v, want %+v", f.Rows, tt.wantRows)
+			}
+			for n, want := range tt.wantRows {
+				got := f.Rows[n]
+				if got.Line != want.Line || got.Kind != want.Kind || got.ID != want.ID || got.Name != want.Name || got.Animated != want.Animated ||
+					got.Count != want.Count || !got.FirstUsed.Equal(want.FirstUsed) || !got.LastUsed.Equal(want.LastUsed) {
+					t.Errorf("row %d = %+v, want %+v", n, got, want)
+				}
+			}
+			var skipped []int
+			for _, s := range f.Skipped {
+				skipped = append(skipped, s.Line)
+			}
+			if len(skipped) != len(tt.wantSkipped) || (len(skipped) > 0 && skipped[0] != tt.wantSkipped[0]) {
+				t.Errorf("skipped = %+v, want lines %v", f.Skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestImportStrategies(t *testing.T) {
+	tests := []struct {
+		strategy string
+		imported int
+		want     int
+	}{
+		{importStrategyAdd, 5, 8},
+		{importStrategyReplace, 5, 5},
+		{importStrategyReplace, 1, 1},
+		{importStrategyMax, 5, 5},
+		{importStrategyMax, 1, 3},
+	}
+	for _, tt := range tests {
+		b := newTestBot(t)
+		for range 3 {
+			b.send(b.message("<:wave:111>"))
+		}
+		f := &ImportFile{Rows: []ImportRow{
+			{Line: 2, Kind: kindEmoji, ID: 111, Name: "wave", Count: tt.imported},
+			{Line: 3, Kind: kindEmoji, ID: 112, Name: "party", Count: tt.imported},
+			{Line: 4, Kind: kindEmoji, ID: 111, Name: "wave", Count: 100},
+		}}
+		plan, err := b.planImport(int64(testGuildID), f, tt.strategy, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Changes) != 2 || plan.Changes[0].Before != 3 || plan.Changes[0].After != tt.want || len(plan.Skipped) != 1 {
+			t.Fatalf("%s %d: plan = %+v, want 3 -> %d and the duplicate skipped", tt.strategy, tt.imported, plan, tt.want)
+		}
+		if err := b.applyImport(plan); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.emojiCount(111); got != tt.want {
+			t.Errorf("%s %d: count = %d, want %d", tt.strategy, tt.imported, got, tt.want)
+		}
+		if got := b.emojiCount(112); got != tt.imported {
+			t.Errorf("%s %d: new emoji count = %d, want %d", tt.strategy, tt.imported, got, tt.imported)
+		}
+	}
+}
+
+func TestImportRejectsAnotherServersExport(t *testing.T) {
+	b := newTestBot(t)
+	f, err := parseImport([]byte("server_id,emote_id,emote_name,usage_count\n1001,111,wave,5\n"), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.planImport(int64(testGuildID), f, importStrategyAdd, nil); err == nil || !strings.Contains(err.Error(), "exported from server 1001") {
+		t.Errorf("err = %v, want the other server's export rejected", err)
+	}
+	if _, err := b.planImport(int64(otherGuildID), f, importStrategyAdd, nil); err != nil {
+		t.Errorf("import into the exporting server: %v", err)
+	}
+}
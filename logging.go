@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// Sampling applied when LOG_SAMPLE is unset: one in this many successful tracking lines
+const defaultTrackingSample = 100
+
+// Level and sampling of one subsystem's logs
+type logSubsystem struct {
+	level       slog.LevelVar
+	sampleEvery atomic.Uint64
+	seen        atomic.Uint64
+}
+
+var (
+	logRoot       atomic.Pointer[slog.Handler] // Handler every subsystem writes to
+	logSubsystems = make(map[string]*logSubsystem)
+	logMutex      sync.Mutex
+)
+
+// Loggers per subsystem. Their levels and sampling are set by configureLogging.
+var (
+	dbLog        = newLogger("db")
+	gatewayLog   = newLogger("gateway")
+	trackingLog  = newLogger("tracking")
+	commandLog   = newLogger("commands")
+	httpLog      = newLogger("http")
+	backfillLog  = newLogger("backfill")
+	reconcileLog = newLogger("reconcile")
+	digestLog    = newLogger("digest")
+	pollLog      = newLogger("polls")
+	imageLog     = newLogger("images")
+	dataLog      = newLogger("data")
+	retentionLog = newLogger("retention")
+)
+
+func init() {
+	setLogRoot(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	trackingSubsystem := getLogSubsystem("tracking")
+	trackingSubsystem.sampleEvery.Store(defaultTrackingSample)
+	// Route the standard logger, used by libraries, through the same output
+	slog.SetDefault(newLogger("lib"))
+}
+
+func setLogRoot(h slog.Handler) {
+	logRoot.Store(&h)
+}
+
+func getLogSubsystem(name string) *logSubsystem {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	sub, ok := logSubsystems[name]
+	if !ok {
+		sub = &logSubsystem{}
+		logSubsystems[name] = sub
+	}
+	return sub
+}
+
+func newLogger(name string) *slog.Logger {
+	return slog.New(&subsystemHandler{sub: getLogSubsystem(name)}).With("subsystem", name)
+}
+
+// Filters by its subsystem's level and sampling, then writes to the current root handler.
+// Attributes and groups are replayed onto the root so reconfiguring applies to existing loggers.
+type subsystemHandler struct {
+	sub  *logSubsystem
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.sub.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	// Warnings and errors are never sampled
+	if every := h.sub.sampleEvery.Load(); every > 1 && r.Level < slog.LevelWarn {
+		if h.sub.seen.Add(1)%every != 1 {
+			return nil
+		}
+		r.AddAttrs(slog.Uint64("sample_rate", every))
+	}
+
+	next := *logRoot.Load()
+	for _, wrap := range h.wrap {
+		next = wrap(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) *subsystemHandler {
+	wraps := make([]func(slog.Handler) slog.Handler, len(h.wrap), len(h.wrap)+1)
+	copy(wraps, h.wrap)
+	return &subsystemHandler{sub: h.sub, wrap: append(wraps, wrap)}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+// Parse "name=value,name=value" settings
+func parseLogSettings(s string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected name=value, got %q", part)
+		}
+		settings[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return settings, nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// Configure logging from LOG_FORMAT, LOG_LEVEL, LOG_LEVELS and LOG_SAMPLE
+func configureLogging(w io.Writer) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		setLogRoot(slog.NewTextHandler(w, opts))
+	case "json":
+		setLogRoot(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json, got %q", format)
+	}
+
+	level := slog.LevelInfo
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		var err error
+		if level, err = parseLogLevel(s); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %w", err)
+		}
+	}
+	levels, err := parseLogSettings(os.Getenv("LOG_LEVELS"))
+	if err != nil {
+		return fmt.Errorf("invalid LOG_LEVELS: %w", err)
+	}
+	overrides := make(map[string]slog.Level)
+	for name, s := range levels {
+		if overrides[name], err = parseLogLevel(s); err != nil {
+			return fmt.Errorf("invalid LOG_LEVELS level for %s: %w", name, err)
+		}
+	}
+
+	// LOG_SAMPLE entries override the defaults; set empty, it turns sampling off
+	samples := map[string]string{"tracking": strconv.Itoa(defaultTrackingSample)}
+	if s, ok := os.LookupEnv("LOG_SAMPLE"); ok && strings.TrimSpace(s) == "" {
+		clear(samples)
+	} else if ok {
+		custom, err := parseLogSettings(s)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_SAMPLE: %w", err)
+		}
+		for name, rate := range custom {
+			samples[name] = rate
+		}
+	}
+	rates := make(map[string]uint64)
+	for name, s := range samples {
+		if rates[name], err = strconv.ParseUint(s, 10, 64); err != nil {
+			return fmt.Errorf("invalid LOG_SAMPLE rate for %s: %w", name, err)
+		}
+	}
+
+	for name := range overrides {
+		getLogSubsystem(name)
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	for name, sub := range logSubsystems {
+		if l, ok := overrides[name]; ok {
+			sub.level.Set(l)
+		} else {
+			sub.level.Set(level)
+		}
+		sub.sampleEvery.Store(rates[name])
+	}
+	return nil
+}
+
+// Log an error and exit
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Discord IDs are logged as strings so JSON consumers don't lose precision
+func idAttr(key string, id int64) slog.Attr {
+	return slog.String(key, strconv.FormatInt(id, 10))
+}
+
+// Fields locating a usage
+func (uc UsageContext) logAttrs() []any {
+	return []any{idAttr("guild_id", uc.ServerID), idAttr("channel_id", uc.ChannelID), idAttr("message_id", uc.MessageID), slog.String("source", uc.Source)}
+}
+
+// Logger for an interaction, with its guild, channel, user and command. In
+// pseudonymizing servers the user is logged by pseudonym, or left out if it
+// can't be computed.
+func (b *Bot) interactionLog(i *gateway.InteractionCreateEvent) *slog.Logger {
+	attrs := []any{
+		idAttr("guild_id", int64(i.GuildID)),
+		idAttr("channel_id", int64(i.ChannelID)),
+		idAttr("interaction_id", int64(i.ID)),
+		slog.String("command", interactionLabel(i)),
+	}
+	if u := i.Sender(); u != nil {
+		userID, ok := int64(u.ID), true
+		if i.GuildID.IsValid() {
+			userID, ok = b.storedUserID(int64(i.GuildID), userID)
+		}
+		if ok {
+			attrs = append(attrs, idAttr("user_id", userID))
+		}
+	}
+	return commandLog.With(attrs...)
+}
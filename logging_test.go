@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Configure logging from env into a buffer, restoring the defaults after the test
+func configureTestLogging(t *testing.T, env map[string]string) *bytes.Buffer {
+	t.Helper()
+	for _, name := range []string{"LOG_FORMAT", "LOG_LEVEL", "LOG_LEVELS", "LOG_SAMPLE"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	t.Cleanup(func() {
+		for _, name := range []string{"LOG_FORMAT", "LOG_LEVEL", "LOG_LEVELS", "LOG_SAMPLE"} {
+			os.Unsetenv(name)
+		}
+		if err := configureLogging(os.Stderr); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var buf bytes.Buffer
+	if err := configureLogging(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// Decode JSON log lines
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", line, err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestConfigureLoggingErrors(t *testing.T) {
+	t.Cleanup(func() { configureLogging(os.Stderr) })
+	for _, env := range []map[string]string{
+		{"LOG_FORMAT": "xml"},
+		{"LOG_LEVEL": "loud"},
+		{"LOG_LEVELS": "db"},
+		{"LOG_LEVELS": "db=loud"},
+		{"LOG_SAMPLE": "tracking=often"},
+	} {
+		for name, value := range env {
+			t.Setenv(name, value)
+		}
+		if err := configureLogging(&bytes.Buffer{}); err == nil {
+			t.Errorf("%v configured without an error", env)
+		}
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	buf := configureTestLogging(t, map[string]string{"LOG_FORMAT": "json", "LOG_LEVEL": "warn", "LOG_LEVELS": "db=debug"})
+
+	dbLog.Debug("db debug")
+	httpLog.Info("http info")
+	httpLog.Warn("http warn")
+
+	var got []string
+	for _, line := range logLines(t, buf) {
+		got = append(got, line["subsystem"].(string)+": "+line["msg"].(string))
+	}
+	if strings.Join(got, "\n") != "db: db debug\nhttp: http warn" {
+		t.Errorf("logged %q, want db's debug line and http's warning", got)
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample string
+		// Info lines logged of 300 per subsystem
+		wantTracking, wantPolls int
+	}{
+		{name: "default", wantTracking: 3, wantPolls: 300},
+		{name: "merged over the default", sample: "polls=10", wantTracking: 3, wantPolls: 30},
+		{name: "tracking overridden", sample: "tracking=1", wantTracking: 300, wantPolls: 300},
+		{name: "empty", sample: " ", wantTracking: 300, wantPolls: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"LOG_FORMAT": "json"}
+			if tt.sample != "" {
+				env["LOG_SAMPLE"] = tt.sample
+			}
+			buf := configureTestLogging(t, env)
+
+			for range 300 {
+				trackingLog.Info("tracked")
+				pollLog.Info("voted")
+			}
+			// Warnings are never sampled
+			for range 5 {
+				trackingLog.Warn("failed")
+			}
+
+			counts := make(map[string]int)
+			for _, line := range logLines(t, buf) {
+				counts[line["subsystem"].(string)+" "+line["level"].(string)]++
+			}
+			if counts["tracking INFO"] != tt.wantTracking || counts["polls INFO"] != tt.wantPolls || counts["tracking WARN"] != 5 {
+				t.Errorf("logged %v, want %d tracking and %d polls info lines and 5 warnings", counts, tt.wantTracking, tt.wantPolls)
+			}
+		})
+	}
+
+	// Sampled lines carry their rate
+	buf := configureTestLogging(t, map[string]string{"LOG_FORMAT": "json", "LOG_SAMPLE": "polls=2"})
+	pollLog.Info("voted")
+	pollLog.Info("voted")
+	if lines := logLines(t, buf); len(lines) != 1 || lines[0]["sample_rate"] != float64(2) {
+		t.Errorf("sampled lines = %v, want one with sample_rate 2", lines)
+	}
+}
+
+// Interaction logs in pseudonymizing servers show the member's pseudonym
+func TestInteractionLogPseudonym(t *testing.T) {
+	b := newTestBot(t)
+	buf := configureTestLogging(t, map[string]string{"LOG_FORMAT": "json"})
+	i := b.command("listemotes")
+
+	b.interactionLog(i).Info("plain")
+	b.configure("pseudonymize_users", "true")
+	b.interactionLog(i).Info("pseudonymized")
+	pseudonym, ok := b.storedUserID(int64(testGuildID), int64(testUserID))
+	if !ok {
+		t.Fatal("no pseudonym")
+	}
+
+	want := map[string]string{"plain": "3000", "pseudonymized": strconv.FormatInt(pseudonym, 10)}
+	for _, line := range logLines(t, buf) {
+		msg := line["msg"].(string)
+		if expected, ok := want[msg]; ok && line["user_id"] != expected {
+			t.Errorf("%s log user_id = %v, want %s", msg, line["user_id"], expected)
+		}
+		delete(want, msg)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing log lines %v", want)
+	}
+}
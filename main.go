@@ -3,14 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/diamondburned/arikawa/v3/api"
@@ -22,12 +22,8 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var (
-	// Regex to match custom Discord emojis: <:name:id> or <a:name:id>
-	customEmojiRegex = regexp.MustCompile(`<a?:(\w+):(\d+)>`)
-	db               *sql.DB
-	botState         *state.State
-)
+// Regex to match custom Discord emojis: <:name:id> or <a:name:id>
+var customEmojiRegex = regexp.MustCompile(`<a?:(\w+):(\d+)>`)
 
 // Database migrations
 type migration struct {
@@ -74,25 +70,501 @@ var migrations = []migration{
 			return err
 		},
 	},
+	{
+		version: 3,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS images (
+				kind TEXT NOT NULL,
+				item_id BIGINT NOT NULL,
+				server_id BIGINT NOT NULL,
+				name TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				content_type TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				retained BOOLEAN DEFAULT FALSE,
+				fetched_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				last_accessed DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY(kind, item_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_images_hash ON images(hash);
+			CREATE INDEX IF NOT EXISTS idx_images_server_id ON images(server_id);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 4,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS usage_daily (
+				server_id BIGINT,
+				kind TEXT NOT NULL,
+				item_id BIGINT,
+				day DATE NOT NULL,
+				usage_count INTEGER DEFAULT 0,
+				PRIMARY KEY(server_id, kind, item_id, day)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_daily_server_id_day ON usage_daily(server_id, day);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 5,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS digests (
+				server_id BIGINT PRIMARY KEY,
+				channel_id BIGINT NOT NULL,
+				schedule TEXT NOT NULL,
+				enabled BOOLEAN DEFAULT TRUE,
+				next_run INTEGER,
+				last_run INTEGER
+			);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 6,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS usage_events (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				channel_id BIGINT,
+				message_id BIGINT,
+				user_id BIGINT,
+				kind TEXT NOT NULL,
+				item_id BIGINT NOT NULL,
+				source TEXT NOT NULL,
+				delta INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_events_server_id_kind_item_id ON usage_events(server_id, kind, item_id, created_at);
+			CREATE INDEX IF NOT EXISTS idx_usage_events_server_id_user_id ON usage_events(server_id, user_id);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 7,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS pruned_items (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				kind TEXT NOT NULL,
+				item_id BIGINT NOT NULL,
+				name TEXT NOT NULL,
+				animated BOOLEAN DEFAULT FALSE,
+				image_hash TEXT,
+				total_uses INTEGER NOT NULL,
+				recent_uses INTEGER NOT NULL,
+				distinct_users INTEGER NOT NULL,
+				approved_by BIGINT NOT NULL,
+				deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_pruned_items_server_id ON pruned_items(server_id);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 8,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS emoji_polls (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				channel_id BIGINT NOT NULL,
+				message_id BIGINT,
+				action TEXT NOT NULL,
+				emoji_id BIGINT,
+				emoji_name TEXT NOT NULL,
+				animated BOOLEAN DEFAULT FALSE,
+				image BLOB,
+				image_type TEXT,
+				created_by BIGINT NOT NULL,
+				closes_at INTEGER NOT NULL,
+				apply BOOLEAN DEFAULT FALSE,
+				status TEXT NOT NULL,
+				yes_votes INTEGER DEFAULT 0,
+				no_votes INTEGER DEFAULT 0,
+				apply_error TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE TABLE IF NOT EXISTS emoji_poll_votes (
+				poll_id INTEGER NOT NULL,
+				user_id BIGINT NOT NULL,
+				vote BOOLEAN NOT NULL,
+				voted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY(poll_id, user_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_emoji_polls_status_closes_at ON emoji_polls(status, closes_at);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 9,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS backfill_jobs (
+				server_id BIGINT PRIMARY KEY,
+				since INTEGER NOT NULL,
+				until INTEGER NOT NULL DEFAULT 0,
+				status TEXT NOT NULL,
+				started_by BIGINT NOT NULL,
+				messages_scanned INTEGER DEFAULT 0,
+				messages_skipped INTEGER DEFAULT 0,
+				items_counted INTEGER DEFAULT 0,
+				error TEXT,
+				started_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS backfill_channels (
+				server_id BIGINT NOT NULL,
+				channel_id BIGINT NOT NULL,
+				cursor BIGINT NOT NULL DEFAULT 0,
+				done BOOLEAN DEFAULT FALSE,
+				error TEXT,
+				PRIMARY KEY(server_id, channel_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_events_server_id_message_id ON usage_events(server_id, message_id, source);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 10,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS reaction_corrections (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				channel_id BIGINT NOT NULL,
+				message_id BIGINT NOT NULL,
+				emoji_id BIGINT NOT NULL,
+				recorded INTEGER NOT NULL,
+				actual INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE TABLE IF NOT EXISTS reconcile_runs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				messages_checked INTEGER NOT NULL,
+				reactions_seen INTEGER NOT NULL,
+				corrections INTEGER NOT NULL,
+				added INTEGER NOT NULL,
+				removed INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_reaction_corrections_server_id_created_at ON reaction_corrections(server_id, created_at);
+			CREATE INDEX IF NOT EXISTS idx_reconcile_runs_server_id_created_at ON reconcile_runs(server_id, created_at);
+			CREATE INDEX IF NOT EXISTS idx_usage_events_created_at ON usage_events(created_at);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 11,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS heartbeat (
+				id INTEGER PRIMARY KEY CHECK (id = 1),
+				last_seen INTEGER NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS outages (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				started_at INTEGER NOT NULL,
+				ended_at INTEGER NOT NULL,
+				reason TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_outages_started_at ON outages(started_at);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 12,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS api_tokens (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				name TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_by BIGINT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				last_used_at DATETIME
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_api_tokens_server_id ON api_tokens(server_id);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 13,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS dashboard_logins (
+				token_hash TEXT PRIMARY KEY,
+				server_id BIGINT NOT NULL,
+				user_id BIGINT NOT NULL,
+				expires_at INTEGER NOT NULL,
+				used_at INTEGER
+			);
+
+			CREATE TABLE IF NOT EXISTS dashboard_sessions (
+				session_hash TEXT PRIMARY KEY,
+				server_id BIGINT NOT NULL,
+				user_id BIGINT NOT NULL,
+				expires_at INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 14,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS guild_settings (
+				server_id BIGINT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY(server_id, key)
+			);
+
+			CREATE TABLE IF NOT EXISTS guild_settings_audit (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				key TEXT NOT NULL,
+				old_value TEXT,
+				new_value TEXT,
+				changed_by BIGINT NOT NULL,
+				changed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_guild_settings_audit_server_id ON guild_settings_audit(server_id, id);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 15,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS channel_filters (
+				server_id BIGINT NOT NULL,
+				channel_id BIGINT NOT NULL,
+				is_category BOOLEAN DEFAULT FALSE,
+				mode TEXT NOT NULL,
+				added_by BIGINT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY(server_id, channel_id)
+			);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 16,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS usage_event_roles (
+				event_id INTEGER NOT NULL,
+				role_id BIGINT NOT NULL,
+				PRIMARY KEY(event_id, role_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_event_roles_role_id ON usage_event_roles(role_id, event_id);
+
+			CREATE TRIGGER IF NOT EXISTS usage_events_delete_roles AFTER DELETE ON usage_events
+			BEGIN
+				DELETE FROM usage_event_roles WHERE event_id = OLD.id;
+			END;
+
+			CREATE TABLE IF NOT EXISTS role_filters (
+				server_id BIGINT NOT NULL,
+				role_id BIGINT NOT NULL,
+				added_by BIGINT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY(server_id, role_id)
+			);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 17,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS privacy_optouts (
+				user_id BIGINT PRIMARY KEY,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_events_user_id ON usage_events(user_id);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 18,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS guild_secrets (
+				server_id BIGINT PRIMARY KEY,
+				secret BLOB NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				rotated_at DATETIME
+			);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 19,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS usage_rollups (
+				server_id BIGINT NOT NULL,
+				period TEXT NOT NULL,
+				period_start DATETIME NOT NULL,
+				channel_id BIGINT NOT NULL,
+				user_id BIGINT NOT NULL,
+				kind TEXT NOT NULL,
+				item_id BIGINT NOT NULL,
+				uses INTEGER NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_rollups_server_id ON usage_rollups(server_id, period, period_start);
+			CREATE INDEX IF NOT EXISTS idx_usage_rollups_user_id ON usage_rollups(user_id);
+
+			CREATE TABLE IF NOT EXISTS retention_state (
+				server_id BIGINT PRIMARY KEY,
+				compacted_before DATETIME NOT NULL,
+				last_run DATETIME NOT NULL
+			);
+
+			CREATE VIEW IF NOT EXISTS usage_history AS
+				SELECT server_id, COALESCE(channel_id, 0) AS channel_id, COALESCE(user_id, 0) AS user_id, kind, item_id, delta, created_at
+				FROM usage_events
+				UNION ALL
+				SELECT server_id, channel_id, user_id, kind, item_id, uses, period_start
+				FROM usage_rollups;
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 20,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS guilds (
+				server_id BIGINT PRIMARY KEY,
+				name TEXT NOT NULL DEFAULT '',
+				joined_at DATETIME,
+				left_at DATETIME
+			);
+
+			CREATE TABLE IF NOT EXISTS guild_purges (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				server_id BIGINT NOT NULL,
+				name TEXT NOT NULL,
+				left_at DATETIME NOT NULL,
+				purged_at DATETIME NOT NULL,
+				rows_deleted INTEGER NOT NULL
+			);
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
+	{
+		version: 21,
+		up: func(tx *sql.Tx) error {
+			query := `
+			CREATE TABLE IF NOT EXISTS usage_role_rollups (
+				server_id BIGINT NOT NULL,
+				period TEXT NOT NULL,
+				period_start DATETIME NOT NULL,
+				role_id BIGINT NOT NULL,
+				user_id BIGINT NOT NULL,
+				kind TEXT NOT NULL,
+				item_id BIGINT NOT NULL,
+				uses INTEGER NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_usage_role_rollups_server_id ON usage_role_rollups(server_id, role_id, period_start);
+			CREATE INDEX IF NOT EXISTS idx_usage_role_rollups_user_id ON usage_role_rollups(user_id);
+
+			CREATE VIEW IF NOT EXISTS role_usage_history AS
+				SELECT ue.server_id, r.role_id, COALESCE(ue.user_id, 0) AS user_id, ue.kind, ue.item_id, ue.delta, ue.created_at
+				FROM usage_event_roles r
+				JOIN usage_events ue ON ue.id = r.event_id
+				UNION ALL
+				SELECT server_id, role_id, user_id, kind, item_id, uses, period_start
+				FROM usage_role_rollups;
+			`
+			_, err := tx.Exec(query)
+			return err
+		},
+	},
 }
 
-func migrate(db *sql.DB) error {
+func (b *Bot) migrate() error {
 	var currentVersion int
-	if err := db.QueryRow("PRAGMA user_version").Scan(&currentVersion); err != nil {
+	if err := b.DB.QueryRow("PRAGMA user_version").Scan(&currentVersion); err != nil {
 		return fmt.Errorf("failed to get user_version: %w", err)
 	}
 
 	// Handle unversioned existing databases
 	if currentVersion == 0 {
 		var count int
-		if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='emojis'").Scan(&count); err != nil {
+		if err := b.DB.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='emojis'").Scan(&count); err != nil {
 			return fmt.Errorf("failed to check tables: %w", err)
 		}
 
 		if count > 0 {
 			// Table exists, check for 'animated' column to determine state
 			var hasAnimated int
-			if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('emojis') WHERE name='animated'").Scan(&hasAnimated); err != nil {
+			if err := b.DB.QueryRow("SELECT COUNT(*) FROM pragma_table_info('emojis') WHERE name='animated'").Scan(&hasAnimated); err != nil {
 				return fmt.Errorf("failed to check schema columns: %w", err)
 			}
 
@@ -103,17 +575,18 @@ func migrate(db *sql.DB) error {
 			}
 
 			// Update DB version to match detected state
-			if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", currentVersion)); err != nil {
+			if _, err := b.DB.Exec(fmt.Sprintf("PRAGMA user_version = %d", currentVersion)); err != nil {
 				return fmt.Errorf("failed to set initial user_version: %w", err)
 			}
-			log.Printf("Detected existing database at version %d", currentVersion)
+			dbLog.Info("Detected existing database", "version", currentVersion)
 		}
 	}
 
+	b.health.noteMigration(currentVersion, currentVersion < migrations[len(migrations)-1].version)
 	for _, m := range migrations {
 		if m.version > currentVersion {
-			log.Printf("Applying migration version %d...", m.version)
-			tx, err := db.Begin()
+			dbLog.Info("Applying migration", "version", m.version)
+			tx, err := b.DB.Begin()
 			if err != nil {
 				return fmt.Errorf("failed to begin transaction: %w", err)
 			}
@@ -132,8 +605,10 @@ func migrate(db *sql.DB) error {
 				return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
 			}
 			currentVersion = m.version
+			b.health.noteMigration(currentVersion, true)
 		}
 	}
+	b.health.noteMigration(currentVersion, false)
 	return nil
 }
 
@@ -143,77 +618,229 @@ type CachedEmojiList struct {
 	ExpiresAt time.Time
 }
 
-var (
-	emojiCache      = make(map[discord.GuildID]CachedEmojiList)
-	emojiCacheMutex sync.Mutex
-)
+const defaultDBPath = "./emote_tracker.db"
 
-func initDB() error {
-	var err error
-	db, err = sql.Open("sqlite3", "./emote_tracker.db")
+// A bot over the database at path, migrated, for subcommands that work
+// without connecting to Discord
+func newOfflineBot(path string) (*Bot, error) {
+	store, err := sql.Open("sqlite3", path)
 	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	b := NewBot(offlineClient{}, store)
+	if err := b.initDB(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return b, nil
+}
 
-	if err := migrate(db); err != nil {
+func (b *Bot) initDB() error {
+	if err := b.migrate(); err != nil {
 		return fmt.Errorf("database migration failed: %w", err)
 	}
 
-	log.Println("Database initialized successfully")
+	dbLog.Info("Database initialized")
 	return nil
 }
 
-// Track custom emoji usage
-func trackCustomEmoji(emojiName string, emojiID int64, serverID int64, animated bool) error {
+// Kinds of tracked items
+const (
+	kindEmoji   = "emoji"
+	kindSticker = "sticker"
+)
+
+// Where, by whom and how an emoji or sticker was used
+type UsageContext struct {
+	ServerID  int64
+	ChannelID int64
+	MessageID int64
+	UserID    int64
+	RoleIDs   []int64 // Roles the member had at the time; nil when unknown
+	Source    string
+	Time      time.Time // When the usage happened; zero means now
+}
+
+// Time of the usage, defaulting to now
+func (uc UsageContext) at() time.Time {
+	if uc.Time.IsZero() {
+		return time.Now()
+	}
+	return uc.Time
+}
+
+// Sources of tracked usage
+const (
+	sourceMessage  = "message"
+	sourceReaction = "reaction"
+)
+
+// Add delta to the usage bucket for the day of the usage
+func bumpDailyUsage(tx *sql.Tx, kind string, itemID int64, uc UsageContext, delta int) error {
 	query := `
-		INSERT INTO emojis (server_id, emote_id, emote_name, usage_count, animated)
-		VALUES (?, ?, ?, 1, ?)
-		ON CONFLICT(server_id, emote_id) DO UPDATE SET
-			usage_count = usage_count + 1,
-			last_used = CURRENT_TIMESTAMP,
-			animated = ?
+		INSERT INTO usage_daily (server_id, kind, item_id, day, usage_count)
+		VALUES (?, ?, ?, ?, MAX(0, ?))
+		ON CONFLICT(server_id, kind, item_id, day) DO UPDATE SET
+			usage_count = MAX(0, usage_count + ?)
 	`
-	_, err := db.Exec(query, serverID, emojiID, emojiName, animated, animated)
+	_, err := tx.Exec(query, uc.ServerID, kind, itemID, uc.at().UTC().Format(time.DateOnly), delta, delta)
 	if err != nil {
-		return fmt.Errorf("failed to track custom emoji: %w", err)
+		return fmt.Errorf("failed to update daily usage: %w", err)
 	}
 	return nil
 }
 
-// Decrease custom emoji usage count
-func decreaseCustomEmoji(emojiID int64, serverID int64) error {
+// Record a single usage event
+func recordUsageEvent(tx *sql.Tx, kind string, itemID int64, uc UsageContext, delta int) error {
 	query := `
-		UPDATE emojis
-		SET usage_count = MAX(0, usage_count - 1)
-		WHERE server_id = ? AND emote_id = ?
+		INSERT INTO usage_events (server_id, channel_id, message_id, user_id, kind, item_id, source, delta, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := db.Exec(query, serverID, emojiID)
+	res, err := tx.Exec(query, uc.ServerID, uc.ChannelID, uc.MessageID, uc.UserID, kind, itemID, uc.Source, delta, sqliteTime(uc.at()))
 	if err != nil {
-		return fmt.Errorf("failed to decrease custom emoji count: %w", err)
+		return fmt.Errorf("failed to record usage event: %w", err)
 	}
-	return nil
+	if len(uc.RoleIDs) == 0 {
+		return nil
+	}
+	eventID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to record usage event: %w", err)
+	}
+	return recordEventRoles(tx, eventID, uc.RoleIDs)
 }
 
-// Track sticker usage
-func trackSticker(stickerID int64, stickerName string, serverID int64) error {
-	query := `
-		INSERT INTO stickers (server_id, sticker_id, sticker_name, usage_count)
-		VALUES (?, ?, ?, 1)
-		ON CONFLICT(server_id, sticker_id) DO UPDATE SET
-			usage_count = usage_count + 1,
-			last_used = CURRENT_TIMESTAMP
-	`
-	_, err := db.Exec(query, serverID, stickerID, stickerName)
+// Run fn in a transaction, committing on success
+func (b *Bot) withTx(fn func(tx *sql.Tx) error) error {
+	start := time.Now()
+	err := b.runTx(fn)
+	b.metrics.dbWriteLatency.Since(start)
+	b.health.noteDBWrite(err)
 	if err != nil {
-		return fmt.Errorf("failed to track sticker: %w", err)
+		b.metrics.dbErrors.Inc("write")
 	}
-	return nil
+	return err
+}
+
+func (b *Bot) runTx(fn func(tx *sql.Tx) error) error {
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Layout of SQLite's CURRENT_TIMESTAMP
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// Format a time the way SQLite's CURRENT_TIMESTAMP stores it
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// Track custom emoji usage
+func (b *Bot) trackCustomEmoji(emojiName string, emojiID int64, animated bool, uc UsageContext) error {
+	err := b.withTx(func(tx *sql.Tx) error {
+		query := `
+			INSERT INTO emojis (server_id, emote_id, emote_name, usage_count, animated, first_used, last_used)
+			VALUES (?, ?, ?, 1, ?, ?, ?)
+			ON CONFLICT(server_id, emote_id) DO UPDATE SET
+				usage_count = usage_count + 1,
+				first_used = MIN(first_used, excluded.first_used),
+				last_used = MAX(last_used, excluded.last_used),
+				animated = ?
+		`
+		at := sqliteTime(uc.at())
+		_, err := tx.Exec(query, uc.ServerID, emojiID, emojiName, animated, at, at, animated)
+		if err != nil {
+			return fmt.Errorf("failed to track custom emoji: %w", err)
+		}
+		if err := bumpDailyUsage(tx, kindEmoji, emojiID, uc, 1); err != nil {
+			return err
+		}
+		return recordUsageEvent(tx, kindEmoji, emojiID, uc, 1)
+	})
+	if err == nil {
+		b.metrics.itemsTracked.Inc(kindEmoji, uc.Source)
+	}
+	return err
+}
+
+// Decrease custom emoji usage count
+func (b *Bot) decreaseCustomEmoji(emojiID int64, uc UsageContext) error {
+	return b.withTx(func(tx *sql.Tx) error {
+		query := `
+			UPDATE emojis
+			SET usage_count = MAX(0, usage_count - 1)
+			WHERE server_id = ? AND emote_id = ?
+		`
+		_, err := tx.Exec(query, uc.ServerID, emojiID)
+		if err != nil {
+			return fmt.Errorf("failed to decrease custom emoji count: %w", err)
+		}
+
+		// Take the use back from the day its add was counted on, falling back
+		// to today when no add is outstanding
+		day := uc
+		var addID int64
+		err = tx.QueryRow(outstandingReactionAddQuery,
+			uc.ServerID, uc.MessageID, uc.Source, kindEmoji, emojiID, uc.UserID,
+		).Scan(&addID, &day.Time)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to find reaction add: %w", err)
+		}
+		if err := bumpDailyUsage(tx, kindEmoji, emojiID, day, -1); err != nil {
+			return err
+		}
+		return recordUsageEvent(tx, kindEmoji, emojiID, uc, -1)
+	})
 }
 
-// Extract and track custom emojis from text
-func processCustomEmojis(content string, serverID int64) {
+// Track sticker usage
+func (b *Bot) trackSticker(stickerID int64, stickerName string, uc UsageContext) error {
+	err := b.withTx(func(tx *sql.Tx) error {
+		query := `
+			INSERT INTO stickers (server_id, sticker_id, sticker_name, usage_count, first_used, last_used)
+			VALUES (?, ?, ?, 1, ?, ?)
+			ON CONFLICT(server_id, sticker_id) DO UPDATE SET
+				usage_count = usage_count + 1,
+				first_used = MIN(first_used, excluded.first_used),
+				last_used = MAX(last_used, excluded.last_used)
+		`
+		at := sqliteTime(uc.at())
+		_, err := tx.Exec(query, uc.ServerID, stickerID, stickerName, at, at)
+		if err != nil {
+			return fmt.Errorf("failed to track sticker: %w", err)
+		}
+		if err := bumpDailyUsage(tx, kindSticker, stickerID, uc, 1); err != nil {
+			return err
+		}
+		return recordUsageEvent(tx, kindSticker, stickerID, uc, 1)
+	})
+	if err == nil {
+		b.metrics.itemsTracked.Inc(kindSticker, uc.Source)
+	}
+	return err
+}
+
+// Extract and track custom emojis from text, returning how many were counted.
+// Repeats of an emoji in the text count once unless the server counts repeats.
+func (b *Bot) processCustomEmojis(content string, uc UsageContext) int {
 	matches := customEmojiRegex.FindAllStringSubmatch(content, -1)
+	repeats := b.getGuildSettings(uc.ServerID).CountRepeats
+	seen := make(map[string]bool)
+	counted := 0
 	for _, match := range matches {
+		if !repeats {
+			if seen[match[2]] {
+				continue
+			}
+			seen[match[2]] = true
+		}
 		if len(match) == 3 {
 			animated := false
 			if strings.Contains(match[0], "<a:") {
@@ -224,58 +851,80 @@ func processCustomEmojis(content string, serverID int64) {
 
 			emojiID, err := strconv.ParseInt(emojiIDStr, 10, 64)
 			if err != nil {
-				log.Printf("Error parsing emoji ID %s: %v", emojiIDStr, err)
+				trackingLog.Error("Error parsing emoji ID", append(uc.logAttrs(), "emoji_id", emojiIDStr, "err", err)...)
 				continue
 			}
 
-			if err := trackCustomEmoji(emojiName, emojiID, serverID, animated); err != nil {
-				log.Printf("Error tracking custom emoji %s: %v", emojiName, err)
+			if err := b.trackCustomEmoji(emojiName, emojiID, animated, uc); err != nil {
+				trackingLog.Error("Error tracking custom emoji", append(uc.logAttrs(), "emoji", emojiName, "err", err)...)
 			} else {
-				log.Printf("Tracked custom emoji: %s (ID: %d) (Anim: %s)", emojiName, emojiID, animated)
+				counted++
+				trackingLog.Info("Tracked custom emoji", append(uc.logAttrs(), "emoji", emojiName, idAttr("emoji_id", emojiID), "animated", animated)...)
 			}
 		}
 	}
+	return counted
 }
 
 // Process stickers from a message
-func processStickers(stickers []discord.StickerItem, serverID int64) {
+func (b *Bot) processStickers(stickers []discord.StickerItem, uc UsageContext) {
 	for _, sticker := range stickers {
 		stickerID := int64(sticker.ID)
 		stickerName := sticker.Name
 
-		if err := trackSticker(stickerID, stickerName, serverID); err != nil {
-			log.Printf("Error tracking sticker %s: %v", stickerName, err)
+		if err := b.trackSticker(stickerID, stickerName, uc); err != nil {
+			trackingLog.Error("Error tracking sticker", append(uc.logAttrs(), "sticker", stickerName, "err", err)...)
 		} else {
-			log.Printf("Tracked sticker: %s (ID: %d)", stickerName, stickerID)
+			trackingLog.Info("Tracked sticker", append(uc.logAttrs(), "sticker", stickerName, idAttr("sticker_id", stickerID))...)
 		}
 	}
 }
 
-// Handle message creation events
-func handleMessageCreate(m *gateway.MessageCreateEvent) {
-	// Skip bot messages
-	if m.Author.Bot {
+// Handle message creation events received at the given time
+func (b *Bot) handleMessageCreate(m *gateway.MessageCreateEvent, at time.Time) {
+	// Only track messages from guilds
+	if !m.GuildID.IsValid() {
 		return
 	}
 
-	// Only track messages from guilds
-	if !m.GuildID.IsValid() {
+	settings := b.getGuildSettings(int64(m.GuildID))
+	if m.Author.Bot && !settings.TrackBotMessages {
 		return
 	}
 
-	serverID := int64(m.GuildID)
+	if !b.channelTracked(m.GuildID, m.ChannelID) {
+		return
+	}
+
+	roleIDs := memberRoleIDs(m.Member)
+	if b.rolesIgnored(int64(m.GuildID), roleIDs) {
+		return
+	}
+
+	uc := UsageContext{
+		ServerID:  int64(m.GuildID),
+		ChannelID: int64(m.ChannelID),
+		MessageID: int64(m.ID),
+		UserID:    int64(m.Author.ID),
+		RoleIDs:   roleIDs,
+		Source:    sourceMessage,
+		Time:      at,
+	}
+	b.applyUserPrivacy(&uc)
 
 	// Process custom emojis
-	processCustomEmojis(m.Content, serverID)
+	if settings.TrackMessages {
+		b.processCustomEmojis(m.Content, uc)
+	}
 
 	// Process stickers
-	if len(m.Stickers) > 0 {
-		processStickers(m.Stickers, serverID)
+	if settings.TrackStickers && len(m.Stickers) > 0 {
+		b.processStickers(m.Stickers, uc)
 	}
 }
 
-// Handle reaction add events
-func handleMessageReactionAdd(r *gateway.MessageReactionAddEvent) {
+// Handle reaction add events received at the given time
+func (b *Bot) handleMessageReactionAdd(r *gateway.MessageReactionAddEvent, at time.Time) {
 	// Only track reactions in guilds
 	if !r.GuildID.IsValid() {
 		return
@@ -286,19 +935,41 @@ func handleMessageReactionAdd(r *gateway.MessageReactionAddEvent) {
 		return
 	}
 
-	serverID := int64(r.GuildID)
+	if !b.getGuildSettings(int64(r.GuildID)).TrackReactions {
+		return
+	}
+
+	if !b.channelTracked(r.GuildID, r.ChannelID) {
+		return
+	}
+
+	roleIDs := memberRoleIDs(r.Member)
+	if b.rolesIgnored(int64(r.GuildID), roleIDs) {
+		return
+	}
+
+	uc := UsageContext{
+		ServerID:  int64(r.GuildID),
+		ChannelID: int64(r.ChannelID),
+		MessageID: int64(r.MessageID),
+		UserID:    int64(r.UserID),
+		RoleIDs:   roleIDs,
+		Source:    sourceReaction,
+		Time:      at,
+	}
+	b.applyUserPrivacy(&uc)
 	emojiID := int64(r.Emoji.ID)
 	emojiName := r.Emoji.Name
 
-	if err := trackCustomEmoji(emojiName, emojiID, serverID, r.Emoji.Animated); err != nil {
-		log.Printf("Error tracking reaction emoji %s: %v", emojiName, err)
+	if err := b.trackCustomEmoji(emojiName, emojiID, r.Emoji.Animated, uc); err != nil {
+		trackingLog.Error("Error tracking reaction emoji", append(uc.logAttrs(), "emoji", emojiName, "err", err)...)
 	} else {
-		log.Printf("Tracked reaction emoji: %s (ID: %d) (Anim: %s)", emojiName, emojiID, r.Emoji.Animated)
+		trackingLog.Info("Tracked reaction emoji", append(uc.logAttrs(), "emoji", emojiName, idAttr("emoji_id", emojiID), "animated", r.Emoji.Animated)...)
 	}
 }
 
-// Handle reaction remove events
-func handleMessageReactionRemove(r *gateway.MessageReactionRemoveEvent) {
+// Handle reaction remove events received at the given time
+func (b *Bot) handleMessageReactionRemove(r *gateway.MessageReactionRemoveEvent, at time.Time) {
 	// Only track reactions in guilds
 	if !r.GuildID.IsValid() {
 		return
@@ -309,13 +980,48 @@ func handleMessageReactionRemove(r *gateway.MessageReactionRemoveEvent) {
 		return
 	}
 
-	serverID := int64(r.GuildID)
+	if settings := b.getGuildSettings(int64(r.GuildID)); !settings.TrackReactions || !settings.CountReactionRemovals {
+		return
+	}
+
+	if !b.channelTracked(r.GuildID, r.ChannelID) {
+		return
+	}
+
+	uc := UsageContext{
+		ServerID:  int64(r.GuildID),
+		ChannelID: int64(r.ChannelID),
+		MessageID: int64(r.MessageID),
+		UserID:    int64(r.UserID),
+		Source:    sourceReaction,
+		Time:      at,
+	}
+	b.applyUserPrivacy(&uc)
 	emojiID := int64(r.Emoji.ID)
 
-	if err := decreaseCustomEmoji(emojiID, serverID); err != nil {
-		log.Printf("Error decreasing reaction emoji count (ID: %d): %v", emojiID, err)
+	if uc.UserID == 0 {
+		// The member's adds are stored anonymously, so there's no telling
+		// whether this one was left out for their roles
+		if b.hasRoleFilters(uc.ServerID) {
+			return
+		}
 	} else {
-		log.Printf("Decreased reaction emoji count (ID: %d)", emojiID)
+		// Removal events carry no member, so take the roles from the add
+		roleIDs, found, err := b.reactionAddRoles(uc, emojiID)
+		if err != nil {
+			trackingLog.Error("Error fetching reaction roles", append(uc.logAttrs(), idAttr("emoji_id", emojiID), "err", err)...)
+		}
+		if !found && b.hasRoleFilters(uc.ServerID) {
+			// The add may have been left out for the member's roles
+			return
+		}
+		uc.RoleIDs = roleIDs
+	}
+
+	if err := b.decreaseCustomEmoji(emojiID, uc); err != nil {
+		trackingLog.Error("Error decreasing reaction emoji count", append(uc.logAttrs(), idAttr("emoji_id", emojiID), "err", err)...)
+	} else {
+		trackingLog.Info("Decreased reaction emoji count", append(uc.logAttrs(), idAttr("emoji_id", emojiID))...)
 	}
 }
 
@@ -341,20 +1047,20 @@ func isInGuild(i *discord.InteractionEvent) bool {
 	return i.Member != nil && i.GuildID.IsValid()
 }
 
-func countEmojis(serverID int64) (int, error) {
+func (b *Bot) countEmojis(serverID int64) (int, error) {
 	query := `SELECT COUNT(*) FROM emojis WHERE server_id = ?`
 	var count int
-	err := db.QueryRow(query, serverID).Scan(&count)
+	err := b.DB.QueryRow(query, serverID).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func countStickers(serverID int64) (int, error) {
+func (b *Bot) countStickers(serverID int64) (int, error) {
 	query := `SELECT COUNT(*) FROM stickers WHERE server_id = ?`
 	var count int
-	err := db.QueryRow(query, serverID).Scan(&count)
+	err := b.DB.QueryRow(query, serverID).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -362,9 +1068,9 @@ func countStickers(serverID int64) (int, error) {
 }
 
 // Get emojis from database for a server
-func getEmojis(serverID int64, offset int, limit int) ([]EmojiData, error) {
+func (b *Bot) getEmojis(serverID int64, offset int, limit int) ([]EmojiData, error) {
 	query := `SELECT emote_name, emote_id, usage_count, last_used, animated FROM emojis WHERE server_id = ? ORDER BY usage_count DESC, last_used DESC LIMIT ? OFFSET ?`
-	rows, err := db.Query(query, serverID, limit, offset)
+	rows, err := b.DB.Query(query, serverID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -382,9 +1088,9 @@ func getEmojis(serverID int64, offset int, limit int) ([]EmojiData, error) {
 }
 
 // Get stickers from database for a server
-func getStickers(serverID int64, offset int, limit int) ([]StickerData, error) {
+func (b *Bot) getStickers(serverID int64, offset int, limit int) ([]StickerData, error) {
 	query := `SELECT sticker_name, sticker_id, usage_count, last_used FROM stickers WHERE server_id = ? ORDER BY usage_count DESC, last_used DESC LIMIT ? OFFSET ?`
-	rows, err := db.Query(query, serverID, limit, offset)
+	rows, err := b.DB.Query(query, serverID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -402,20 +1108,20 @@ func getStickers(serverID int64, offset int, limit int) ([]StickerData, error) {
 }
 
 // Retrieve guild emojis (with caching)
-func getGuildEmojis(s *state.State, guildID discord.GuildID) ([]discord.Emoji, error) {
-	emojiCacheMutex.Lock()
-	defer emojiCacheMutex.Unlock()
+func (b *Bot) getGuildEmojis(guildID discord.GuildID) ([]discord.Emoji, error) {
+	b.emojiCacheMutex.Lock()
+	defer b.emojiCacheMutex.Unlock()
 
-	if cached, ok := emojiCache[guildID]; ok && time.Now().Before(cached.ExpiresAt) {
+	if cached, ok := b.emojiCache[guildID]; ok && time.Now().Before(cached.ExpiresAt) {
 		return cached.Emojis, nil
 	}
 
-	emojis, err := s.Emojis(guildID)
+	emojis, err := b.Client.Emojis(guildID)
 	if err != nil {
 		return nil, err
 	}
 
-	emojiCache[guildID] = CachedEmojiList{
+	b.emojiCache[guildID] = CachedEmojiList{
 		Emojis:    emojis,
 		ExpiresAt: time.Now().Add(24 * time.Hour),
 	}
@@ -423,6 +1129,31 @@ func getGuildEmojis(s *state.State, guildID discord.GuildID) ([]discord.Emoji, e
 	return emojis, nil
 }
 
+// Handle guild emoji list changes
+func (b *Bot) handleGuildEmojisUpdate(e *gateway.GuildEmojisUpdateEvent) {
+	b.emojiCacheMutex.Lock()
+	b.emojiCache[e.GuildID] = CachedEmojiList{
+		Emojis:    e.Emojis,
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+	}
+	b.emojiCacheMutex.Unlock()
+
+	if b.Images == nil {
+		return
+	}
+	if err := b.Images.RetainDeletedEmojis(int64(e.GuildID), e.Emojis); err != nil {
+		imageLog.Error("Error retaining deleted emoji images", idAttr("guild_id", int64(e.GuildID)), "err", err)
+	}
+	// Downloads would hold up the gateway's events
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emojiImagePrefetchTimeout)
+		defer cancel()
+		if err := b.Images.CacheEmojis(ctx, int64(e.GuildID), e.Emojis); err != nil {
+			imageLog.Warn("Error caching new emoji images", idAttr("guild_id", int64(e.GuildID)), "err", err)
+		}
+	}()
+}
+
 // Create pagination buttons
 func createPaginationButtons(page, totalPages int, customIDPrefix string) *discord.ActionRowComponent {
 	row := discord.ActionRowComponent{}
@@ -489,9 +1220,30 @@ func createPageJumpModalResponse(customId string, page int) api.InteractionRespo
 	return resp
 }
 
+// Format an emoji as a list line, with the count in the number format of a locale
+func formatEmojiLine(e EmojiData, locale string) string {
+	if e.Animated {
+		return fmt.Sprintf("- <a:%s:%d> **x%s** (Last: <t:%d:R>)\n", e.Name, e.ID, formatCount(e.Count, locale), e.LastUsed.Unix())
+	}
+	return fmt.Sprintf("- <:%s:%d> **x%s** (Last: <t:%d:R>)\n", e.Name, e.ID, formatCount(e.Count, locale), e.LastUsed.Unix())
+}
+
+// Create an embed showing a sticker and its count
+func createStickerEmbed(s StickerData, locale string) discord.Embed {
+	return discord.Embed{
+		Title: fmt.Sprintf("%s x%s", s.Name, formatCount(s.Count, locale)),
+		Image: &discord.EmbedImage{URL: stickerImageURL(s.ID)},
+	}
+}
+
+// Number of pages listing total items
+func pageCount(total, perPage int) int {
+	return total/perPage + 1
+}
+
 // Create emoji list message
-func createEmojiListMessage(emojis []EmojiData, page int, totalPages int) api.InteractionResponseData {
-	const perPage = 25
+func createEmojiListMessage(emojis []EmojiData, page int, totalPages int, settings GuildSettings) api.InteractionResponseData {
+	perPage := settings.EmojiPageSize
 
 	var content strings.Builder
 	content.WriteString("**Custom Emoji Usage Statistics**\n\n")
@@ -501,11 +1253,7 @@ func createEmojiListMessage(emojis []EmojiData, page int, totalPages int) api.In
 	} else {
 		for i := 0; i < min(perPage, len(emojis)); i++ {
 			e := emojis[i]
-			if e.Animated {
-				content.WriteString(fmt.Sprintf("- <a:%s:%d> **x%d** (Last: <t:%d:R>)\n", e.Name, e.ID, e.Count, e.LastUsed.Unix()))
-			} else {
-				content.WriteString(fmt.Sprintf("- <:%s:%d> **x%d** (Last: <t:%d:R>)\n", e.Name, e.ID, e.Count, e.LastUsed.Unix()))
-			}
+			content.WriteString(formatEmojiLine(e, settings.Locale))
 		}
 	}
 
@@ -521,8 +1269,8 @@ func createEmojiListMessage(emojis []EmojiData, page int, totalPages int) api.In
 }
 
 // Create sticker list message
-func createStickerListMessage(stickers []StickerData, page int, totalPages int) api.InteractionResponseData {
-	const perPage = 5
+func createStickerListMessage(stickers []StickerData, page int, totalPages int, settings GuildSettings) api.InteractionResponseData {
+	perPage := settings.StickerPageSize
 
 	var content strings.Builder
 	content.WriteString("**Sticker Usage Statistics**\n\n")
@@ -534,11 +1282,7 @@ func createStickerListMessage(stickers []StickerData, page int, totalPages int)
 	embeds := []discord.Embed{}
 
 	for i := 0; i < min(perPage, len(stickers)); i++ {
-		s := stickers[i]
-		embeds = append(embeds, discord.Embed{
-			Title: fmt.Sprintf("%s x%d", s.Name, s.Count),
-			Image: &discord.EmbedImage{URL: fmt.Sprintf("https://media.discordapp.net/stickers/%d.webp?size=96&quality=lossless", s.ID)},
-		})
+		embeds = append(embeds, createStickerEmbed(stickers[i], settings.Locale))
 	}
 
 	return api.InteractionResponseData{
@@ -549,7 +1293,7 @@ func createStickerListMessage(stickers []StickerData, page int, totalPages int)
 }
 
 // Handle slash commands
-func handleCommandInteraction(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleCommandInteraction(i *gateway.InteractionCreateEvent) {
 	if i.Data.InteractionType() != discord.CommandInteractionType {
 		return
 	}
@@ -558,130 +1302,156 @@ func handleCommandInteraction(i *gateway.InteractionCreateEvent) {
 
 	switch data.Name {
 	case "listemotes":
-		handleListEmotes(i)
+		b.handleListEmotes(i)
 	case "liststickers":
-		handleListStickers(i)
+		b.handleListStickers(i)
 	case "resetcount":
-		handleResetCount(i)
+		b.handleResetCount(i)
 	case "listleastused":
-		handleListLeastUsed(i)
+		b.handleListLeastUsed(i)
+	case "trending":
+		b.handleTrending(i)
+	case "digest":
+		b.handleDigest(i)
+	case "slots":
+		b.handleSlots(i)
+	case "prune":
+		b.handlePrune(i)
+	case "emojivote":
+		b.handleEmojiVote(i)
+	case "export":
+		b.handleExport(i)
+	case "import":
+		b.handleImport(i)
+	case "backfill":
+		b.handleBackfill(i)
+	case "reconcile":
+		b.handleReconcile(i)
+	case "outages":
+		b.handleOutages(i)
+	case "apitoken":
+		b.handleAPIToken(i)
+	case "dashboard":
+		b.handleDashboard(i)
+	case "config":
+		b.handleConfig(i)
+	case "tracking":
+		b.handleTracking(i)
+	case "rolestats":
+		b.handleRoleStats(i)
+	case "privacy":
+		b.handlePrivacy(i)
+	case "myemojis":
+		b.handleMyEmojis(i)
 	}
 }
 
 // Handle /listemotes command
-func handleListEmotes(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleListEmotes(i *gateway.InteractionCreateEvent) {
 	if !isInGuild(&i.InteractionEvent) {
-		respondError(i, "This command can only be used in a server.")
+		b.respondError(i, "This command can only be used in a server.")
 		return
 	}
 
-	share := false
-	if len(i.Data.(*discord.CommandInteraction).Options) > 0 {
-		opts := i.Data.(*discord.CommandInteraction).Options
-		share, _ = opts.Find("share").BoolValue()
-	}
-
 	serverID := int64(i.GuildID)
+	settings := b.getGuildSettings(serverID)
+	share := shareList(i.Data.(*discord.CommandInteraction).Options, settings)
 
-	totalEmojis, err := countEmojis(serverID)
+	totalEmojis, err := b.countEmojis(serverID)
 	if err != nil {
-		log.Printf("Error counting emojis: %v", err)
-		respondError(i, "Failed to count emojis.")
+		b.interactionLog(i).Error("Error counting emojis", "err", err)
+		b.respondError(i, "Failed to count emojis.")
 		return
 	}
 
-	emojis, err := getEmojis(serverID, 0, 25)
+	emojis, err := b.getEmojis(serverID, 0, settings.EmojiPageSize)
 	if err != nil {
-		log.Printf("Error fetching emojis: %v", err)
-		respondError(i, "Failed to fetch emoji data.")
+		b.interactionLog(i).Error("Error fetching emojis", "err", err)
+		b.respondError(i, "Failed to fetch emoji data.")
 		return
 	}
 
 	if len(emojis) == 0 {
-		respondError(i, "No emoji data found for this server.")
+		b.respondError(i, "No emoji data found for this server.")
 		return
 	}
 
-	response := createEmojiListMessage(emojis, 0, totalEmojis/25+1)
+	response := createEmojiListMessage(emojis, 0, pageCount(totalEmojis, settings.EmojiPageSize), settings)
 
 	if share {
 		response.Flags &= ^discord.EphemeralMessage
 	}
 
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.MessageInteractionWithSource,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error responding to interaction: %v\n%+v", err, response)
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
 	}
 }
 
 // Handle /liststickers command
-func handleListStickers(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleListStickers(i *gateway.InteractionCreateEvent) {
 	if !isInGuild(&i.InteractionEvent) {
-		respondError(i, "This command can only be used in a server.")
+		b.respondError(i, "This command can only be used in a server.")
 		return
 	}
 
-	share := false
-	if len(i.Data.(*discord.CommandInteraction).Options) > 0 {
-		opts := i.Data.(*discord.CommandInteraction).Options
-		share, _ = opts.Find("share").BoolValue()
-	}
-
 	serverID := int64(i.GuildID)
+	settings := b.getGuildSettings(serverID)
+	share := shareList(i.Data.(*discord.CommandInteraction).Options, settings)
 
-	totalStickers, err := countStickers(serverID)
+	totalStickers, err := b.countStickers(serverID)
 	if err != nil {
-		log.Printf("Error counting stickers: %v", err)
-		respondError(i, "Failed to count stickers.")
+		b.interactionLog(i).Error("Error counting stickers", "err", err)
+		b.respondError(i, "Failed to count stickers.")
 		return
 	}
-	stickers, err := getStickers(serverID, 0, 5)
+	stickers, err := b.getStickers(serverID, 0, settings.StickerPageSize)
 	if err != nil {
-		log.Printf("Error fetching stickers: %v", err)
-		respondError(i, "Failed to fetch sticker data.")
+		b.interactionLog(i).Error("Error fetching stickers", "err", err)
+		b.respondError(i, "Failed to fetch sticker data.")
 		return
 	}
 
 	if len(stickers) == 0 {
-		respondError(i, "No sticker data found for this server.")
+		b.respondError(i, "No sticker data found for this server.")
 		return
 	}
 
-	response := createStickerListMessage(stickers, 0, totalStickers/5+1)
+	response := createStickerListMessage(stickers, 0, pageCount(totalStickers, settings.StickerPageSize), settings)
 
 	if share {
 		response.Flags &= ^discord.EphemeralMessage
 	}
 
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.MessageInteractionWithSource,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error responding to interaction: %v\n%+v", err, response)
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
 	}
 }
 
 // Handle /listleastused command
-func handleListLeastUsed(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleListLeastUsed(i *gateway.InteractionCreateEvent) {
 	if !isInGuild(&i.InteractionEvent) {
-		respondError(i, "This command can only be used in a server.")
+		b.respondError(i, "This command can only be used in a server.")
 		return
 	}
 
 	serverID := i.GuildID
 
 	// Get live emojis (cached)
-	liveEmojis, err := getGuildEmojis(botState, serverID)
+	liveEmojis, err := b.getGuildEmojis(serverID)
 	if err != nil {
-		log.Printf("Error fetching guild emojis: %v", err)
-		respondError(i, "Failed to fetch guild emojis.")
+		b.interactionLog(i).Error("Error fetching guild emojis", "err", err)
+		b.respondError(i, "Failed to fetch guild emojis.")
 		return
 	}
 
 	if len(liveEmojis) == 0 {
-		respondError(i, "No custom emojis found in this server.")
+		b.respondError(i, "No custom emojis found in this server.")
 		return
 	}
 
@@ -700,10 +1470,10 @@ func handleListLeastUsed(i *gateway.InteractionCreateEvent) {
 	}
 	queryBuilder.WriteString(") ORDER BY usage_count ASC, last_used ASC LIMIT 25")
 
-	rows, err := db.Query(queryBuilder.String(), args...)
+	rows, err := b.DB.Query(queryBuilder.String(), args...)
 	if err != nil {
-		log.Printf("Error fetching emoji usage: %v", err)
-		respondError(i, "Failed to fetch usage data.")
+		b.interactionLog(i).Error("Error fetching emoji usage", "err", err)
+		b.respondError(i, "Failed to fetch usage data.")
 		return
 	}
 	defer rows.Close()
@@ -712,23 +1482,20 @@ func handleListLeastUsed(i *gateway.InteractionCreateEvent) {
 	for rows.Next() {
 		var e EmojiData
 		if err := rows.Scan(&e.Name, &e.ID, &e.Count, &e.LastUsed); err != nil {
-			log.Printf("Error scanning row: %v", err)
+			b.interactionLog(i).Error("Error scanning row", "err", err)
 			continue
 		}
 		topCandidates = append(topCandidates, e)
 	}
 
+	locale := b.getGuildSettings(int64(serverID)).Locale
 	var content strings.Builder
 	content.WriteString("**Least Used Custom Emojis (tracked)**\n\n")
 	if len(topCandidates) == 0 {
 		content.WriteString("No tracked emojis found in the current guild list.")
 	} else {
 		for _, e := range topCandidates {
-			if e.Animated {
-				content.WriteString(fmt.Sprintf("- <a:%s:%d> **x%d** (Last: <t:%d:R>)\n", e.Name, e.ID, e.Count, e.LastUsed.Unix()))
-			} else {
-				content.WriteString(fmt.Sprintf("- <:%s:%d> **x%d** (Last: <t:%d:R>)\n", e.Name, e.ID, e.Count, e.LastUsed.Unix()))
-			}
+			content.WriteString(formatEmojiLine(e, locale))
 		}
 	}
 
@@ -738,31 +1505,44 @@ func handleListLeastUsed(i *gateway.InteractionCreateEvent) {
 	}
 
 	// Respond
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.MessageInteractionWithSource,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error responding to interaction: %v", err)
+		b.interactionLog(i).Error("Error responding to interaction", "err", err)
 	}
 }
 
 // Handle /resetcount command
-func handleResetCount(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleResetCount(i *gateway.InteractionCreateEvent) {
 	if !isInGuild(&i.InteractionEvent) {
-		respondError(i, "This command can only be used in a server.")
+		b.respondError(i, "This command can only be used in a server.")
 		return
 	}
 
 	serverID := int64(i.GuildID)
 
-	// Reset emoji counts
-	_, err1 := db.Exec("DELETE FROM emojis WHERE server_id = ?", serverID)
-	// Reset sticker counts
-	_, err2 := db.Exec("DELETE FROM stickers WHERE server_id = ?", serverID)
-
-	if err1 != nil || err2 != nil {
-		log.Printf("Error resetting counts: %v, %v", err1, err2)
-		respondError(i, "Failed to reset counts.")
+	// Everything is cleared together so a failure can't leave counts and history out of step
+	err := b.withTx(func(tx *sql.Tx) error {
+		for _, table := range []string{
+			"emojis",
+			"stickers",
+			"usage_daily",
+			"usage_events",
+			"usage_rollups",
+			"usage_role_rollups",
+			// Lets /backfill count compacted history again
+			"retention_state",
+		} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE server_id = ?", serverID); err != nil {
+				return fmt.Errorf("failed to reset %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.interactionLog(i).Error("Error resetting counts", "err", err)
+		b.respondError(i, "Failed to reset counts.")
 		return
 	}
 
@@ -771,26 +1551,50 @@ func handleResetCount(i *gateway.InteractionCreateEvent) {
 		Flags:   discord.EphemeralMessage,
 	}
 
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.MessageInteractionWithSource,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error responding to interaction: %v\n%+v", err, response)
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
 	}
 }
 
 // Handle button interactions for pagination
-func handleButtonInteraction(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleButtonInteraction(i *gateway.InteractionCreateEvent) {
 	if i.Data.InteractionType() != discord.ComponentInteractionType {
 		return
 	}
 
+	if data, ok := i.Data.(*discord.StringSelectInteraction); ok {
+		if data.CustomID == "prune_select" {
+			b.handlePruneSelect(i, data)
+		}
+		return
+	}
+
 	data, ok := i.Data.(*discord.ButtonInteraction)
 	if !ok {
 		return
 	}
 
 	customID := string(data.CustomID)
+	if strings.HasPrefix(customID, "prune_") {
+		b.handlePruneButton(i, customID)
+		return
+	}
+	if strings.HasPrefix(customID, "import_") {
+		b.handleImportButton(i, customID)
+		return
+	}
+	if strings.HasPrefix(customID, "privacy_") {
+		b.handlePrivacyButton(i, customID)
+		return
+	}
+	if strings.HasPrefix(customID, "emojivote:") {
+		b.handleEmojiVoteButton(i, customID)
+		return
+	}
+
 	// Parse custom ID (format: "emoji_page:0" or "sticker_page:2")
 	parts := strings.Split(customID, ":")
 	if len(parts) < 2 {
@@ -803,68 +1607,69 @@ func handleButtonInteraction(i *gateway.InteractionCreateEvent) {
 
 	if len(parts) > 2 && parts[2] == "jump" {
 		resp := createPageJumpModalResponse(customID, page)
-		if err := botState.RespondInteraction(i.ID, i.Token, resp); err != nil {
-			log.Printf("Error responding to interaction: %v\n%+v", err, resp)
+		if err := b.Client.RespondInteraction(i.ID, i.Token, resp); err != nil {
+			b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", resp)
 		}
 		return
 	}
 
 	serverID := int64(i.GuildID)
+	settings := b.getGuildSettings(serverID)
 
 	var response api.InteractionResponseData
 
 	if strings.HasPrefix(customID, "emoji_page:") {
-		totalEmojis, err := countEmojis(serverID)
+		totalEmojis, err := b.countEmojis(serverID)
 		if err != nil {
-			log.Printf("Error counting emojis: %v", err)
+			b.interactionLog(i).Error("Error counting emojis", "err", err)
 			return
 		}
-		emojis, err := getEmojis(serverID, 25*page, 25)
+		emojis, err := b.getEmojis(serverID, settings.EmojiPageSize*page, settings.EmojiPageSize)
 		if err != nil {
-			log.Printf("Error fetching emojis: %v", err)
+			b.interactionLog(i).Error("Error fetching emojis", "err", err)
 			return
 		}
-		response = createEmojiListMessage(emojis, page, totalEmojis/25+1)
+		response = createEmojiListMessage(emojis, page, pageCount(totalEmojis, settings.EmojiPageSize), settings)
 	} else if strings.HasPrefix(customID, "sticker_page:") {
-		totalStickers, err := countStickers(serverID)
+		totalStickers, err := b.countStickers(serverID)
 		if err != nil {
-			log.Printf("Error counting stickers: %v", err)
+			b.interactionLog(i).Error("Error counting stickers", "err", err)
 			return
 		}
-		stickers, err := getStickers(serverID, 5*page, 5)
+		stickers, err := b.getStickers(serverID, settings.StickerPageSize*page, settings.StickerPageSize)
 		if err != nil {
-			log.Printf("Error fetching stickers: %v", err)
+			b.interactionLog(i).Error("Error fetching stickers", "err", err)
 			return
 		}
-		response = createStickerListMessage(stickers, page, totalStickers/5+1)
+		response = createStickerListMessage(stickers, page, pageCount(totalStickers, settings.StickerPageSize), settings)
 	} else {
 		return
 	}
 
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.UpdateMessage,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error updating message: %v", err)
+		b.interactionLog(i).Error("Error updating message", "err", err)
 	}
 }
 
 // Helper function to respond with error
-func respondError(i *gateway.InteractionCreateEvent, message string) {
+func (b *Bot) respondError(i *gateway.InteractionCreateEvent, message string) {
 	response := api.InteractionResponseData{
 		Content: option.NewNullableString("❌ " + message),
 		Flags:   discord.EphemeralMessage,
 	}
 
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.MessageInteractionWithSource,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error responding with error: %v", err)
+		b.interactionLog(i).Error("Error responding with error", "err", err)
 	}
 }
 
-func handlePageJumpInteraction(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handlePageJumpInteraction(i *gateway.InteractionCreateEvent) {
 	data := i.Data.(*discord.ModalInteraction)
 
 	input, is := data.Components.Find(discord.ComponentID("page_input")).(*discord.TextInputComponent)
@@ -878,12 +1683,15 @@ func handlePageJumpInteraction(i *gateway.InteractionCreateEvent) {
 	}
 	pageNum -= 1
 
-	totalEmojis, err := countEmojis(int64(i.GuildID))
+	serverID := int64(i.GuildID)
+	settings := b.getGuildSettings(serverID)
+
+	totalEmojis, err := b.countEmojis(serverID)
 	if err != nil {
 		return
 	}
 
-	totalPages := totalEmojis/25 + 1
+	totalPages := pageCount(totalEmojis, settings.EmojiPageSize)
 
 	if pageNum < 0 || pageNum > totalPages-1 {
 		return
@@ -891,57 +1699,56 @@ func handlePageJumpInteraction(i *gateway.InteractionCreateEvent) {
 
 	var response api.InteractionResponseData
 	if strings.HasPrefix(string(data.CustomID), "emoji_page:") {
-		totalEmojis, err := countEmojis(int64(i.GuildID))
-		if err != nil {
-			log.Printf("Error counting emojis: %v", err)
-			return
-		}
-		emojis, err := getEmojis(int64(i.GuildID), 25*pageNum, 25)
+		emojis, err := b.getEmojis(serverID, settings.EmojiPageSize*pageNum, settings.EmojiPageSize)
 		if err != nil {
-			log.Printf("Error fetching emojis: %v", err)
+			b.interactionLog(i).Error("Error fetching emojis", "err", err)
 			return
 		}
-		response = createEmojiListMessage(emojis, pageNum, totalEmojis/25+1)
+		response = createEmojiListMessage(emojis, pageNum, totalPages, settings)
 	} else if strings.HasPrefix(string(data.CustomID), "sticker_page:") {
-		totalStickers, err := countStickers(int64(i.GuildID))
+		totalStickers, err := b.countStickers(serverID)
 		if err != nil {
-			log.Printf("Error counting stickers: %v", err)
+			b.interactionLog(i).Error("Error counting stickers", "err", err)
 			return
 		}
-		stickers, err := getStickers(int64(i.GuildID), 5*pageNum, 5)
+		stickers, err := b.getStickers(serverID, settings.StickerPageSize*pageNum, settings.StickerPageSize)
 		if err != nil {
-			log.Printf("Error fetching stickers: %v", err)
+			b.interactionLog(i).Error("Error fetching stickers", "err", err)
 			return
 		}
-		response = createStickerListMessage(stickers, pageNum, totalStickers/5+1)
+		response = createStickerListMessage(stickers, pageNum, pageCount(totalStickers, settings.StickerPageSize), settings)
 	} else {
 		return
 	}
 
-	if err := botState.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
 		Type: api.UpdateMessage,
 		Data: &response,
 	}); err != nil {
-		log.Printf("Error updating message: %v", err)
+		b.interactionLog(i).Error("Error updating message", "err", err)
 	}
 
 }
 
 // Handle interaction creation events
-func handleInteractionCreate(i *gateway.InteractionCreateEvent) {
+func (b *Bot) handleInteractionCreate(i *gateway.InteractionCreateEvent) {
+	label := interactionLabel(i)
+	b.metrics.interactions.Inc(label)
+	defer b.metrics.interactionLatency.Since(time.Now(), label)
+
 	// Handle commands and buttons
 	switch i.Data.InteractionType() {
 	case discord.CommandInteractionType:
-		handleCommandInteraction(i)
+		b.handleCommandInteraction(i)
 	case discord.ComponentInteractionType:
-		handleButtonInteraction(i)
+		b.handleButtonInteraction(i)
 	case discord.ModalInteractionType:
-		handlePageJumpInteraction(i)
+		b.handlePageJumpInteraction(i)
 	}
 }
 
 // Register application commands
-func registerCommands(s *state.State, appID discord.AppID) error {
+func registerCommands(c DiscordClient, appID discord.AppID) error {
 	manageGuildPerm := discord.NewPermissions(discord.PermissionManageGuild)
 
 	commands := []api.CreateCommandData{
@@ -971,63 +1778,347 @@ func registerCommands(s *state.State, appID discord.AppID) error {
 			Description:              "List least used emojis from the current guild list found in the database",
 			DefaultMemberPermissions: manageGuildPerm,
 		},
+		{
+			Name:                     "trending",
+			Description:              "List emojis and stickers growing fastest against their own baseline (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				&discord.IntegerOption{OptionName: "days", Description: "Recent window in days (default 7)", Min: option.NewInt(1), Max: option.NewInt(30)},
+				&discord.IntegerOption{OptionName: "baseline", Description: "Baseline window in days before the recent window (default 28)", Min: option.NewInt(1), Max: option.NewInt(90)},
+				&discord.IntegerOption{OptionName: "min_count", Description: "Minimum uses in the recent window (default 5)", Min: option.NewInt(1)},
+				discord.NewBooleanOption("share", "Everyone can see the list", false),
+			},
+		},
+		{
+			Name:                     "digest",
+			Description:              "Configure the scheduled emoji digest (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("channel", "Post the digest to a channel and enable it",
+					&discord.ChannelOption{OptionName: "channel", Description: "Channel to post the digest in", Required: true, ChannelTypes: []discord.ChannelType{discord.GuildText, discord.GuildAnnouncement}},
+				),
+				discord.NewSubcommandOption("schedule", "Set when the digest is posted",
+					discord.NewStringOption("cron", "Cron expression in UTC, e.g. \"0 9 * * 1\" or \"@weekly\"", true),
+				),
+				discord.NewSubcommandOption("preview", "Show the digest now, only to you"),
+				discord.NewSubcommandOption("disable", "Stop posting the digest"),
+			},
+		},
+		{
+			Name:                     "slots",
+			Description:              "Show emoji and sticker slot usage and recommend removals (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				&discord.IntegerOption{OptionName: "days", Description: "Window for recent usage in days (default 30)", Min: option.NewInt(1), Max: option.NewInt(365)},
+				&discord.NumberOption{OptionName: "weight_usage", Description: "Weight of low recent usage (default 1)", Min: option.NewFloat(0), Max: option.NewFloat(10)},
+				&discord.NumberOption{OptionName: "weight_age", Description: "Weight of emoji age (default 1)", Min: option.NewFloat(0), Max: option.NewFloat(10)},
+				&discord.NumberOption{OptionName: "weight_users", Description: "Weight of few distinct users (default 1)", Min: option.NewFloat(0), Max: option.NewFloat(10)},
+			},
+		},
+		{
+			Name:                     "prune",
+			Description:              "Propose least useful emojis and stickers for deletion (Moderator only)",
+			DefaultMemberPermissions: discord.NewPermissions(discord.PermissionManageGuild | discord.PermissionManageEmojisAndStickers),
+			Options: []discord.CommandOption{
+				&discord.IntegerOption{OptionName: "count", Description: "Number of candidates to propose (default 10)", Min: option.NewInt(1), Max: option.NewInt(maxPruneCount)},
+			},
+		},
+		{
+			Name:                     "emojivote",
+			Description:              "Start a community vote on adding or removing an emoji (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("add", "Propose adding an uploaded image as an emoji",
+					discord.NewStringOption("name", "Name of the new emoji", true),
+					&discord.AttachmentOption{OptionName: "image", Description: "PNG, JPEG or GIF up to 256 KB", Required: true},
+					&discord.IntegerOption{OptionName: "hours", Description: "How long the vote stays open (default 24)", Min: option.NewInt(1), Max: option.NewInt(maxPollHours)},
+					discord.NewBooleanOption("apply", "Add the emoji automatically if the vote passes", false),
+				),
+				discord.NewSubcommandOption("remove", "Propose removing an existing emoji",
+					discord.NewStringOption("emoji", "The emoji or its name", true),
+					&discord.IntegerOption{OptionName: "hours", Description: "How long the vote stays open (default 24)", Min: option.NewInt(1), Max: option.NewInt(maxPollHours)},
+					discord.NewBooleanOption("apply", "Remove the emoji automatically if the vote passes", false),
+				),
+			},
+		},
+		{
+			Name:                     "export",
+			Description:              "Export this server's statistics as a file (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				&discord.StringOption{OptionName: "format", Description: "File format", Required: true, Choices: []discord.StringChoice{
+					{Name: "CSV", Value: exportFormatCSV},
+					{Name: "JSON", Value: exportFormatJSON},
+				}},
+				&discord.StringOption{OptionName: "type", Description: "What to export", Required: true, Choices: []discord.StringChoice{
+					{Name: "Emojis", Value: exportTypeEmojis},
+					{Name: "Stickers", Value: exportTypeStickers},
+					{Name: "Usage events", Value: exportTypeEvents},
+					{Name: "Compacted usage", Value: exportTypeRollups},
+				}},
+			},
+		},
+		{
+			Name:                     "import",
+			Description:              "Import emoji and sticker counts from an export or another bot (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				&discord.AttachmentOption{OptionName: "file", Description: "CSV or JSON export, optionally gzipped", Required: true},
+				&discord.StringOption{OptionName: "strategy", Description: "How to merge with existing counts", Required: true, Choices: []discord.StringChoice{
+					{Name: "Add to existing counts", Value: importStrategyAdd},
+					{Name: "Replace existing counts", Value: importStrategyReplace},
+					{Name: "Keep the larger count", Value: importStrategyMax},
+				}},
+				discord.NewStringOption("mapping", "Columns of another bot's CSV, e.g. \"id=Emoji,count=Uses\"", false),
+				&discord.StringOption{OptionName: "kind", Description: "What a mapped CSV contains (default emojis)", Choices: []discord.StringChoice{
+					{Name: "Emojis", Value: kindEmoji},
+					{Name: "Stickers", Value: kindSticker},
+				}},
+			},
+		},
+		{
+			Name:                     "backfill",
+			Description:              "Count emojis and stickers from message history (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("start", "Crawl message history back to a date",
+					discord.NewStringOption("since", "Oldest date to crawl, YYYY-MM-DD (UTC)", true),
+					&discord.ChannelOption{OptionName: "channel", Description: "Only crawl this channel (default all readable channels)", ChannelTypes: []discord.ChannelType{discord.GuildText, discord.GuildAnnouncement}},
+				),
+				discord.NewSubcommandOption("status", "Show the progress of the backfill"),
+				discord.NewSubcommandOption("cancel", "Stop the running backfill"),
+			},
+		},
+		{
+			Name:                     "reconcile",
+			Description:              "Check recorded reactions against Discord and correct drift (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("run", "Reconcile recently active messages now"),
+				discord.NewSubcommandOption("stats", "Show how many reactions had to be corrected",
+					&discord.IntegerOption{OptionName: "days", Description: "Window in days (default 30)", Min: option.NewInt(1), Max: option.NewInt(365)},
+				),
+			},
+		},
+		{
+			Name:                     "outages",
+			Description:              "Show when the bot was offline and recover missed usage (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("list", "List recent outages"),
+				discord.NewSubcommandOption("backfill", "Backfill an outage from message history in active channels",
+					&discord.IntegerOption{OptionName: "id", Description: "Outage ID from /outages list", Required: true, Min: option.NewInt(1)},
+				),
+			},
+		},
+		{
+			Name:                     "apitoken",
+			Description:              "Manage tokens for the HTTP statistics API (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("create", "Create a read-only token for this server",
+					discord.NewStringOption("name", "Label to recognize the token by", true),
+				),
+				discord.NewSubcommandOption("list", "List this server's tokens"),
+				discord.NewSubcommandOption("revoke", "Revoke a token",
+					&discord.IntegerOption{OptionName: "id", Description: "Token ID from /apitoken list", Required: true, Min: option.NewInt(1)},
+				),
+			},
+		},
+		{
+			Name:                     "dashboard",
+			Description:              "Get a one-time login link to the web dashboard in DMs (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+		},
+		{
+			Name:                     "config",
+			Description:              "View and change how this server is tracked (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("view", "Show every setting and its value"),
+				discord.NewSubcommandOption("set", "Change a setting",
+					&discord.StringOption{OptionName: "setting", Description: "Setting to change", Required: true, Choices: settingChoices()},
+					discord.NewStringOption("value", "New value, e.g. true, 10 or public", true),
+				),
+				discord.NewSubcommandOption("reset", "Put settings back to their defaults",
+					&discord.StringOption{OptionName: "setting", Description: "Setting to reset (default all)", Choices: settingChoices()},
+				),
+				discord.NewSubcommandOption("history", "Show who changed which settings"),
+				discord.NewSubcommandOption("rotate_secret", "Replace the secret of pseudonymized user IDs and re-key stored usage"),
+			},
+		},
+		{
+			Name:                     "tracking",
+			Description:              "Choose which channels and categories are tracked (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("ignore", "Stop tracking usage in a channel or category",
+					&discord.ChannelOption{OptionName: "channel", Description: "Channel or category to ignore", Required: true, ChannelTypes: filterableChannelTypes},
+				),
+				discord.NewSubcommandOption("allow", "Track a channel or category; once any is allowed, only allowed ones are tracked",
+					&discord.ChannelOption{OptionName: "channel", Description: "Channel or category to allow", Required: true, ChannelTypes: filterableChannelTypes},
+				),
+				discord.NewSubcommandOption("clear", "Take a channel or category off the ignore and allow lists",
+					&discord.ChannelOption{OptionName: "channel", Description: "Channel or category to clear", Required: true, ChannelTypes: filterableChannelTypes},
+				),
+				discord.NewSubcommandOption("ignore_role", "Stop counting usage by members with a role",
+					&discord.RoleOption{OptionName: "role", Description: "Role to ignore", Required: true},
+				),
+				discord.NewSubcommandOption("clear_role", "Count usage by members with a role again",
+					&discord.RoleOption{OptionName: "role", Description: "Role to stop ignoring", Required: true},
+				),
+				discord.NewSubcommandOption("list", "Show the ignore and allow lists and ignored roles"),
+			},
+		},
+		{
+			Name:                     "rolestats",
+			Description:              "Show which emojis and stickers a role's members use most (Moderator only)",
+			DefaultMemberPermissions: manageGuildPerm,
+			Options: []discord.CommandOption{
+				&discord.RoleOption{OptionName: "role", Description: "Role to report on", Required: true},
+				&discord.IntegerOption{OptionName: "days", Description: "Only the last days (default all time)", Min: option.NewInt(1), Max: option.NewInt(365)},
+				discord.NewBooleanOption("share", "Everyone can see the list", false),
+			},
+		},
+		{
+			Name:        "myemojis",
+			Description: "Show the emojis and stickers you use most in this server",
+		},
+		{
+			Name:        "privacy",
+			Description: "Control the emoji and sticker usage data stored about you",
+			Options: []discord.CommandOption{
+				discord.NewSubcommandOption("optout", "Stop attributing your usage to you; it still counts anonymously"),
+				discord.NewSubcommandOption("optin", "Attribute your usage to you again"),
+				discord.NewSubcommandOption("delete", "Erase the usage attributed to you"),
+				discord.NewSubcommandOption("export", "Get your data as JSON in DMs"),
+			},
+		},
 	}
 
-	if _, err := s.BulkOverwriteCommands(appID, commands); err != nil {
+	if _, err := c.BulkOverwriteCommands(appID, commands); err != nil {
 		return fmt.Errorf("failed to create command %s: %w", commands[0].Name, err)
 	}
 	return nil
 }
 
+// Offline subcommands work on the database file without connecting to Discord
+var subcommands = map[string]func(args []string) error{
+	"compact": runCompactCommand,
+	"export":  runExportCommand,
+	"guilds":  runGuildsCommand,
+	"import":  runImportCommand,
+	"replay":  runReplayCommand,
+}
+
 func main() {
+	if err := configureLogging(os.Stderr); err != nil {
+		fatal(gatewayLog, "Invalid logging settings", "err", err)
+	}
+
+	if len(os.Args) > 1 {
+		run, ok := subcommands[os.Args[1]]
+		if !ok {
+			fatal(dataLog, "Unknown subcommand", "subcommand", os.Args[1])
+		}
+		if err := run(os.Args[2:]); err != nil {
+			fatal(dataLog, "Subcommand failed", "subcommand", os.Args[1], "err", err)
+		}
+		return
+	}
+
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal(gatewayLog, "Error loading .env file")
+	}
+	// .env may carry logging settings too
+	if err := configureLogging(os.Stderr); err != nil {
+		fatal(gatewayLog, "Invalid logging settings", "err", err)
 	}
 
 	token := os.Getenv("DISCORD_CLIENT_TOKEN")
 	if token == "" {
-		log.Fatal("DISCORD_CLIENT_TOKEN environment variable is required")
+		fatal(gatewayLog, "DISCORD_CLIENT_TOKEN environment variable is required")
+	}
+	maxRetentionDays, err := parseRetentionMaxDays(os.Getenv("RETENTION_MAX_DAYS"))
+	if err != nil {
+		fatal(retentionLog, "Invalid RETENTION_MAX_DAYS", "err", err)
+	}
+	guildPurgeDays, err := parseGuildPurgeDays(os.Getenv("GUILD_PURGE_DAYS"))
+	if err != nil {
+		fatal(dataLog, "Invalid GUILD_PURGE_DAYS", "err", err)
 	}
 
-	// Initialize database
-	if err := initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	// Container runtimes stop the bot with SIGTERM
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// The database is migrated below, once health checks are served
+	store, err := sql.Open("sqlite3", defaultDBPath)
+	if err != nil {
+		fatal(dbLog, "Failed to open database", "err", err)
 	}
-	defer db.Close()
+	defer store.Close()
 
 	// Create a new state
-	s := state.NewWithIntents("Bot "+token, gateway.IntentGuildMessages|gateway.IntentMessageContent|gateway.IntentGuildMessageReactions)
-	botState = s
+	s := state.NewWithIntents("Bot "+token, gateway.IntentGuilds|gateway.IntentGuildMessages|gateway.IntentMessageContent|gateway.IntentGuildMessageReactions|gateway.IntentGuildEmojis)
+	bot := NewBot(stateClient{s}, store)
 
-	// Add event handlers
-	s.AddHandler(handleMessageCreate)
-	s.AddHandler(handleInteractionCreate)
-	s.AddHandler(handleMessageReactionAdd)
-	s.AddHandler(handleMessageReactionRemove)
+	// Built before the HTTP server starts, since the dashboard and metrics
+	// read it once the database is ready
+	bot.Images, err = NewImageCache(store, imageCacheDir, newHTTPImageFetcher(), defaultMaxImageBytes, defaultMaxImageCacheLen)
+	if err != nil {
+		fatal(imageLog, "Failed to initialize image cache", "err", err)
+	}
 
-	s.AddHandler(func(e *gateway.ReadyEvent) {
-		log.Printf("Bot is ready! Logged in as %s", e.User.Tag())
+	// Serve health checks while migrations run
+	if addr := os.Getenv("HTTP_LISTEN_ADDR"); addr != "" {
+		go bot.runHTTPServer(ctx, addr)
+	}
 
-		// Register slash commands
-		appID := discord.AppID(e.User.ID)
+	// Initialize database
+	if err := bot.initDB(); err != nil {
+		fatal(dbLog, "Failed to initialize database", "err", err)
+	}
 
-		if err := registerCommands(s, appID); err != nil {
-			log.Printf("Failed to register commands: %v", err)
-		} else {
-			log.Println("All commands registered successfully!")
+	if path := os.Getenv("RECORD_EVENTS"); path != "" {
+		if os.Getenv("RECORD_HASH_KEY") == "" {
+			pseudonymizing, err := bot.anyGuildPseudonymizes()
+			if err != nil {
+				fatal(dataLog, "Failed to check for pseudonymizing servers", "err", err)
+			}
+			if pseudonymizing {
+				fatal(dataLog, "RECORD_HASH_KEY is required to record events while servers pseudonymize users")
+			}
 		}
-	})
+		recorder, err := OpenEventRecorder(path, os.Getenv("RECORD_HASH_KEY"))
+		if err != nil {
+			fatal(dataLog, "Failed to open event recording", "err", err)
+		}
+		defer recorder.Close()
+		bot.Recorder = recorder
+		dataLog.Info("Recording events", "path", path, "hashed_ids", os.Getenv("RECORD_HASH_KEY") != "")
+	}
 
-	// Connect to Discord
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
+	// Add event handlers
+	s.AddHandler(bot.HandleEvent)
+	s.AddHandler(bot.handleReadyGap(ctx))
 
-	log.Println("Connecting to Discord...")
+	go bot.runDigestScheduler(ctx)
+	go bot.runEmojiPollScheduler(ctx)
+	go bot.runReconcileScheduler(ctx)
+	go bot.runRetentionScheduler(ctx, maxRetentionDays)
+	go bot.runGuildPurgeScheduler(ctx, guildPurgeDays)
+
+	bot.Backfiller = NewBackfiller(ctx, bot)
+	bot.Backfiller.ResumeAll()
+
+	// Connect to Discord
+	gatewayLog.Info("Connecting to Discord")
 
 	if err := s.Connect(ctx); err != nil && err != context.Canceled {
-		log.Fatalf("Failed to connect: %v", err)
+		fatal(gatewayLog, "Failed to connect", "err", err)
 	}
 	<-ctx.Done()
-	log.Println("Shutting down...")
+	gatewayLog.Info("Shutting down")
 }
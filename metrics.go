@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// Metrics in the Prometheus text exposition format, written by hand to avoid
+// pulling in the client library for a handful of series.
+
+// Something that writes its samples on scrape
+type metricCollector interface {
+	writeMetric(w io.Writer)
+}
+
+// Label values joined into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v)
+}
+
+// Format label names and values as {a="x",b="y"}, or "" without labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, kind)
+}
+
+// Monotonic counter partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64), keys: make(map[string][]string)}
+}
+
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) Add(v float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = slices.Clone(values)
+	}
+	c.values[key] += v
+}
+
+func (c *counterVec) writeMetric(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+// Observations of one label set
+type histogramSeries struct {
+	values []string
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Histogram with fixed upper bounds, partitioned by labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: slices.Clone(values), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Observe the seconds elapsed since start
+func (h *histogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) writeMetric(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	names := append(slices.Clone(h.labels), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, append(slices.Clone(s.values), formatFloat(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, append(slices.Clone(s.values), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+// Gauge read at scrape time. collect returns values by the single label's value,
+// or by "" when the gauge has no label.
+type gaugeFunc struct {
+	name    string
+	help    string
+	label   string
+	collect func() map[string]float64
+}
+
+func (g *gaugeFunc) writeMetric(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.collect()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		labels := ""
+		if g.label != "" {
+			labels = formatLabels([]string{g.label}, []string{key})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[key]))
+	}
+}
+
+var (
+	dbLatencyBuckets          = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+	interactionLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// Counters and histograms a bot updates as it works
+type botMetrics struct {
+	eventsReceived     *counterVec
+	itemsTracked       *counterVec
+	dbErrors           *counterVec
+	interactions       *counterVec
+	dbWriteLatency     *histogramVec
+	interactionLatency *histogramVec
+}
+
+func newBotMetrics() *botMetrics {
+	return &botMetrics{
+		eventsReceived:     newCounterVec("dek_gateway_events_received_total", "Gateway events received, by event type.", "type"),
+		itemsTracked:       newCounterVec("dek_items_tracked_total", "Emoji and sticker uses recorded, by kind and source.", "kind", "source"),
+		dbErrors:           newCounterVec("dek_db_errors_total", "Failed database operations, by operation.", "op"),
+		interactions:       newCounterVec("dek_interactions_total", "Interactions handled, by command.", "command"),
+		dbWriteLatency:     newHistogramVec("dek_db_write_duration_seconds", "Time to run and commit a write transaction.", dbLatencyBuckets),
+		interactionLatency: newHistogramVec("dek_interaction_duration_seconds", "Time from receiving an interaction to finishing its handler, by command.", interactionLatencyBuckets, "command"),
+	}
+}
+
+// Everything exposed on /metrics, in output order
+func (b *Bot) metricCollectors() []metricCollector {
+	return []metricCollector{
+		b.metrics.eventsReceived,
+		b.metrics.itemsTracked,
+		b.metrics.dbErrors,
+		b.metrics.interactions,
+		b.metrics.dbWriteLatency,
+		b.metrics.interactionLatency,
+		&gaugeFunc{name: "dek_cache_entries", help: "Entries in in-memory caches, by cache.", label: "cache", collect: b.collectCacheEntries},
+		&gaugeFunc{name: "dek_image_cache_bytes", help: "Bytes of images stored in the image cache.", collect: b.collectImageCacheBytes},
+		&gaugeFunc{name: "dek_queue_depth", help: "Work waiting to be processed, by queue.", label: "queue", collect: b.collectQueueDepth},
+	}
+}
+
+func (b *Bot) collectCacheEntries() map[string]float64 {
+	b.emojiCacheMutex.Lock()
+	emojis := len(b.emojiCache)
+	b.emojiCacheMutex.Unlock()
+	return map[string]float64{"guild_emojis": float64(emojis)}
+}
+
+func (b *Bot) collectImageCacheBytes() map[string]float64 {
+	if b.Images == nil {
+		return nil
+	}
+	total, err := b.Images.TotalBytes()
+	if err != nil {
+		b.metrics.dbErrors.Inc("read")
+		httpLog.Error("Error reading image cache size", "err", err)
+		return nil
+	}
+	return map[string]float64{"": float64(total)}
+}
+
+func (b *Bot) collectQueueDepth() map[string]float64 {
+	depth := make(map[string]float64)
+
+	var channels int
+	err := b.DB.QueryRow(`
+		SELECT COUNT(*) FROM backfill_channels c
+		JOIN backfill_jobs j ON j.server_id = c.server_id
+		WHERE j.status = ? AND c.done = FALSE`, backfillStatusRunning).Scan(&channels)
+	if err != nil {
+		b.metrics.dbErrors.Inc("read")
+		httpLog.Error("Error reading backfill queue depth", "err", err)
+	} else {
+		depth["backfill_channels"] = float64(channels)
+	}
+
+	b.pruneSelectionsMutex.Lock()
+	depth["prune_confirmations"] = float64(len(b.pruneSelections))
+	b.pruneSelectionsMutex.Unlock()
+	b.pendingImportsMutex.Lock()
+	depth["import_confirmations"] = float64(len(b.pendingImports))
+	b.pendingImportsMutex.Unlock()
+	return depth
+}
+
+// Write metrics in the text exposition format
+func writeMetrics(w io.Writer, collectors []metricCollector) {
+	for _, c := range collectors {
+		c.writeMetric(w)
+	}
+}
+
+// GET /metrics
+func (b *Bot) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, b.metricCollectors())
+}
+
+// Metric label for an interaction: the command name, or the kind of component or modal
+func interactionLabel(i *gateway.InteractionCreateEvent) string {
+	switch data := i.Data.(type) {
+	case *discord.CommandInteraction:
+		return data.Name
+	case *discord.ButtonInteraction:
+		// Custom IDs carry state after their prefix, e.g. emojivote:<poll>:yes
+		prefix, _, _ := strings.Cut(string(data.CustomID), ":")
+		prefix, _, _ = strings.Cut(prefix, "_")
+		return "button:" + prefix
+	case *discord.StringSelectInteraction:
+		return "select"
+	case *discord.ModalInteraction:
+		return "modal"
+	}
+	return "other"
+}
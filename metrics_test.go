@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestWriteMetricsGolden(t *testing.T) {
+	events := newCounterVec("test_events_total", "Events, by type.\nSecond line with a \\.", "type", "source")
+	events.Inc("MESSAGE_CREATE", "live")
+	events.Add(2, "MESSAGE_CREATE", "live")
+	events.Inc(`say "hi"`+"\n"+`C:\path`, "backfill")
+	unlabeled := newCounterVec("test_unlabeled_total", "No labels.")
+	unlabeled.Inc()
+
+	latency := newHistogramVec("test_duration_seconds", "Durations, by command.", []float64{0.1, 1}, "command")
+	for _, v := range []float64{0.25, 0.5, 0.5, 3} {
+		latency.Observe(v, "stats")
+	}
+	latency.Observe(0.0625, `a"b`)
+	plain := newHistogramVec("test_plain_seconds", "Without labels.", []float64{0.5})
+	plain.Observe(0.5)
+
+	collectors := []metricCollector{
+		events,
+		unlabeled,
+		latency,
+		plain,
+		&gaugeFunc{name: "test_queue_depth", help: "Queued work, by queue.", label: "queue", collect: func() map[string]float64 {
+			return map[string]float64{"prune": 2, "backfill": 1.5}
+		}},
+		&gaugeFunc{name: "test_bytes", help: "Bytes.", collect: func() map[string]float64 { return map[string]float64{"": 1 << 20} }},
+	}
+
+	var got bytes.Buffer
+	writeMetrics(&got, collectors)
+
+	path := filepath.Join("testdata", "metrics.golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("metrics differ from %s (run with -update to accept):\n%s", path, got.String())
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/diamondburned/arikawa/v3/utils/sendpart"
+)
+
+// SQL for an event's member in reports: null when the usage is anonymous or
+// the member opted out, so opted-out members drop out of per-member reports
+// and distinct member counts
+const reportedUserID = "CASE WHEN user_id = 0 OR user_id IN (SELECT user_id FROM privacy_optouts) THEN NULL ELSE user_id END"
+
+// Bumped when the personal export's fields change
+const privacyExportVersion = 2
+
+const myEmojisLimit = 15
+
+func (b *Bot) loadOptOuts() (map[int64]bool, error) {
+	rows, err := b.DB.Query("SELECT user_id FROM privacy_optouts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	optOuts := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		optOuts[id] = true
+	}
+	return optOuts, rows.Err()
+}
+
+// Whether a member opted out of having usage attributed to them
+func (b *Bot) optedOut(userID int64) bool {
+	b.optOutCacheMutex.Lock()
+	defer b.optOutCacheMutex.Unlock()
+
+	if b.optOutCache == nil {
+		optOuts, err := b.loadOptOuts()
+		if err != nil {
+			// Fail closed: counting anonymously loses less than attributing
+			// usage to someone who asked us not to
+			trackingLog.Error("Error loading privacy opt-outs", "err", err)
+			return true
+		}
+		b.optOutCache = optOuts
+	}
+	return b.optOutCache[userID]
+}
+
+// Apply the member's and the server's privacy choices before usage is
+// stored: opted-out members are recorded anonymously without their roles, and
+// pseudonymizing servers store a keyed hash instead of the user ID
+func (b *Bot) applyUserPrivacy(uc *UsageContext) {
+	if uc.UserID == 0 {
+		return
+	}
+	if b.optedOut(uc.UserID) {
+		uc.UserID = 0
+		uc.RoleIDs = nil
+		return
+	}
+	id, ok := b.storedUserID(uc.ServerID, uc.UserID)
+	if !ok {
+		// Never fall back to storing the raw ID
+		uc.UserID = 0
+		uc.RoleIDs = nil
+		return
+	}
+	uc.UserID = id
+}
+
+// Set whether a member is opted out, returning whether that changed anything
+// and how many pseudonymized rows became anonymous. Opting out makes the
+// member's pseudonymized usage anonymous for good, since reports can't tell a
+// pseudonym belongs to an opted-out member.
+func (b *Bot) setOptOut(userID int64, out bool) (bool, int64, error) {
+	keys, err := b.getAllPseudonymKeys()
+	if err != nil {
+		return false, 0, err
+	}
+	var n, anonymized int64
+	err = b.withTx(func(tx *sql.Tx) error {
+		if !out {
+			res, err := tx.Exec("DELETE FROM privacy_optouts WHERE user_id = ?", userID)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			return err
+		}
+
+		res, err := tx.Exec("INSERT OR IGNORE INTO privacy_optouts (user_id, created_at) VALUES (?, ?)", userID, sqliteTime(time.Now()))
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		for serverID, key := range keys {
+			moved, err := remapUserIDs(tx, usageTables(), serverID, map[int64]int64{pseudonymize(key, userID): 0})
+			if err != nil {
+				return err
+			}
+			anonymized += moved
+		}
+		return nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	b.optOutCacheMutex.Lock()
+	if b.optOutCache != nil {
+		if out {
+			b.optOutCache[userID] = true
+		} else {
+			delete(b.optOutCache, userID)
+		}
+	}
+	b.optOutCacheMutex.Unlock()
+
+	return n > 0, anonymized, nil
+}
+
+// Erase a member from every usage event and rollup attributed to them in
+// every server, under their ID or a pseudonym, and drop the roles recorded
+// with their usage. The rows stay as anonymous usage, since reconciliation
+// and backfill read them as what was already counted.
+func (b *Bot) deleteUserEvents(userID int64) (int64, error) {
+	cond, args, err := b.userRowsCondition("user_id", "server_id", userID)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = b.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM usage_event_roles WHERE event_id IN (SELECT id FROM usage_events WHERE "+cond+")", args...); err != nil {
+			return fmt.Errorf("failed to delete event roles: %w", err)
+		}
+		res, err := tx.Exec("UPDATE usage_events SET user_id = 0 WHERE "+cond, args...)
+		if err != nil {
+			return fmt.Errorf("failed to anonymize usage events: %w", err)
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE usage_rollups SET user_id = 0 WHERE "+cond, args...); err != nil {
+			return fmt.Errorf("failed to anonymize usage rollups: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM usage_role_rollups WHERE "+cond, args...); err != nil {
+			return fmt.Errorf("failed to delete role rollups: %w", err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// One usage event in a personal export
+type privacyExportEvent struct {
+	ServerID  string    `json:"server_id"`
+	ChannelID string    `json:"channel_id"`
+	MessageID string    `json:"message_id"`
+	Kind      string    `json:"kind"`
+	ItemID    string    `json:"item_id"`
+	ItemName  string    `json:"item_name"`
+	Source    string    `json:"source"`
+	Delta     int       `json:"delta"`
+	RoleIDs   []string  `json:"role_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Compacted usage for one day or month in a personal export
+type privacyExportRollup struct {
+	ServerID    string    `json:"server_id"`
+	ChannelID   string    `json:"channel_id"`
+	Kind        string    `json:"kind"`
+	ItemID      string    `json:"item_id"`
+	ItemName    string    `json:"item_name"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"period_start"`
+	Uses        int       `json:"uses"`
+}
+
+// Compacted usage under one role for one day or month in a personal export
+type privacyExportRoleRollup struct {
+	ServerID    string    `json:"server_id"`
+	RoleID      string    `json:"role_id"`
+	Kind        string    `json:"kind"`
+	ItemID      string    `json:"item_id"`
+	ItemName    string    `json:"item_name"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"period_start"`
+	Uses        int       `json:"uses"`
+}
+
+// One emoji vote in a personal export
+type privacyExportVote struct {
+	ServerID  string    `json:"server_id"`
+	PollID    int64     `json:"poll_id"`
+	Action    string    `json:"action"`
+	EmojiName string    `json:"emoji_name"`
+	Vote      bool      `json:"vote"`
+	VotedAt   time.Time `json:"voted_at"`
+}
+
+// Everything stored about a member
+type privacyExport struct {
+	Version      int                       `json:"version"`
+	UserID       string                    `json:"user_id"`
+	ExportedAt   time.Time                 `json:"exported_at"`
+	OptedOutAt   *time.Time                `json:"opted_out_at"`
+	UsageEvents  []privacyExportEvent      `json:"usage_events"`
+	UsageRollups []privacyExportRollup     `json:"usage_rollups"`
+	RoleRollups  []privacyExportRoleRollup `json:"usage_role_rollups"`
+	PollVotes    []privacyExportVote       `json:"poll_votes"`
+}
+
+func (b *Bot) getPrivacyExport(userID int64, now time.Time) (*privacyExport, error) {
+	export := privacyExport{
+		Version:      privacyExportVersion,
+		UserID:       idString(userID),
+		ExportedAt:   now.UTC(),
+		UsageEvents:  []privacyExportEvent{},
+		UsageRollups: []privacyExportRollup{},
+		RoleRollups:  []privacyExportRoleRollup{},
+		PollVotes:    []privacyExportVote{},
+	}
+
+	var optedOutAt time.Time
+	err := b.DB.QueryRow("SELECT created_at FROM privacy_optouts WHERE user_id = ?", userID).Scan(&optedOutAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to fetch opt-out: %w", err)
+	}
+	if err == nil {
+		optedOutAt = optedOutAt.UTC()
+		export.OptedOutAt = &optedOutAt
+	}
+
+	cond, args, err := b.userRowsCondition("ue.user_id", "ue.server_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.DB.Query(`
+		SELECT ue.id, ue.server_id, COALESCE(ue.channel_id, 0), COALESCE(ue.message_id, 0), ue.kind, ue.item_id,
+			COALESCE(e.emote_name, s.sticker_name, ''), ue.source, ue.delta, ue.created_at
+		FROM usage_events ue
+		LEFT JOIN emojis e ON ue.kind = 'emoji' AND e.server_id = ue.server_id AND e.emote_id = ue.item_id
+		LEFT JOIN stickers s ON ue.kind = 'sticker' AND s.server_id = ue.server_id AND s.sticker_id = ue.item_id
+		WHERE `+cond+`
+		ORDER BY ue.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch usage events: %w", err)
+	}
+	defer rows.Close()
+	index := make(map[int64]int)
+	for rows.Next() {
+		var id, serverID, channelID, messageID, itemID int64
+		e := privacyExportEvent{RoleIDs: []string{}}
+		if err := rows.Scan(&id, &serverID, &channelID, &messageID, &e.Kind, &itemID, &e.ItemName, &e.Source, &e.Delta, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.ServerID, e.ChannelID, e.MessageID, e.ItemID = idString(serverID), idString(channelID), idString(messageID), idString(itemID)
+		e.CreatedAt = e.CreatedAt.UTC()
+		index[id] = len(export.UsageEvents)
+		export.UsageEvents = append(export.UsageEvents, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	roleRows, err := b.DB.Query(`
+		SELECT r.event_id, r.role_id FROM usage_event_roles r
+		JOIN usage_events ue ON ue.id = r.event_id
+		WHERE `+cond+`
+		ORDER BY r.event_id, r.role_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch event roles: %w", err)
+	}
+	defer roleRows.Close()
+	for roleRows.Next() {
+		var eventID, roleID int64
+		if err := roleRows.Scan(&eventID, &roleID); err != nil {
+			return nil, err
+		}
+		if n, ok := index[eventID]; ok {
+			export.UsageEvents[n].RoleIDs = append(export.UsageEvents[n].RoleIDs, idString(roleID))
+		}
+	}
+	if err := roleRows.Err(); err != nil {
+		return nil, err
+	}
+
+	rollupCond, rollupArgs, err := b.userRowsCondition("r.user_id", "r.server_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	rollupRows, err := b.DB.Query(`
+		SELECT r.server_id, r.channel_id, r.kind, r.item_id, COALESCE(e.emote_name, s.sticker_name, ''), r.period, r.period_start, r.uses
+		FROM usage_rollups r
+		LEFT JOIN emojis e ON r.kind = 'emoji' AND e.server_id = r.server_id AND e.emote_id = r.item_id
+		LEFT JOIN stickers s ON r.kind = 'sticker' AND s.server_id = r.server_id AND s.sticker_id = r.item_id
+		WHERE `+rollupCond+`
+		ORDER BY r.period_start, r.server_id, r.item_id`, rollupArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch usage rollups: %w", err)
+	}
+	defer rollupRows.Close()
+	for rollupRows.Next() {
+		var serverID, channelID, itemID int64
+		var r privacyExportRollup
+		if err := rollupRows.Scan(&serverID, &channelID, &r.Kind, &itemID, &r.ItemName, &r.Period, &r.PeriodStart, &r.Uses); err != nil {
+			return nil, err
+		}
+		r.ServerID, r.ChannelID, r.ItemID = idString(serverID), idString(channelID), idString(itemID)
+		r.PeriodStart = r.PeriodStart.UTC()
+		export.UsageRollups = append(export.UsageRollups, r)
+	}
+	if err := rollupRows.Err(); err != nil {
+		return nil, err
+	}
+
+	roleRollupRows, err := b.DB.Query(`
+		SELECT r.server_id, r.role_id, r.kind, r.item_id, COALESCE(e.emote_name, s.sticker_name, ''), r.period, r.period_start, r.uses
+		FROM usage_role_rollups r
+		LEFT JOIN emojis e ON r.kind = 'emoji' AND e.server_id = r.server_id AND e.emote_id = r.item_id
+		LEFT JOIN stickers s ON r.kind = 'sticker' AND s.server_id = r.server_id AND s.sticker_id = r.item_id
+		WHERE `+rollupCond+`
+		ORDER BY r.period_start, r.server_id, r.role_id, r.item_id`, rollupArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch role rollups: %w", err)
+	}
+	defer roleRollupRows.Close()
+	for roleRollupRows.Next() {
+		var serverID, roleID, itemID int64
+		var r privacyExportRoleRollup
+		if err := roleRollupRows.Scan(&serverID, &roleID, &r.Kind, &itemID, &r.ItemName, &r.Period, &r.PeriodStart, &r.Uses); err != nil {
+			return nil, err
+		}
+		r.ServerID, r.RoleID, r.ItemID = idString(serverID), idString(roleID), idString(itemID)
+		r.PeriodStart = r.PeriodStart.UTC()
+		export.RoleRollups = append(export.RoleRollups, r)
+	}
+	if err := roleRollupRows.Err(); err != nil {
+		return nil, err
+	}
+
+	voteCond, voteArgs, err := b.userRowsCondition("v.user_id", "p.server_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	voteRows, err := b.DB.Query(`
+		SELECT p.server_id, p.id, p.action, p.emoji_name, v.vote, v.voted_at
+		FROM emoji_poll_votes v
+		JOIN emoji_polls p ON p.id = v.poll_id
+		WHERE `+voteCond+`
+		ORDER BY v.voted_at, p.id`, voteArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch poll votes: %w", err)
+	}
+	defer voteRows.Close()
+	for voteRows.Next() {
+		var serverID int64
+		var v privacyExportVote
+		if err := voteRows.Scan(&serverID, &v.PollID, &v.Action, &v.EmojiName, &v.Vote, &v.VotedAt); err != nil {
+			return nil, err
+		}
+		v.ServerID = idString(serverID)
+		v.VotedAt = v.VotedAt.UTC()
+		export.PollVotes = append(export.PollVotes, v)
+	}
+	return &export, voteRows.Err()
+}
+
+// DM a member everything stored about them as JSON
+func (b *Bot) sendPrivacyExport(userID discord.UserID) error {
+	export, err := b.getPrivacyExport(int64(userID), time.Now())
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode export: %w", err)
+	}
+
+	name := fmt.Sprintf("my-data-%s.json", export.ExportedAt.Format("20060102"))
+	dm, err := b.Client.CreatePrivateChannel(userID)
+	if err != nil {
+		return err
+	}
+	first := true
+	return streamExport(name, bytes.NewReader(data), api.UploadSizeLimit, func(f sendpart.File, last bool) error {
+		msg := api.SendMessageData{Files: []sendpart.File{f}}
+		if first {
+			msg.Content = fmt.Sprintf("Here is everything this bot stores about you: %d usage events, %d compacted daily or monthly totals and %d emoji votes.", len(export.UsageEvents), len(export.UsageRollups), len(export.PollVotes))
+			if !last {
+				msg.Content += fmt.Sprintf(" The export is split into parts; join them with `cat %s.gz.part* > %s.gz`.", name, name)
+			}
+			first = false
+		}
+		_, err := b.Client.SendMessageComplex(dm.ID, msg)
+		return err
+	})
+}
+
+// Ask before erasing a member's events
+func privacyDeleteConfirmation() api.InteractionResponseData {
+	components := discord.ContainerComponents{
+		&discord.ActionRowComponent{
+			&discord.ButtonComponent{
+				Label:    "Delete my data",
+				CustomID: "privacy_delete",
+				Style:    discord.DangerButtonStyle(),
+			},
+			&discord.ButtonComponent{
+				Label:    "Cancel",
+				CustomID: "privacy_cancel",
+				Style:    discord.SecondaryButtonStyle(),
+			},
+		},
+	}
+	return api.InteractionResponseData{
+		Content: option.NewNullableString("This erases every emoji and sticker use attributed to you in every server this bot is in. " +
+			"Server totals stay as they are, but your uses no longer appear in any per-member statistics. This can't be undone."),
+		Components: &components,
+		Flags:      discord.EphemeralMessage,
+	}
+}
+
+// Handle /privacy command
+func (b *Bot) handlePrivacy(i *gateway.InteractionCreateEvent) {
+	userID := i.SenderID()
+	if !userID.IsValid() {
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+	response := api.InteractionResponseData{Flags: discord.EphemeralMessage}
+
+	switch sub.Name {
+	case "optout", "optin":
+		out := sub.Name == "optout"
+		changed, anonymized, err := b.setOptOut(int64(userID), out)
+		if err != nil {
+			b.interactionLog(i).Error("Error saving privacy opt-out", "err", err)
+			b.respondError(i, "Failed to save your choice.")
+			return
+		}
+		switch {
+		case out && changed:
+			b.interactionLog(i).Info("Member opted out")
+			content := "✅ Your emoji and sticker use is no longer attributed to you. It still counts toward server totals anonymously, " +
+				"and uses recorded before are hidden from per-member statistics. Use `/privacy delete` to erase them."
+			if anonymized > 0 {
+				content += "\nIn servers that store pseudonyms instead of user IDs, your earlier uses were made anonymous. " +
+					"They can't be erased or attributed to you again, even if you opt back in."
+			}
+			response.Content = option.NewNullableString(content)
+		case out:
+			response.Content = option.NewNullableString("You have already opted out.")
+		case changed:
+			b.interactionLog(i).Info("Member opted back in")
+			response.Content = option.NewNullableString("✅ Your emoji and sticker use is attributed to you again.")
+		default:
+			response.Content = option.NewNullableString("You haven't opted out.")
+		}
+
+	case "delete":
+		response = privacyDeleteConfirmation()
+
+	case "export":
+		// Collecting and uploading the export can take a while
+		if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+			Type: api.DeferredMessageInteractionWithSource,
+			Data: &api.InteractionResponseData{Flags: discord.EphemeralMessage},
+		}); err != nil {
+			b.interactionLog(i).Error("Error deferring privacy export", "err", err)
+			return
+		}
+		content := "✅ Sent you your data in DMs."
+		if err := b.sendPrivacyExport(userID); err != nil {
+			b.interactionLog(i).Error("Error sending privacy export", "err", err)
+			content = "❌ Couldn't DM you your data. Allow direct messages from server members and try again."
+		}
+		if _, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+			Content: option.NewNullableString(content),
+		}); err != nil {
+			b.interactionLog(i).Error("Error editing interaction response", "err", err)
+		}
+		return
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
+
+// Handle Delete/Cancel on the /privacy delete confirmation. Only the member
+// who ran the command sees it, so the clicker's data is the data to erase.
+func (b *Bot) handlePrivacyButton(i *gateway.InteractionCreateEvent, customID string) {
+	userID := i.SenderID()
+	if !userID.IsValid() {
+		return
+	}
+
+	var response api.InteractionResponseData
+	emptyComponents := discord.ContainerComponents{}
+	response.Components = &emptyComponents
+
+	if customID == "privacy_delete" {
+		n, err := b.deleteUserEvents(int64(userID))
+		if err != nil {
+			b.interactionLog(i).Error("Error deleting member data", "err", err)
+			response.Content = option.NewNullableString("❌ Failed to delete your data. Nothing was deleted.")
+		} else {
+			b.interactionLog(i).Info("Deleted member data", "events", n)
+			response.Content = option.NewNullableString(fmt.Sprintf("✅ Erased you from %d usage events. They now count as anonymous uses.", n))
+		}
+	} else {
+		response.Content = option.NewNullableString("Nothing was deleted.")
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.UpdateMessage,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error updating message", "err", err)
+	}
+}
+
+// Handle /myemojis command. Usage in pseudonymizing servers is found by
+// hashing the caller's ID.
+func (b *Bot) handleMyEmojis(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	userID := int64(i.Member.User.ID)
+	if b.optedOut(userID) {
+		b.respondError(i, "You opted out, so no usage is attributed to you. Use `/privacy optin` to change that.")
+		return
+	}
+
+	serverID := int64(i.GuildID)
+	items, err := b.getUserTopItems(serverID, userID, myEmojisLimit)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching member stats", "err", err)
+		b.respondError(i, "Failed to fetch your statistics.")
+		return
+	}
+
+	locale := b.getGuildSettings(serverID).Locale
+	var content strings.Builder
+	content.WriteString("**Your Most Used Emojis and Stickers**\n\n")
+	if len(items) == 0 {
+		content.WriteString("No usage recorded from you yet.")
+	}
+	for _, u := range items {
+		content.WriteString(fmt.Sprintf("- %s **x%s**\n", formatItem(u), formatCount(u.Count, locale)))
+	}
+
+	response := api.InteractionResponseData{
+		Content: option.NewNullableString(content.String()),
+		Flags:   discord.EphemeralMessage,
+	}
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
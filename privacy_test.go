@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+const otherUserID = discord.UserID(3001)
+
+// Events attributed to a member in the test guild
+func (b *testBot) userEvents(userID discord.UserID) int {
+	b.t.Helper()
+	var n int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM usage_events WHERE user_id = ?", int64(userID)).Scan(&n); err != nil {
+		b.t.Fatal(err)
+	}
+	return n
+}
+
+func TestPrivacyOptOut(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+
+	before := b.message("<:wave:111>")
+	before.Member = withRoles(modRoleID)
+	other := b.message("<:wave:111>")
+	other.Author.ID = otherUserID
+	b.send(before, other)
+
+	b.send(b.command("privacy", subcommand("optout")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "no longer attributed") || strings.Contains(content, "made anonymous") {
+		t.Errorf("optout replied %q", content)
+	}
+
+	after := b.message("<:wave:111>")
+	after.Member = withRoles(modRoleID)
+	b.send(after, b.reactionAdd(after.ID, wave), b.reactionRemove(after.ID, wave))
+	if got := b.emojiCount(111); got != 3 {
+		t.Errorf("emoji count = %d, want 3: opted-out usage still counts", got)
+	}
+	if got := b.userEvents(testUserID); got != 1 {
+		t.Errorf("attributed events = %d, want only the one from before opting out", got)
+	}
+	if got := b.userEvents(0); got != 3 {
+		t.Errorf("anonymous events = %d, want 3", got)
+	}
+
+	// Reports hide the member, including usage from before opting out
+	users, err := b.getTopUsers(int64(testGuildID), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].UserID != int64(otherUserID) {
+		t.Errorf("top users = %+v, want only %d", users, otherUserID)
+	}
+	if n, err := b.countUsers(int64(testGuildID)); err != nil || n != 1 {
+		t.Errorf("countUsers = %d, %v; want 1", n, err)
+	}
+	if items, err := b.getUserTopItems(int64(testGuildID), int64(testUserID), 10); err != nil || len(items) != 0 {
+		t.Errorf("opted-out member's items = %+v, %v; want none", items, err)
+	}
+	if items, members, err := b.getRoleTopItems(int64(testGuildID), int64(modRoleID), time.Time{}, roleStatsLimit); err != nil || len(items) != 1 || members[0] != 0 {
+		t.Errorf("role items = %+v, members %v, %v; want the earlier use by no reportable member", items, members, err)
+	}
+	var export strings.Builder
+	if err := b.writeExport(&export, int64(testGuildID), exportFormatCSV, exportTypeEvents); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(export.String(), ","+testUserID.String()+",") {
+		t.Errorf("events export attributes usage to the opted-out member:\n%s", export.String())
+	}
+
+	b.send(b.command("privacy", subcommand("optout")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "already opted out") {
+		t.Errorf("second optout replied %q", content)
+	}
+	b.send(b.command("privacy", subcommand("optin")))
+	b.send(b.message("<:wave:111>"))
+	if got := b.userEvents(testUserID); got != 2 {
+		t.Errorf("attributed events after opting in = %d, want 2", got)
+	}
+}
+
+func TestOptedOutReactionRemovalWithIgnoredRoles(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	m := b.message("hi")
+	b.send(m)
+	// A backfilled reaction by an unknown member
+	if _, _, err := b.backfillMessage(testGuildID, discord.Message{ID: m.ID, ChannelID: testChannelID, Author: m.Author, Reactions: []discord.Reaction{{Emoji: wave, Count: 1}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b.send(b.command("privacy", subcommand("optout")))
+	b.send(b.command("tracking", subcommand("ignore_role", roleOption("role", botsRoleID))))
+	add := b.reactionAdd(m.ID, wave)
+	add.Member = withRoles(botsRoleID)
+	b.send(add, b.reactionRemove(m.ID, wave))
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count = %d, want the backfilled reaction kept", got)
+	}
+}
+
+func TestPrivacyDelete(t *testing.T) {
+	b := newTestBot(t)
+	m := b.message("<:wave:111>")
+	m.Member = withRoles(modRoleID)
+	other := b.message("<:wave:111>")
+	other.Author.ID = otherUserID
+	b.send(m, other)
+
+	b.send(b.command("privacy", subcommand("delete")))
+	if resp := b.fake.lastResponse(t); resp.Data.Components == nil || len(*resp.Data.Components) == 0 {
+		t.Fatal("delete did not ask for confirmation")
+	}
+	b.send(b.button("privacy_cancel"))
+	if got := b.userEvents(testUserID); got != 1 {
+		t.Fatalf("cancel deleted events: %d left", got)
+	}
+
+	b.send(b.button("privacy_delete"))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Erased you from 1 usage events") {
+		t.Errorf("delete replied %q", content)
+	}
+	if got := b.userEvents(testUserID); got != 0 {
+		t.Errorf("attributed events after delete = %d, want 0", got)
+	}
+	if got := b.userEvents(otherUserID); got != 1 {
+		t.Errorf("other member's events = %d, want 1", got)
+	}
+	var roles int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM usage_event_roles").Scan(&roles); err != nil || roles != 0 {
+		t.Errorf("event roles = %d, %v; want them deleted with the events", roles, err)
+	}
+	if got := b.emojiCount(111); got != 2 {
+		t.Errorf("emoji count = %d, want totals kept", got)
+	}
+}
+
+// Erased usage still counts as recorded, so neither reconciliation nor a
+// backfill counts it again or gives it back to the member
+func TestPrivacyDeleteThenReconcileAndBackfill(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	m := b.message("<:wave:111>")
+	b.send(m, b.reactionAdd(m.ID, wave))
+
+	if _, err := b.deleteUserEvents(int64(testUserID)); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := discord.Message{ID: m.ID, ChannelID: testChannelID, Author: m.Author, Content: m.Content, Reactions: []discord.Reaction{{Emoji: wave, Count: 1}}}
+	b.fake.Messages[m.ID] = snapshot
+	results, err := b.reconcileRecent(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[int64(testGuildID)]; r == nil || r.MessagesChecked != 1 || r.Corrections != 0 {
+		t.Errorf("reconcile result = %+v, want the message checked without corrections", r)
+	}
+	if _, _, err := b.backfillMessage(testGuildID, snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := b.emojiCount(111); got != 2 {
+		t.Errorf("emoji count = %d, want 2", got)
+	}
+	if got := b.userEvents(testUserID); got != 0 {
+		t.Errorf("attributed events = %d, want 0", got)
+	}
+}
+
+func TestPrivacyExport(t *testing.T) {
+	b := newTestBot(t)
+	m := b.message("<:wave:111>", discord.StickerItem{ID: 211, Name: "cat"})
+	m.Member = withRoles(modRoleID)
+	other := b.message("<:wave:111>")
+	other.Author.ID = otherUserID
+	b.send(m, other)
+	b.send(b.command("privacy", subcommand("optout")))
+
+	b.send(b.command("privacy", subcommand("export")))
+	if len(b.fake.Edits) != 1 || !strings.Contains(b.fake.Edits[0].Content.Val, "Sent you your data") {
+		t.Fatalf("edits = %+v, want a confirmation", b.fake.Edits)
+	}
+	if len(b.fake.Sent) != 1 || len(b.fake.Sent[0].Data.Files) != 1 {
+		t.Fatalf("sent = %+v, want one DM with a file", b.fake.Sent)
+	}
+	raw, err := io.ReadAll(b.fake.Sent[0].Data.Files[0].Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export privacyExport
+	if err := json.Unmarshal(raw, &export); err != nil {
+		t.Fatalf("export is not JSON: %v\n%s", err, raw)
+	}
+	if export.UserID != "3000" || export.OptedOutAt == nil || len(export.UsageEvents) != 2 {
+		t.Fatalf("export = %+v, want 2 events of opted-out member 3000", export)
+	}
+	e := export.UsageEvents[0]
+	if e.ServerID != "1000" || e.Kind != kindEmoji || e.ItemID != "111" || e.ItemName != "wave" || len(e.RoleIDs) != 1 || e.RoleIDs[0] != "5001" {
+		t.Errorf("first event = %+v", e)
+	}
+
+	b.fake.DMsDisabled = true
+	b.send(b.command("privacy", subcommand("export")))
+	if got := b.fake.Edits[len(b.fake.Edits)-1].Content.Val; !strings.Contains(got, "Couldn't DM you") {
+		t.Errorf("export with DMs closed replied %q", got)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	defaultPruneCount   = 10
+	maxPruneCount       = 25 // Discord's select menu option limit
+	pruneSelectionTTL   = 15 * time.Minute
+	pruneStatsDays      = defaultSlotsWindowDays
+	prunePermissionName = "Manage Emojis and Stickers"
+)
+
+// Items a moderator ticked in a pruning proposal
+type pruneSelection struct {
+	UserID    discord.UserID
+	Values    []string
+	ExpiresAt time.Time
+}
+
+// Check the bot can manage emojis and stickers in the interaction's channel
+func (b *Bot) botCanManageEmojis(channelID discord.ChannelID) (bool, error) {
+	me, err := b.Client.Me()
+	if err != nil {
+		return false, err
+	}
+	perms, err := b.Client.Permissions(channelID, me.ID)
+	if err != nil {
+		return false, err
+	}
+	return perms.Has(discord.PermissionManageEmojisAndStickers), nil
+}
+
+// Select menu value for a candidate, e.g. "emoji:123"
+func pruneValue(kind string, id int64) string {
+	return fmt.Sprintf("%s:%d", kind, id)
+}
+
+func parsePruneValue(value string) (string, int64, bool) {
+	kind, idStr, ok := strings.Cut(value, ":")
+	if !ok || (kind != kindEmoji && kind != kindSticker) {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return kind, id, true
+}
+
+// Create pruning proposal with a select menu and confirm/cancel buttons
+func createPruneProposalMessage(candidates []RemovalCandidate, w ScoreWeights) api.InteractionResponseData {
+	var content strings.Builder
+	content.WriteString("**Pruning Proposal**\n")
+	content.WriteString("Select the emojis and stickers to delete, then press **Delete selected**. Images, names and final stats are archived.\n\n")
+
+	options := make([]discord.SelectOption, 0, len(candidates))
+	for i, c := range candidates {
+		content.WriteString(fmt.Sprintf("%d. %s score **%.2f**: %s\n", i+1, candidateLabel(c), c.Score, explainCandidate(c, w)))
+
+		opt := discord.SelectOption{
+			Label:       c.Name,
+			Value:       pruneValue(c.Kind, c.ID),
+			Description: fmt.Sprintf("%s, %d uses in %dd", c.Kind, c.RecentUses, w.Days),
+		}
+		if c.Kind == kindEmoji {
+			opt.Emoji = &discord.ComponentEmoji{ID: discord.EmojiID(c.ID), Name: c.Name, Animated: c.Animated}
+		}
+		options = append(options, opt)
+	}
+
+	components := discord.ContainerComponents{
+		&discord.ActionRowComponent{
+			&discord.StringSelectComponent{
+				CustomID:    "prune_select",
+				Placeholder: "Choose items to delete",
+				Options:     options,
+				ValueLimits: [2]int{1, len(options)},
+			},
+		},
+		&discord.ActionRowComponent{
+			&discord.ButtonComponent{
+				CustomID: "prune_confirm",
+				Label:    "Delete selected",
+				Style:    discord.DangerButtonStyle(),
+			},
+			&discord.ButtonComponent{
+				CustomID: "prune_cancel",
+				Label:    "Cancel",
+				Style:    discord.SecondaryButtonStyle(),
+			},
+		},
+	}
+
+	return api.InteractionResponseData{
+		Content:    option.NewNullableString(content.String()),
+		Components: &components,
+		Flags:      discord.EphemeralMessage,
+	}
+}
+
+// Handle /prune command
+func (b *Bot) handlePrune(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	ok, err := b.botCanManageEmojis(i.ChannelID)
+	if err != nil {
+		b.interactionLog(i).Error("Error checking bot permissions", "err", err)
+		b.respondError(i, "Failed to check bot permissions.")
+		return
+	}
+	if !ok {
+		b.respondError(i, fmt.Sprintf("The bot needs the **%s** permission to delete emojis.", prunePermissionName))
+		return
+	}
+
+	count := defaultPruneCount
+	if v, err := i.Data.(*discord.CommandInteraction).Options.Find("count").IntValue(); err == nil && v > 0 {
+		count = min(int(v), maxPruneCount)
+	}
+
+	emojis, err := b.getGuildEmojis(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild emojis", "err", err)
+		b.respondError(i, "Failed to fetch guild emojis.")
+		return
+	}
+	stickers, err := b.getGuildStickers(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild stickers", "err", err)
+		b.respondError(i, "Failed to fetch guild stickers.")
+		return
+	}
+
+	w := ScoreWeights{Usage: 1, Age: 1, Users: 1, Days: pruneStatsDays}
+	candidates, err := b.getRemovalCandidates(int64(i.GuildID), emojis, stickers, time.Now(), w, count)
+	if err != nil {
+		b.interactionLog(i).Error("Error scoring removal candidates", "err", err)
+		b.respondError(i, "Failed to fetch usage data.")
+		return
+	}
+	if len(candidates) == 0 {
+		b.respondError(i, "No emojis or stickers found in this server.")
+		return
+	}
+
+	response := createPruneProposalMessage(candidates, w)
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
+
+// The unexpired selection of a pruning proposal, if any, and the moderator
+// it belongs to: whoever selected its items, or before that whoever ran
+// /prune. The owner is zero when the message doesn't say. Must be called
+// with pruneSelectionsMutex held.
+func (b *Bot) pruneProposal(m *discord.Message) (*pruneSelection, discord.UserID) {
+	if sel, ok := b.pruneSelections[m.ID]; ok && !time.Now().After(sel.ExpiresAt) {
+		return &sel, sel.UserID
+	}
+	if m.Interaction != nil {
+		return nil, m.Interaction.User.ID
+	}
+	return nil, 0
+}
+
+// Handle selections in a pruning proposal
+func (b *Bot) handlePruneSelect(i *gateway.InteractionCreateEvent, data *discord.StringSelectInteraction) {
+	if i.Message == nil || i.Member == nil {
+		return
+	}
+
+	b.pruneSelectionsMutex.Lock()
+	now := time.Now()
+	for id, sel := range b.pruneSelections {
+		if now.After(sel.ExpiresAt) {
+			delete(b.pruneSelections, id)
+		}
+	}
+	if _, owner := b.pruneProposal(i.Message); owner.IsValid() && owner != i.Member.User.ID {
+		b.pruneSelectionsMutex.Unlock()
+		b.respondError(i, "Only the moderator who started this can change the selection.")
+		return
+	}
+	b.pruneSelections[i.Message.ID] = pruneSelection{
+		UserID:    i.Member.User.ID,
+		Values:    data.Values,
+		ExpiresAt: now.Add(pruneSelectionTTL),
+	}
+	b.pruneSelectionsMutex.Unlock()
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.DeferredMessageUpdate,
+	}); err != nil {
+		b.interactionLog(i).Error("Error acknowledging prune selection", "err", err)
+	}
+}
+
+// Final stats for a pruned item
+func (b *Bot) getItemTotals(serverID int64, kind string, itemID int64) (int, error) {
+	var query string
+	if kind == kindEmoji {
+		query = "SELECT COALESCE(SUM(usage_count), 0) FROM emojis WHERE server_id = ? AND emote_id = ?"
+	} else {
+		query = "SELECT COALESCE(SUM(usage_count), 0) FROM stickers WHERE server_id = ? AND sticker_id = ?"
+	}
+	var count int
+	err := b.DB.QueryRow(query, serverID, itemID).Scan(&count)
+	return count, err
+}
+
+// Archive an item about to be deleted, returning the archive row's ID
+func (b *Bot) archivePrunedItem(c RemovalCandidate, serverID int64, imageHash string, approvedBy discord.UserID) (int64, error) {
+	total, err := b.getItemTotals(serverID, c.Kind, c.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch final stats: %w", err)
+	}
+
+	query := `
+		INSERT INTO pruned_items (server_id, kind, item_id, name, animated, image_hash, total_uses, recent_uses, distinct_users, approved_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := b.DB.Exec(query, serverID, c.Kind, c.ID, c.Name, c.Animated, imageHash, total, c.RecentUses, c.DistinctUsers, int64(approvedBy))
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive pruned item: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// Drop the archive of an item whose deletion failed
+func (b *Bot) unarchivePrunedItem(archiveID int64) error {
+	_, err := b.DB.Exec("DELETE FROM pruned_items WHERE id = ?", archiveID)
+	return err
+}
+
+// Delete an emoji or sticker from the guild
+func (b *Bot) deleteGuildItem(guildID discord.GuildID, kind string, itemID int64, reason api.AuditLogReason) error {
+	if kind == kindEmoji {
+		return b.Client.DeleteEmoji(guildID, discord.EmojiID(itemID), reason)
+	}
+	return b.Client.DeleteGuildSticker(guildID, discord.StickerID(itemID), reason)
+}
+
+// Archive then delete one selected item, returning a result line
+func (b *Bot) pruneItem(ctx context.Context, guildID discord.GuildID, c RemovalCandidate, approver discord.User) string {
+	serverID := int64(guildID)
+	// Emoji markup won't render once the emoji is gone, so show its name
+	label := c.Name
+	if c.Kind == kindSticker {
+		label = candidateLabel(c)
+	}
+
+	// Fetch the image before deleting, the CDN stops serving it afterwards.
+	// An item the archive couldn't show is kept rather than lost.
+	var img *CachedImage
+	var err error
+	if c.Kind == kindEmoji {
+		img, err = b.Images.EmojiImage(ctx, serverID, EmojiData{Name: c.Name, ID: c.ID, Animated: c.Animated})
+	} else {
+		img, err = b.Images.StickerImage(ctx, serverID, StickerData{Name: c.Name, ID: c.ID})
+	}
+	if err != nil {
+		commandLog.Error("Error archiving image", idAttr("guild_id", serverID), "kind", c.Kind, idAttr("item_id", c.ID), "err", err)
+		return fmt.Sprintf("- ❌ %s: couldn't archive its image, not deleted", label)
+	}
+
+	archiveID, err := b.archivePrunedItem(c, serverID, img.Hash, approver.ID)
+	if err != nil {
+		commandLog.Error("Error archiving item", idAttr("guild_id", serverID), "kind", c.Kind, idAttr("item_id", c.ID), "err", err)
+		return fmt.Sprintf("- ❌ %s: couldn't archive it, not deleted", label)
+	}
+
+	reason := api.AuditLogReason(fmt.Sprintf("Pruned by emote keeper, approved by %s", approver.Tag()))
+	if err := b.deleteGuildItem(guildID, c.Kind, c.ID, reason); err != nil {
+		commandLog.Error("Error deleting item", idAttr("guild_id", serverID), "kind", c.Kind, idAttr("item_id", c.ID), "err", err)
+		if err := b.unarchivePrunedItem(archiveID); err != nil {
+			commandLog.Error("Error removing archive of undeleted item", idAttr("guild_id", serverID), "kind", c.Kind, idAttr("item_id", c.ID), "err", err)
+		}
+		return fmt.Sprintf("- ❌ %s: failed to delete", label)
+	}
+
+	if err := b.Images.Retain(c.Kind, c.ID); err != nil {
+		commandLog.Error("Error retaining image", idAttr("guild_id", serverID), "kind", c.Kind, idAttr("item_id", c.ID), "err", err)
+	}
+	commandLog.Info("Pruned item", idAttr("guild_id", serverID), "kind", c.Kind, "name", c.Name, idAttr("item_id", c.ID), idAttr("approved_by", int64(approver.ID)))
+	return fmt.Sprintf("- ✅ %s deleted", label)
+}
+
+// Handle confirm and cancel buttons of a pruning proposal
+func (b *Bot) handlePruneButton(i *gateway.InteractionCreateEvent, customID string) {
+	if i.Message == nil || i.Member == nil {
+		return
+	}
+
+	action := "confirm"
+	if customID == "prune_cancel" {
+		action = "cancel"
+	}
+	b.pruneSelectionsMutex.Lock()
+	sel, owner := b.pruneProposal(i.Message)
+	if owner.IsValid() && owner != i.Member.User.ID {
+		b.pruneSelectionsMutex.Unlock()
+		b.respondError(i, fmt.Sprintf("Only the moderator who started this can %s it.", action))
+		return
+	}
+	delete(b.pruneSelections, i.Message.ID)
+	b.pruneSelectionsMutex.Unlock()
+
+	var response api.InteractionResponseData
+	emptyComponents := discord.ContainerComponents{}
+	response.Components = &emptyComponents
+
+	if customID == "prune_cancel" {
+		response.Content = option.NewNullableString("Pruning cancelled.")
+		if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+			Type: api.UpdateMessage,
+			Data: &response,
+		}); err != nil {
+			b.interactionLog(i).Error("Error updating message", "err", err)
+		}
+		return
+	}
+
+	if sel == nil {
+		b.respondError(i, "Select at least one item to delete first.")
+		return
+	}
+
+	canManage, err := b.botCanManageEmojis(i.ChannelID)
+	if err != nil || !canManage {
+		b.respondError(i, fmt.Sprintf("The bot needs the **%s** permission to delete emojis.", prunePermissionName))
+		return
+	}
+
+	// Deleting many items and fetching their images can exceed the 3 second response window
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.DeferredMessageUpdate,
+	}); err != nil {
+		b.interactionLog(i).Error("Error deferring prune confirmation", "err", err)
+		return
+	}
+
+	emojis, err := b.getGuildEmojis(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild emojis", "err", err)
+	}
+	stickers, err := b.getGuildStickers(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild stickers", "err", err)
+	}
+
+	w := ScoreWeights{Usage: 1, Age: 1, Users: 1, Days: pruneStatsDays}
+	candidates, err := b.getRemovalCandidates(int64(i.GuildID), emojis, stickers, time.Now(), w, len(emojis)+len(stickers))
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching prune stats", "err", err)
+	}
+	byValue := make(map[string]RemovalCandidate, len(candidates))
+	for _, c := range candidates {
+		byValue[pruneValue(c.Kind, c.ID)] = c
+	}
+
+	var content strings.Builder
+	content.WriteString("**Pruning Results**\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	for _, v := range sel.Values {
+		kind, id, ok := parsePruneValue(v)
+		if !ok {
+			continue
+		}
+		c, found := byValue[v]
+		if !found {
+			content.WriteString(fmt.Sprintf("- %s %d: no longer in this server\n", kind, id))
+			continue
+		}
+		content.WriteString(b.pruneItem(ctx, i.GuildID, c, i.Member.User) + "\n")
+	}
+
+	b.emojiCacheMutex.Lock()
+	delete(b.emojiCache, i.GuildID)
+	b.emojiCacheMutex.Unlock()
+
+	if _, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+		Content:    option.NewNullableString(content.String()),
+		Components: &emptyComponents,
+	}); err != nil {
+		b.interactionLog(i).Error("Error editing prune results", "err", err)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// Table whose user_id column holds pseudonyms in pseudonymizing servers
+type pseudonymTable struct {
+	name string
+	// SQL expression for a row's server
+	server string
+	// Usage rather than the member's own choices; opted-out members' usage is anonymous
+	usage bool
+}
+
+// Member data stored per server. Moderator actions (settings changes, filter
+// entries, API tokens and polls created) keep user IDs, since they are shown
+// as mentions.
+var pseudonymTables = []pseudonymTable{
+	{"usage_events", "server_id", true},
+	{"usage_rollups", "server_id", true},
+	{"usage_role_rollups", "server_id", true},
+	{"emoji_poll_votes", "(SELECT server_id FROM emoji_polls WHERE id = poll_id)", false},
+	{"dashboard_logins", "server_id", false},
+	{"dashboard_sessions", "server_id", false},
+}
+
+// Tables of usage, which becomes anonymous when a member opts out
+func usageTables() []pseudonymTable {
+	var tables []pseudonymTable
+	for _, t := range pseudonymTables {
+		if t.usage {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+var errNotPseudonymized = errors.New("server has no pseudonym secret")
+
+// Keyed hash of a user ID. Pseudonyms are negative, so they can never be
+// mistaken for a raw snowflake or the anonymous 0.
+func pseudonymize(key []byte, userID int64) int64 {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, uint64(userID))
+	return -int64(binary.BigEndian.Uint64(mac.Sum(nil))>>2 | 1)
+}
+
+// Pseudonym for a member whose user ID isn't known
+func randomPseudonym() (int64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return -int64(binary.BigEndian.Uint64(buf[:])>>2 | 1), nil
+}
+
+// Key for a server's stored secret. With PSEUDONYM_KEY set, the database alone
+// isn't enough to check a user ID against a pseudonym.
+func pseudonymKeyFromSecret(secret []byte) []byte {
+	master := os.Getenv("PSEUDONYM_KEY")
+	if master == "" {
+		return secret
+	}
+	mac := hmac.New(sha256.New, []byte(master))
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+func newPseudonymSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return secret, nil
+}
+
+// A server's pseudonym key, or nil if it never pseudonymized users
+func (b *Bot) getPseudonymKey(serverID int64) ([]byte, error) {
+	b.pseudonymKeyCacheMutex.Lock()
+	defer b.pseudonymKeyCacheMutex.Unlock()
+
+	if key, ok := b.pseudonymKeyCache[serverID]; ok {
+		return key, nil
+	}
+	var secret []byte
+	err := b.DB.QueryRow("SELECT secret FROM guild_secrets WHERE server_id = ?", serverID).Scan(&secret)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	key := pseudonymKeyFromSecret(secret)
+	b.pseudonymKeyCache[serverID] = key
+	return key, nil
+}
+
+func (b *Bot) invalidatePseudonymKey(serverID int64) {
+	b.pseudonymKeyCacheMutex.Lock()
+	delete(b.pseudonymKeyCache, serverID)
+	b.pseudonymKeyCacheMutex.Unlock()
+}
+
+// Pseudonym keys of every server that has a secret
+func (b *Bot) getAllPseudonymKeys() (map[int64][]byte, error) {
+	rows, err := b.DB.Query("SELECT server_id, secret FROM guild_secrets")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[int64][]byte)
+	for rows.Next() {
+		var serverID int64
+		var secret []byte
+		if err := rows.Scan(&serverID, &secret); err != nil {
+			return nil, err
+		}
+		keys[serverID] = pseudonymKeyFromSecret(secret)
+	}
+	return keys, rows.Err()
+}
+
+// Whether any server has pseudonymize_users turned on
+func (b *Bot) anyGuildPseudonymizes() (bool, error) {
+	var found bool
+	err := b.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM guild_settings WHERE key = 'pseudonymize_users' AND value = 'true')").Scan(&found)
+	return found, err
+}
+
+// The stored user ID of a member's usage in a server: the pseudonym when the
+// server pseudonymizes users, else the ID itself. ok is false when the server
+// pseudonymizes but its key can't be read.
+func (b *Bot) storedUserID(serverID, userID int64) (int64, bool) {
+	if !b.getGuildSettings(serverID).PseudonymizeUsers {
+		return userID, true
+	}
+	key, err := b.getPseudonymKey(serverID)
+	if err != nil || key == nil {
+		trackingLog.Error("Error loading pseudonym key", idAttr("guild_id", serverID), "err", err)
+		return 0, false
+	}
+	return pseudonymize(key, userID), true
+}
+
+// Both IDs a member's usage in a server can be stored under: the ID as given,
+// and its pseudonym if the server ever pseudonymized users. Either a raw ID or
+// a pseudonym from a report can be passed.
+func (b *Bot) userIDCandidates(serverID, userID int64) ([2]int64, error) {
+	ids := [2]int64{userID, userID}
+	key, err := b.getPseudonymKey(serverID)
+	if err != nil {
+		return ids, err
+	}
+	if key != nil && userID > 0 {
+		ids[1] = pseudonymize(key, userID)
+	}
+	return ids, nil
+}
+
+// SQL condition matching a member's rows in every server, with the raw ID and
+// their pseudonym in each pseudonymizing server
+func (b *Bot) userRowsCondition(column, serverColumn string, userID int64) (string, []any, error) {
+	keys, err := b.getAllPseudonymKeys()
+	if err != nil {
+		return "", nil, err
+	}
+	cond := []string{column + " = ?"}
+	args := []any{userID}
+	for serverID, key := range keys {
+		cond = append(cond, fmt.Sprintf("(%s = ? AND %s = ?)", serverColumn, column))
+		args = append(args, serverID, pseudonymize(key, userID))
+	}
+	return "(" + strings.Join(cond, " OR ") + ")", args, nil
+}
+
+// Move a server's rows in the given tables from one stored user ID to another,
+// returning how many rows moved
+func remapUserIDs(tx *sql.Tx, tables []pseudonymTable, serverID int64, mapping map[int64]int64) (int64, error) {
+	var moved int64
+	for _, table := range tables {
+		for from, to := range mapping {
+			res, err := tx.Exec("UPDATE "+table.name+" SET user_id = ? WHERE "+table.server+" = ? AND user_id = ?", to, serverID, from)
+			if err != nil {
+				return moved, fmt.Errorf("failed to re-key %s: %w", table.name, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return moved, err
+			}
+			moved += n
+		}
+	}
+	return moved, nil
+}
+
+// Distinct stored user IDs of a server matching a condition on user_id
+func distinctUserIDs(tx *sql.Tx, serverID int64, cond string) ([]int64, error) {
+	var ids []int64
+	for _, table := range pseudonymTables {
+		rows, err := tx.Query("SELECT DISTINCT user_id FROM "+table.name+" WHERE "+table.server+" = ? AND "+cond, serverID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// Replace the raw user IDs a server has stored when it starts pseudonymizing.
+// Usage of opted-out members becomes anonymous instead, as it would be hidden
+// anyway and a pseudonym would escape the opt-out.
+func pseudonymizeStoredUsers(tx *sql.Tx, serverID int64, value string) error {
+	if value != "true" {
+		// Rows stay pseudonymized; the secret is kept so members still resolve
+		return nil
+	}
+
+	var secret []byte
+	err := tx.QueryRow("SELECT secret FROM guild_secrets WHERE server_id = ?", serverID).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		if secret, err = newPseudonymSecret(); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO guild_secrets (server_id, secret, created_at) VALUES (?, ?, ?)", serverID, secret, sqliteTime(time.Now()))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load pseudonym secret: %w", err)
+	}
+	key := pseudonymKeyFromSecret(secret)
+
+	for _, table := range usageTables() {
+		if _, err := tx.Exec("UPDATE "+table.name+" SET user_id = 0 WHERE "+table.server+" = ? AND user_id IN (SELECT user_id FROM privacy_optouts)", serverID); err != nil {
+			return fmt.Errorf("failed to anonymize opted-out usage: %w", err)
+		}
+	}
+	ids, err := distinctUserIDs(tx, serverID, "user_id > 0")
+	if err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
+	}
+	mapping := make(map[int64]int64, len(ids))
+	for _, id := range ids {
+		mapping[id] = pseudonymize(key, id)
+	}
+	_, err = remapUserIDs(tx, pseudonymTables, serverID, mapping)
+	return err
+}
+
+// Replace a server's secret and re-key its pseudonyms. Pseudonyms of current
+// members move to their new pseudonym; the rest, of members who left, get a
+// random one, so their usage stays together but can't be tied to them again.
+func (b *Bot) rotatePseudonymSecret(serverID int64, memberIDs []int64) (rekeyed, former int, err error) {
+	defer b.invalidatePseudonymKey(serverID)
+
+	err = b.withTx(func(tx *sql.Tx) error {
+		var oldSecret []byte
+		err := tx.QueryRow("SELECT secret FROM guild_secrets WHERE server_id = ?", serverID).Scan(&oldSecret)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotPseudonymized
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load pseudonym secret: %w", err)
+		}
+		secret, err := newPseudonymSecret()
+		if err != nil {
+			return err
+		}
+		oldKey, newKey := pseudonymKeyFromSecret(oldSecret), pseudonymKeyFromSecret(secret)
+
+		members := make(map[int64]int64, len(memberIDs))
+		for _, id := range memberIDs {
+			members[pseudonymize(oldKey, id)] = pseudonymize(newKey, id)
+		}
+		ids, err := distinctUserIDs(tx, serverID, "user_id < 0")
+		if err != nil {
+			return fmt.Errorf("failed to list pseudonyms: %w", err)
+		}
+		mapping := make(map[int64]int64, len(ids))
+		for _, id := range ids {
+			if _, done := mapping[id]; done {
+				continue
+			}
+			if to, ok := members[id]; ok {
+				mapping[id] = to
+				rekeyed++
+				continue
+			}
+			if mapping[id], err = randomPseudonym(); err != nil {
+				return err
+			}
+			former++
+		}
+		if _, err := remapUserIDs(tx, pseudonymTables, serverID, mapping); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE guild_secrets SET secret = ?, rotated_at = ? WHERE server_id = ?", secret, sqliteTime(time.Now()), serverID)
+		return err
+	})
+	return rekeyed, former, err
+}
+
+// Handle /config rotate_secret, which lists the server's members to re-key
+// their pseudonyms and can take a while
+func (b *Bot) handleRotateSecret(i *gateway.InteractionCreateEvent) {
+	serverID := int64(i.GuildID)
+	if key, err := b.getPseudonymKey(serverID); err != nil || key == nil {
+		b.respondError(i, "This server doesn't pseudonymize users. Turn it on with `/config set setting:pseudonymize_users value:true`.")
+		return
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.DeferredMessageInteractionWithSource,
+		Data: &api.InteractionResponseData{Flags: discord.EphemeralMessage},
+	}); err != nil {
+		b.interactionLog(i).Error("Error deferring secret rotation", "err", err)
+		return
+	}
+
+	content := ""
+	// Every page, not just the first thousand members the state would fetch: a
+	// member missing from the list would lose their usage to a random pseudonym
+	members, err := b.Client.MembersAfter(i.GuildID, 0, 0)
+	if err == nil && len(members) == 0 {
+		// The bot itself is a member, so the list can't really be empty
+		err = errors.New("no members listed")
+	}
+	if err != nil {
+		b.interactionLog(i).Error("Error listing members for secret rotation", "err", err)
+		content = "❌ Couldn't list the server's members, so nothing was changed. The bot needs the Server Members intent to rotate the secret."
+	} else {
+		ids := make([]int64, len(members))
+		for n, m := range members {
+			ids[n] = int64(m.User.ID)
+		}
+		rekeyed, former, err := b.rotatePseudonymSecret(serverID, ids)
+		if err != nil {
+			b.interactionLog(i).Error("Error rotating pseudonym secret", "err", err)
+			content = "❌ Failed to rotate the secret. Nothing was changed."
+		} else {
+			b.interactionLog(i).Info("Rotated pseudonym secret", "rekeyed", rekeyed, "former", former)
+			content = fmt.Sprintf("✅ Rotated the pseudonym secret. Re-keyed the usage of %d members; usage of %d members who left now has new pseudonyms that can't be tied to them.", rekeyed, former)
+		}
+	}
+
+	if _, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+		Content: option.NewNullableString(content),
+	}); err != nil {
+		b.interactionLog(i).Error("Error editing interaction response", "err", err)
+	}
+}
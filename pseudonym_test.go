@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Stored user IDs of the test guild's usage events, by number of events
+func (b *testBot) storedUsers() map[int64]int {
+	b.t.Helper()
+	rows, err := b.DB.Query("SELECT user_id, COUNT(*) FROM usage_events WHERE server_id = ? GROUP BY user_id", int64(testGuildID))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer rows.Close()
+	users := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			b.t.Fatal(err)
+		}
+		users[id] = n
+	}
+	return users
+}
+
+// Send a message with an emoji from a member
+func (b *testBot) messageFrom(userID discord.UserID) {
+	m := b.message("<:wave:111>")
+	m.Author.ID = userID
+	b.send(m)
+}
+
+func TestPseudonymizedUsers(t *testing.T) {
+	b := newTestBot(t)
+	b.messageFrom(testUserID)
+	b.messageFrom(otherUserID)
+
+	b.configure("pseudonymize_users", "true")
+	b.messageFrom(testUserID)
+
+	users := b.storedUsers()
+	if len(users) != 2 {
+		t.Fatalf("stored users = %v, want 2 pseudonyms", users)
+	}
+	var pseudonym int64
+	for id, n := range users {
+		if id >= 0 {
+			t.Errorf("raw or anonymous user ID %d stored", id)
+		}
+		if n == 2 {
+			pseudonym = id
+		}
+	}
+	if pseudonym == 0 {
+		t.Fatalf("stored users = %v, want earlier and new usage under one pseudonym", users)
+	}
+
+	top, err := b.getTopUsers(int64(testGuildID), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].UserID != pseudonym || top[0].Count != 2 {
+		t.Errorf("top users = %+v, want %d first with 2 uses", top, pseudonym)
+	}
+	for _, id := range []int64{int64(testUserID), pseudonym} {
+		if items, err := b.getUserTopItems(int64(testGuildID), id, 10); err != nil || len(items) != 1 || items[0].Count != 2 {
+			t.Errorf("items of %d = %+v, %v; want 2 uses", id, items, err)
+		}
+	}
+
+	b.send(b.command("myemojis"))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "<:wave:111> **x2**") {
+		t.Errorf("myemojis replied %q", content)
+	}
+
+	// Turning it off keeps the pseudonyms, and members still resolve
+	b.configure("pseudonymize_users", "false")
+	b.messageFrom(testUserID)
+	if got := b.storedUsers()[int64(testUserID)]; got != 1 {
+		t.Errorf("raw events after turning off = %d, want 1", got)
+	}
+	if items, err := b.getUserTopItems(int64(testGuildID), int64(testUserID), 10); err != nil || len(items) != 1 || items[0].Count != 3 {
+		t.Errorf("items after turning off = %+v, %v; want 3 uses", items, err)
+	}
+}
+
+func TestPseudonymizedPrivacy(t *testing.T) {
+	b := newTestBot(t)
+	b.messageFrom(testUserID)
+	b.messageFrom(otherUserID)
+	b.send(b.command("privacy", subcommand("optout")))
+
+	// Usage from before the opt-out becomes anonymous instead of pseudonymous
+	b.configure("pseudonymize_users", "true")
+	if got := b.storedUsers()[0]; got != 1 {
+		t.Errorf("anonymous events = %d, want the opted-out member's 1", got)
+	}
+
+	b.send(b.command("privacy", subcommand("optin")))
+	b.messageFrom(testUserID)
+	if n, err := b.countUsers(int64(testGuildID)); err != nil || n != 2 {
+		t.Errorf("countUsers = %d, %v; want 2", n, err)
+	}
+
+	export, err := b.getPrivacyExport(int64(testUserID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.UsageEvents) != 1 {
+		t.Errorf("exported events = %d, want the 1 pseudonymized event", len(export.UsageEvents))
+	}
+
+	b.send(b.command("privacy", subcommand("optout")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "earlier uses were made anonymous") {
+		t.Errorf("opt-out with pseudonymized usage replied %q, want a warning that it's anonymized", content)
+	}
+	if got := b.storedUsers()[0]; got != 2 {
+		t.Errorf("anonymous events after opting out again = %d, want 2", got)
+	}
+
+	b.send(b.command("privacy", subcommand("optin")))
+	b.messageFrom(testUserID)
+	b.send(b.button("privacy_delete"))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Erased you from 1 usage events") {
+		t.Errorf("delete replied %q", content)
+	}
+	if users := b.storedUsers(); len(users) != 2 || users[0] != 3 {
+		t.Errorf("stored users after delete = %v, want 3 anonymous events and the other member's", users)
+	}
+}
+
+func TestRotatePseudonymSecret(t *testing.T) {
+	b := newTestBot(t)
+	const leftUserID = discord.UserID(3002)
+
+	b.send(b.command("config", subcommand("rotate_secret")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "doesn't pseudonymize") {
+		t.Errorf("rotate without pseudonyms replied %q", content)
+	}
+
+	b.configure("pseudonymize_users", "true")
+	b.messageFrom(testUserID)
+	b.messageFrom(leftUserID)
+	before := b.storedUsers()
+
+	// Without the full member list nothing changes
+	b.send(b.command("config", subcommand("rotate_secret")))
+	if got := b.fake.Edits[len(b.fake.Edits)-1].Content.Val; !strings.Contains(got, "Couldn't list") {
+		t.Errorf("rotate without members replied %q", got)
+	}
+	b.fake.MembersByGuild[testGuildID] = []discord.Member{}
+	b.send(b.command("config", subcommand("rotate_secret")))
+	if got := b.fake.Edits[len(b.fake.Edits)-1].Content.Val; !strings.Contains(got, "Couldn't list") {
+		t.Errorf("rotate with an empty member list replied %q", got)
+	}
+	if after := b.storedUsers(); !maps.Equal(after, before) {
+		t.Errorf("stored users without a member list = %v, want %v", after, before)
+	}
+
+	b.fake.MembersByGuild[testGuildID] = []discord.Member{{User: discord.User{ID: testUserID}}, {User: discord.User{ID: otherUserID}}}
+	b.send(b.command("config", subcommand("rotate_secret")))
+	if got := b.fake.Edits[len(b.fake.Edits)-1].Content.Val; !strings.Contains(got, "usage of 1 members; usage of 1 members who left") {
+		t.Errorf("rotate replied %q", got)
+	}
+
+	after := b.storedUsers()
+	if len(after) != 2 {
+		t.Fatalf("stored users after rotation = %v, want 2", after)
+	}
+	for id := range before {
+		if after[id] != 0 {
+			t.Errorf("pseudonym %d survived the rotation", id)
+		}
+	}
+
+	// A current member's new usage joins their re-keyed usage
+	b.messageFrom(testUserID)
+	if items, err := b.getUserTopItems(int64(testGuildID), int64(testUserID), 10); err != nil || len(items) != 1 || items[0].Count != 2 {
+		t.Errorf("items after rotation = %+v, %v; want 2 uses", items, err)
+	}
+	if got := len(b.storedUsers()); got != 2 {
+		t.Errorf("stored users = %d, want 2", got)
+	}
+}
+
+// Stored voter IDs of a poll
+func (b *testBot) voters(pollID int64) []int64 {
+	b.t.Helper()
+	rows, err := b.DB.Query("SELECT user_id FROM emoji_poll_votes WHERE poll_id = ? ORDER BY user_id", pollID)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			b.t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestPseudonymizedVotes(t *testing.T) {
+	b := newTestBot(t)
+	p := &EmojiPoll{ServerID: int64(testGuildID), ChannelID: int64(testChannelID), Action: pollActionRemove, EmojiID: 111, EmojiName: "wave", CreatedBy: int64(otherUserID), ClosesAt: time.Now().Add(time.Hour)}
+	if err := b.createEmojiPoll(p); err != nil {
+		t.Fatal(err)
+	}
+	vote := func(userID discord.UserID, choice string) {
+		t.Helper()
+		e := b.button(fmt.Sprintf("emojivote:%d:%s", p.ID, choice))
+		e.Member.User.ID = userID
+		b.send(e)
+	}
+	vote(testUserID, "yes")
+
+	// Turning it on replaces the voter's ID
+	b.configure("pseudonymize_users", "true")
+	voters := b.voters(p.ID)
+	if len(voters) != 1 || voters[0] >= 0 {
+		t.Fatalf("voters = %v, want one pseudonym", voters)
+	}
+	if _, err := b.createDashboardLogin(int64(testGuildID), int64(testUserID), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var login int64
+	if err := b.DB.QueryRow("SELECT user_id FROM dashboard_logins").Scan(&login); err != nil || login >= 0 {
+		t.Errorf("dashboard login user = %d, %v; want a pseudonym", login, err)
+	}
+
+	export, err := b.getPrivacyExport(int64(testUserID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.PollVotes) != 1 || !export.PollVotes[0].Vote {
+		t.Errorf("exported votes = %+v, want the pseudonymized yes", export.PollVotes)
+	}
+
+	// Rotation re-keys the vote, so voting again replaces it
+	b.fake.MembersByGuild[testGuildID] = []discord.Member{{User: discord.User{ID: testUserID}}}
+	b.send(b.command("config", subcommand("rotate_secret")))
+	vote(testUserID, "no")
+	if after := b.voters(p.ID); len(after) != 1 || after[0] == voters[0] {
+		t.Errorf("voters after rotation = %v, want one new pseudonym", after)
+	}
+
+	// So does voting once it is turned off
+	b.configure("pseudonymize_users", "false")
+	vote(testUserID, "yes")
+	if yes, no, err := b.tallyEmojiPoll(p.ID); err != nil || yes != 1 || no != 0 {
+		t.Errorf("tally = %d yes, %d no, %v; want the member's one vote", yes, no, err)
+	}
+}
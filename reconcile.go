@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/httputil"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	reconcileInterval = time.Hour
+	// Messages with usage this recent have their reactions checked
+	reconcileWindow       = 24 * time.Hour
+	reconcileMessageLimit = 500
+	reconcileRequestDelay = 250 * time.Millisecond
+	defaultDriftStatsDays = 30
+)
+
+// Discord API calls reconciliation needs. *api.Client implements it; the
+// state's cached messages would only repeat what the gateway already told us.
+type ReconcileAPI interface {
+	ChannelAPI
+	Message(channelID discord.ChannelID, messageID discord.MessageID) (*discord.Message, error)
+}
+
+// Message with recent tracked usage
+type activeMessage struct {
+	ServerID  int64
+	ChannelID int64
+	MessageID int64
+}
+
+// Difference between recorded and actual reactions with one emoji on a message
+type ReactionDrift struct {
+	EmojiID  int64
+	Name     string
+	Animated bool
+	Recorded int
+	Actual   int
+}
+
+// Totals for one server's reconciliation run
+type ReconcileResult struct {
+	MessagesChecked int
+	ReactionsSeen   int
+	Corrections     int
+	Added           int
+	Removed         int
+}
+
+// Messages with usage events since a time, most recently active first. serverID 0 means all servers.
+func (b *Bot) getRecentlyActiveMessages(serverID int64, since time.Time, limit int) ([]activeMessage, error) {
+	query := `
+		SELECT server_id, channel_id, message_id
+		FROM usage_events
+		WHERE created_at >= ? AND message_id != 0 AND channel_id != 0 AND (? = 0 OR server_id = ?)
+		GROUP BY server_id, channel_id, message_id
+		ORDER BY MAX(created_at) DESC
+		LIMIT ?
+	`
+	rows, err := b.DB.Query(query, sqliteTime(since), serverID, serverID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []activeMessage
+	for rows.Next() {
+		var m activeMessage
+		if err := rows.Scan(&m.ServerID, &m.ChannelID, &m.MessageID); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// Net recorded reactions per emoji on a message
+func (b *Bot) getRecordedReactions(serverID, messageID int64) (map[int64]int, error) {
+	rows, err := b.DB.Query(
+		"SELECT item_id, SUM(delta) FROM usage_events WHERE server_id = ? AND message_id = ? AND source = ? AND kind = ? GROUP BY item_id",
+		serverID, messageID, sourceReaction, kindEmoji,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recorded := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		recorded[id] = count
+	}
+	return recorded, rows.Err()
+}
+
+// Compare recorded reactions with a message's current custom emoji reactions
+func compareReactions(recorded map[int64]int, reactions []discord.Reaction) []ReactionDrift {
+	var drifts []ReactionDrift
+	seen := make(map[int64]bool)
+	for _, r := range reactions {
+		if !r.Emoji.IsCustom() {
+			continue
+		}
+		id := int64(r.Emoji.ID)
+		seen[id] = true
+		if recorded[id] != r.Count {
+			drifts = append(drifts, ReactionDrift{EmojiID: id, Name: r.Emoji.Name, Animated: r.Emoji.Animated, Recorded: recorded[id], Actual: r.Count})
+		}
+	}
+	// Reactions that were removed entirely
+	for id, count := range recorded {
+		if !seen[id] && count != 0 {
+			drifts = append(drifts, ReactionDrift{EmojiID: id, Recorded: count})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].EmojiID < drifts[j].EmojiID })
+	return drifts
+}
+
+// Apply a correction to the aggregates and record it
+func (b *Bot) correctReactionDrift(m activeMessage, d ReactionDrift) error {
+	delta := d.Actual - d.Recorded
+	// The reactors behind a correction are unknown
+	uc := UsageContext{
+		ServerID:  m.ServerID,
+		ChannelID: m.ChannelID,
+		MessageID: m.MessageID,
+		Source:    sourceReaction,
+	}
+
+	return b.withTx(func(tx *sql.Tx) error {
+		var err error
+		if d.Name != "" {
+			query := `
+				INSERT INTO emojis (server_id, emote_id, emote_name, usage_count, animated)
+				VALUES (?, ?, ?, MAX(0, ?), ?)
+				ON CONFLICT(server_id, emote_id) DO UPDATE SET
+					usage_count = MAX(0, usage_count + ?)
+			`
+			_, err = tx.Exec(query, m.ServerID, d.EmojiID, d.Name, delta, d.Animated, delta)
+		} else {
+			_, err = tx.Exec("UPDATE emojis SET usage_count = MAX(0, usage_count + ?) WHERE server_id = ? AND emote_id = ?",
+				delta, m.ServerID, d.EmojiID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to correct emoji count: %w", err)
+		}
+		if err := bumpDailyUsage(tx, kindEmoji, d.EmojiID, uc, delta); err != nil {
+			return err
+		}
+		if err := recordUsageEvent(tx, kindEmoji, d.EmojiID, uc, delta); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO reaction_corrections (server_id, channel_id, message_id, emoji_id, recorded, actual) VALUES (?, ?, ?, ?, ?, ?)",
+			m.ServerID, m.ChannelID, m.MessageID, d.EmojiID, d.Recorded, d.Actual,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record reaction correction: %w", err)
+		}
+		return nil
+	})
+}
+
+// Check each message's reactions against what was recorded and correct any drift.
+// Returns totals per server.
+func (b *Bot) reconcileMessages(ctx context.Context, msgs []activeMessage) map[int64]*ReconcileResult {
+	results := make(map[int64]*ReconcileResult)
+	for idx, m := range msgs {
+		settings := b.getGuildSettings(m.ServerID)
+		if !settings.TrackReactions {
+			continue
+		}
+		// Reactions from compacted events are only in rollups, so every one of
+		// them would look missing
+		compactedBefore, err := b.getCompactedBefore(m.ServerID)
+		if err != nil {
+			reconcileLog.Error("Error fetching retention state", idAttr("guild_id", m.ServerID), "err", err)
+			continue
+		}
+		if discord.MessageID(m.MessageID).Time().Before(compactedBefore) {
+			continue
+		}
+		if !b.channelTracked(discord.GuildID(m.ServerID), discord.ChannelID(m.ChannelID)) {
+			continue
+		}
+		if idx > 0 {
+			if err := sleepContext(ctx, reconcileRequestDelay); err != nil {
+				break
+			}
+		}
+
+		msg, err := b.Client.Message(discord.ChannelID(m.ChannelID), discord.MessageID(m.MessageID))
+		var httpErr *httputil.HTTPError
+		if errors.As(err, &httpErr) && (httpErr.Status == http.StatusNotFound || httpErr.Status == http.StatusForbidden) {
+			// Deleted, or no longer readable; there is nothing to compare against
+			continue
+		}
+		if err != nil {
+			reconcileLog.Error("Error fetching message for reconciliation", idAttr("guild_id", m.ServerID), idAttr("channel_id", m.ChannelID), idAttr("message_id", m.MessageID), "err", err)
+			continue
+		}
+
+		recorded, err := b.getRecordedReactions(m.ServerID, m.MessageID)
+		if err != nil {
+			reconcileLog.Error("Error fetching recorded reactions", idAttr("guild_id", m.ServerID), idAttr("message_id", m.MessageID), "err", err)
+			continue
+		}
+
+		roleFiltered := b.hasRoleFilters(m.ServerID)
+		res, ok := results[m.ServerID]
+		if !ok {
+			res = &ReconcileResult{}
+			results[m.ServerID] = res
+		}
+		res.MessagesChecked++
+		for _, r := range msg.Reactions {
+			if r.Emoji.IsCustom() {
+				res.ReactionsSeen += r.Count
+			}
+		}
+
+		for _, d := range compareReactions(recorded, msg.Reactions) {
+			if d.Actual < d.Recorded && !settings.CountReactionRemovals {
+				// Removals aren't taken back on this server, so fewer reactions than recorded is expected
+				continue
+			}
+			if d.Actual > d.Recorded && roleFiltered {
+				// Reactions from ignored roles were never recorded, and the
+				// reactors behind the difference can't be checked
+				continue
+			}
+			if err := b.correctReactionDrift(m, d); err != nil {
+				reconcileLog.Error("Error correcting reactions", idAttr("guild_id", m.ServerID), idAttr("message_id", m.MessageID), "err", err)
+				continue
+			}
+			reconcileLog.Info("Corrected reaction drift", idAttr("guild_id", m.ServerID), idAttr("message_id", m.MessageID),
+				idAttr("emoji_id", d.EmojiID), "recorded", d.Recorded, "actual", d.Actual)
+			res.Corrections++
+			if delta := d.Actual - d.Recorded; delta > 0 {
+				res.Added += delta
+			} else {
+				res.Removed -= delta
+			}
+		}
+	}
+	return results
+}
+
+func (b *Bot) saveReconcileRun(serverID int64, r *ReconcileResult) error {
+	_, err := b.DB.Exec(
+		"INSERT INTO reconcile_runs (server_id, messages_checked, reactions_seen, corrections, added, removed) VALUES (?, ?, ?, ?, ?, ?)",
+		serverID, r.MessagesChecked, r.ReactionsSeen, r.Corrections, r.Added, r.Removed,
+	)
+	return err
+}
+
+// Reconcile recently active messages, for one server or all (serverID 0)
+func (b *Bot) reconcileRecent(ctx context.Context, serverID int64) (map[int64]*ReconcileResult, error) {
+	msgs, err := b.getRecentlyActiveMessages(serverID, time.Now().Add(-reconcileWindow), reconcileMessageLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch active messages: %w", err)
+	}
+
+	results := b.reconcileMessages(ctx, msgs)
+	for id, r := range results {
+		if err := b.saveReconcileRun(id, r); err != nil {
+			reconcileLog.Error("Error saving reconcile run", "err", err)
+		}
+	}
+	return results, nil
+}
+
+// Reconcile reactions once an hour until the context is cancelled
+func (b *Bot) runReconcileScheduler(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		results, err := b.reconcileRecent(ctx, 0)
+		if err != nil {
+			reconcileLog.Error("Error reconciling reactions", "err", err)
+			continue
+		}
+		for id, r := range results {
+			if r.Corrections > 0 {
+				reconcileLog.Info("Reconciled messages", idAttr("guild_id", id), "messages", r.MessagesChecked, "corrections", r.Corrections, "added", r.Added, "removed", r.Removed)
+			}
+		}
+	}
+}
+
+// Drift totals over a window
+type DriftStats struct {
+	Runs            int
+	MessagesChecked int
+	ReactionsSeen   int
+	Corrections     int
+	Added           int
+	Removed         int
+	LastRun         time.Time
+}
+
+func (b *Bot) getDriftStats(serverID int64, since time.Time) (DriftStats, error) {
+	var s DriftStats
+	var lastRun sql.NullString
+	err := b.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(messages_checked), 0), COALESCE(SUM(reactions_seen), 0), COALESCE(SUM(corrections), 0),
+			COALESCE(SUM(added), 0), COALESCE(SUM(removed), 0), MAX(created_at)
+		FROM reconcile_runs WHERE server_id = ? AND created_at >= ?`,
+		serverID, sqliteTime(since),
+	).Scan(&s.Runs, &s.MessagesChecked, &s.ReactionsSeen, &s.Corrections, &s.Added, &s.Removed, &lastRun)
+	if err != nil {
+		return s, err
+	}
+	// MAX() loses the column type, so the driver returns text
+	if lastRun.Valid {
+		s.LastRun, _ = time.Parse(sqliteTimeLayout, lastRun.String)
+	}
+	return s, nil
+}
+
+// Messages with the most corrected reactions
+func (b *Bot) getTopDriftMessages(serverID int64, since time.Time, limit int) ([]activeMessage, []int, error) {
+	rows, err := b.DB.Query(`
+		SELECT channel_id, message_id, SUM(ABS(actual - recorded)) AS drift
+		FROM reaction_corrections WHERE server_id = ? AND created_at >= ?
+		GROUP BY channel_id, message_id
+		ORDER BY drift DESC
+		LIMIT ?`,
+		serverID, sqliteTime(since), limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var msgs []activeMessage
+	var drifts []int
+	for rows.Next() {
+		m := activeMessage{ServerID: serverID}
+		var drift int
+		if err := rows.Scan(&m.ChannelID, &m.MessageID, &drift); err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, m)
+		drifts = append(drifts, drift)
+	}
+	return msgs, drifts, rows.Err()
+}
+
+// Percentage of seen reactions that had to be corrected
+func driftRate(s DriftStats) float64 {
+	if s.ReactionsSeen == 0 {
+		return 0
+	}
+	return 100 * float64(s.Added+s.Removed) / float64(s.ReactionsSeen)
+}
+
+func formatDriftStats(guildID discord.GuildID, s DriftStats, days int, top []activeMessage, drifts []int) string {
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**Reaction Drift** (last %d days)\n", days))
+	if s.Runs == 0 {
+		content.WriteString("No reconciliation has run yet.")
+		return content.String()
+	}
+	content.WriteString(fmt.Sprintf("- Runs: %d, last <t:%d:R>\n", s.Runs, s.LastRun.Unix()))
+	content.WriteString(fmt.Sprintf("- Messages checked: %d, custom emoji reactions seen: %d\n", s.MessagesChecked, s.ReactionsSeen))
+	content.WriteString(fmt.Sprintf("- Corrections: %d (**+%d** missed adds, **-%d** missed removals)\n", s.Corrections, s.Added, s.Removed))
+	content.WriteString(fmt.Sprintf("- Drift: **%.2f%%** of seen reactions\n", driftRate(s)))
+	if len(top) > 0 {
+		content.WriteString("\n**Most Corrected Messages**\n")
+		for idx, m := range top {
+			content.WriteString(fmt.Sprintf("%d. https://discord.com/channels/%d/%d/%d (%d reactions)\n", idx+1, guildID, m.ChannelID, m.MessageID, drifts[idx]))
+		}
+	}
+	return content.String()
+}
+
+// Handle /reconcile command
+func (b *Bot) handleReconcile(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	serverID := int64(i.GuildID)
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+
+	switch sub.Name {
+	case "run":
+		// Fetching each message can exceed the 3 second response window
+		if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+			Type: api.DeferredMessageInteractionWithSource,
+			Data: &api.InteractionResponseData{Flags: discord.EphemeralMessage},
+		}); err != nil {
+			b.interactionLog(i).Error("Error deferring reconciliation", "err", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		content := "❌ Failed to reconcile reactions."
+		results, err := b.reconcileRecent(ctx, serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error reconciling reactions", "err", err)
+		} else {
+			r := results[serverID]
+			if r == nil {
+				r = &ReconcileResult{}
+			}
+			content = fmt.Sprintf("✅ Checked %d recently active messages: %d corrections (+%d/-%d reactions).",
+				r.MessagesChecked, r.Corrections, r.Added, r.Removed)
+		}
+		if _, err := b.Client.EditInteractionResponse(i.AppID, i.Token, api.EditInteractionResponseData{
+			Content: option.NewNullableString(content),
+		}); err != nil {
+			b.interactionLog(i).Error("Error editing interaction response", "err", err)
+		}
+
+	case "stats":
+		days := defaultDriftStatsDays
+		if v, err := sub.Options.Find("days").IntValue(); err == nil && v > 0 {
+			days = int(v)
+		}
+		since := time.Now().AddDate(0, 0, -days)
+
+		stats, err := b.getDriftStats(serverID, since)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching drift stats", "err", err)
+			b.respondError(i, "Failed to fetch drift statistics.")
+			return
+		}
+		top, drifts, err := b.getTopDriftMessages(serverID, since, 5)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching drift messages", "err", err)
+			b.respondError(i, "Failed to fetch drift statistics.")
+			return
+		}
+
+		if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+			Type: api.MessageInteractionWithSource,
+			Data: &api.InteractionResponseData{
+				Content: option.NewNullableString(formatDriftStats(i.GuildID, stats, days, top, drifts)),
+				Flags:   discord.EphemeralMessage,
+			},
+		}); err != nil {
+			b.interactionLog(i).Error("Error responding to interaction", "err", err)
+		}
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+func TestCompareReactions(t *testing.T) {
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	dance := discord.Emoji{ID: 112, Name: "dance", Animated: true}
+	tests := []struct {
+		name      string
+		recorded  map[int64]int
+		reactions []discord.Reaction
+		want      []ReactionDrift
+	}{
+		{
+			name:      "in sync",
+			recorded:  map[int64]int{111: 2},
+			reactions: []discord.Reaction{{Emoji: wave, Count: 2}},
+		},
+		{
+			name:      "missed adds",
+			recorded:  map[int64]int{111: 1},
+			reactions: []discord.Reaction{{Emoji: wave, Count: 3}},
+			want:      []ReactionDrift{{EmojiID: 111, Name: "wave", Recorded: 1, Actual: 3}},
+		},
+		{
+			name:      "missed removals",
+			recorded:  map[int64]int{111: 3},
+			reactions: []discord.Reaction{{Emoji: wave, Count: 1}},
+			want:      []ReactionDrift{{EmojiID: 111, Name: "wave", Recorded: 3, Actual: 1}},
+		},
+		{
+			name:     "removed entirely",
+			recorded: map[int64]int{111: 2, 112: 0},
+			want:     []ReactionDrift{{EmojiID: 111, Recorded: 2}},
+		},
+		{
+			name:      "never recorded, sorted by emoji",
+			recorded:  map[int64]int{111: 1},
+			reactions: []discord.Reaction{{Emoji: dance, Count: 1}, {Emoji: discord.Emoji{Name: "👍"}, Count: 4}},
+			want: []ReactionDrift{
+				{EmojiID: 111, Recorded: 1},
+				{EmojiID: 112, Name: "dance", Animated: true, Actual: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := compareReactions(tt.recorded, tt.reactions); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: drifts = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	tests := []struct {
+		name            string
+		countRemovals   bool
+		recorded        int
+		actual          []discord.Reaction
+		wantCount       int
+		wantCorrections int
+		wantAdded       int
+		wantRemoved     int
+	}{
+		{"drift up", true, 1, []discord.Reaction{{Emoji: wave, Count: 3}}, 3, 1, 2, 0},
+		{"drift down", true, 3, []discord.Reaction{{Emoji: wave, Count: 1}}, 1, 1, 0, 2},
+		{"emoji removed entirely", true, 2, nil, 0, 1, 0, 2},
+		{"removals not counted", false, 2, nil, 2, 0, 0, 0},
+		{"added while removals are not counted", false, 1, []discord.Reaction{{Emoji: wave, Count: 2}}, 2, 1, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			if !tt.countRemovals {
+				b.configure("count_reaction_removals", "false")
+			}
+			for n := range tt.recorded {
+				add := b.reactionAdd(500, wave)
+				add.UserID = testUserID + discord.UserID(n)
+				b.send(add)
+			}
+			b.fake.Messages[500] = discord.Message{ID: 500, ChannelID: testChannelID, Reactions: tt.actual}
+
+			results, err := b.reconcileRecent(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := results[int64(testGuildID)]
+			if r == nil || r.MessagesChecked != 1 || r.Corrections != tt.wantCorrections || r.Added != tt.wantAdded || r.Removed != tt.wantRemoved {
+				t.Errorf("result = %+v, want %d corrections adding %d and removing %d", r, tt.wantCorrections, tt.wantAdded, tt.wantRemoved)
+			}
+			if got := b.emojiCount(111); got != tt.wantCount {
+				t.Errorf("emoji count = %d, want %d", got, tt.wantCount)
+			}
+			if got := b.rows("reaction_corrections"); got != tt.wantCorrections {
+				t.Errorf("stored corrections = %d, want %d", got, tt.wantCorrections)
+			}
+
+			// A second run finds nothing left to correct
+			results, err = b.reconcileRecent(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r := results[int64(testGuildID)]; r != nil && r.Corrections != 0 {
+				t.Errorf("second run = %+v, want no corrections", r)
+			}
+		})
+	}
+}
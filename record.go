@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// One line of a recording
+type recordedEvent struct {
+	Type  string          `json:"type"`
+	At    time.Time       `json:"at"`
+	Event json.RawMessage `json:"event"`
+}
+
+// Events worth recording, by type, with a constructor for decoding them
+var recordedEventTypes = map[string]func() gateway.Event{
+	string((&gateway.MessageCreateEvent{}).EventType()):         func() gateway.Event { return &gateway.MessageCreateEvent{} },
+	string((&gateway.MessageReactionAddEvent{}).EventType()):    func() gateway.Event { return &gateway.MessageReactionAddEvent{} },
+	string((&gateway.MessageReactionRemoveEvent{}).EventType()): func() gateway.Event { return &gateway.MessageReactionRemoveEvent{} },
+	string((&gateway.InteractionCreateEvent{}).EventType()):     func() gateway.Event { return &gateway.InteractionCreateEvent{} },
+}
+
+// Writes the events the bot consumes to a gzip-compressed JSONL file
+type EventRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	// Key snowflakes are hashed with; nil records them as they are
+	hashKey []byte
+}
+
+// Open a recording, appending to the file if it exists. Message text is
+// reduced to its custom emojis. With a hash key, guild, channel, message, user
+// and interaction IDs are replaced by keyed hashes.
+func OpenEventRecorder(path, hashKey string) (*EventRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	// Appending starts a new gzip member, which readers treat as one stream
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	enc.SetEscapeHTML(false)
+	r := &EventRecorder{file: f, gz: gz, enc: enc}
+	if hashKey != "" {
+		r.hashKey = []byte(hashKey)
+	}
+	return r, nil
+}
+
+// Record an event received at the given time. Events the handlers don't track are skipped.
+func (r *EventRecorder) Record(e gateway.Event, at time.Time) error {
+	eventType := string(e.EventType())
+	if _, ok := recordedEventTypes[eventType]; !ok {
+		return nil
+	}
+	if i, ok := e.(*gateway.InteractionCreateEvent); ok {
+		// The token lets anyone answer the interaction for 15 minutes
+		stripped := *i
+		stripped.Token = ""
+		e = &stripped
+	}
+	if m, ok := e.(*gateway.MessageCreateEvent); ok {
+		// The handlers read nothing of the text but its emojis
+		stripped := *m
+		stripped.Content = emojiMarkup(m.Content)
+		e = &stripped
+	}
+	if r.hashKey != nil {
+		e = r.anonymize(e)
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false) // Keep emoji markup greppable
+	if err := enc.Encode(e); err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(recordedEvent{Type: eventType, At: at.UTC(), Event: bytes.TrimSpace(data.Bytes())}); err != nil {
+		return err
+	}
+	// Flush so a crash loses at most the event being written
+	return r.gz.Flush()
+}
+
+// Whether IDs are hashed in the recording
+func (r *EventRecorder) hashed() bool {
+	return r.hashKey != nil
+}
+
+func (r *EventRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.gz.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// The guild and member of an event that can be recorded
+func recordedEventOrigin(e gateway.Event) (discord.GuildID, discord.UserID) {
+	switch e := e.(type) {
+	case *gateway.MessageCreateEvent:
+		return e.GuildID, e.Author.ID
+	case *gateway.MessageReactionAddEvent:
+		return e.GuildID, e.UserID
+	case *gateway.MessageReactionRemoveEvent:
+		return e.GuildID, e.UserID
+	case *gateway.InteractionCreateEvent:
+		if e.Member != nil {
+			return e.GuildID, e.Member.User.ID
+		}
+		if e.User != nil {
+			return e.GuildID, e.User.ID
+		}
+		return e.GuildID, 0
+	}
+	return 0, 0
+}
+
+// Whether an event may be written to the recording. Opted-out members' events
+// are left out, and so are pseudonymizing servers' events unless IDs are
+// hashed, so their members' raw IDs never touch disk.
+func (b *Bot) recordable(e gateway.Event) bool {
+	guildID, userID := recordedEventOrigin(e)
+	if userID.IsValid() && b.optedOut(int64(userID)) {
+		return false
+	}
+	if guildID.IsValid() && !b.Recorder.hashed() && b.getGuildSettings(int64(guildID)).PseudonymizeUsers {
+		return false
+	}
+	return true
+}
+
+// Replace a snowflake with a keyed hash of it. Equal IDs hash equally, so
+// relations between events survive; zero (no ID) stays zero.
+func hashSnowflake[ID ~uint64](key []byte, id ID) ID {
+	if id == 0 {
+		return id
+	}
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, uint64(id))
+	// Keep the result positive and non-zero when stored as int64
+	return ID(binary.BigEndian.Uint64(mac.Sum(nil))>>2 | 1)
+}
+
+// Only the custom emoji markup in a message's text
+func emojiMarkup(content string) string {
+	return strings.Join(customEmojiRegex.FindAllString(content, -1), " ")
+}
+
+// Only the roles of a member, which role filters and stats read
+func memberRoles(m *discord.Member) *discord.Member {
+	if m == nil {
+		return nil
+	}
+	return &discord.Member{RoleIDs: m.RoleIDs}
+}
+
+// Copy of an event with IDs hashed and anything the handlers don't read dropped.
+// Emoji and sticker IDs and names are kept, since they are what is counted.
+func (r *EventRecorder) anonymize(e gateway.Event) gateway.Event {
+	switch e := e.(type) {
+	case *gateway.MessageCreateEvent:
+		return &gateway.MessageCreateEvent{Message: discord.Message{
+			ID:        hashSnowflake(r.hashKey, e.ID),
+			ChannelID: hashSnowflake(r.hashKey, e.ChannelID),
+			GuildID:   hashSnowflake(r.hashKey, e.GuildID),
+			Author:    discord.User{ID: hashSnowflake(r.hashKey, e.Author.ID), Bot: e.Author.Bot},
+			Content:   emojiMarkup(e.Content),
+			Stickers:  e.Stickers,
+			Timestamp: e.Timestamp,
+		}, Member: memberRoles(e.Member)}
+	case *gateway.MessageReactionAddEvent:
+		return &gateway.MessageReactionAddEvent{
+			UserID:    hashSnowflake(r.hashKey, e.UserID),
+			ChannelID: hashSnowflake(r.hashKey, e.ChannelID),
+			MessageID: hashSnowflake(r.hashKey, e.MessageID),
+			GuildID:   hashSnowflake(r.hashKey, e.GuildID),
+			Member:    memberRoles(e.Member),
+			Emoji:     e.Emoji,
+		}
+	case *gateway.MessageReactionRemoveEvent:
+		return &gateway.MessageReactionRemoveEvent{
+			UserID:    hashSnowflake(r.hashKey, e.UserID),
+			ChannelID: hashSnowflake(r.hashKey, e.ChannelID),
+			MessageID: hashSnowflake(r.hashKey, e.MessageID),
+			GuildID:   hashSnowflake(r.hashKey, e.GuildID),
+			Emoji:     e.Emoji,
+		}
+	case *gateway.InteractionCreateEvent:
+		i := discord.InteractionEvent{
+			ID:        hashSnowflake(r.hashKey, e.ID),
+			AppID:     e.AppID,
+			ChannelID: hashSnowflake(r.hashKey, e.ChannelID),
+			GuildID:   hashSnowflake(r.hashKey, e.GuildID),
+			Data:      r.anonymizeData(e.Data),
+		}
+		if e.Member != nil {
+			i.Member = &discord.Member{User: discord.User{ID: hashSnowflake(r.hashKey, e.Member.User.ID)}}
+		}
+		if e.User != nil {
+			i.User = &discord.User{ID: hashSnowflake(r.hashKey, e.User.ID)}
+		}
+		if e.Message != nil {
+			i.Message = &discord.Message{ID: hashSnowflake(r.hashKey, e.Message.ID)}
+		}
+		return &gateway.InteractionCreateEvent{InteractionEvent: i}
+	}
+	return e
+}
+
+// Copy of a command's data with snowflake options hashed. Resolved is
+// dropped: it holds the picked users, roles and channels by their raw IDs,
+// and the handlers look them up again when it is missing.
+func (r *EventRecorder) anonymizeData(data discord.InteractionData) discord.InteractionData {
+	c, ok := data.(*discord.CommandInteraction)
+	if !ok {
+		return data
+	}
+	return &discord.CommandInteraction{
+		ID:       c.ID,
+		Name:     c.Name,
+		Options:  r.anonymizeOptions(c.Options),
+		GuildID:  hashSnowflake(r.hashKey, c.GuildID),
+		TargetID: hashSnowflake(r.hashKey, c.TargetID),
+	}
+}
+
+func (r *EventRecorder) anonymizeOptions(opts discord.CommandInteractionOptions) discord.CommandInteractionOptions {
+	if opts == nil {
+		return nil
+	}
+	hashed := make(discord.CommandInteractionOptions, len(opts))
+	for n, o := range opts {
+		hashed[n] = discord.CommandInteractionOption{Type: o.Type, Name: o.Name, Value: o.Value, Options: r.anonymizeOptions(o.Options)}
+		switch o.Type {
+		case discord.UserOptionType, discord.ChannelOptionType, discord.RoleOptionType, discord.MentionableOptionType, discord.AttachmentOptionType:
+			id, err := o.SnowflakeValue()
+			if err != nil {
+				hashed[n].Value = nil
+				continue
+			}
+			hashed[n].Value, _ = json.Marshal(hashSnowflake(r.hashKey, id))
+		}
+	}
+	return hashed
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// Traffic touching every recorded event type
+func recordTraffic(b *testBot) {
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	m := b.message("morning <:wave:111> <a:dance:112>", discord.StickerItem{ID: 211, Name: "cat"})
+	other := b.message("<:wave:111>")
+	other.Author.ID = testUserID + 1
+	b.send(
+		m,
+		other,
+		b.reactionAdd(m.ID, wave),
+		b.reactionAdd(other.ID, wave),
+		b.reactionRemove(other.ID, wave),
+		b.command("listemotes"),
+		&gateway.TypingStartEvent{ChannelID: testChannelID},
+	)
+}
+
+// Record traffic with a bot and return the recording
+func record(t *testing.T, hashKey string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.jsonl.gz")
+	recorder, err := OpenEventRecorder(path, hashKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBot(t)
+	b.Recorder = recorder
+	recordTraffic(b)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func decompress(t *testing.T, data []byte) string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+// Emoji and sticker counts summed over every guild
+func totals(t *testing.T, b *testBot) (emojis, stickers, users int) {
+	t.Helper()
+	row := b.DB.QueryRow(`SELECT
+		(SELECT COALESCE(SUM(usage_count), 0) FROM emojis),
+		(SELECT COALESCE(SUM(usage_count), 0) FROM stickers),
+		(SELECT COUNT(DISTINCT user_id) FROM usage_events)`)
+	if err := row.Scan(&emojis, &stickers, &users); err != nil {
+		t.Fatal(err)
+	}
+	return emojis, stickers, users
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		hashKey string
+	}{
+		{name: "raw IDs"},
+		{name: "hashed IDs", hashKey: "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recording := record(t, tt.hashKey)
+
+			live := newTestBot(t)
+			recordTraffic(live)
+			wantEmojis, wantStickers, wantUsers := totals(t, live)
+
+			replayed := newTestBot(t)
+			stats := ReplayStats{Events: make(map[string]int)}
+			if err := replayEvents(replayed.Bot, bytes.NewReader(recording), &stats); err != nil {
+				t.Fatal(err)
+			}
+			if got := stats.Total(); got != 6 {
+				t.Errorf("replayed %d events, want 6 (typing is not recorded): %v", got, stats.Events)
+			}
+
+			emojis, stickers, users := totals(t, replayed)
+			if emojis != wantEmojis || stickers != wantStickers || users != wantUsers {
+				t.Errorf("replayed totals = %d emojis, %d stickers, %d users; want %d, %d, %d",
+					emojis, stickers, users, wantEmojis, wantStickers, wantUsers)
+			}
+			if len(replayed.fake.Responses) != 1 {
+				t.Errorf("replayed command sent %d responses, want 1", len(replayed.fake.Responses))
+			}
+		})
+	}
+}
+
+func TestRecordingHidesIDsAndText(t *testing.T) {
+	plain := decompress(t, record(t, "secret"))
+
+	for _, secret := range []string{
+		`"guild_id":"` + strconv.FormatUint(uint64(testGuildID), 10) + `"`,
+		`"id":"` + strconv.FormatUint(uint64(testUserID), 10) + `"`,
+		"morning",
+		`"token":"token"`,
+	} {
+		if strings.Contains(plain, secret) {
+			t.Errorf("hashed recording contains %q", secret)
+		}
+	}
+	for _, kept := range []string{"<:wave:111>", "<a:dance:112>", `"name":"cat"`} {
+		if !strings.Contains(plain, kept) {
+			t.Errorf("hashed recording lost %q", kept)
+		}
+	}
+
+	// Picked channels are hashed in options and not resolved
+	b := newTestBot(t)
+	cmd := b.command("tracking", subcommand("ignore", channelOption("channel", memesChannelID)))
+	data := cmd.Data.(*discord.CommandInteraction)
+	data.Resolved.Channels = map[discord.ChannelID]discord.Channel{memesChannelID: {ID: memesChannelID, Name: "memes"}}
+	path := filepath.Join(t.TempDir(), "events.jsonl.gz")
+	recorder, err := OpenEventRecorder(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Record(cmd, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain = decompress(t, raw)
+	for _, secret := range []string{`"2001"`, `"memes"`, `"channels"`} {
+		if strings.Contains(plain, secret) {
+			t.Errorf("hashed command contains %q: %s", secret, plain)
+		}
+	}
+	hashed := strconv.FormatUint(uint64(hashSnowflake([]byte("secret"), memesChannelID)), 10)
+	if !strings.Contains(plain, `"value":"`+hashed+`"`) {
+		t.Errorf("hashed command lost the channel option: %s", plain)
+	}
+}
+
+func TestRecordingDropsTokensAndText(t *testing.T) {
+	plain := decompress(t, record(t, ""))
+	if strings.Contains(plain, `"token":"token"`) {
+		t.Error("recording contains an interaction token")
+	}
+	if strings.Contains(plain, "morning") {
+		t.Error("raw recording contains message text")
+	}
+	if !strings.Contains(plain, "<:wave:111>") {
+		t.Error("raw recording lost the message's emojis")
+	}
+}
+
+func TestRecordingSkipsPrivateMembers(t *testing.T) {
+	tests := []struct {
+		name         string
+		hashKey      string
+		pseudonymize bool
+		optOut       bool
+		want         int
+	}{
+		{name: "raw IDs", want: 2},
+		{name: "raw IDs with an opted-out member", optOut: true, want: 1},
+		{name: "raw IDs in a pseudonymizing server", pseudonymize: true, want: 0},
+		{name: "hashed IDs in a pseudonymizing server", hashKey: "secret", pseudonymize: true, want: 2},
+		{name: "hashed IDs with an opted-out member", hashKey: "secret", optOut: true, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			if tt.pseudonymize {
+				b.configure("pseudonymize_users", "true")
+			}
+			if tt.optOut {
+				if _, _, err := b.setOptOut(int64(testUserID), true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(t.TempDir(), "events.jsonl.gz")
+			recorder, err := OpenEventRecorder(path, tt.hashKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Recorder = recorder
+			other := b.message("<:wave:111>")
+			other.Author.ID = testUserID + 1
+			b.send(b.message("<:wave:111>"), other)
+			recorder.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(decompress(t, data), "\n"); got != tt.want {
+				t.Errorf("recorded %d events, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayUsesRecordedTimes(t *testing.T) {
+	var buf bytes.Buffer
+	path := filepath.Join(t.TempDir(), "events.jsonl.gz")
+	recorder, err := OpenEventRecorder(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBot(t)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := recorder.Record(b.message("<:wave:111>"), at); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+	data, _ := os.ReadFile(path)
+	buf.Write(data)
+
+	stats := ReplayStats{Events: make(map[string]int)}
+	if err := replayEvents(b.Bot, &buf, &stats); err != nil {
+		t.Fatal(err)
+	}
+	var day string
+	if err := b.DB.QueryRow("SELECT date(day) FROM usage_daily WHERE item_id = 111").Scan(&day); err != nil {
+		t.Fatal(err)
+	}
+	if day != "2024-03-01" {
+		t.Errorf("usage recorded on %s, want 2024-03-01", day)
+	}
+}
+
+func TestRecordingAppendsAndSurvivesTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl.gz")
+	b := newTestBot(t)
+	for range 2 {
+		recorder, err := OpenEventRecorder(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := recorder.Record(b.message("<:wave:111>"), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		recorder.Close()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := ReplayStats{Events: make(map[string]int)}
+	if err := replayEvents(b.Bot, bytes.NewReader(data), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.Total(); got != 2 {
+		t.Errorf("replayed %d events from two sessions, want 2", got)
+	}
+
+	// A crash leaves the last gzip member without its trailer
+	stats = ReplayStats{Events: make(map[string]int)}
+	if err := replayEvents(b.Bot, bytes.NewReader(data[:len(data)-4]), &stats); err != nil {
+		t.Errorf("truncated recording: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+var errOffline = errors.New("not connected to Discord")
+
+// DiscordClient for replays. Responses are dropped and lookups fail, since
+// there is no session to answer them; image fetches fail the same way.
+type offlineClient struct{}
+
+var _ DiscordClient = offlineClient{}
+
+func (offlineClient) RespondInteraction(discord.InteractionID, string, api.InteractionResponse) error {
+	return nil
+}
+
+func (offlineClient) EditInteractionResponse(discord.AppID, string, api.EditInteractionResponseData) (*discord.Message, error) {
+	return &discord.Message{}, nil
+}
+
+func (offlineClient) FollowUpInteraction(discord.AppID, string, api.InteractionResponseData) (*discord.Message, error) {
+	return &discord.Message{}, nil
+}
+
+func (offlineClient) BulkOverwriteCommands(discord.AppID, []api.CreateCommandData) ([]discord.Command, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) SendMessageComplex(channelID discord.ChannelID, _ api.SendMessageData) (*discord.Message, error) {
+	return &discord.Message{ChannelID: channelID}, nil
+}
+
+func (offlineClient) EditMessageComplex(channelID discord.ChannelID, messageID discord.MessageID, _ api.EditMessageData) (*discord.Message, error) {
+	return &discord.Message{ID: messageID, ChannelID: channelID}, nil
+}
+
+func (offlineClient) CreatePrivateChannel(discord.UserID) (*discord.Channel, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) Me() (*discord.User, error) { return nil, errOffline }
+
+func (offlineClient) Guild(discord.GuildID) (*discord.Guild, error) { return nil, errOffline }
+
+func (offlineClient) Channel(discord.ChannelID) (*discord.Channel, error) { return nil, errOffline }
+
+func (offlineClient) MembersAfter(discord.GuildID, discord.UserID, uint) ([]discord.Member, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) Member(discord.GuildID, discord.UserID) (*discord.Member, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) Channels(discord.GuildID) ([]discord.Channel, error) { return nil, errOffline }
+
+func (offlineClient) Permissions(discord.ChannelID, discord.UserID) (discord.Permissions, error) {
+	return 0, errOffline
+}
+
+func (offlineClient) Emojis(discord.GuildID) ([]discord.Emoji, error) { return nil, errOffline }
+
+func (offlineClient) CreateEmoji(discord.GuildID, api.CreateEmojiData) (*discord.Emoji, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) DeleteEmoji(discord.GuildID, discord.EmojiID, api.AuditLogReason) error {
+	return errOffline
+}
+
+func (offlineClient) GuildStickers(discord.GuildID) ([]discord.Sticker, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) DeleteGuildSticker(discord.GuildID, discord.StickerID, api.AuditLogReason) error {
+	return errOffline
+}
+
+func (offlineClient) Message(discord.ChannelID, discord.MessageID) (*discord.Message, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) MessagesBefore(discord.ChannelID, discord.MessageID, uint) ([]discord.Message, error) {
+	return nil, errOffline
+}
+
+func (offlineClient) Fetch(context.Context, string, int64) ([]byte, string, error) {
+	return nil, "", errOffline
+}
+
+// What a replay fed through the handlers
+type ReplayStats struct {
+	Events  map[string]int // By event type
+	Skipped int            // Lines of types the handlers don't take
+	Elapsed time.Duration
+}
+
+func (s ReplayStats) Total() int {
+	total := 0
+	for _, n := range s.Events {
+		total += n
+	}
+	return total
+}
+
+// Feed a recording through the bot's handlers, in order and at the times the events were received
+func replayEvents(b *Bot, r io.Reader, stats *ReplayStats) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+	defer gz.Close()
+
+	start := time.Now()
+	defer func() { stats.Elapsed += time.Since(start) }()
+
+	dec := json.NewDecoder(gz)
+	for line := 1; ; line++ {
+		var rec recordedEvent
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The recording was cut off by a crash while writing
+			dataLog.Warn("Recording ends mid-event", "line", line)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		newEvent, ok := recordedEventTypes[rec.Type]
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+		e := newEvent()
+		if err := json.Unmarshal(rec.Event, e); err != nil {
+			return fmt.Errorf("line %d: failed to decode %s: %w", line, rec.Type, err)
+		}
+		b.dispatch(e, rec.At)
+		stats.Events[rec.Type]++
+	}
+}
+
+// Replay recordings into a fresh database: emote_keeper replay [-db path] recording.jsonl.gz...
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	dbPath := fs.String("db", "./replay.db", "path of the fresh SQLite database to create")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no recordings given")
+	}
+	if _, err := os.Stat(*dbPath); err == nil {
+		return fmt.Errorf("%s already exists; replay needs a fresh database", *dbPath)
+	}
+
+	b, err := newOfflineBot(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer b.DB.Close()
+
+	imageDir, err := os.MkdirTemp("", "emote_keeper_replay")
+	if err != nil {
+		return fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+	defer os.RemoveAll(imageDir)
+	if b.Images, err = NewImageCache(b.DB, imageDir, offlineClient{}, defaultMaxImageBytes, defaultMaxImageCacheLen); err != nil {
+		return err
+	}
+
+	b.Backfiller = NewBackfiller(context.Background(), b)
+
+	stats := ReplayStats{Events: make(map[string]int)}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open recording: %w", err)
+		}
+		err = replayEvents(b, f, &stats)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	types := make([]string, 0, len(stats.Events))
+	for t := range stats.Events {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	for _, t := range types {
+		fmt.Printf("%-24s %d\n", t, stats.Events[t])
+	}
+	if stats.Skipped > 0 {
+		fmt.Printf("%-24s %d\n", "skipped", stats.Skipped)
+	}
+	total := stats.Total()
+	fmt.Printf("Replayed %d events into %s in %s (%.0f events/s)\n",
+		total, *dbPath, stats.Elapsed.Round(time.Millisecond), float64(total)/max(stats.Elapsed.Seconds(), 1e-9))
+	return nil
+}
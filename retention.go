@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Raw events are kept at least this long, since reconciliation and
+	// backfill compare against them
+	minRetentionDays = 7
+	// Daily rollups older than this are merged into monthly ones
+	dailyRollupDays   = 365
+	retentionSchedule = "30 3 * * *"
+)
+
+// Periods of usage rollups
+const (
+	rollupDay   = "day"
+	rollupMonth = "month"
+)
+
+// Parse RETENTION_MAX_DAYS, the most days any server keeps raw events. Empty
+// or 0 means no maximum.
+func parseRetentionMaxDays(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(s)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("expected a number of days, got %q", s)
+	}
+	return days, nil
+}
+
+// Days of raw events a server keeps, 0 for all of them: its retention_days
+// setting, capped by the global maximum and no lower than minRetentionDays
+func (b *Bot) retentionDays(serverID int64, maxDays int) int {
+	days := b.getGuildSettings(serverID).RetentionDays
+	if maxDays > 0 && (days == 0 || days > maxDays) {
+		days = maxDays
+	}
+	if days > 0 && days < minRetentionDays {
+		days = minRetentionDays
+	}
+	return days
+}
+
+// What one compaction changed in a server
+type RetentionResult struct {
+	EventsCompacted int64
+	RollupsMerged   int64
+}
+
+// Compact a server's events older than its retention into daily rollups, and
+// daily rollups older than dailyRollupDays into monthly ones. Rollups keep net
+// uses per item, channel and member, and role rollups per item, role and
+// member, so per-channel, per-member and per-role reports stay complete.
+func (b *Bot) compactUsage(serverID int64, days int, now time.Time) (RetentionResult, error) {
+	var r RetentionResult
+	err := b.withTx(func(tx *sql.Tx) error {
+		if days > 0 {
+			// Whole days only, so a day is never split between events and a rollup
+			cutoff := sqliteTime(now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -days))
+			_, err := tx.Exec(`
+				INSERT INTO usage_rollups (server_id, period, period_start, channel_id, user_id, kind, item_id, uses)
+				SELECT server_id, ?, strftime('%Y-%m-%d 00:00:00', created_at), COALESCE(channel_id, 0), COALESCE(user_id, 0), kind, item_id, SUM(delta)
+				FROM usage_events
+				WHERE server_id = ? AND created_at < ?
+				GROUP BY 3, 4, 5, 6, 7
+				HAVING SUM(delta) != 0`,
+				rollupDay, serverID, cutoff,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to roll up events: %w", err)
+			}
+			// Before the events go, since their roles are deleted with them
+			_, err = tx.Exec(`
+				INSERT INTO usage_role_rollups (server_id, period, period_start, role_id, user_id, kind, item_id, uses)
+				SELECT ue.server_id, ?, strftime('%Y-%m-%d 00:00:00', ue.created_at), r.role_id, COALESCE(ue.user_id, 0), ue.kind, ue.item_id, SUM(ue.delta)
+				FROM usage_event_roles r
+				JOIN usage_events ue ON ue.id = r.event_id
+				WHERE ue.server_id = ? AND ue.created_at < ?
+				GROUP BY 3, 4, 5, 6, 7
+				HAVING SUM(ue.delta) != 0`,
+				rollupDay, serverID, cutoff,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to roll up event roles: %w", err)
+			}
+			res, err := tx.Exec("DELETE FROM usage_events WHERE server_id = ? AND created_at < ?", serverID, cutoff)
+			if err != nil {
+				return fmt.Errorf("failed to delete compacted events: %w", err)
+			}
+			if r.EventsCompacted, err = res.RowsAffected(); err != nil {
+				return err
+			}
+			if r.EventsCompacted > 0 {
+				_, err = tx.Exec(`
+					INSERT INTO retention_state (server_id, compacted_before, last_run) VALUES (?, ?, ?)
+					ON CONFLICT(server_id) DO UPDATE SET
+						compacted_before = MAX(compacted_before, excluded.compacted_before),
+						last_run = excluded.last_run`,
+					serverID, cutoff, sqliteTime(now),
+				)
+				if err != nil {
+					return fmt.Errorf("failed to save retention state: %w", err)
+				}
+			}
+		}
+
+		// Whole months only, so each month has one set of monthly rollups
+		t := now.UTC().AddDate(0, 0, -dailyRollupDays)
+		monthCutoff := sqliteTime(time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC))
+		_, err := tx.Exec(`
+			INSERT INTO usage_rollups (server_id, period, period_start, channel_id, user_id, kind, item_id, uses)
+			SELECT server_id, ?, strftime('%Y-%m-01 00:00:00', period_start), channel_id, user_id, kind, item_id, SUM(uses)
+			FROM usage_rollups
+			WHERE server_id = ? AND period = ? AND period_start < ?
+			GROUP BY 3, 4, 5, 6, 7
+			HAVING SUM(uses) != 0`,
+			rollupMonth, serverID, rollupDay, monthCutoff,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to merge daily rollups: %w", err)
+		}
+		res, err := tx.Exec("DELETE FROM usage_rollups WHERE server_id = ? AND period = ? AND period_start < ?", serverID, rollupDay, monthCutoff)
+		if err != nil {
+			return fmt.Errorf("failed to delete merged rollups: %w", err)
+		}
+		if r.RollupsMerged, err = res.RowsAffected(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO usage_role_rollups (server_id, period, period_start, role_id, user_id, kind, item_id, uses)
+			SELECT server_id, ?, strftime('%Y-%m-01 00:00:00', period_start), role_id, user_id, kind, item_id, SUM(uses)
+			FROM usage_role_rollups
+			WHERE server_id = ? AND period = ? AND period_start < ?
+			GROUP BY 3, 4, 5, 6, 7
+			HAVING SUM(uses) != 0`,
+			rollupMonth, serverID, rollupDay, monthCutoff,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to merge daily role rollups: %w", err)
+		}
+		res, err = tx.Exec("DELETE FROM usage_role_rollups WHERE server_id = ? AND period = ? AND period_start < ?", serverID, rollupDay, monthCutoff)
+		if err != nil {
+			return fmt.Errorf("failed to delete merged role rollups: %w", err)
+		}
+		merged, err := res.RowsAffected()
+		r.RollupsMerged += merged
+		return err
+	})
+	return r, err
+}
+
+// Start of the compacted part of a server's history, or the zero time.
+// Events before it are only in rollups, so a backfill can't tell which
+// messages were counted.
+func (b *Bot) getCompactedBefore(serverID int64) (time.Time, error) {
+	var t time.Time
+	err := b.DB.QueryRow("SELECT compacted_before FROM retention_state WHERE server_id = ?", serverID).Scan(&t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return t, err
+}
+
+// Compact every server with stored usage, then vacuum if anything was removed
+func (b *Bot) runRetention(now time.Time, maxDays int) (map[int64]RetentionResult, error) {
+	rows, err := b.DB.Query("SELECT server_id FROM usage_events UNION SELECT server_id FROM usage_rollups UNION SELECT server_id FROM usage_role_rollups")
+	if err != nil {
+		return nil, err
+	}
+	var servers []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		servers = append(servers, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make(map[int64]RetentionResult)
+	removed := false
+	for _, id := range servers {
+		r, err := b.compactUsage(id, b.retentionDays(id, maxDays), now)
+		if err != nil {
+			retentionLog.Error("Error compacting usage", idAttr("guild_id", id), "err", err)
+			continue
+		}
+		results[id] = r
+		removed = removed || r.EventsCompacted > 0 || r.RollupsMerged > 0
+	}
+
+	if removed {
+		if err := b.vacuumDatabase(context.Background()); err != nil {
+			return results, fmt.Errorf("failed to vacuum: %w", err)
+		}
+	}
+	return results, nil
+}
+
+// Give pages freed by compaction back to the file system. The first run
+// switches the database to incremental auto-vacuum with a full VACUUM; later
+// runs only release the free pages.
+func (b *Bot) vacuumDatabase(ctx context.Context) error {
+	// The auto_vacuum mode only takes effect through VACUUM on the same connection
+	conn, err := b.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode != 2 {
+		if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, "VACUUM")
+		return err
+	}
+
+	// Each step frees a page, so read through every row
+	rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+func logRetentionResults(results map[int64]RetentionResult) {
+	for id, r := range results {
+		if r.EventsCompacted > 0 || r.RollupsMerged > 0 {
+			retentionLog.Info("Compacted usage", idAttr("guild_id", id), "events", r.EventsCompacted, "daily_rollups", r.RollupsMerged)
+		}
+	}
+}
+
+// Compact usage every day at retentionSchedule (UTC)
+func (b *Bot) runRetentionScheduler(ctx context.Context, maxDays int) {
+	schedule, err := parseCron(retentionSchedule)
+	if err != nil {
+		retentionLog.Error("Invalid retention schedule", "schedule", retentionSchedule, "err", err)
+		return
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(schedule.Next(time.Now().UTC())))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		results, err := b.runRetention(time.Now(), maxDays)
+		if err != nil {
+			retentionLog.Error("Error applying retention", "err", err)
+		}
+		logRetentionResults(results)
+	}
+}
+
+// Offline compaction, e.g. before copying or archiving the database
+func runCompactCommand(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the SQLite database")
+	maxDays := fs.String("max-days", os.Getenv("RETENTION_MAX_DAYS"), "most days any server keeps raw events, 0 for no maximum")
+	fs.Parse(args)
+
+	days, err := parseRetentionMaxDays(*maxDays)
+	if err != nil {
+		return fmt.Errorf("-max-days: %w", err)
+	}
+
+	b, err := newOfflineBot(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer b.DB.Close()
+
+	results, err := b.runRetention(time.Now(), days)
+	logRetentionResults(results)
+	return err
+}
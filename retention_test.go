@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Per-member, per-channel and per-item reports that must survive compaction
+func usageReports(t *testing.T, b *testBot) string {
+	t.Helper()
+	users, err := b.getTopUsers(int64(testGuildID), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels, err := b.getChannelUsage(int64(testGuildID), kindEmoji, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := b.getUserTopItems(int64(testGuildID), int64(testUserID), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranking, err := b.getItemRanking(int64(testGuildID), RankingFilter{Kind: kindEmoji, ChannelID: int64(memesChannelID)}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := b.countUsers(int64(testGuildID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("users %v channels %v items %v ranking %v count %d", users, channels, items, ranking, n)
+}
+
+func TestRetentionCompaction(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+
+	m := b.message("<:wave:111> <:cat:112>")
+	memes := b.message("<:wave:111>")
+	memes.ChannelID = memesChannelID
+	other := b.message("<:cat:112>")
+	other.Author.ID = otherUserID
+	b.send(m, memes, other, b.reactionAdd(m.ID, wave), b.reactionAdd(other.ID, wave), b.reactionRemove(other.ID, wave))
+	before := usageReports(t, b)
+	events := b.rows("usage_events")
+
+	// Nothing expires without a setting or a global maximum, or before its time
+	now := time.Now()
+	if results, err := b.runRetention(now.AddDate(0, 0, 30), 0); err != nil || results[int64(testGuildID)].EventsCompacted != 0 {
+		t.Fatalf("retention without limits = %+v, %v", results, err)
+	}
+	if results, err := b.runRetention(now.AddDate(0, 0, 30), 60); err != nil || results[int64(testGuildID)].EventsCompacted != 0 {
+		t.Fatalf("retention within the maximum = %+v, %v", results, err)
+	}
+
+	b.configure("retention_days", "10")
+	results, err := b.runRetention(now.AddDate(0, 0, 30), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[int64(testGuildID)].EventsCompacted; got != int64(events) {
+		t.Errorf("compacted %d events, want all %d", got, events)
+	}
+	if got := b.rows("usage_events"); got != 0 {
+		t.Errorf("events left = %d, want 0", got)
+	}
+	// The added and removed reaction cancels out
+	if got := b.rows("usage_rollups"); got != 4 {
+		t.Errorf("rollups = %d, want 4", got)
+	}
+	if after := usageReports(t, b); after != before {
+		t.Errorf("reports changed by compaction:\nbefore %s\nafter  %s", before, after)
+	}
+
+	// A year on, daily rollups are merged into monthly ones
+	results, err = b.runRetention(now.AddDate(0, 0, 30+dailyRollupDays+31), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[int64(testGuildID)].RollupsMerged; got != 4 {
+		t.Errorf("merged %d daily rollups, want 4", got)
+	}
+	var months int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM usage_rollups WHERE period = ?", rollupMonth).Scan(&months); err != nil || months != 4 {
+		t.Errorf("monthly rollups = %d, %v; want 4", months, err)
+	}
+	if after := usageReports(t, b); after != before {
+		t.Errorf("reports changed by merging:\nbefore %s\nafter  %s", before, after)
+	}
+	if got := b.emojiCount(111); got != 3 {
+		t.Errorf("emoji count = %d, want totals kept", got)
+	}
+}
+
+func TestRetentionDays(t *testing.T) {
+	b := newTestBot(t)
+	tests := []struct {
+		setting string
+		maxDays int
+		want    int
+	}{
+		{"0", 0, 0},
+		{"90", 0, 90},
+		{"90", 30, 30},
+		{"0", 30, 30},
+		{"1", 0, minRetentionDays},
+		{"10", 3, minRetentionDays},
+	}
+	for _, tt := range tests {
+		b.configure("retention_days", tt.setting)
+		if got := b.retentionDays(int64(testGuildID), tt.maxDays); got != tt.want {
+			t.Errorf("retention_days %s with maximum %d = %d, want %d", tt.setting, tt.maxDays, got, tt.want)
+		}
+	}
+
+	if _, err := parseRetentionMaxDays("-1"); err == nil {
+		t.Error("negative maximum accepted")
+	}
+}
+
+func TestBackfillSkipsCompactedHistory(t *testing.T) {
+	b := newTestBot(t)
+	b.configure("retention_days", "7")
+	b.send(b.message("<:wave:111>"))
+	now := time.Now().AddDate(0, 0, 30)
+	if _, err := b.runRetention(now, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	old := discord.Message{ID: 900, ChannelID: testChannelID, Author: discord.User{ID: testUserID}, Content: "<:wave:111>", Timestamp: discord.NewTimestamp(now.AddDate(0, 0, -20))}
+	if skipped, counted, err := b.backfillMessage(testGuildID, old, nil); err != nil || !skipped || counted != 0 {
+		t.Errorf("backfill of compacted history = %v, %d, %v; want skipped", skipped, counted, err)
+	}
+	recent := old
+	recent.ID = 901
+	recent.Timestamp = discord.NewTimestamp(now.AddDate(0, 0, -2))
+	if skipped, counted, err := b.backfillMessage(testGuildID, recent, nil); err != nil || skipped || counted != 1 {
+		t.Errorf("backfill of retained history = %v, %d, %v; want 1 counted", skipped, counted, err)
+	}
+}
+
+func TestRetentionPrivacy(t *testing.T) {
+	b := newTestBot(t)
+	b.messageFrom(testUserID)
+	b.messageFrom(otherUserID)
+	b.configure("retention_days", "7")
+	if _, err := b.runRetention(time.Now().AddDate(0, 0, 30), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compacted usage is pseudonymized and found like events are
+	b.configure("pseudonymize_users", "true")
+	var raw int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM usage_rollups WHERE user_id > 0").Scan(&raw); err != nil || raw != 0 {
+		t.Errorf("rollups with raw user IDs = %d, %v; want 0", raw, err)
+	}
+	if items, err := b.getUserTopItems(int64(testGuildID), int64(testUserID), 10); err != nil || len(items) != 1 || items[0].Count != 1 {
+		t.Errorf("compacted items = %+v, %v; want 1 use", items, err)
+	}
+
+	export, err := b.getPrivacyExport(int64(testUserID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.UsageRollups) != 1 || export.UsageRollups[0].ItemName != "wave" || export.UsageRollups[0].Period != rollupDay {
+		t.Errorf("exported rollups = %+v, want one day of wave", export.UsageRollups)
+	}
+
+	b.send(b.command("privacy", subcommand("delete")), b.button("privacy_delete"))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Erased you") {
+		t.Errorf("delete replied %q", content)
+	}
+	var attributed int
+	if err := b.DB.QueryRow("SELECT COUNT(*) FROM usage_rollups WHERE user_id != 0").Scan(&attributed); err != nil || attributed != 1 {
+		t.Errorf("attributed rollups after delete = %d, %v; want only the other member's", attributed, err)
+	}
+	if got := b.rows("usage_rollups"); got != 2 {
+		t.Errorf("rollups after delete = %d, want the erased one kept anonymously", got)
+	}
+}
+
+func TestReconcileSkipsCompactedHistory(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	b.configure("retention_days", "7")
+	m := b.message("hi")
+	b.send(m, b.reactionAdd(m.ID, wave))
+	if _, err := b.runRetention(time.Now().AddDate(0, 0, 30), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new reaction on a message whose earlier reaction was compacted
+	add := b.reactionAdd(m.ID, wave)
+	add.UserID = otherUserID
+	b.send(add)
+	b.fake.Messages[m.ID] = discord.Message{ID: m.ID, ChannelID: testChannelID, Reactions: []discord.Reaction{{Emoji: wave, Count: 2}}}
+
+	results, err := b.reconcileRecent(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[int64(testGuildID)]; r != nil && r.Corrections != 0 {
+		t.Errorf("corrections = %d, want none", r.Corrections)
+	}
+	if got := b.emojiCount(111); got != 2 {
+		t.Errorf("emoji count = %d, want 2", got)
+	}
+}
+
+func TestRetentionKeepsRoleHistory(t *testing.T) {
+	b := newTestBot(t)
+	m := b.message("<:wave:111> <:wave:111>")
+	m.Member = withRoles(modRoleID)
+	other := b.message("<:wave:111>")
+	other.Author.ID = otherUserID
+	other.Member = withRoles(modRoleID, botsRoleID)
+	b.send(m, other)
+	roleStats := func() string {
+		t.Helper()
+		items, members, err := b.getRoleTopItems(int64(testGuildID), int64(modRoleID), time.Time{}, roleStatsLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%v %v", items, members)
+	}
+	before := roleStats()
+
+	b.configure("retention_days", "7")
+	if _, err := b.runRetention(time.Now().AddDate(0, 0, 30), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.rows("usage_role_rollups"); got != 3 {
+		t.Errorf("role rollups = %d, want 3", got)
+	}
+	if after := roleStats(); after != before {
+		t.Errorf("role stats changed by compaction: before %s, after %s", before, after)
+	}
+
+	var export strings.Builder
+	if err := b.writeExport(&export, int64(testGuildID), exportFormatCSV, exportTypeRollups); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(export.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "1000,day,") {
+		t.Errorf("rollups export = %q, want a header and 2 daily rows", export.String())
+	}
+
+	p, err := b.getPrivacyExport(int64(testUserID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.RoleRollups) != 1 || p.RoleRollups[0].RoleID != "5001" || p.RoleRollups[0].Uses != 2 {
+		t.Errorf("exported role rollups = %+v, want 2 uses under the mod role", p.RoleRollups)
+	}
+	if _, err := b.deleteUserEvents(int64(testUserID)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.rows("usage_role_rollups"); got != 2 {
+		t.Errorf("role rollups after delete = %d, want only the other member's", got)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const roleStatsLimit = 20
+
+// A role whose members' usage isn't counted
+type RoleFilter struct {
+	RoleID    int64
+	AddedBy   int64
+	CreatedAt time.Time
+}
+
+// Role IDs of a member, or nil when the event carried no member
+func memberRoleIDs(m *discord.Member) []int64 {
+	if m == nil {
+		return nil
+	}
+	ids := make([]int64, len(m.RoleIDs))
+	for i, id := range m.RoleIDs {
+		ids[i] = int64(id)
+	}
+	return ids
+}
+
+// Store the roles a member had when an event happened, so later role
+// changes don't move their past usage between roles
+func recordEventRoles(tx *sql.Tx, eventID int64, roleIDs []int64) error {
+	for _, roleID := range roleIDs {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO usage_event_roles (event_id, role_id) VALUES (?, ?)", eventID, roleID); err != nil {
+			return fmt.Errorf("failed to record event roles: %w", err)
+		}
+	}
+	return nil
+}
+
+// The member's latest counted add of a reaction, provided their adds and
+// removes of it don't already cancel out. An older add that a remove already
+// took back mustn't be taken back again.
+const outstandingReactionAddQuery = `
+	SELECT id, created_at FROM usage_events
+	WHERE server_id = ?1 AND message_id = ?2 AND source = ?3 AND kind = ?4 AND item_id = ?5 AND user_id = ?6 AND delta > 0
+		AND (
+			SELECT COALESCE(SUM(delta), 0) FROM usage_events
+			WHERE server_id = ?1 AND message_id = ?2 AND source = ?3 AND kind = ?4 AND item_id = ?5 AND user_id = ?6
+		) > 0
+	ORDER BY id DESC LIMIT 1
+`
+
+// Roles recorded with the member's outstanding add of a reaction. found is
+// false when no add is outstanding, e.g. because it was filtered out.
+func (b *Bot) reactionAddRoles(uc UsageContext, emojiID int64) (roleIDs []int64, found bool, err error) {
+	var eventID int64
+	var at time.Time
+	err = b.DB.QueryRow(outstandingReactionAddQuery,
+		uc.ServerID, uc.MessageID, sourceReaction, kindEmoji, emojiID, uc.UserID,
+	).Scan(&eventID, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	rows, err := b.DB.Query("SELECT role_id FROM usage_event_roles WHERE event_id = ? ORDER BY role_id", eventID)
+	if err != nil {
+		return nil, true, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, true, err
+		}
+		roleIDs = append(roleIDs, id)
+	}
+	return roleIDs, true, rows.Err()
+}
+
+func (b *Bot) getRoleFilters(serverID int64) ([]RoleFilter, error) {
+	rows, err := b.DB.Query("SELECT role_id, added_by, created_at FROM role_filters WHERE server_id = ? ORDER BY created_at", serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []RoleFilter
+	for rows.Next() {
+		var f RoleFilter
+		if err := rows.Scan(&f.RoleID, &f.AddedBy, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, rows.Err()
+}
+
+func (b *Bot) addRoleFilter(serverID, roleID, addedBy int64) error {
+	_, err := b.DB.Exec(
+		"INSERT OR IGNORE INTO role_filters (server_id, role_id, added_by, created_at) VALUES (?, ?, ?, ?)",
+		serverID, roleID, addedBy, sqliteTime(time.Now()),
+	)
+	b.invalidateRoleFilters(serverID)
+	return err
+}
+
+// Stop ignoring a role, returning whether it was ignored
+func (b *Bot) removeRoleFilter(serverID, roleID int64) (bool, error) {
+	res, err := b.DB.Exec("DELETE FROM role_filters WHERE server_id = ? AND role_id = ?", serverID, roleID)
+	b.invalidateRoleFilters(serverID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (b *Bot) getCachedRoleFilters(serverID int64) (map[int64]bool, error) {
+	b.roleFilterCacheMutex.Lock()
+	defer b.roleFilterCacheMutex.Unlock()
+
+	if ignored, ok := b.roleFilterCache[serverID]; ok {
+		return ignored, nil
+	}
+	filters, err := b.getRoleFilters(serverID)
+	if err != nil {
+		return nil, err
+	}
+	ignored := make(map[int64]bool, len(filters))
+	for _, f := range filters {
+		ignored[f.RoleID] = true
+	}
+	b.roleFilterCache[serverID] = ignored
+	return ignored, nil
+}
+
+func (b *Bot) invalidateRoleFilters(serverID int64) {
+	b.roleFilterCacheMutex.Lock()
+	delete(b.roleFilterCache, serverID)
+	b.roleFilterCacheMutex.Unlock()
+}
+
+// Whether the server ignores any roles
+func (b *Bot) hasRoleFilters(serverID int64) bool {
+	ignored, err := b.getCachedRoleFilters(serverID)
+	if err != nil {
+		trackingLog.Error("Error loading role filters", idAttr("guild_id", serverID), "err", err)
+		return false
+	}
+	return len(ignored) > 0
+}
+
+// Whether a member with these roles is left out of the counts
+func (b *Bot) rolesIgnored(serverID int64, roleIDs []int64) bool {
+	ignored, err := b.getCachedRoleFilters(serverID)
+	if err != nil {
+		// Count rather than drop usage on a bad read
+		trackingLog.Error("Error loading role filters", idAttr("guild_id", serverID), "err", err)
+		return false
+	}
+	for _, id := range roleIDs {
+		if ignored[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// The emojis and stickers a role's members used most since a time (zero for
+// all time), by the roles they had when using them. Compacted usage counts
+// toward the day or month it was rolled up into.
+func (b *Bot) getRoleTopItems(serverID, roleID int64, since time.Time, limit int) ([]ItemUsage, []int, error) {
+	rows, err := b.DB.Query(`
+		SELECT h.kind, h.item_id, COALESCE(e.emote_name, s.sticker_name, ''), COALESCE(e.animated, FALSE), SUM(h.delta) AS uses, COUNT(DISTINCT `+reportedUserID+`)
+		FROM role_usage_history h
+		LEFT JOIN emojis e ON h.kind = 'emoji' AND e.server_id = h.server_id AND e.emote_id = h.item_id
+		LEFT JOIN stickers s ON h.kind = 'sticker' AND s.server_id = h.server_id AND s.sticker_id = h.item_id
+		WHERE h.role_id = ? AND h.server_id = ? AND h.created_at >= ?
+		GROUP BY h.kind, h.item_id
+		HAVING uses > 0
+		ORDER BY uses DESC, h.item_id
+		LIMIT ?`,
+		roleID, serverID, sqliteTime(since), limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var items []ItemUsage
+	var members []int
+	for rows.Next() {
+		var u ItemUsage
+		var n int
+		if err := rows.Scan(&u.Kind, &u.ID, &u.Name, &u.Animated, &u.Count, &n); err != nil {
+			return nil, nil, err
+		}
+		items = append(items, u)
+		members = append(members, n)
+	}
+	return items, members, rows.Err()
+}
+
+// Format an emoji or sticker for a list line
+func formatItem(u ItemUsage) string {
+	if u.Kind == kindSticker {
+		return fmt.Sprintf("%s (sticker)", u.Name)
+	}
+	if u.Animated {
+		return fmt.Sprintf("<a:%s:%d>", u.Name, u.ID)
+	}
+	return fmt.Sprintf("<:%s:%d>", u.Name, u.ID)
+}
+
+func formatRoleStats(roleID discord.RoleID, days int, items []ItemUsage, members []int, locale string) string {
+	var content strings.Builder
+	if days > 0 {
+		content.WriteString(fmt.Sprintf("**Most Used by %s (last %d days)**\n\n", roleID.Mention(), days))
+	} else {
+		content.WriteString(fmt.Sprintf("**Most Used by %s**\n\n", roleID.Mention()))
+	}
+	if len(items) == 0 {
+		content.WriteString("No usage recorded from members with this role.")
+	}
+	for i, u := range items {
+		content.WriteString(fmt.Sprintf("- %s **x%s** by %d members\n", formatItem(u), formatCount(u.Count, locale), members[i]))
+	}
+	content.WriteString("\nRoles are counted as members had them at the time of use.")
+	return content.String()
+}
+
+// Handle /rolestats command
+func (b *Bot) handleRoleStats(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	opts := i.Data.(*discord.CommandInteraction).Options
+	id, err := opts.Find("role").SnowflakeValue()
+	if err != nil || !id.IsValid() {
+		b.respondError(i, "Invalid role.")
+		return
+	}
+	roleID := discord.RoleID(id)
+	days := 0
+	if v, err := opts.Find("days").IntValue(); err == nil && v > 0 {
+		days = int(v)
+	}
+
+	serverID := int64(i.GuildID)
+	settings := b.getGuildSettings(serverID)
+	var since time.Time
+	if days > 0 {
+		since = time.Now().AddDate(0, 0, -days)
+	}
+	items, members, err := b.getRoleTopItems(serverID, int64(roleID), since, roleStatsLimit)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching role stats", idAttr("role_id", int64(roleID)), "err", err)
+		b.respondError(i, "Failed to fetch role statistics.")
+		return
+	}
+
+	response := api.InteractionResponseData{
+		Content:         option.NewNullableString(formatRoleStats(roleID, days, items, members, settings.Locale)),
+		Flags:           discord.EphemeralMessage,
+		AllowedMentions: &api.AllowedMentions{},
+	}
+	if shareList(opts, settings) {
+		response.Flags &= ^discord.EphemeralMessage
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+const (
+	modRoleID  = discord.RoleID(5001)
+	botsRoleID = discord.RoleID(5002)
+)
+
+func withRoles(roles ...discord.RoleID) *discord.Member {
+	return &discord.Member{RoleIDs: roles}
+}
+
+func TestRolesRecordedAtEventTime(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+
+	m := b.message("<:wave:111>")
+	m.Member = withRoles(modRoleID)
+	b.send(m)
+
+	// The member loses the role; earlier usage stays with it
+	later := b.message("<:wave:111> <:wave:111>")
+	later.Member = withRoles()
+	add := b.reactionAdd(later.ID, wave)
+	add.Member = withRoles(botsRoleID)
+	b.send(later, add)
+
+	items, members, err := b.getRoleTopItems(int64(testGuildID), int64(modRoleID), time.Time{}, roleStatsLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Count != 1 || members[0] != 1 {
+		t.Errorf("mod role items = %+v, members %v; want one use of 111", items, members)
+	}
+
+	// Removing the reaction takes it off the role it was added with
+	b.send(b.reactionRemove(later.ID, wave))
+	items, _, err = b.getRoleTopItems(int64(testGuildID), int64(botsRoleID), time.Time{}, roleStatsLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("bots role items after removal = %+v, want none", items)
+	}
+	if got := b.emojiCount(111); got != 3 {
+		t.Errorf("emoji count = %d, want 3", got)
+	}
+}
+
+func TestIgnoredRoles(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	const message = discord.MessageID(500)
+
+	// Added before the role was ignored, so its removal still counts
+	early := b.reactionAdd(message, wave)
+	early.Member = withRoles(botsRoleID)
+	b.send(early)
+
+	b.send(b.command("tracking", subcommand("ignore_role", roleOption("role", botsRoleID))))
+
+	m := b.message("<:wave:111>")
+	m.Member = withRoles(modRoleID, botsRoleID)
+	other := b.reactionAdd(501, wave)
+	other.Member = withRoles(botsRoleID)
+	b.send(m, other, b.reactionRemove(501, wave))
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count with ignored role = %d, want 1", got)
+	}
+
+	b.send(b.reactionRemove(message, wave))
+	if got := b.emojiCount(111); got != 0 {
+		t.Errorf("emoji count after removing the early reaction = %d, want 0", got)
+	}
+
+	// Members without the role are still counted
+	m = b.message("<:wave:111>")
+	m.Member = withRoles(modRoleID)
+	b.send(m)
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count for another role = %d, want 1", got)
+	}
+}
+
+func TestRemoveAfterIgnoredReAdd(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	const message = discord.MessageID(500)
+
+	b.send(b.message("<:wave:111>"))
+	b.send(b.command("tracking", subcommand("ignore_role", roleOption("role", botsRoleID))))
+
+	add := b.reactionAdd(message, wave)
+	add.Member = withRoles(modRoleID)
+	b.send(add, b.reactionRemove(message, wave))
+
+	// The member gains the ignored role, so their next add isn't counted and
+	// its removal mustn't take back the add that was already removed
+	again := b.reactionAdd(message, wave)
+	again.Member = withRoles(modRoleID, botsRoleID)
+	b.send(again, b.reactionRemove(message, wave))
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count = %d, want 1", got)
+	}
+}
+
+func TestIgnoredRolesInReconcileAndBackfill(t *testing.T) {
+	b := newTestBot(t)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	b.send(b.command("tracking", subcommand("ignore_role", roleOption("role", botsRoleID))))
+
+	counted := b.reactionAdd(500, wave)
+	counted.Member = withRoles(modRoleID)
+	ignored := b.reactionAdd(500, wave)
+	ignored.UserID = otherUserID
+	ignored.Member = withRoles(botsRoleID)
+	removed := b.reactionAdd(501, wave)
+	removed.Member = withRoles(modRoleID)
+	b.send(counted, ignored, removed)
+
+	// The ignored member's reaction isn't missing; a removal still is
+	b.fake.Messages[500] = discord.Message{ID: 500, ChannelID: testChannelID, Reactions: []discord.Reaction{{Emoji: wave, Count: 2}}}
+	b.fake.Messages[501] = discord.Message{ID: 501, ChannelID: testChannelID}
+	results, err := b.reconcileRecent(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[int64(testGuildID)]; r == nil || r.Corrections != 1 || r.Removed != 1 {
+		t.Errorf("reconcile = %+v, want only the removal corrected", r)
+	}
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count after reconcile = %d, want 1", got)
+	}
+
+	// Backfilled messages from ignored authors aren't counted, nor are reactions whose reactors are unknown
+	m := discord.Message{ID: 600, ChannelID: testChannelID, Author: discord.User{ID: otherUserID}, Content: "<:wave:111>", Reactions: []discord.Reaction{{Emoji: wave, Count: 1}}}
+	if _, n, err := b.backfillMessage(testGuildID, m, withRoles(botsRoleID)); err != nil || n != 0 {
+		t.Errorf("backfill from an ignored role counted %d, %v; want 0", n, err)
+	}
+	m.ID = 601
+	if _, n, err := b.backfillMessage(testGuildID, m, withRoles(modRoleID)); err != nil || n != 1 {
+		t.Errorf("backfill from another role counted %d, %v; want only the message", n, err)
+	}
+}
+
+func TestRoleStatsCommand(t *testing.T) {
+	b := newTestBot(t)
+	seedEmojis(b, 2)
+
+	m := b.message("<:e0:10000> <:e0:10000> <:e1:10001>", discord.StickerItem{ID: 211, Name: "cat"})
+	m.Member = withRoles(modRoleID)
+	b.send(m)
+
+	b.send(b.command("rolestats", roleOption("role", modRoleID)))
+	content := b.fake.lastContent(t)
+	for _, want := range []string{"Most Used by <@&5001>", "- <:e0:10000> **x2** by 1 members", "- <:e1:10001> **x1**", "cat (sticker) **x1**"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("rolestats missing %q: %q", want, content)
+		}
+	}
+	if b.fake.lastResponse(t).Data.Flags&discord.EphemeralMessage == 0 {
+		t.Error("rolestats is not ephemeral by default")
+	}
+
+	b.send(b.command("rolestats", roleOption("role", botsRoleID), intOption("days", 7)))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "(last 7 days)") || !strings.Contains(content, "No usage recorded") {
+		t.Errorf("rolestats for an unused role replied %q", content)
+	}
+}
+
+func TestTrackingRoleCommands(t *testing.T) {
+	b := newTestBot(t)
+
+	b.send(b.command("tracking", subcommand("ignore_role", roleOption("role", discord.RoleID(testGuildID)))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "@everyone") {
+		t.Errorf("ignoring @everyone replied %q", content)
+	}
+
+	b.send(b.command("tracking", subcommand("ignore_role", roleOption("role", botsRoleID))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "members with <@&5002> is no longer tracked") {
+		t.Errorf("ignore_role replied %q", content)
+	}
+	b.send(b.command("tracking", subcommand("list")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "__Ignored Roles__") || !strings.Contains(content, "- <@&5002> by <@3000>") {
+		t.Errorf("list replied %q", content)
+	}
+
+	b.send(b.command("tracking", subcommand("clear_role", roleOption("role", botsRoleID))))
+	b.send(b.command("tracking", subcommand("clear_role", roleOption("role", botsRoleID))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "is not ignored") {
+		t.Errorf("second clear_role replied %q", content)
+	}
+	if got := b.rows("role_filters"); got != 0 {
+		t.Errorf("role filters = %d, want 0", got)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// Values of the default_visibility setting
+const (
+	visibilityPrivate = "private"
+	visibilityPublic  = "public"
+)
+
+// How a server wants usage counted and shown
+type GuildSettings struct {
+	TrackBotMessages      bool
+	TrackMessages         bool
+	TrackReactions        bool
+	TrackStickers         bool
+	CountRepeats          bool // Count an emoji each time it appears in a message, not once
+	CountReactionRemovals bool
+	DefaultVisibility     string
+	EmojiPageSize         int
+	StickerPageSize       int
+	Locale                string
+	PseudonymizeUsers     bool // Store keyed hashes instead of user IDs
+	RetentionDays         int  // Days raw usage events are kept; 0 keeps them
+}
+
+// Whether lists are posted for everyone unless the share option says otherwise
+func (s GuildSettings) ShareByDefault() bool {
+	return s.DefaultVisibility == visibilityPublic
+}
+
+// Kinds of setting values
+type settingKind int
+
+const (
+	settingBool settingKind = iota
+	settingInt
+	settingChoice
+)
+
+// A configurable setting and how its stored value is checked and applied
+type setting struct {
+	Key         string
+	Description string
+	Kind        settingKind
+	Default     string
+	Min, Max    int      // For settingInt
+	Choices     []string // For settingChoice
+	apply       func(s *GuildSettings, value string)
+	// Run in the transaction that changes the stored value, for settings
+	// that have to rewrite stored data
+	onChange func(tx *sql.Tx, serverID int64, value string) error
+}
+
+func (d setting) whenChanged(fn func(tx *sql.Tx, serverID int64, value string) error) setting {
+	d.onChange = fn
+	return d
+}
+
+func boolSetting(key, description string, def bool, field func(*GuildSettings) *bool) setting {
+	return setting{
+		Key: key, Description: description, Kind: settingBool, Default: strconv.FormatBool(def),
+		apply: func(s *GuildSettings, value string) { *field(s) = value == "true" },
+	}
+}
+
+func intSetting(key, description string, def, lo, hi int, field func(*GuildSettings) *int) setting {
+	return setting{
+		Key: key, Description: description, Kind: settingInt, Default: strconv.Itoa(def), Min: lo, Max: hi,
+		apply: func(s *GuildSettings, value string) { *field(s), _ = strconv.Atoi(value) },
+	}
+}
+
+func choiceSetting(key, description, def string, choices []string, field func(*GuildSettings) *string) setting {
+	return setting{
+		Key: key, Description: description, Kind: settingChoice, Default: def, Choices: choices,
+		apply: func(s *GuildSettings, value string) { *field(s) = value },
+	}
+}
+
+// Digit group separators of the supported locales
+var localeGroupSeparators = map[string]string{
+	"en":    ",",
+	"de":    ".",
+	"es":    ".",
+	"fr":    "\u202f", // Narrow no-break space
+	"it":    ".",
+	"ja":    ",",
+	"ko":    ",",
+	"nl":    ".",
+	"pt-BR": ".",
+	"zh-CN": ",",
+}
+
+func supportedLocales() []string {
+	locales := make([]string, 0, len(localeGroupSeparators))
+	for l := range localeGroupSeparators {
+		locales = append(locales, l)
+	}
+	slices.Sort(locales)
+	return locales
+}
+
+// Every setting, in the order they are listed
+var settings = []setting{
+	boolSetting("track_messages", "Count custom emojis in messages", true,
+		func(s *GuildSettings) *bool { return &s.TrackMessages }),
+	boolSetting("track_reactions", "Count custom emoji reactions", true,
+		func(s *GuildSettings) *bool { return &s.TrackReactions }),
+	boolSetting("track_stickers", "Count stickers in messages", true,
+		func(s *GuildSettings) *bool { return &s.TrackStickers }),
+	boolSetting("track_bot_messages", "Count emojis and stickers in messages from bots", false,
+		func(s *GuildSettings) *bool { return &s.TrackBotMessages }),
+	boolSetting("count_repeats", "Count an emoji every time it appears in a message, not once per message", true,
+		func(s *GuildSettings) *bool { return &s.CountRepeats }),
+	boolSetting("count_reaction_removals", "Take a use back when a reaction is removed", true,
+		func(s *GuildSettings) *bool { return &s.CountReactionRemovals }),
+	choiceSetting("default_visibility", "Whether lists are visible to everyone when share is not given", visibilityPrivate,
+		[]string{visibilityPrivate, visibilityPublic},
+		func(s *GuildSettings) *string { return &s.DefaultVisibility }),
+	intSetting("emoji_page_size", "Emojis per page of /listemotes", 25, 5, 25,
+		func(s *GuildSettings) *int { return &s.EmojiPageSize }),
+	intSetting("sticker_page_size", "Stickers per page of /liststickers", 5, 1, 10,
+		func(s *GuildSettings) *int { return &s.StickerPageSize }),
+	choiceSetting("locale", "Number format of counts", "en", supportedLocales(),
+		func(s *GuildSettings) *string { return &s.Locale }),
+	boolSetting("pseudonymize_users", "Store keyed hashes of user IDs instead of the IDs", false,
+		func(s *GuildSettings) *bool { return &s.PseudonymizeUsers }).whenChanged(pseudonymizeStoredUsers),
+	intSetting("retention_days", "Days to keep usage events before compacting them into rollups, 0 to keep them", 0, 0, 3650,
+		func(s *GuildSettings) *int { return &s.RetentionDays }),
+}
+
+// Find a setting by key
+func lookupSetting(key string) (setting, bool) {
+	i := slices.IndexFunc(settings, func(d setting) bool { return d.Key == key })
+	if i < 0 {
+		return setting{}, false
+	}
+	return settings[i], true
+}
+
+// Check a value for the setting, returning it in its stored form
+func (d setting) parse(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch d.Kind {
+	case settingBool:
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1":
+			return "true", nil
+		case "false", "no", "off", "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("%s must be true or false", d.Key)
+	case settingInt:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < d.Min || n > d.Max {
+			return "", fmt.Errorf("%s must be a whole number from %d to %d", d.Key, d.Min, d.Max)
+		}
+		return strconv.Itoa(n), nil
+	case settingChoice:
+		for _, c := range d.Choices {
+			if strings.EqualFold(value, c) {
+				return c, nil
+			}
+		}
+		return "", fmt.Errorf("%s must be one of %s", d.Key, strings.Join(d.Choices, ", "))
+	}
+	return "", fmt.Errorf("unknown setting kind %d", d.Kind)
+}
+
+// Settings of a server that changed nothing
+func defaultGuildSettings() GuildSettings {
+	var s GuildSettings
+	for _, d := range settings {
+		d.apply(&s, d.Default)
+	}
+	return s
+}
+
+// Stored values of a server's changed settings, by key
+func (b *Bot) getSettingValues(serverID int64) (map[string]string, error) {
+	rows, err := b.DB.Query("SELECT key, value FROM guild_settings WHERE server_id = ?", serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+// Read a server's settings from the database
+func (b *Bot) loadGuildSettings(serverID int64) (GuildSettings, error) {
+	s := defaultGuildSettings()
+	values, err := b.getSettingValues(serverID)
+	if err != nil {
+		return s, err
+	}
+	for key, value := range values {
+		d, ok := lookupSetting(key)
+		if !ok {
+			continue // Left by a newer version
+		}
+		if value, err = d.parse(value); err != nil {
+			dbLog.Warn("Ignoring invalid stored setting", idAttr("guild_id", serverID), "setting", key, "err", err)
+			continue
+		}
+		d.apply(&s, value)
+	}
+	return s, nil
+}
+
+// A server's settings, from the cache when possible. Falls back to the
+// defaults if they can't be read, so tracking never stops on a bad read.
+func (b *Bot) getGuildSettings(serverID int64) GuildSettings {
+	b.settingsCacheMutex.Lock()
+	defer b.settingsCacheMutex.Unlock()
+
+	if s, ok := b.settingsCache[serverID]; ok {
+		return s
+	}
+	s, err := b.loadGuildSettings(serverID)
+	if err != nil {
+		dbLog.Error("Error loading guild settings, using defaults", idAttr("guild_id", serverID), "err", err)
+		return s
+	}
+	b.settingsCache[serverID] = s
+	return s
+}
+
+func (b *Bot) invalidateGuildSettings(serverID int64) {
+	b.settingsCacheMutex.Lock()
+	delete(b.settingsCache, serverID)
+	b.settingsCacheMutex.Unlock()
+}
+
+// Record a settings change in the audit trail. A null value means the default.
+func auditSettingChange(tx *sql.Tx, serverID int64, key string, oldValue, newValue sql.NullString, changedBy int64) error {
+	_, err := tx.Exec(
+		"INSERT INTO guild_settings_audit (server_id, key, old_value, new_value, changed_by, changed_at) VALUES (?, ?, ?, ?, ?, ?)",
+		serverID, key, oldValue, newValue, changedBy, sqliteTime(time.Now()),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to audit setting change: %w", err)
+	}
+	return nil
+}
+
+// Change a setting, returning the value stored. Setting the current value changes nothing.
+func (b *Bot) setGuildSetting(serverID int64, key, value string, changedBy int64) (string, error) {
+	d, ok := lookupSetting(key)
+	if !ok {
+		return "", fmt.Errorf("unknown setting %q", key)
+	}
+	value, err := d.parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	err = b.withTx(func(tx *sql.Tx) error {
+		var old sql.NullString
+		err := tx.QueryRow("SELECT value FROM guild_settings WHERE server_id = ? AND key = ?", serverID, key).Scan(&old)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to read setting: %w", err)
+		}
+		if old.Valid && old.String == value {
+			return nil
+		}
+		_, err = tx.Exec(`
+			INSERT INTO guild_settings (server_id, key, value) VALUES (?, ?, ?)
+			ON CONFLICT(server_id, key) DO UPDATE SET value = excluded.value
+		`, serverID, key, value)
+		if err != nil {
+			return fmt.Errorf("failed to store setting: %w", err)
+		}
+		if d.onChange != nil {
+			if err := d.onChange(tx, serverID, value); err != nil {
+				return err
+			}
+		}
+		return auditSettingChange(tx, serverID, key, old, sql.NullString{String: value, Valid: true}, changedBy)
+	})
+	b.invalidateGuildSettings(serverID)
+	return value, err
+}
+
+// Put settings back to their defaults, or every setting when no key is given.
+// Returns the keys that had been changed.
+func (b *Bot) resetGuildSettings(serverID int64, key string, changedBy int64) ([]string, error) {
+	var reset []string
+	err := b.withTx(func(tx *sql.Tx) error {
+		query := "SELECT key, value FROM guild_settings WHERE server_id = ?"
+		args := []any{serverID}
+		if key != "" {
+			query += " AND key = ?"
+			args = append(args, key)
+		}
+		rows, err := tx.Query(query+" ORDER BY key", args...)
+		if err != nil {
+			return fmt.Errorf("failed to read settings: %w", err)
+		}
+		old := make(map[string]string)
+		for rows.Next() {
+			var k, v string
+			if err := rows.Scan(&k, &v); err != nil {
+				rows.Close()
+				return err
+			}
+			reset = append(reset, k)
+			old[k] = v
+		}
+		rows.Close()
+
+		for _, k := range reset {
+			if _, err := tx.Exec("DELETE FROM guild_settings WHERE server_id = ? AND key = ?", serverID, k); err != nil {
+				return fmt.Errorf("failed to reset setting: %w", err)
+			}
+			if d, ok := lookupSetting(k); ok && d.onChange != nil {
+				if err := d.onChange(tx, serverID, d.Default); err != nil {
+					return err
+				}
+			}
+			if err := auditSettingChange(tx, serverID, k, sql.NullString{String: old[k], Valid: true}, sql.NullString{}, changedBy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	b.invalidateGuildSettings(serverID)
+	return reset, err
+}
+
+// One change in the settings audit trail
+type SettingChange struct {
+	Key       string
+	OldValue  sql.NullString
+	NewValue  sql.NullString
+	ChangedBy int64
+	ChangedAt time.Time
+}
+
+// Most recent settings changes of a server, newest first
+func (b *Bot) getSettingChanges(serverID int64, limit int) ([]SettingChange, error) {
+	rows, err := b.DB.Query(`
+		SELECT key, old_value, new_value, changed_by, changed_at FROM guild_settings_audit
+		WHERE server_id = ? ORDER BY id DESC LIMIT ?
+	`, serverID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []SettingChange
+	for rows.Next() {
+		var c SettingChange
+		if err := rows.Scan(&c.Key, &c.OldValue, &c.NewValue, &c.ChangedBy, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// Format a count with the digit grouping of a locale
+func formatCount(n int, locale string) string {
+	sep, ok := localeGroupSeparators[locale]
+	if !ok {
+		sep = localeGroupSeparators["en"]
+	}
+	digits := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(d)
+	}
+	return sign + b.String()
+}
+
+// Whether a list is posted for everyone: the share option if given, else the server's default
+func shareList(opts discord.CommandInteractionOptions, s GuildSettings) bool {
+	opt := opts.Find("share")
+	if opt.Name == "" {
+		return s.ShareByDefault()
+	}
+	share, _ := opt.BoolValue()
+	return share
+}
+
+// Describe what values a setting takes
+func describeSettingValues(d setting) string {
+	switch d.Kind {
+	case settingBool:
+		return "true or false"
+	case settingInt:
+		return fmt.Sprintf("%d to %d", d.Min, d.Max)
+	}
+	return strings.Join(d.Choices, ", ")
+}
+
+func formatSettings(values map[string]string) string {
+	var content strings.Builder
+	content.WriteString("**Server Settings**\n\n")
+	for _, d := range settings {
+		if v, ok := values[d.Key]; ok {
+			content.WriteString(fmt.Sprintf("- `%s` = **%s** (default %s)\n", d.Key, v, d.Default))
+		} else {
+			content.WriteString(fmt.Sprintf("- `%s` = %s\n", d.Key, d.Default))
+		}
+		content.WriteString(fmt.Sprintf("  %s. Takes %s.\n", d.Description, describeSettingValues(d)))
+	}
+	return content.String()
+}
+
+const settingsHistoryShown = 15
+
+func formatSettingChanges(changes []SettingChange) string {
+	if len(changes) == 0 {
+		return "No settings have been changed on this server."
+	}
+	value := func(v sql.NullString) string {
+		if !v.Valid {
+			return "default"
+		}
+		return v.String
+	}
+	var content strings.Builder
+	content.WriteString("**Settings History**\n\n")
+	for _, c := range changes {
+		content.WriteString(fmt.Sprintf("- <t:%d:f> <@%d> `%s`: %s → %s\n",
+			c.ChangedAt.Unix(), c.ChangedBy, c.Key, value(c.OldValue), value(c.NewValue)))
+	}
+	return content.String()
+}
+
+// Handle /config command
+func (b *Bot) handleConfig(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+	serverID := int64(i.GuildID)
+	userID := int64(i.Member.User.ID)
+
+	var response api.InteractionResponseData
+
+	switch sub.Name {
+	case "rotate_secret":
+		b.handleRotateSecret(i)
+		return
+
+	case "view":
+		values, err := b.getSettingValues(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching settings", "err", err)
+			b.respondError(i, "Failed to fetch settings.")
+			return
+		}
+		response.Content = option.NewNullableString(formatSettings(values))
+
+	case "set":
+		key := sub.Options.Find("setting").String()
+		d, ok := lookupSetting(key)
+		if !ok {
+			b.respondError(i, "Unknown setting.")
+			return
+		}
+		raw := sub.Options.Find("value").String()
+		if _, err := d.parse(raw); err != nil {
+			b.respondError(i, fmt.Sprintf("Invalid value: %v.", err))
+			return
+		}
+		value, err := b.setGuildSetting(serverID, key, raw, userID)
+		if err != nil {
+			b.interactionLog(i).Error("Error changing setting", "setting", key, "err", err)
+			b.respondError(i, "Failed to change setting.")
+			return
+		}
+		b.interactionLog(i).Info("Changed setting", "setting", key, "value", value)
+		response.Content = option.NewNullableString(fmt.Sprintf("✅ `%s` is now **%s**.", key, value))
+
+	case "reset":
+		key := sub.Options.Find("setting").String()
+		if key != "" {
+			if _, ok := lookupSetting(key); !ok {
+				b.respondError(i, "Unknown setting.")
+				return
+			}
+		}
+		reset, err := b.resetGuildSettings(serverID, key, userID)
+		if err != nil {
+			b.interactionLog(i).Error("Error resetting settings", "setting", key, "err", err)
+			b.respondError(i, "Failed to reset settings.")
+			return
+		}
+		b.interactionLog(i).Info("Reset settings", "settings", reset)
+		switch {
+		case len(reset) == 0:
+			response.Content = option.NewNullableString("Nothing to reset; already using the defaults.")
+		case key != "":
+			response.Content = option.NewNullableString(fmt.Sprintf("✅ `%s` is back to its default.", key))
+		default:
+			response.Content = option.NewNullableString(fmt.Sprintf("✅ Reset %d settings to their defaults.", len(reset)))
+		}
+
+	case "history":
+		changes, err := b.getSettingChanges(serverID, settingsHistoryShown)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching settings history", "err", err)
+			b.respondError(i, "Failed to fetch settings history.")
+			return
+		}
+		response.Content = option.NewNullableString(formatSettingChanges(changes))
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	response.Flags = discord.EphemeralMessage
+	// History and replies mention members; don't ping them
+	response.AllowedMentions = &api.AllowedMentions{}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
+
+// Choices for the setting option of /config
+func settingChoices() []discord.StringChoice {
+	choices := make([]discord.StringChoice, len(settings))
+	for i, d := range settings {
+		choices[i] = discord.StringChoice{Name: d.Key, Value: d.Key}
+	}
+	return choices
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+)
+
+// Change a setting of the test guild
+func (b *testBot) configure(key, value string) {
+	b.t.Helper()
+	if _, err := b.setGuildSetting(int64(testGuildID), key, value, int64(testUserID)); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+func TestSettingParse(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string // Empty when the value is invalid
+	}{
+		{key: "track_reactions", value: "off", want: "false"},
+		{key: "track_reactions", value: " Yes ", want: "true"},
+		{key: "track_reactions", value: "maybe"},
+		{key: "emoji_page_size", value: "10", want: "10"},
+		{key: "emoji_page_size", value: "4"},
+		{key: "emoji_page_size", value: "26"},
+		{key: "emoji_page_size", value: "ten"},
+		{key: "default_visibility", value: "PUBLIC", want: "public"},
+		{key: "default_visibility", value: "hidden"},
+		{key: "locale", value: "pt-br", want: "pt-BR"},
+		{key: "locale", value: "xx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			d, ok := lookupSetting(tt.key)
+			if !ok {
+				t.Fatalf("no setting %s", tt.key)
+			}
+			got, err := d.parse(tt.value)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("parse(%q) = %q, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parse(%q) = %q, %v; want %q", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultSettingsAreValid(t *testing.T) {
+	for _, d := range settings {
+		if got, err := d.parse(d.Default); err != nil || got != d.Default {
+			t.Errorf("default of %s = %q does not parse to itself: %q, %v", d.Key, d.Default, got, err)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	tests := []struct {
+		n      int
+		locale string
+		want   string
+	}{
+		{n: 7, locale: "en", want: "7"},
+		{n: 999, locale: "en", want: "999"},
+		{n: 1234, locale: "en", want: "1,234"},
+		{n: 1234567, locale: "de", want: "1.234.567"},
+		{n: -1234, locale: "fr", want: "-1\u202f234"},
+		{n: 1234, locale: "unknown", want: "1,234"},
+	}
+	for _, tt := range tests {
+		if got := formatCount(tt.n, tt.locale); got != tt.want {
+			t.Errorf("formatCount(%d, %q) = %q, want %q", tt.n, tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestSettingsChangeTracking(t *testing.T) {
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	const message = discord.MessageID(500)
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		events   func(b *testBot) []gateway.Event
+		emoji    int
+		sticker  int
+	}{
+		{
+			name:     "bot messages counted",
+			settings: map[string]string{"track_bot_messages": "true"},
+			events: func(b *testBot) []gateway.Event {
+				m := b.message("<:wave:111>")
+				m.Author.Bot = true
+				return []gateway.Event{m}
+			},
+			emoji:   1,
+			sticker: -1,
+		},
+		{
+			name:     "messages not counted",
+			settings: map[string]string{"track_messages": "false"},
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.message("<:wave:111>", discord.StickerItem{ID: 211, Name: "cat"})}
+			},
+			emoji:   -1,
+			sticker: 1,
+		},
+		{
+			name:     "stickers not counted",
+			settings: map[string]string{"track_stickers": "false"},
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.message("<:wave:111>", discord.StickerItem{ID: 211, Name: "cat"})}
+			},
+			emoji:   1,
+			sticker: -1,
+		},
+		{
+			name:     "repeats count once",
+			settings: map[string]string{"count_repeats": "false"},
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.message("<:wave:111> <:wave:111> <:wave:111>")}
+			},
+			emoji:   1,
+			sticker: -1,
+		},
+		{
+			name:     "reactions not counted",
+			settings: map[string]string{"track_reactions": "false"},
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, wave)}
+			},
+			emoji:   -1,
+			sticker: -1,
+		},
+		{
+			name:     "reaction removals kept",
+			settings: map[string]string{"count_reaction_removals": "false"},
+			events: func(b *testBot) []gateway.Event {
+				return []gateway.Event{b.reactionAdd(message, wave), b.reactionRemove(message, wave)}
+			},
+			emoji:   1,
+			sticker: -1,
+		},
+		{
+			name:     "reset restores defaults",
+			settings: map[string]string{"track_messages": "false"},
+			events: func(b *testBot) []gateway.Event {
+				if _, err := b.resetGuildSettings(int64(testGuildID), "", int64(testUserID)); err != nil {
+					b.t.Fatal(err)
+				}
+				return []gateway.Event{b.message("<:wave:111>")}
+			},
+			emoji:   1,
+			sticker: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			for key, value := range tt.settings {
+				b.configure(key, value)
+			}
+			b.send(tt.events(b)...)
+
+			if got := b.emojiCount(111); got != tt.emoji {
+				t.Errorf("emoji count = %d, want %d", got, tt.emoji)
+			}
+			if got := b.stickerCount(211); got != tt.sticker {
+				t.Errorf("sticker count = %d, want %d", got, tt.sticker)
+			}
+		})
+	}
+}
+
+func TestSettingsChangeLists(t *testing.T) {
+	b := newTestBot(t)
+	seedEmojis(b, 30)
+	b.configure("emoji_page_size", "10")
+
+	b.send(b.command("listemotes"))
+	if n := listLines(b.fake.lastContent(t)); n != 10 {
+		t.Errorf("first page lists %d emojis, want 10", n)
+	}
+	b.send(b.button("emoji_page:2"))
+	if content := b.fake.lastContent(t); listLines(content) != 10 || !strings.Contains(content, "<:e20:10020>") {
+		t.Errorf("third page does not list the 21st to 30th emoji: %q", content)
+	}
+
+	b.configure("default_visibility", "public")
+	b.send(b.command("listemotes"))
+	if b.fake.lastResponse(t).Data.Flags&discord.EphemeralMessage != 0 {
+		t.Error("list is ephemeral with default_visibility public")
+	}
+	b.send(b.command("listemotes", boolOption("share", false)))
+	if b.fake.lastResponse(t).Data.Flags&discord.EphemeralMessage == 0 {
+		t.Error("share:false did not override default_visibility")
+	}
+
+	if _, err := b.DB.Exec("UPDATE emojis SET usage_count = 1234 WHERE emote_id = 10000"); err != nil {
+		t.Fatal(err)
+	}
+	b.configure("locale", "de")
+	b.send(b.command("listemotes"))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "**x1.234**") {
+		t.Errorf("count not formatted for de: %q", content)
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	b := newTestBot(t)
+
+	b.send(b.command("config", subcommand("set", stringOption("setting", "emoji_page_size"), stringOption("value", "100"))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Invalid value") {
+		t.Errorf("out of range value accepted: %q", content)
+	}
+
+	b.send(b.command("config", subcommand("set", stringOption("setting", "emoji_page_size"), stringOption("value", "10"))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "`emoji_page_size` is now **10**") {
+		t.Errorf("set replied %q", content)
+	}
+	if got := b.getGuildSettings(int64(testGuildID)).EmojiPageSize; got != 10 {
+		t.Errorf("cached page size = %d, want 10", got)
+	}
+
+	b.send(b.command("config", subcommand("view")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "`emoji_page_size` = **10** (default 25)") ||
+		!strings.Contains(content, "`track_reactions` = true") {
+		t.Errorf("view shows %q", content)
+	}
+
+	b.send(b.command("config", subcommand("reset", stringOption("setting", "emoji_page_size"))))
+	if got := b.getGuildSettings(int64(testGuildID)).EmojiPageSize; got != 25 {
+		t.Errorf("page size after reset = %d, want 25", got)
+	}
+	b.send(b.command("config", subcommand("reset")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Nothing to reset") {
+		t.Errorf("second reset replied %q", content)
+	}
+
+	b.send(b.command("config", subcommand("history")))
+	content := b.fake.lastContent(t)
+	for _, want := range []string{"`emoji_page_size`: default → 10", "`emoji_page_size`: 10 → default", "<@3000>"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("history missing %q: %q", want, content)
+		}
+	}
+	if got := b.rows("guild_settings_audit"); got != 2 {
+		t.Errorf("audit rows = %d, want 2 (the rejected value and the empty reset change nothing)", got)
+	}
+}
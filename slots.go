@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	defaultSlotsWindowDays = 30
+	slotsCandidateLimit    = 10
+)
+
+// Slot limits per boost tier. Static and animated emojis each get Emojis slots.
+type slotLimits struct {
+	Emojis   int
+	Stickers int
+}
+
+var premiumTierSlots = map[discord.NitroBoost]slotLimits{
+	discord.NoNitroLevel: {Emojis: 50, Stickers: 5},
+	discord.NitroLevel1:  {Emojis: 100, Stickers: 15},
+	discord.NitroLevel2:  {Emojis: 150, Stickers: 30},
+	discord.NitroLevel3:  {Emojis: 250, Stickers: 60},
+}
+
+// Weights for the removal score. Each factor is normalized to 0..1 before weighting.
+type ScoreWeights struct {
+	Usage float64
+	Age   float64
+	Users float64
+	Days  int
+}
+
+// Emoji or sticker suggested for removal
+type RemovalCandidate struct {
+	Kind          string
+	ID            int64
+	Name          string
+	Animated      bool
+	RecentUses    int
+	DistinctUsers int
+	AgeDays       int
+	Score         float64
+}
+
+// Fetch the guild's stickers
+func (b *Bot) getGuildStickers(guildID discord.GuildID) ([]discord.Sticker, error) {
+	return b.Client.GuildStickers(guildID)
+}
+
+// Arikawa has no wrapper for this endpoint
+func fetchGuildStickers(c *api.Client, guildID discord.GuildID) ([]discord.Sticker, error) {
+	var stickers []discord.Sticker
+	err := c.RequestJSON(&stickers, "GET", api.EndpointGuilds+guildID.String()+"/stickers")
+	return stickers, err
+}
+
+// Recent use counts per item from the daily buckets
+func (b *Bot) getRecentUsage(serverID int64, kind string, since time.Time) (map[int64]int, error) {
+	rows, err := b.DB.Query(
+		"SELECT item_id, SUM(usage_count) FROM usage_daily WHERE server_id = ? AND kind = ? AND day >= ? GROUP BY item_id",
+		serverID, kind, since.UTC().Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		usage[id] = count
+	}
+	return usage, rows.Err()
+}
+
+// Distinct users per item since a time
+func (b *Bot) getDistinctUsers(serverID int64, kind string, since time.Time) (map[int64]int, error) {
+	rows, err := b.DB.Query(
+		"SELECT item_id, COUNT(DISTINCT "+reportedUserID+") FROM usage_history WHERE server_id = ? AND kind = ? AND delta > 0 AND created_at >= ? GROUP BY item_id",
+		serverID, kind, sqliteTime(since),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		users[id] = count
+	}
+	return users, rows.Err()
+}
+
+// Higher scores are better removal candidates
+func removalScore(c RemovalCandidate, w ScoreWeights) float64 {
+	total := w.Usage + w.Age + w.Users
+	if total <= 0 {
+		return 0
+	}
+	usage := 1 / (1 + float64(c.RecentUses))
+	age := math.Min(float64(c.AgeDays)/365, 1)
+	users := 1 / (1 + float64(c.DistinctUsers))
+	return (w.Usage*usage + w.Age*age + w.Users*users) / total
+}
+
+// Score live emojis and stickers and return the best removal candidates
+func (b *Bot) getRemovalCandidates(serverID int64, emojis []discord.Emoji, stickers []discord.Sticker, now time.Time, w ScoreWeights, limit int) ([]RemovalCandidate, error) {
+	since := now.AddDate(0, 0, -w.Days)
+
+	emojiUsage, err := b.getRecentUsage(serverID, kindEmoji, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch emoji usage: %w", err)
+	}
+	emojiUsers, err := b.getDistinctUsers(serverID, kindEmoji, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch emoji users: %w", err)
+	}
+	stickerUsage, err := b.getRecentUsage(serverID, kindSticker, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sticker usage: %w", err)
+	}
+	stickerUsers, err := b.getDistinctUsers(serverID, kindSticker, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sticker users: %w", err)
+	}
+
+	candidates := make([]RemovalCandidate, 0, len(emojis)+len(stickers))
+	for _, e := range emojis {
+		id := int64(e.ID)
+		candidates = append(candidates, RemovalCandidate{
+			Kind:          kindEmoji,
+			ID:            id,
+			Name:          e.Name,
+			Animated:      e.Animated,
+			RecentUses:    emojiUsage[id],
+			DistinctUsers: emojiUsers[id],
+			AgeDays:       int(now.Sub(e.CreatedAt()).Hours() / 24),
+		})
+	}
+	for _, s := range stickers {
+		id := int64(s.ID)
+		candidates = append(candidates, RemovalCandidate{
+			Kind:          kindSticker,
+			ID:            id,
+			Name:          s.Name,
+			RecentUses:    stickerUsage[id],
+			DistinctUsers: stickerUsers[id],
+			AgeDays:       int(now.Sub(s.CreatedAt()).Hours() / 24),
+		})
+	}
+
+	for i := range candidates {
+		candidates[i].Score = removalScore(candidates[i], w)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].RecentUses < candidates[j].RecentUses
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates, nil
+}
+
+// Label for an emoji or sticker in a list
+func candidateLabel(c RemovalCandidate) string {
+	if c.Kind == kindSticker {
+		return fmt.Sprintf("%s (sticker)", c.Name)
+	}
+	if c.Animated {
+		return fmt.Sprintf("<a:%s:%d>", c.Name, c.ID)
+	}
+	return fmt.Sprintf("<:%s:%d>", c.Name, c.ID)
+}
+
+// Explain why a candidate was recommended
+func explainCandidate(c RemovalCandidate, w ScoreWeights) string {
+	uses := "no uses"
+	if c.RecentUses > 0 {
+		uses = fmt.Sprintf("%d uses by %d members", c.RecentUses, c.DistinctUsers)
+	}
+	return fmt.Sprintf("%s in the last %dd, added %d days ago", uses, w.Days, c.AgeDays)
+}
+
+// Create slot usage and removal recommendation message
+func createSlotsMessage(tier discord.NitroBoost, emojis []discord.Emoji, stickers []discord.Sticker, candidates []RemovalCandidate, w ScoreWeights) api.InteractionResponseData {
+	limits := premiumTierSlots[tier]
+	static, animated := 0, 0
+	for _, e := range emojis {
+		if e.Animated {
+			animated++
+		} else {
+			static++
+		}
+	}
+
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**Emoji Slots (Boost Tier %d)**\n\n", tier))
+	content.WriteString(fmt.Sprintf("- Static emojis: **%d/%d**\n", static, limits.Emojis))
+	content.WriteString(fmt.Sprintf("- Animated emojis: **%d/%d**\n", animated, limits.Emojis))
+	content.WriteString(fmt.Sprintf("- Stickers: **%d/%d**\n\n", len(stickers), limits.Stickers))
+
+	content.WriteString(fmt.Sprintf("**Removal Candidates** (weights: usage %g, age %g, users %g)\n", w.Usage, w.Age, w.Users))
+	if len(candidates) == 0 {
+		content.WriteString("No emojis or stickers found in this server.")
+	}
+	for i, c := range candidates {
+		content.WriteString(fmt.Sprintf("%d. %s score **%.2f**: %s\n", i+1, candidateLabel(c), c.Score, explainCandidate(c, w)))
+	}
+
+	return api.InteractionResponseData{
+		Content: option.NewNullableString(content.String()),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
+// Read score weight options, falling back to defaults
+func scoreWeightsFromOptions(opts discord.CommandInteractionOptions) ScoreWeights {
+	w := ScoreWeights{Usage: 1, Age: 1, Users: 1, Days: defaultSlotsWindowDays}
+	if v, err := opts.Find("days").IntValue(); err == nil && v > 0 {
+		w.Days = int(v)
+	}
+	if v, err := opts.Find("weight_usage").FloatValue(); err == nil && v >= 0 {
+		w.Usage = v
+	}
+	if v, err := opts.Find("weight_age").FloatValue(); err == nil && v >= 0 {
+		w.Age = v
+	}
+	if v, err := opts.Find("weight_users").FloatValue(); err == nil && v >= 0 {
+		w.Users = v
+	}
+	return w
+}
+
+// Handle /slots command
+func (b *Bot) handleSlots(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	w := scoreWeightsFromOptions(i.Data.(*discord.CommandInteraction).Options)
+
+	guild, err := b.Client.Guild(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild", "err", err)
+		b.respondError(i, "Failed to fetch server info.")
+		return
+	}
+
+	emojis, err := b.getGuildEmojis(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild emojis", "err", err)
+		b.respondError(i, "Failed to fetch guild emojis.")
+		return
+	}
+
+	stickers, err := b.getGuildStickers(i.GuildID)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching guild stickers", "err", err)
+		b.respondError(i, "Failed to fetch guild stickers.")
+		return
+	}
+
+	candidates, err := b.getRemovalCandidates(int64(i.GuildID), emojis, stickers, time.Now(), w, slotsCandidateLimit)
+	if err != nil {
+		b.interactionLog(i).Error("Error scoring removal candidates", "err", err)
+		b.respondError(i, "Failed to fetch usage data.")
+		return
+	}
+
+	response := createSlotsMessage(guild.NitroBoost, emojis, stickers, candidates, w)
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
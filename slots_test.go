@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+func TestRemovalScore(t *testing.T) {
+	all := ScoreWeights{Usage: 1, Age: 1, Users: 1}
+	tests := []struct {
+		name      string
+		candidate RemovalCandidate
+		weights   ScoreWeights
+		want      float64
+	}{
+		{name: "unused and old", candidate: RemovalCandidate{AgeDays: 400}, weights: all, want: 1},
+		{name: "used by one member", candidate: RemovalCandidate{RecentUses: 3, DistinctUsers: 1, AgeDays: 400}, weights: all, want: (0.25 + 1 + 0.5) / 3},
+		{name: "usage only", candidate: RemovalCandidate{RecentUses: 3, AgeDays: 400}, weights: ScoreWeights{Usage: 1}, want: 0.25},
+		{name: "age is capped at a year", candidate: RemovalCandidate{RecentUses: 9, DistinctUsers: 9, AgeDays: 730}, weights: ScoreWeights{Age: 2}, want: 1},
+		{name: "weights are relative", candidate: RemovalCandidate{DistinctUsers: 1}, weights: ScoreWeights{Usage: 3, Users: 1}, want: (3*1 + 0.5) / 4},
+		{name: "zero weights", candidate: RemovalCandidate{AgeDays: 400}, want: 0},
+		{name: "negative weights", candidate: RemovalCandidate{AgeDays: 400}, weights: ScoreWeights{Usage: -1}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := removalScore(tt.candidate, tt.weights); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: score = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemovalCandidates(t *testing.T) {
+	b := newTestBot(t)
+	now := time.Now()
+	createdDaysAgo := func(days int) discord.Snowflake { return discord.NewSnowflake(now.AddDate(0, 0, -days)) }
+
+	stale := discord.Emoji{ID: discord.EmojiID(createdDaysAgo(400)), Name: "stale"}
+	fresh := discord.Emoji{ID: discord.EmojiID(createdDaysAgo(10)), Name: "fresh"}
+	popular := discord.Emoji{ID: discord.EmojiID(createdDaysAgo(401)), Name: "popular"}
+	sticker := discord.Sticker{ID: discord.StickerID(createdDaysAgo(402)), Name: "cat"}
+
+	// Usage before the window doesn't count
+	b.dispatch(b.message(fmt.Sprintf("<:stale:%d>", stale.ID)), now.AddDate(0, 0, -40))
+	for range 3 {
+		b.dispatch(b.message(fmt.Sprintf("<:popular:%d>", popular.ID)), now.AddDate(0, 0, -1))
+	}
+	b.dispatch(b.message("", discord.StickerItem{ID: sticker.ID, Name: sticker.Name}), now.AddDate(0, 0, -1))
+
+	emojis := []discord.Emoji{stale, fresh, popular}
+	stickers := []discord.Sticker{sticker}
+	tests := []struct {
+		name    string
+		weights ScoreWeights
+		limit   int
+		want    []string
+	}{
+		// stale 1, fresh ~0.68, cat ~0.67, popular ~0.58
+		{name: "highest score first", weights: ScoreWeights{Usage: 1, Age: 1, Users: 1, Days: 30}, limit: 3, want: []string{"stale", "fresh", "cat"}},
+		// Every score is 0, so the least used come first
+		{name: "zero weights", weights: ScoreWeights{Days: 30}, limit: 10, want: []string{"stale", "fresh", "cat", "popular"}},
+		// Usage alone ties stale and fresh, which keep their order
+		{name: "usage only", weights: ScoreWeights{Usage: 1, Days: 30}, limit: 10, want: []string{"stale", "fresh", "cat", "popular"}},
+		// The year-old items tie and the least used come first
+		{name: "age only", weights: ScoreWeights{Age: 1, Days: 30}, limit: 10, want: []string{"stale", "cat", "popular", "fresh"}},
+	}
+	for _, tt := range tests {
+		candidates, err := b.getRemovalCandidates(int64(testGuildID), emojis, stickers, now, tt.weights, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range candidates {
+			got = append(got, c.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: candidates = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
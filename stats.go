@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Detailed statistics for one emoji
+type EmojiDetail struct {
+	EmojiData
+	FirstUsed     time.Time
+	RecentUses    int
+	DistinctUsers int
+	Days          int
+}
+
+// Get an emoji's totals plus usage over the last days, or nil if it was never used
+func (b *Bot) getEmojiDetail(serverID, emojiID int64, days int, now time.Time) (*EmojiDetail, error) {
+	d := EmojiDetail{Days: days}
+	err := b.DB.QueryRow(
+		"SELECT emote_name, emote_id, usage_count, first_used, last_used, animated FROM emojis WHERE server_id = ? AND emote_id = ?",
+		serverID, emojiID,
+	).Scan(&d.Name, &d.ID, &d.Count, &d.FirstUsed, &d.LastUsed, &d.Animated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch emoji: %w", err)
+	}
+
+	since := now.AddDate(0, 0, -days)
+	err = b.DB.QueryRow(
+		"SELECT COALESCE(SUM(usage_count), 0) FROM usage_daily WHERE server_id = ? AND kind = ? AND item_id = ? AND day >= ?",
+		serverID, kindEmoji, emojiID, since.UTC().Format(time.DateOnly),
+	).Scan(&d.RecentUses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recent usage: %w", err)
+	}
+	err = b.DB.QueryRow(
+		"SELECT COUNT(DISTINCT "+reportedUserID+") FROM usage_history WHERE server_id = ? AND kind = ? AND item_id = ? AND delta > 0 AND created_at >= ?",
+		serverID, kindEmoji, emojiID, sqliteTime(since),
+	).Scan(&d.DistinctUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch distinct users: %w", err)
+	}
+	return &d, nil
+}
+
+// Uses on one day
+type DailyCount struct {
+	Day   time.Time
+	Count int
+}
+
+// Daily usage from since to now, with zero days filled in. itemID 0 sums every
+// item of the kind; channelID 0 covers every channel.
+func (b *Bot) getUsageSeries(serverID int64, kind string, itemID, channelID int64, since, now time.Time) ([]DailyCount, error) {
+	var rows *sql.Rows
+	var err error
+	if channelID == 0 {
+		rows, err = b.DB.Query(
+			"SELECT date(day), SUM(usage_count) FROM usage_daily WHERE server_id = ? AND kind = ? AND day >= ? AND (? = 0 OR item_id = ?) GROUP BY date(day)",
+			serverID, kind, since.UTC().Format(time.DateOnly), itemID, itemID,
+		)
+	} else {
+		// Daily totals have no channel, so per-channel series come from the events and their rollups
+		rows, err = b.DB.Query(
+			"SELECT date(created_at), SUM(delta) FROM usage_history WHERE server_id = ? AND kind = ? AND channel_id = ? AND created_at >= ? AND (? = 0 OR item_id = ?) GROUP BY date(created_at)",
+			serverID, kind, channelID, sqliteTime(since.UTC().Truncate(24*time.Hour)), itemID, itemID,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day string
+		var count int
+		if err := rows.Scan(&day, &count); err != nil {
+			return nil, err
+		}
+		counts[day] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var series []DailyCount
+	start := since.UTC().Truncate(24 * time.Hour)
+	for day := start; !day.After(now.UTC()); day = day.AddDate(0, 0, 1) {
+		series = append(series, DailyCount{Day: day, Count: counts[day.Format(time.DateOnly)]})
+	}
+	return series, nil
+}
+
+// Narrows a ranking. Zero values mean all time, every channel and any name.
+type RankingFilter struct {
+	Kind      string
+	ChannelID int64
+	Since     time.Time
+	Name      string
+}
+
+// Emojis or stickers ranked by uses matching a filter. All-time rankings over
+// every channel use the stored totals, the same as /listemotes and /liststickers.
+func (b *Bot) getItemRanking(serverID int64, f RankingFilter, limit int) ([]ItemUsage, error) {
+	name := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Name) + "%"
+
+	var query string
+	var args []any
+	switch {
+	case f.ChannelID == 0 && f.Since.IsZero() && f.Kind == kindSticker:
+		query = `SELECT sticker_id, sticker_name, FALSE, usage_count FROM stickers
+			WHERE server_id = ? AND sticker_name LIKE ? ESCAPE '\'
+			ORDER BY usage_count DESC, last_used DESC LIMIT ?`
+		args = []any{serverID, name, limit}
+	case f.ChannelID == 0 && f.Since.IsZero():
+		query = `SELECT emote_id, emote_name, animated, usage_count FROM emojis
+			WHERE server_id = ? AND emote_name LIKE ? ESCAPE '\'
+			ORDER BY usage_count DESC, last_used DESC LIMIT ?`
+		args = []any{serverID, name, limit}
+	default:
+		query = `
+			SELECT ue.item_id, COALESCE(e.emote_name, s.sticker_name, ''), COALESCE(e.animated, FALSE), SUM(ue.delta) AS uses
+			FROM usage_history ue
+			LEFT JOIN emojis e ON ue.kind = 'emoji' AND e.server_id = ue.server_id AND e.emote_id = ue.item_id
+			LEFT JOIN stickers s ON ue.kind = 'sticker' AND s.server_id = ue.server_id AND s.sticker_id = ue.item_id
+			WHERE ue.server_id = ? AND ue.kind = ? AND (? = 0 OR ue.channel_id = ?) AND ue.created_at >= ?
+				AND COALESCE(e.emote_name, s.sticker_name, '') LIKE ? ESCAPE '\'
+			GROUP BY ue.item_id
+			HAVING uses > 0
+			ORDER BY uses DESC, ue.item_id
+			LIMIT ?`
+		args = []any{serverID, f.Kind, f.ChannelID, f.ChannelID, sqliteTime(f.Since), name, limit}
+	}
+
+	rows, err := b.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []ItemUsage
+	for rows.Next() {
+		u := ItemUsage{Kind: f.Kind}
+		if err := rows.Scan(&u.ID, &u.Name, &u.Animated, &u.Count); err != nil {
+			return nil, err
+		}
+		items = append(items, u)
+	}
+	return items, rows.Err()
+}
+
+// Net uses in one channel
+type ChannelUsage struct {
+	ChannelID int64
+	Count     int
+}
+
+// Channels ranked by uses of a kind since a time
+func (b *Bot) getChannelUsage(serverID int64, kind string, since time.Time) ([]ChannelUsage, error) {
+	rows, err := b.DB.Query(`
+		SELECT channel_id, SUM(delta) AS uses
+		FROM usage_history
+		WHERE server_id = ? AND kind = ? AND channel_id != 0 AND created_at >= ?
+		GROUP BY channel_id
+		HAVING uses > 0
+		ORDER BY uses DESC, channel_id`,
+		serverID, kind, sqliteTime(since),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []ChannelUsage
+	for rows.Next() {
+		var c ChannelUsage
+		if err := rows.Scan(&c.ChannelID, &c.Count); err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+// Net uses by one member
+type UserUsage struct {
+	UserID int64
+	Count  int
+}
+
+// Number of members with recorded usage
+func (b *Bot) countUsers(serverID int64) (int, error) {
+	var count int
+	err := b.DB.QueryRow("SELECT COUNT(DISTINCT "+reportedUserID+") FROM usage_history WHERE server_id = ?", serverID).Scan(&count)
+	return count, err
+}
+
+// Members ranked by net emoji and sticker uses
+func (b *Bot) getTopUsers(serverID int64, offset, limit int) ([]UserUsage, error) {
+	rows, err := b.DB.Query(`
+		SELECT user_id, SUM(delta) AS uses
+		FROM usage_history
+		WHERE server_id = ? AND user_id != 0 AND user_id NOT IN (SELECT user_id FROM privacy_optouts)
+		GROUP BY user_id
+		ORDER BY uses DESC, user_id
+		LIMIT ? OFFSET ?`,
+		serverID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []UserUsage
+	for rows.Next() {
+		var u UserUsage
+		if err := rows.Scan(&u.UserID, &u.Count); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Net uses of an emoji or sticker
+type ItemUsage struct {
+	Kind     string
+	ID       int64
+	Name     string
+	Animated bool
+	Count    int
+}
+
+// A member's most used emojis and stickers, by user ID or pseudonym
+func (b *Bot) getUserTopItems(serverID, userID int64, limit int) ([]ItemUsage, error) {
+	ids, err := b.userIDCandidates(serverID, userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.DB.Query(`
+		SELECT ue.kind, ue.item_id, COALESCE(e.emote_name, s.sticker_name, ''), COALESCE(e.animated, FALSE), SUM(ue.delta) AS uses
+		FROM usage_history ue
+		LEFT JOIN emojis e ON ue.kind = 'emoji' AND e.server_id = ue.server_id AND e.emote_id = ue.item_id
+		LEFT JOIN stickers s ON ue.kind = 'sticker' AND s.server_id = ue.server_id AND s.sticker_id = ue.item_id
+		WHERE ue.server_id = ? AND ue.user_id IN (?, ?) AND ue.user_id NOT IN (SELECT user_id FROM privacy_optouts)
+		GROUP BY ue.kind, ue.item_id
+		HAVING uses > 0
+		ORDER BY uses DESC, ue.item_id
+		LIMIT ?`,
+		serverID, ids[0], ids[1], limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []ItemUsage
+	for rows.Next() {
+		var u ItemUsage
+		if err := rows.Scan(&u.Kind, &u.ID, &u.Name, &u.Animated, &u.Count); err != nil {
+			return nil, err
+		}
+		items = append(items, u)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// Modes of a channel filter
+const (
+	filterIgnore = "ignore"
+	filterAllow  = "allow"
+)
+
+// A channel or category on a server's ignore or allow list
+type ChannelFilter struct {
+	ChannelID  int64
+	IsCategory bool
+	Mode       string
+	AddedBy    int64
+	CreatedAt  time.Time
+}
+
+// A server's channel filters, by channel or category ID
+type channelFilters struct {
+	Modes    map[int64]string
+	HasAllow bool // Only allowed channels are tracked
+}
+
+// Channel types that can be put on a list
+var filterableChannelTypes = []discord.ChannelType{
+	discord.GuildText, discord.GuildAnnouncement, discord.GuildForum, discord.GuildCategory,
+}
+
+func (b *Bot) getChannelFilters(serverID int64) ([]ChannelFilter, error) {
+	rows, err := b.DB.Query(
+		"SELECT channel_id, is_category, mode, added_by, created_at FROM channel_filters WHERE server_id = ? ORDER BY mode, is_category DESC, created_at",
+		serverID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []ChannelFilter
+	for rows.Next() {
+		var f ChannelFilter
+		if err := rows.Scan(&f.ChannelID, &f.IsCategory, &f.Mode, &f.AddedBy, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, rows.Err()
+}
+
+// Put a channel or category on the ignore or allow list, replacing any earlier entry for it
+func (b *Bot) setChannelFilter(serverID int64, f ChannelFilter) error {
+	_, err := b.DB.Exec(`
+		INSERT INTO channel_filters (server_id, channel_id, is_category, mode, added_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(server_id, channel_id) DO UPDATE SET
+			mode = excluded.mode,
+			added_by = excluded.added_by,
+			created_at = excluded.created_at
+	`, serverID, f.ChannelID, f.IsCategory, f.Mode, f.AddedBy, sqliteTime(time.Now()))
+	b.invalidateChannelFilters(serverID)
+	return err
+}
+
+// Take a channel or category off the lists, returning whether it was on one
+func (b *Bot) removeChannelFilter(serverID, channelID int64) (bool, error) {
+	res, err := b.DB.Exec("DELETE FROM channel_filters WHERE server_id = ? AND channel_id = ?", serverID, channelID)
+	b.invalidateChannelFilters(serverID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// A server's channel filters, from the cache when possible
+func (b *Bot) getCachedChannelFilters(serverID int64) (channelFilters, error) {
+	b.channelFilterCacheMutex.Lock()
+	defer b.channelFilterCacheMutex.Unlock()
+
+	if f, ok := b.channelFilterCache[serverID]; ok {
+		return f, nil
+	}
+	list, err := b.getChannelFilters(serverID)
+	if err != nil {
+		return channelFilters{}, err
+	}
+	f := channelFilters{Modes: make(map[int64]string, len(list))}
+	for _, entry := range list {
+		f.Modes[entry.ChannelID] = entry.Mode
+		f.HasAllow = f.HasAllow || entry.Mode == filterAllow
+	}
+	b.channelFilterCache[serverID] = f
+	return f, nil
+}
+
+func (b *Bot) invalidateChannelFilters(serverID int64) {
+	b.channelFilterCacheMutex.Lock()
+	delete(b.channelFilterCache, serverID)
+	b.channelFilterCacheMutex.Unlock()
+}
+
+// Channel lookups needed to apply channel filters to threads and channels in categories
+type ChannelAPI interface {
+	Channel(id discord.ChannelID) (*discord.Channel, error)
+}
+
+// The channel, then its parent channel if it is a thread, then its category:
+// the IDs whose list entries apply to usage in it, most specific first
+func channelLineage(c ChannelAPI, channelID discord.ChannelID) ([]int64, error) {
+	lineage := []int64{int64(channelID)}
+	ch, err := c.Channel(channelID)
+	if err != nil {
+		return lineage, err
+	}
+	switch ch.Type {
+	case discord.GuildPublicThread, discord.GuildPrivateThread, discord.GuildAnnouncementThread:
+		if !ch.ParentID.IsValid() {
+			return lineage, nil
+		}
+		lineage = append(lineage, int64(ch.ParentID))
+		if ch, err = c.Channel(ch.ParentID); err != nil {
+			return lineage, err
+		}
+	}
+	if ch.ParentID.IsValid() {
+		lineage = append(lineage, int64(ch.ParentID))
+	}
+	return lineage, nil
+}
+
+// Whether usage in a channel counts under the server's ignore and allow lists.
+// Threads follow their parent channel and channels follow their category,
+// unless listed themselves. With an allow list, anything not allowed is ignored.
+func (b *Bot) channelTracked(guildID discord.GuildID, channelID discord.ChannelID) bool {
+	filters, err := b.getCachedChannelFilters(int64(guildID))
+	if err != nil {
+		// Count rather than drop usage on a bad read
+		trackingLog.Error("Error loading channel filters", idAttr("guild_id", int64(guildID)), "err", err)
+		return true
+	}
+	if len(filters.Modes) == 0 {
+		return true
+	}
+
+	lineage, err := channelLineage(b.Client, channelID)
+	if err != nil {
+		// Only the channel's own entry can be checked
+		trackingLog.Warn("Error looking up channel parents", idAttr("guild_id", int64(guildID)), idAttr("channel_id", int64(channelID)), "err", err)
+	}
+	for _, id := range lineage {
+		if mode, ok := filters.Modes[id]; ok {
+			return mode == filterAllow
+		}
+	}
+	return !filters.HasAllow
+}
+
+func formatTrackingFilters(filters []ChannelFilter, roles []RoleFilter) string {
+	if len(filters) == 0 && len(roles) == 0 {
+		return "Usage is tracked in every channel and from every member. Use `/tracking ignore`, `/tracking allow` or `/tracking ignore_role` to change that."
+	}
+
+	var content strings.Builder
+	content.WriteString("**Tracking Filters**\n\n")
+	for _, mode := range []string{filterAllow, filterIgnore} {
+		var lines []string
+		for _, f := range filters {
+			if f.Mode != mode {
+				continue
+			}
+			line := fmt.Sprintf("- <#%d>", f.ChannelID)
+			if f.IsCategory {
+				line += " (category)"
+			}
+			lines = append(lines, line+fmt.Sprintf(" by <@%d> <t:%d:R>\n", f.AddedBy, f.CreatedAt.Unix()))
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		if mode == filterAllow {
+			content.WriteString("__Allowed__ (only these are tracked)\n")
+		} else {
+			content.WriteString("__Ignored__\n")
+		}
+		content.WriteString(strings.Join(lines, ""))
+		content.WriteString("\n")
+	}
+	if len(roles) > 0 {
+		content.WriteString("__Ignored Roles__\n")
+		for _, r := range roles {
+			content.WriteString(fmt.Sprintf("- <@&%d> by <@%d> <t:%d:R>\n", r.RoleID, r.AddedBy, r.CreatedAt.Unix()))
+		}
+		content.WriteString("\n")
+	}
+	content.WriteString("Threads follow their channel, and channels follow their category unless listed themselves.")
+	return content.String()
+}
+
+// The channel picked in a /tracking option and whether it is a category
+func (b *Bot) filterTarget(i *gateway.InteractionCreateEvent, opts discord.CommandInteractionOptions) (discord.ChannelID, bool, error) {
+	id, err := opts.Find("channel").SnowflakeValue()
+	if err != nil || !id.IsValid() {
+		return 0, false, fmt.Errorf("invalid channel")
+	}
+	channelID := discord.ChannelID(id)
+	if ch, ok := i.Data.(*discord.CommandInteraction).Resolved.Channels[channelID]; ok {
+		return channelID, ch.Type == discord.GuildCategory, nil
+	}
+	ch, err := b.Client.Channel(channelID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to look up channel: %w", err)
+	}
+	return channelID, ch.Type == discord.GuildCategory, nil
+}
+
+// Handle /tracking command
+func (b *Bot) handleTracking(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	data := i.Data.(*discord.CommandInteraction)
+	if len(data.Options) == 0 {
+		b.respondError(i, "Missing subcommand.")
+		return
+	}
+	sub := data.Options[0]
+	serverID := int64(i.GuildID)
+
+	var response api.InteractionResponseData
+
+	switch sub.Name {
+	case filterIgnore, filterAllow:
+		channelID, isCategory, err := b.filterTarget(i, sub.Options)
+		if err != nil {
+			b.interactionLog(i).Error("Error resolving tracking target", "err", err)
+			b.respondError(i, "Invalid channel.")
+			return
+		}
+		before, err := b.getCachedChannelFilters(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching channel filters", "err", err)
+			b.respondError(i, "Failed to fetch tracking filters.")
+			return
+		}
+		err = b.setChannelFilter(serverID, ChannelFilter{
+			ChannelID:  int64(channelID),
+			IsCategory: isCategory,
+			Mode:       sub.Name,
+			AddedBy:    int64(i.Member.User.ID),
+		})
+		if err != nil {
+			b.interactionLog(i).Error("Error saving channel filter", "err", err)
+			b.respondError(i, "Failed to save tracking filter.")
+			return
+		}
+		b.interactionLog(i).Info("Changed channel filter", idAttr("target_id", int64(channelID)), "category", isCategory, "mode", sub.Name)
+
+		what := channelID.Mention()
+		if isCategory {
+			what = "the " + what + " category"
+		}
+		if sub.Name == filterIgnore {
+			response.Content = option.NewNullableString(fmt.Sprintf("✅ Usage in %s is no longer tracked.", what))
+		} else {
+			content := fmt.Sprintf("✅ Usage in %s is tracked.", what)
+			if !before.HasAllow {
+				content += " Only allowed channels and categories are tracked from now on."
+			}
+			response.Content = option.NewNullableString(content)
+		}
+
+	case "clear":
+		// The channel may be gone, so don't look it up
+		id, err := sub.Options.Find("channel").SnowflakeValue()
+		if err != nil || !id.IsValid() {
+			b.respondError(i, "Invalid channel.")
+			return
+		}
+		channelID := discord.ChannelID(id)
+		ok, err := b.removeChannelFilter(serverID, int64(channelID))
+		if err != nil {
+			b.interactionLog(i).Error("Error removing channel filter", "err", err)
+			b.respondError(i, "Failed to remove tracking filter.")
+			return
+		}
+		if !ok {
+			b.respondError(i, fmt.Sprintf("%s is not on the ignore or allow list.", channelID.Mention()))
+			return
+		}
+		b.interactionLog(i).Info("Removed channel filter", idAttr("target_id", int64(channelID)))
+		response.Content = option.NewNullableString(fmt.Sprintf("✅ %s is off the ignore and allow lists.", channelID.Mention()))
+
+	case "ignore_role", "clear_role":
+		id, err := sub.Options.Find("role").SnowflakeValue()
+		if err != nil || !id.IsValid() {
+			b.respondError(i, "Invalid role.")
+			return
+		}
+		roleID := discord.RoleID(id)
+		if sub.Name == "clear_role" {
+			ok, err := b.removeRoleFilter(serverID, int64(roleID))
+			if err != nil {
+				b.interactionLog(i).Error("Error removing role filter", "err", err)
+				b.respondError(i, "Failed to remove role filter.")
+				return
+			}
+			if !ok {
+				b.respondError(i, fmt.Sprintf("%s is not ignored.", roleID.Mention()))
+				return
+			}
+			b.interactionLog(i).Info("Removed role filter", idAttr("role_id", int64(roleID)))
+			response.Content = option.NewNullableString(fmt.Sprintf("✅ Usage by members with %s is tracked again.", roleID.Mention()))
+			break
+		}
+		if int64(roleID) == serverID {
+			b.respondError(i, "Everyone has the @everyone role; use `/config` to turn tracking off instead.")
+			return
+		}
+		if err := b.addRoleFilter(serverID, int64(roleID), int64(i.Member.User.ID)); err != nil {
+			b.interactionLog(i).Error("Error saving role filter", "err", err)
+			b.respondError(i, "Failed to save role filter.")
+			return
+		}
+		b.interactionLog(i).Info("Added role filter", idAttr("role_id", int64(roleID)))
+		response.Content = option.NewNullableString(fmt.Sprintf("✅ Usage by members with %s is no longer tracked.", roleID.Mention()))
+
+	case "list":
+		filters, err := b.getChannelFilters(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching channel filters", "err", err)
+			b.respondError(i, "Failed to fetch tracking filters.")
+			return
+		}
+		roles, err := b.getRoleFilters(serverID)
+		if err != nil {
+			b.interactionLog(i).Error("Error fetching role filters", "err", err)
+			b.respondError(i, "Failed to fetch tracking filters.")
+			return
+		}
+		response.Content = option.NewNullableString(formatTrackingFilters(filters, roles))
+
+	default:
+		b.respondError(i, "Unknown subcommand.")
+		return
+	}
+
+	response.Flags = discord.EphemeralMessage
+	response.AllowedMentions = &api.AllowedMentions{}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// Channels of the test guild: general and memes in the chat category,
+// bots outside any category, and a thread in general
+const (
+	chatCategoryID = discord.ChannelID(2100)
+	memesChannelID = discord.ChannelID(2001)
+	botsChannelID  = discord.ChannelID(2002)
+	threadID       = discord.ChannelID(2200)
+)
+
+func addTestChannels(b *testBot) {
+	b.fake.ChannelsByGuild[testGuildID] = []discord.Channel{
+		{ID: chatCategoryID, GuildID: testGuildID, Name: "chat", Type: discord.GuildCategory},
+		{ID: testChannelID, GuildID: testGuildID, Name: "general", Type: discord.GuildText, ParentID: chatCategoryID},
+		{ID: memesChannelID, GuildID: testGuildID, Name: "memes", Type: discord.GuildText, ParentID: chatCategoryID},
+		{ID: botsChannelID, GuildID: testGuildID, Name: "bots", Type: discord.GuildText},
+		{ID: threadID, GuildID: testGuildID, Name: "thread", Type: discord.GuildPublicThread, ParentID: testChannelID},
+	}
+}
+
+func TestChannelFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters map[discord.ChannelID]string // Subcommand by channel
+		tracked map[discord.ChannelID]bool
+	}{
+		{
+			name:    "no filters",
+			tracked: map[discord.ChannelID]bool{testChannelID: true, botsChannelID: true, threadID: true},
+		},
+		{
+			name:    "ignored channel",
+			filters: map[discord.ChannelID]string{botsChannelID: filterIgnore},
+			tracked: map[discord.ChannelID]bool{testChannelID: true, botsChannelID: false},
+		},
+		{
+			name:    "ignored category",
+			filters: map[discord.ChannelID]string{chatCategoryID: filterIgnore},
+			tracked: map[discord.ChannelID]bool{testChannelID: false, memesChannelID: false, threadID: false, botsChannelID: true},
+		},
+		{
+			name:    "thread follows its channel",
+			filters: map[discord.ChannelID]string{testChannelID: filterIgnore},
+			tracked: map[discord.ChannelID]bool{threadID: false, memesChannelID: true},
+		},
+		{
+			name:    "allow list",
+			filters: map[discord.ChannelID]string{memesChannelID: filterAllow},
+			tracked: map[discord.ChannelID]bool{memesChannelID: true, testChannelID: false, botsChannelID: false},
+		},
+		{
+			name:    "channel overrides its category",
+			filters: map[discord.ChannelID]string{chatCategoryID: filterAllow, memesChannelID: filterIgnore},
+			tracked: map[discord.ChannelID]bool{testChannelID: true, threadID: true, memesChannelID: false, botsChannelID: false},
+		},
+	}
+
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for channelID, want := range tt.tracked {
+				b := newTestBot(t)
+				addTestChannels(b)
+				for target, mode := range tt.filters {
+					b.send(b.command("tracking", subcommand(mode, channelOption("channel", target))))
+				}
+
+				m := b.message("<:wave:111>")
+				m.ChannelID = channelID
+				add := b.reactionAdd(m.ID, wave)
+				add.ChannelID = channelID
+				b.send(m, add)
+
+				wantCount := -1
+				if want {
+					wantCount = 2
+				}
+				if got := b.emojiCount(111); got != wantCount {
+					t.Errorf("channel %d: emoji count = %d, want %d", channelID, got, wantCount)
+				}
+			}
+		})
+	}
+}
+
+func TestIgnoredChannelSkipsReactionRemoval(t *testing.T) {
+	b := newTestBot(t)
+	addTestChannels(b)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	const message = discord.MessageID(500)
+
+	b.send(b.reactionAdd(message, wave))
+	b.send(b.command("tracking", subcommand(filterIgnore, channelOption("channel", testChannelID))))
+	b.send(b.reactionRemove(message, wave))
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count = %d, want 1", got)
+	}
+	if got := b.rows("usage_events"); got != 1 {
+		t.Errorf("usage events = %d, want 1", got)
+	}
+}
+
+func TestIgnoredChannelSkipsReconcile(t *testing.T) {
+	b := newTestBot(t)
+	addTestChannels(b)
+	wave := discord.Emoji{ID: 111, Name: "wave"}
+	const message = discord.MessageID(500)
+
+	b.send(b.reactionAdd(message, wave))
+	b.send(b.command("tracking", subcommand(filterIgnore, channelOption("channel", chatCategoryID))))
+	b.fake.Messages[message] = discord.Message{ID: message, ChannelID: testChannelID, Reactions: []discord.Reaction{{Emoji: wave, Count: 3}}}
+	results, err := b.reconcileRecent(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[int64(testGuildID)]; r != nil {
+		t.Errorf("reconciled an ignored channel: %+v", r)
+	}
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count = %d, want 1", got)
+	}
+}
+
+func TestTrackingCommand(t *testing.T) {
+	b := newTestBot(t)
+	addTestChannels(b)
+
+	b.send(b.command("tracking", subcommand("list")))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "tracked in every channel") {
+		t.Errorf("empty list replied %q", content)
+	}
+
+	b.send(b.command("tracking", subcommand(filterIgnore, channelOption("channel", chatCategoryID))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "the <#2100> category is no longer tracked") {
+		t.Errorf("ignore replied %q", content)
+	}
+	b.send(b.command("tracking", subcommand(filterAllow, channelOption("channel", memesChannelID))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "Only allowed channels") {
+		t.Errorf("first allow did not warn about the allow list: %q", content)
+	}
+
+	b.send(b.command("tracking", subcommand("list")))
+	content := b.fake.lastContent(t)
+	for _, want := range []string{"__Allowed__", "- <#2001> by <@3000>", "__Ignored__", "- <#2100> (category)"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("list missing %q: %q", want, content)
+		}
+	}
+
+	b.send(b.command("tracking", subcommand("clear", channelOption("channel", chatCategoryID))))
+	b.send(b.command("tracking", subcommand("clear", channelOption("channel", chatCategoryID))))
+	if content := b.fake.lastContent(t); !strings.Contains(content, "not on the ignore or allow list") {
+		t.Errorf("second clear replied %q", content)
+	}
+	if got := b.rows("channel_filters"); got != 1 {
+		t.Errorf("filters = %d, want 1", got)
+	}
+}
+
+func TestChannelFiltersWithoutChannelInfo(t *testing.T) {
+	b := newTestBot(t)
+	addTestChannels(b)
+	b.send(b.command("tracking", subcommand(filterIgnore, channelOption("channel", chatCategoryID))))
+
+	// A channel the client can't look up only matches its own entry
+	m := b.message("<:wave:111>")
+	m.ChannelID = 9999
+	b.send(m)
+	if got := b.emojiCount(111); got != 1 {
+		t.Errorf("emoji count = %d, want 1", got)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	defaultTrendingDays     = 7
+	defaultTrendingBaseline = 28
+	defaultTrendingMinCount = 5
+	trendingListLimit       = 10
+)
+
+// Emoji or sticker usage in a recent window compared to its own baseline
+type TrendingItem struct {
+	Kind       string
+	Name       string
+	ID         int64
+	Animated   bool
+	Recent     int
+	Baseline   int
+	Multiplier float64
+	New        bool
+}
+
+// Window settings for a trending query
+type TrendingWindow struct {
+	RecentDays   int
+	BaselineDays int
+	MinCount     int
+}
+
+// Rank items of a kind by recent daily rate over baseline daily rate.
+// Items with fewer than MinCount recent uses are dropped as noise.
+func (b *Bot) getTrending(serverID int64, kind string, now time.Time, w TrendingWindow, limit int) ([]TrendingItem, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	recentStart := today.AddDate(0, 0, -(w.RecentDays - 1)).Format(time.DateOnly)
+	baselineStart := today.AddDate(0, 0, -(w.RecentDays + w.BaselineDays - 1)).Format(time.DateOnly)
+
+	// Names and animation flags come from the all-time tables
+	var nameColumn, animatedColumn string
+	switch kind {
+	case kindEmoji:
+		nameColumn = "(SELECT emote_name FROM emojis WHERE server_id = d.server_id AND emote_id = d.item_id)"
+		animatedColumn = "(SELECT animated FROM emojis WHERE server_id = d.server_id AND emote_id = d.item_id)"
+	case kindSticker:
+		nameColumn = "(SELECT sticker_name FROM stickers WHERE server_id = d.server_id AND sticker_id = d.item_id)"
+		animatedColumn = "FALSE"
+	default:
+		return nil, fmt.Errorf("unknown kind %q", kind)
+	}
+
+	query := `
+		SELECT d.item_id,
+			COALESCE(` + nameColumn + `, ''),
+			COALESCE(` + animatedColumn + `, FALSE),
+			SUM(CASE WHEN d.day >= ? THEN d.usage_count ELSE 0 END) AS recent,
+			SUM(CASE WHEN d.day < ? THEN d.usage_count ELSE 0 END) AS baseline
+		FROM usage_daily d
+		WHERE d.server_id = ? AND d.kind = ? AND d.day >= ?
+		GROUP BY d.item_id
+		HAVING recent >= ?
+	`
+	rows, err := b.DB.Query(query, recentStart, recentStart, serverID, kind, baselineStart, w.MinCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []TrendingItem
+	for rows.Next() {
+		t := TrendingItem{Kind: kind}
+		if err := rows.Scan(&t.ID, &t.Name, &t.Animated, &t.Recent, &t.Baseline); err != nil {
+			return nil, err
+		}
+		// Corrections can take a baseline below zero
+		t.Baseline = max(t.Baseline, 0)
+		t.Multiplier, t.New = trendingMultiplier(t.Recent, t.Baseline, w)
+		items = append(items, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Multiplier != items[j].Multiplier {
+			return items[i].Multiplier > items[j].Multiplier
+		}
+		return items[i].Recent > items[j].Recent
+	})
+
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+// Ratio of recent daily rate to baseline daily rate. Items with no baseline
+// usage are treated as if used once in the baseline and flagged as new.
+func trendingMultiplier(recent, baseline int, w TrendingWindow) (float64, bool) {
+	recentRate := float64(recent) / float64(w.RecentDays)
+	if baseline <= 0 {
+		return recentRate / (1 / float64(w.BaselineDays)), true
+	}
+	baselineRate := float64(baseline) / float64(w.BaselineDays)
+	return recentRate / baselineRate, false
+}
+
+func formatMultiplier(m float64) string {
+	if m >= 10 {
+		return fmt.Sprintf("x%.0f", math.Round(m))
+	}
+	return fmt.Sprintf("x%.1f", m)
+}
+
+// Format a trending item as a list line
+func formatTrendingLine(t TrendingItem, w TrendingWindow) string {
+	var label string
+	if t.Kind == kindEmoji {
+		if t.Animated {
+			label = fmt.Sprintf("<a:%s:%d>", t.Name, t.ID)
+		} else {
+			label = fmt.Sprintf("<:%s:%d>", t.Name, t.ID)
+		}
+	} else {
+		label = t.Name
+	}
+
+	if t.New {
+		return fmt.Sprintf("- %s **new** (%d in last %dd, none in prior %dd)\n", label, t.Recent, w.RecentDays, w.BaselineDays)
+	}
+	return fmt.Sprintf("- %s **%s** (%d in last %dd vs %d in prior %dd)\n", label, formatMultiplier(t.Multiplier), t.Recent, w.RecentDays, t.Baseline, w.BaselineDays)
+}
+
+// Create trending message
+func createTrendingMessage(emojis, stickers []TrendingItem, w TrendingWindow, notice string) api.InteractionResponseData {
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("**Trending (last %d days vs prior %d days, min %d uses)**\n\n", w.RecentDays, w.BaselineDays, w.MinCount))
+
+	content.WriteString("__Emojis__\n")
+	if len(emojis) == 0 {
+		content.WriteString("No emojis above the minimum volume.\n")
+	}
+	for _, t := range emojis {
+		content.WriteString(formatTrendingLine(t, w))
+	}
+
+	content.WriteString("\n__Stickers__\n")
+	if len(stickers) == 0 {
+		content.WriteString("No stickers above the minimum volume.\n")
+	}
+	for _, t := range stickers {
+		content.WriteString(formatTrendingLine(t, w))
+	}
+
+	if notice != "" {
+		content.WriteString("\n" + notice + "\n")
+	}
+
+	return api.InteractionResponseData{
+		Content: option.NewNullableString(content.String()),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
+// Read trending window options, falling back to defaults
+func trendingWindowFromOptions(opts discord.CommandInteractionOptions) TrendingWindow {
+	w := TrendingWindow{
+		RecentDays:   defaultTrendingDays,
+		BaselineDays: defaultTrendingBaseline,
+		MinCount:     defaultTrendingMinCount,
+	}
+	if v, err := opts.Find("days").IntValue(); err == nil && v > 0 {
+		w.RecentDays = int(v)
+	}
+	if v, err := opts.Find("baseline").IntValue(); err == nil && v > 0 {
+		w.BaselineDays = int(v)
+	}
+	if v, err := opts.Find("min_count").IntValue(); err == nil && v > 0 {
+		w.MinCount = int(v)
+	}
+	return w
+}
+
+// Handle /trending command
+func (b *Bot) handleTrending(i *gateway.InteractionCreateEvent) {
+	if !isInGuild(&i.InteractionEvent) {
+		b.respondError(i, "This command can only be used in a server.")
+		return
+	}
+
+	serverID := int64(i.GuildID)
+	opts := i.Data.(*discord.CommandInteraction).Options
+	share := shareList(opts, b.getGuildSettings(serverID))
+	w := trendingWindowFromOptions(opts)
+	now := time.Now()
+
+	emojis, err := b.getTrending(serverID, kindEmoji, now, w, trendingListLimit)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching trending emojis", "err", err)
+		b.respondError(i, "Failed to fetch trending emojis.")
+		return
+	}
+	stickers, err := b.getTrending(serverID, kindSticker, now, w, trendingListLimit)
+	if err != nil {
+		b.interactionLog(i).Error("Error fetching trending stickers", "err", err)
+		b.respondError(i, "Failed to fetch trending stickers.")
+		return
+	}
+
+	notice := b.outageNotice(now.AddDate(0, 0, -(w.RecentDays+w.BaselineDays)), now)
+	response := createTrendingMessage(emojis, stickers, w, notice)
+
+	if share {
+		response.Flags &= ^discord.EphemeralMessage
+	}
+
+	if err := b.Client.RespondInteraction(i.ID, i.Token, api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &response,
+	}); err != nil {
+		b.interactionLog(i).Error("Error responding to interaction", "err", err, "response", response)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrending(t *testing.T) {
+	now := time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC)
+	w := TrendingWindow{RecentDays: 7, BaselineDays: 28, MinCount: 5}
+	recentDay := now.AddDate(0, 0, -3)
+	baselineDay := now.AddDate(0, 0, -20)
+	// Before the baseline window, so never counted
+	oldDay := now.AddDate(0, 0, -40)
+
+	tests := []struct {
+		name           string
+		uses           map[time.Time]int // Daily usage of the one item, by day
+		wantListed     bool
+		wantMultiplier float64
+		wantNew        bool
+	}{
+		{name: "steady", uses: map[time.Time]int{recentDay: 7, baselineDay: 28}, wantListed: true, wantMultiplier: 1},
+		{name: "spiking", uses: map[time.Time]int{recentDay: 14, baselineDay: 14}, wantListed: true, wantMultiplier: 4},
+		{name: "below min_count", uses: map[time.Time]int{recentDay: 4}},
+		{name: "new", uses: map[time.Time]int{recentDay: 7, oldDay: 50}, wantListed: true, wantMultiplier: 28, wantNew: true},
+		{name: "baseline corrected below zero", uses: map[time.Time]int{recentDay: 7, baselineDay: -2}, wantListed: true, wantMultiplier: 28, wantNew: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			for day, n := range tt.uses {
+				if _, err := b.DB.Exec("INSERT INTO usage_daily (server_id, kind, item_id, day, usage_count) VALUES (?, ?, 111, ?, ?)",
+					int64(testGuildID), kindEmoji, day.Format(time.DateOnly), n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			items, err := b.getTrending(int64(testGuildID), kindEmoji, now, w, trendingListLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantListed {
+				if len(items) != 0 {
+					t.Errorf("items = %+v, want none", items)
+				}
+				return
+			}
+			if len(items) != 1 {
+				t.Fatalf("items = %+v, want one", items)
+			}
+			got := items[0]
+			if math.Abs(got.Multiplier-tt.wantMultiplier) > 1e-9 || got.New != tt.wantNew || got.Baseline < 0 {
+				t.Errorf("item = %+v, want multiplier %v, new %v", got, tt.wantMultiplier, tt.wantNew)
+			}
+			if line := formatTrendingLine(got, w); tt.wantNew && !strings.Contains(line, "**new**") {
+				t.Errorf("line = %q, want the item shown as new", line)
+			}
+		})
+	}
+}
+
+func TestTrendingRanking(t *testing.T) {
+	b := newTestBot(t)
+	now := time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC)
+	w := TrendingWindow{RecentDays: 7, BaselineDays: 28, MinCount: 5}
+	seed := func(itemID int64, daysAgo, n int) {
+		t.Helper()
+		if _, err := b.DB.Exec("INSERT INTO usage_daily (server_id, kind, item_id, day, usage_count) VALUES (?, ?, ?, ?, ?)",
+			int64(testGuildID), kindEmoji, itemID, now.AddDate(0, 0, -daysAgo).Format(time.DateOnly), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seed(111, 1, 10) // x4
+	seed(111, 10, 10)
+	seed(112, 1, 5) // x2
+	seed(112, 10, 10)
+	seed(113, 1, 10) // x2 with more recent uses than 112
+	seed(113, 10, 20)
+	seed(114, 1, 6)  // New
+	seed(115, 0, 20) // Steady
+	seed(115, 7, 80)
+
+	items, err := b.getTrending(int64(testGuildID), kindEmoji, now, w, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for _, item := range items {
+		got = append(got, item.ID)
+	}
+	want := []int64{114, 111, 113, 112}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ranking = %v, want %v", got, want)
+	}
+}